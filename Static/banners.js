@@ -0,0 +1,24 @@
+// Dismissible announcement banners. Dismissed banners are remembered per
+// browser in localStorage.
+(function () {
+  var storageKey = "gowiki.banners.dismissed"
+  var dismissed = JSON.parse(localStorage.getItem(storageKey) || "[]")
+
+  document.querySelectorAll(".banner[data-dismissible]").forEach(function (banner) {
+    var id = banner.dataset.id
+    if (dismissed.indexOf(id) >= 0) {
+      banner.remove()
+      return
+    }
+    var close = document.createElement("button")
+    close.type = "button"
+    close.textContent = "×"
+    close.title = "Dismiss"
+    close.onclick = function () {
+      dismissed.push(id)
+      localStorage.setItem(storageKey, JSON.stringify(dismissed))
+      banner.remove()
+    }
+    banner.appendChild(close)
+  })
+})()
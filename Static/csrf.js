@@ -0,0 +1,15 @@
+// Adds the CSRF token to forms the server did not render it into, such
+// as the forms readers fill in on wiki pages, which are cached and
+// shared between users.
+(function () {
+  var meta = document.querySelector("meta[name='csrf-token']")
+  if (!meta) return
+  document.querySelectorAll("form").forEach(function (form) {
+    if (form.method.toLowerCase() !== "post" || form.elements.namedItem("csrf")) return
+    var input = document.createElement("input")
+    input.type = "hidden"
+    input.name = "csrf"
+    input.value = meta.content
+    form.appendChild(input)
+  })
+})()
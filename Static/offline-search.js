@@ -0,0 +1,29 @@
+// Client-side search for the offline bundle. SEARCH_INDEX is defined by
+// search-index.js; every entry has a title (t), file (f) and text (x).
+(function () {
+  var input = document.getElementById("search")
+  var list = document.getElementById("pages")
+  if (!input || !list || typeof SEARCH_INDEX === "undefined") {
+    return
+  }
+
+  function show(entries) {
+    list.textContent = ""
+    entries.forEach(function (e) {
+      var li = document.createElement("li")
+      var a = document.createElement("a")
+      a.href = e.f
+      a.textContent = e.t
+      li.appendChild(a)
+      list.appendChild(li)
+    })
+  }
+
+  input.addEventListener("input", function () {
+    var words = input.value.toLowerCase().split(/\s+/).filter(Boolean)
+    show(SEARCH_INDEX.filter(function (e) {
+      var text = (e.t + " " + e.x).toLowerCase()
+      return words.every(function (w) { return text.indexOf(w) >= 0 })
+    }))
+  })
+})()
@@ -0,0 +1,64 @@
+// Hover cards for links to other wiki pages.
+//
+// Hovering a /view/ link fetches /summary/{title} and shows the page
+// excerpt in a small card next to the link. Summaries are cached for the
+// lifetime of the page.
+(function () {
+  var cache = {}
+  var card = null
+  var timer = null
+
+  function hide() {
+    clearTimeout(timer)
+    if (card) {
+      card.remove()
+      card = null
+    }
+  }
+
+  function show(link, summary) {
+    hide()
+    card = document.createElement("div")
+    card.className = "preview-card"
+    card.style.cssText = "position:absolute;max-width:24em;padding:.5em 1em;" +
+      "background:#fff;border:1px solid #aaa;box-shadow:0 2px 6px #aaa;z-index:10;"
+
+    var h = document.createElement("strong")
+    h.textContent = summary.title
+    card.appendChild(h)
+
+    var p = document.createElement("p")
+    p.textContent = summary.excerpt || "This page is empty."
+    card.appendChild(p)
+
+    var rect = link.getBoundingClientRect()
+    card.style.left = (window.scrollX + rect.left) + "px"
+    card.style.top = (window.scrollY + rect.bottom + 4) + "px"
+    document.body.appendChild(card)
+  }
+
+  function summary(title) {
+    if (!cache[title]) {
+      cache[title] = fetch("/summary/" + encodeURIComponent(title)).then(function (res) {
+        if (!res.ok) {
+          throw new Error(res.statusText)
+        }
+        return res.json()
+      })
+    }
+    return cache[title]
+  }
+
+  document.addEventListener("mouseover", function (e) {
+    var link = e.target.closest && e.target.closest("a[href^='/view/']")
+    if (!link) {
+      return
+    }
+    var title = decodeURIComponent(link.getAttribute("href").slice("/view/".length))
+    clearTimeout(timer)
+    timer = setTimeout(function () {
+      summary(title).then(function (s) { show(link, s) }, hide)
+    }, 300)
+    link.addEventListener("mouseleave", hide, { once: true })
+  })
+})()
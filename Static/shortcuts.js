@@ -0,0 +1,105 @@
+// Keyboard shortcuts for gowiki.
+//
+// Bindings are fetched from /shortcuts.json. Pressing "?" toggles a help
+// overlay listing them, where signed in users can also switch shortcuts
+// off. The choice is posted back and kept with their account.
+(function () {
+  var script = document.currentScript
+  var title = script ? script.dataset.title || "" : ""
+  var settings = { bindings: [], enabled: true, saved: false }
+  var overlay = null
+
+  function setEnabled(on) {
+    var token = document.querySelector("meta[name='csrf-token']")
+    fetch("/shortcuts.json", {
+      method: "POST",
+      body: new URLSearchParams({ enabled: String(on) }),
+      headers: { "X-CSRF-Token": token ? token.content : "" }
+    })
+      .then(function (res) { return res.ok ? res.json() : settings })
+      .then(function (data) { settings = data })
+  }
+
+  function usable(b) {
+    return b.url.indexOf("{title}") < 0 || title !== ""
+  }
+
+  function buildOverlay() {
+    var div = document.createElement("div")
+    div.id = "shortcuts-help"
+    div.setAttribute("role", "dialog")
+    div.style.cssText = "position:fixed;top:20%;left:50%;transform:translateX(-50%);" +
+      "background:#fff;border:1px solid #888;padding:1em 2em;box-shadow:0 2px 8px #888;"
+
+    var h = document.createElement("h2")
+    h.textContent = "Keyboard shortcuts"
+    div.appendChild(h)
+
+    var table = document.createElement("table")
+    settings.bindings.filter(usable).concat([{ key: "?", description: "Show or hide this help" }])
+      .forEach(function (b) {
+        var tr = table.insertRow()
+        var k = document.createElement("kbd")
+        k.textContent = b.key
+        tr.insertCell().appendChild(k)
+        tr.insertCell().textContent = b.description
+      })
+    div.appendChild(table)
+
+    if (settings.saved) {
+      var label = document.createElement("label")
+      var box = document.createElement("input")
+      box.type = "checkbox"
+      box.checked = settings.enabled
+      box.onchange = function () { setEnabled(box.checked) }
+      label.appendChild(box)
+      label.appendChild(document.createTextNode(" Enable shortcuts"))
+      div.appendChild(label)
+    }
+
+    return div
+  }
+
+  function toggleHelp() {
+    if (overlay) {
+      overlay.remove()
+      overlay = null
+      return
+    }
+    overlay = buildOverlay()
+    document.body.appendChild(overlay)
+  }
+
+  document.addEventListener("keydown", function (e) {
+    if (e.ctrlKey || e.metaKey || e.altKey) {
+      return
+    }
+    var t = e.target
+    if (t.isContentEditable || /^(INPUT|TEXTAREA|SELECT)$/.test(t.tagName)) {
+      return
+    }
+    if (e.key === "Escape" && overlay) {
+      toggleHelp()
+      return
+    }
+    if (e.key === "?") {
+      toggleHelp()
+      return
+    }
+    if (!settings.enabled) {
+      return
+    }
+    for (var i = 0; i < settings.bindings.length; i++) {
+      var b = settings.bindings[i]
+      if (b.key === e.key && usable(b)) {
+        e.preventDefault()
+        window.location = b.url.replace("{title}", encodeURIComponent(title))
+        return
+      }
+    }
+  })
+
+  fetch("/shortcuts.json")
+    .then(function (res) { return res.json() })
+    .then(function (data) { settings = data })
+})()
@@ -0,0 +1,77 @@
+// Spellchecking for the edit form.
+//
+// The text is checked by the wiki itself at /spellcheck, nothing is sent
+// to third parties. Misspelled words are listed under the editor with
+// suggestions that replace the word when clicked. Words can be accepted
+// for the whole wiki by adding them to the Dictionary page.
+(function () {
+  var button = document.getElementById("spellcheck")
+  var textarea = document.querySelector("textarea[name=body]")
+  var results = document.getElementById("spellcheck-results")
+  if (!button || !textarea || !results) {
+    return
+  }
+
+  function replaceAt(offset, word, replacement) {
+    var text = textarea.value
+    // Offsets are in bytes; convert by encoding the prefix.
+    var prefix = new TextDecoder().decode(new TextEncoder().encode(text).slice(0, offset))
+    if (text.substr(prefix.length, word.length) !== word) {
+      return false
+    }
+    textarea.value = prefix + replacement + text.slice(prefix.length + word.length)
+    return true
+  }
+
+  function show(list) {
+    results.textContent = ""
+    if (list.length === 0) {
+      results.textContent = "No spelling mistakes found."
+      return
+    }
+    var ul = document.createElement("ul")
+    list.forEach(function (m) {
+      var li = document.createElement("li")
+      var word = document.createElement("span")
+      word.textContent = m.word
+      word.style.textDecoration = "underline wavy red"
+      li.appendChild(word)
+      m.suggestions.forEach(function (s) {
+        var a = document.createElement("button")
+        a.type = "button"
+        a.textContent = s
+        a.onclick = function () {
+          if (replaceAt(m.offset, m.word, s)) {
+            check()
+          }
+        }
+        li.appendChild(document.createTextNode(" "))
+        li.appendChild(a)
+      })
+      ul.appendChild(li)
+    })
+    results.appendChild(ul)
+  }
+
+  function check() {
+    var form = new FormData()
+    form.append("text", textarea.value)
+    var token = document.querySelector("meta[name='csrf-token']")
+    fetch("/spellcheck", {
+      method: "POST",
+      body: new URLSearchParams(form),
+      headers: { "X-CSRF-Token": token ? token.content : "" }
+    })
+      .then(function (res) {
+        if (res.status === 501) {
+          button.hidden = true
+          return []
+        }
+        return res.json()
+      })
+      .then(show)
+  }
+
+  button.hidden = false
+  button.onclick = check
+})()
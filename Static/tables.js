@@ -0,0 +1,36 @@
+// Sorts tables with the "sortable" class by the column whose heading is
+// clicked. Clicking the same heading again reverses the order.
+(function () {
+  function value(row, col, numeric) {
+    var cell = row.cells[col]
+    var text = cell ? cell.textContent.trim() : ""
+    if (numeric) {
+      var n = parseFloat(text.replace(/,/g, ""))
+      return isNaN(n) ? -Infinity : n
+    }
+    return text.toLowerCase()
+  }
+
+  document.querySelectorAll("table.sortable").forEach(function (table) {
+    var body = table.tBodies[0]
+    var headings = table.querySelectorAll("thead th")
+    headings.forEach(function (th, col) {
+      th.style.cursor = "pointer"
+      th.setAttribute("aria-sort", "none")
+      th.addEventListener("click", function () {
+        var ascending = th.getAttribute("aria-sort") !== "ascending"
+        var numeric = th.classList.contains("num")
+        var rows = Array.prototype.slice.call(body.rows)
+        rows.sort(function (a, b) {
+          var x = value(a, col, numeric)
+          var y = value(b, col, numeric)
+          var c = x < y ? -1 : x > y ? 1 : 0
+          return ascending ? c : -c
+        })
+        rows.forEach(function (r) { body.appendChild(r) })
+        headings.forEach(function (h) { h.setAttribute("aria-sort", "none") })
+        th.setAttribute("aria-sort", ascending ? "ascending" : "descending")
+      })
+    })
+  })
+})()
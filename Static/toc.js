@@ -0,0 +1,39 @@
+// Highlights the table of contents entry of the section being read.
+(function () {
+  var toc = document.querySelector(".toc")
+  if (!toc || !("IntersectionObserver" in window)) {
+    return
+  }
+
+  var links = {}
+  toc.querySelectorAll("a[href^='#']").forEach(function (a) {
+    links[decodeURIComponent(a.getAttribute("href").slice(1))] = a
+  })
+
+  var visible = {}
+  var observer = new IntersectionObserver(function (entries) {
+    entries.forEach(function (e) { visible[e.target.id] = e.isIntersecting })
+
+    var current = null
+    Object.keys(links).some(function (id) {
+      if (visible[id]) {
+        current = id
+        return true
+      }
+      return false
+    })
+    if (!current) {
+      return
+    }
+    Object.keys(links).forEach(function (id) {
+      links[id].classList.toggle("current", id === current)
+    })
+  })
+
+  Object.keys(links).forEach(function (id) {
+    var h = document.getElementById(id)
+    if (h) {
+      observer.observe(h)
+    }
+  })
+})()
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// analyticsDays is the period covered by the analytics dashboard.
+const analyticsDays = 30
+
+// analyticsTopLimit is the number of rows in the top pages and referrers tables.
+const analyticsTopLimit = 20
+
+// dayFormat is used for the day field of analytics documents.
+const dayFormat = "2006-01-02"
+
+// DailyCount is a number of views on a single day.
+type DailyCount struct {
+	Day   string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+// NamedCount is a number of views attributed to a page title or referrer host.
+type NamedCount struct {
+	Name  string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+// Analytics is the data shown on the analytics dashboard.
+type Analytics struct {
+	Days         int
+	Daily        []DailyCount
+	MaxDaily     int64
+	TopPages     []NamedCount
+	TopReferrers []NamedCount
+	SearchMisses []SearchMiss
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Analytics",
+		Description: "Page view trends, top pages, referrers and failed searches.",
+		Handler:     analyticsHandler,
+		Mongo:       true,
+		Role:        roleAdmin,
+	})
+}
+
+var upsert = options.Update().SetUpsert(true)
+
+// byViews sorts the results of sumByField by count, most viewed first.
+var byViews = bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}
+
+// viewFlushInterval is how often the view counts gathered in memory are
+// written to the database.
+const viewFlushInterval = 10 * time.Second
+
+// viewKey identifies a count of views of a page, or from a referrer
+// host, on one day.
+type viewKey struct {
+	name string
+	day  string
+}
+
+// pendingViews holds the view counts not yet written by flushViews.
+var pendingViews = struct {
+	sync.Mutex
+	pages     map[viewKey]int64
+	referrers map[viewKey]int64
+}{pages: map[viewKey]int64{}, referrers: map[viewKey]int64{}}
+
+// recordView counts a view of a page for today, along with the external
+// site the visitor came from, if any. The counts are kept in memory until
+// the next flushViews, so viewing a page costs no database round trip.
+func recordView(title string, r *http.Request) {
+	if appFrom(r.Context()).db == nil || r.Context().Err() != nil {
+		return
+	}
+	day := time.Now().Format(dayFormat)
+	host := referrerHost(r)
+
+	pendingViews.Lock()
+	defer pendingViews.Unlock()
+	pendingViews.pages[viewKey{title, day}]++
+	if host != "" {
+		pendingViews.referrers[viewKey{host, day}]++
+	}
+}
+
+// writeViews flushes the recorded views every interval until stop is
+// closed.
+func writeViews(c context.Context, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			flushViews(c)
+		}
+	}
+}
+
+// flushViews adds the views recorded since the last flush to the
+// database, one bulk write per collection. Counts that cannot be written
+// while the database is degraded are kept for the next flush.
+func flushViews(c context.Context) {
+	if appFrom(c).db == nil || databaseDegraded() {
+		return
+	}
+	pendingViews.Lock()
+	pages, referrers := pendingViews.pages, pendingViews.referrers
+	pendingViews.pages, pendingViews.referrers = map[viewKey]int64{}, map[viewKey]int64{}
+	pendingViews.Unlock()
+
+	if err := addViews(appFrom(c).db.views, "title", pages); err != nil {
+		log.Printf("recording page views: %v", err)
+	}
+	if err := addViews(appFrom(c).db.referrers, "host", referrers); err != nil {
+		log.Printf("recording referrers: %v", err)
+	}
+}
+
+// addViews increments the daily counts of coll, keyed by field.
+func addViews(coll *mongo.Collection, field string, counts map[viewKey]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(counts))
+	for k, n := range counts {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				primitive.E{Key: field, Value: k.name},
+				primitive.E{Key: "day", Value: k.day},
+			}).
+			SetUpdate(bson.D{primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "count", Value: n}}}}).
+			SetUpsert(true))
+	}
+	wctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	_, err := coll.BulkWrite(wctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// referrerHost returns the host of an external referring site, or an
+// empty string for direct visits and links within the wiki.
+func referrerHost(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Host == "" || ref.Host == r.Host {
+		return ""
+	}
+	return ref.Hostname()
+}
+
+// sumByField totals the count field of coll since the given day,
+// grouped by field and sorted by the pipeline stages in sort.
+func sumByField(c context.Context, coll *mongo.Collection, since, field string, sort bson.D, limit int) (*mongo.Cursor, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "day", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + field},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: sort}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	return coll.Aggregate(c, pipeline)
+}
+
+func loadAnalytics(c context.Context) (*Analytics, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	a := &Analytics{Days: analyticsDays}
+	since := time.Now().AddDate(0, 0, -analyticsDays+1).Format(dayFormat)
+
+	cur, err := sumByField(c, appFrom(c).db.views, since, "day", bson.D{{Key: "_id", Value: 1}}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(c, &a.Daily); err != nil {
+		return nil, err
+	}
+	for _, d := range a.Daily {
+		if d.Count > a.MaxDaily {
+			a.MaxDaily = d.Count
+		}
+	}
+
+	cur, err = sumByField(c, appFrom(c).db.views, since, "title", byViews, analyticsTopLimit)
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(c, &a.TopPages); err != nil {
+		return nil, err
+	}
+
+	cur, err = sumByField(c, appFrom(c).db.referrers, since, "host", byViews, analyticsTopLimit)
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(c, &a.TopReferrers); err != nil {
+		return nil, err
+	}
+
+	a.SearchMisses, err = listSearchMisses(c, analyticsTopLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := loadAnalytics(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "analytics", nil, a)
+}
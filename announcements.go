@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// announcementsTTL is how long the active announcements are cached.
+const announcementsTTL = time.Minute
+
+// datetimeLocal is the format of HTML datetime-local inputs.
+const datetimeLocal = "2006-01-02T15:04"
+
+// Announcement severities. Critical announcements cannot be dismissed.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Announcement is a site wide banner shown between Start and End.
+type Announcement struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Message  string             `bson:"message"`
+	Severity string             `bson:"severity"`
+	Start    time.Time          `bson:"start"`
+	End      time.Time          `bson:"end"`
+}
+
+// Dismissible reports whether visitors may hide the announcement.
+func (a *Announcement) Dismissible() bool {
+	return a.Severity != SeverityCritical
+}
+
+var activeAnnouncements struct {
+	sync.Mutex
+	list    []Announcement
+	fetched time.Time
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Announcements",
+		Description: "Manage the banners shown on every page.",
+		Handler:     announcementsHandler,
+		Role:        roleAdmin,
+	})
+}
+
+func listAnnouncements(c context.Context, filter bson.D) ([]Announcement, error) {
+	if appFrom(c).db == nil {
+		return []Announcement{}, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.announcements.Find(c, filter, options.Find().SetSort(bson.D{{Key: "start", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Announcement{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// currentAnnouncements returns the announcements active right now.
+func currentAnnouncements(c context.Context) []Announcement {
+	activeAnnouncements.Lock()
+	defer activeAnnouncements.Unlock()
+
+	now := time.Now()
+	if now.Sub(activeAnnouncements.fetched) > announcementsTTL {
+		list, err := listAnnouncements(c, bson.D{
+			primitive.E{Key: "start", Value: bson.D{primitive.E{Key: "$lte", Value: now}}},
+			primitive.E{Key: "end", Value: bson.D{primitive.E{Key: "$gt", Value: now}}},
+		})
+		if err != nil {
+			log.Printf("loading announcements: %v", err)
+		} else {
+			activeAnnouncements.list = list
+			activeAnnouncements.fetched = now
+		}
+	}
+
+	list := []Announcement{}
+	for _, a := range activeAnnouncements.list {
+		if !now.Before(a.Start) && now.Before(a.End) {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+func invalidateAnnouncements() {
+	activeAnnouncements.Lock()
+	activeAnnouncements.fetched = time.Time{}
+	activeAnnouncements.Unlock()
+}
+
+func parseAnnouncement(r *http.Request) (*Announcement, error) {
+	a := &Announcement{
+		Message:  strings.TrimSpace(r.FormValue("message")),
+		Severity: r.FormValue("severity"),
+	}
+	if a.Message == "" {
+		return nil, errors.New("message is required")
+	}
+	switch a.Severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return nil, errors.New("unknown severity")
+	}
+
+	var err error
+	a.Start, err = time.ParseInLocation(datetimeLocal, r.FormValue("start"), time.Local)
+	if err != nil {
+		return nil, errors.New("invalid start time")
+	}
+	a.End, err = time.ParseInLocation(datetimeLocal, r.FormValue("end"), time.Local)
+	if err != nil {
+		return nil, errors.New("invalid end time")
+	}
+	if !a.End.After(a.Start) {
+		return nil, errors.New("end must be after start")
+	}
+	return a, nil
+}
+
+func announcementsHandler(w http.ResponseWriter, r *http.Request) {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	if r.Method == http.MethodPost {
+		var err error
+		if id := r.FormValue("delete"); id != "" {
+			var oid primitive.ObjectID
+			oid, err = primitive.ObjectIDFromHex(id)
+			if err == nil {
+				_, err = appFrom(c).db.announcements.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: oid}})
+			}
+		} else {
+			var a *Announcement
+			a, err = parseAnnouncement(r)
+			if err == nil {
+				_, err = appFrom(c).db.announcements.InsertOne(c, a)
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		invalidateAnnouncements()
+		addFlash(w, r, "Announcements updated.")
+		http.Redirect(w, r, "/special/Announcements", http.StatusFound)
+		return
+	}
+
+	list, err := listAnnouncements(c, bson.D{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "announcements", nil, list)
+}
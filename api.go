@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is where version 1 of the JSON API is served.
+const apiPrefix = "/api/v1/pages"
+
+// APIPage is a page as represented in the JSON API. When writing a page,
+// Revision, or Updated, may be set to that of the version the change is
+// based on; the write is refused with 409 Conflict if the page has
+// changed since. Summary describes the change for the recent changes
+// list and is not returned.
+type APIPage struct {
+	Title    string    `json:"title"`
+	Body     string    `json:"body"`
+	Lang     string    `json:"lang,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	Reviewer string    `json:"reviewer,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Updated  time.Time `json:"updated"`
+	Revision int       `json:"revision"`
+	Remote   string    `json:"remote,omitempty"`
+	Summary  string    `json:"summary,omitempty"`
+}
+
+// APIPageList is the response listing all pages.
+type APIPageList struct {
+	Pages []string `json:"pages"`
+}
+
+// APIError is the body of every error response.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+func newAPIPage(p *Page) *APIPage {
+	return &APIPage{
+		Title:    p.Title,
+		Body:     string(p.Body),
+		Lang:     p.Lang,
+		Owner:    p.Owner,
+		Reviewer: p.Reviewer,
+		Tags:     p.Tags,
+		Updated:  p.Updated,
+		Revision: p.Revision,
+		Remote:   p.Remote,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &APIError{Error: msg})
+}
+
+// apiListHandler serves GET /api/v1/pages, the page titles in
+// alphabetical order. ?offset=N&limit=M returns a slice of them.
+func apiListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var offset, limit int
+	for name, v := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if s := r.FormValue(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				apiError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*v = n
+		}
+	}
+	hidden, err := unlistedNamespaces(r.Context(), currentUser(r))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list, err := appFrom(r.Context()).pages.Summaries(r.Context(), ListQuery{
+		Sort:   sortByTitle,
+		Offset: offset,
+		Limit:  limit,
+		Hidden: hidden,
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Title
+	}
+	writeJSON(w, http.StatusOK, &APIPageList{Pages: names})
+}
+
+// apiPageHandler serves GET, PUT and DELETE on /api/v1/pages/{title}.
+// Reading is public; writing needs a signed in editor and deleting an
+// admin, either through the session cookie or HTTP basic authentication
+// for scripts.
+//
+// /api/v1/pages/{title}/data serves the page's front matter. This
+// shadows pages called "data" inside a namespace, which the API cannot
+// reach.
+func apiPageHandler(w http.ResponseWriter, r *http.Request) {
+	title := strings.TrimPrefix(r.URL.Path, apiPrefix+"/")
+	if t := strings.TrimSuffix(title, "/data"); t != title && validTitle(r.Context(), t) {
+		if apiCheckRead(w, r, t) {
+			apiPageData(w, r, t)
+		}
+		return
+	}
+	if !validTitle(r.Context(), title) {
+		apiError(w, http.StatusNotFound, "invalid page title")
+		return
+	}
+	if !apiCheckRead(w, r, title) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		apiGetPage(w, r, title)
+	case http.MethodPut, http.MethodDelete:
+		u := currentUser(r)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gowiki"`)
+			apiError(w, http.StatusUnauthorized, "sign in required")
+			return
+		}
+		role := actionRole("edit")
+		if r.Method == http.MethodDelete {
+			role = actionRole("delete")
+		}
+		if !u.Can(role) {
+			apiError(w, http.StatusForbidden, "this needs the "+role+" role")
+			return
+		}
+		if r.Method == http.MethodPut {
+			idempotent(apiPutPage)(w, r, title)
+		} else {
+			idempotent(apiDeletePage)(w, r, title)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiCheckRead reports whether the client may read title, answering
+// 401 or 403 if not.
+func apiCheckRead(w http.ResponseWriter, r *http.Request, title string) bool {
+	if canRead(r.Context(), currentUser(r), title) {
+		return true
+	}
+	if currentUser(r) == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gowiki"`)
+		apiError(w, http.StatusUnauthorized, "sign in required")
+		return false
+	}
+	apiError(w, http.StatusForbidden, "this needs the "+readRole(r.Context(), title)+" role")
+	return false
+}
+
+func apiGetPage(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIPage(p))
+}
+
+// apiPutPage creates or replaces a page, answering 201 Created for new
+// pages and 200 OK for updates. Changes to protected pages are queued
+// for approval and answered with 202 Accepted.
+func apiPutPage(w http.ResponseWriter, r *http.Request, title string) {
+	var in APIPage
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if in.Lang != "" && !validLanguage.MatchString(in.Lang) {
+		apiError(w, http.StatusBadRequest, "invalid language")
+		return
+	}
+	tags, err := parseTags(strings.Join(in.Tags, ","))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	author := userName(r)
+	old, err := loadPage(r.Context(), title)
+	exists := err == nil
+	if exists && !in.Updated.IsZero() && !old.Updated.Equal(in.Updated) {
+		apiError(w, http.StatusConflict, "the page has changed since "+in.Updated.Format(time.RFC3339))
+		return
+	}
+	if exists && in.Revision != 0 && old.Revision != in.Revision {
+		apiError(w, http.StatusConflict, "the page is at revision "+strconv.Itoa(old.Revision)+", not "+strconv.Itoa(in.Revision))
+		return
+	}
+
+	p := &Page{
+		Title:    title,
+		Body:     []byte(in.Body),
+		Lang:     in.Lang,
+		Owner:    strings.TrimSpace(in.Owner),
+		Reviewer: strings.TrimSpace(in.Reviewer),
+		Tags:     tags,
+		Updated:  time.Now(),
+	}
+	secrets, ok := appFrom(r.Context()).secrets.screen(r.Context(), p, author)
+	if !ok {
+		apiError(w, http.StatusUnprocessableEntity, "the page seems to contain credentials: "+describeSecrets(secrets))
+		return
+	}
+	if secrets != nil {
+		w.Header().Set("Warning", `199 gowiki "the page seems to contain credentials: `+describeSecrets(secrets)+`"`)
+	}
+	if isProtected(r.Context(), title) {
+		if err := submitPendingEdit(r.Context(), p, author); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Location", pageURL("pending", title))
+		writeJSON(w, http.StatusAccepted, newAPIPage(p))
+		return
+	}
+
+	switch {
+	case !exists:
+		err = commitEdit(r.Context(), p, author, 0)
+	case in.Revision != 0:
+		err = commitEdit(r.Context(), p, author, in.Revision)
+	default:
+		err = commitRevision(r.Context(), p, author)
+	}
+	if err == errEditConflict {
+		apiError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err == nil {
+		err = recordEvent(r.Context(), eventSaved, title, author, editSummary(in.Summary))
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+		w.Header().Set("Location", pageURL(strings.TrimPrefix(apiPrefix, "/"), title))
+	}
+	writeJSON(w, status, newAPIPage(p))
+}
+
+// apiDeletePage moves a page to the trash, answering 204 No Content.
+func apiDeletePage(w http.ResponseWriter, r *http.Request, title string) {
+	if _, err := loadPage(r.Context(), title); err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	err := trashPage(r.Context(), title)
+	if err == errLegalHold {
+		apiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err == nil {
+		err = recordEvent(r.Context(), eventDeleted, title, userName(r), "")
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIGetPage(t *testing.T) {
+	h := newTestWiki(t, newMemStore(&Page{Title: "Docs/Setup", Body: []byte("Run it."), Revision: 2}))
+
+	w := serve(h, httptest.NewRequest(http.MethodGet, apiPrefix+"/Docs/Setup", nil), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	var p APIPage
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Docs/Setup" || p.Body != "Run it." || p.Revision != 2 {
+		t.Errorf("got %+v", p)
+	}
+
+	w = serve(h, httptest.NewRequest(http.MethodGet, apiPrefix+"/Missing", nil), "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing page: status %d, want 404", w.Code)
+	}
+}
+
+func TestAPIListPages(t *testing.T) {
+	h := newTestWiki(t, newMemStore(&Page{Title: "B"}, &Page{Title: "A"}, &Page{Title: "C"}))
+	w := serve(h, httptest.NewRequest(http.MethodGet, apiPrefix+"?offset=1&limit=1", nil), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	var list APIPageList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Pages) != 1 || list.Pages[0] != "B" {
+		t.Errorf("got %v, want [B]", list.Pages)
+	}
+}
+
+func TestAPIPutPage(t *testing.T) {
+	store := newMemStore()
+	h := newTestWiki(t, store)
+	put := func(body, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, apiPrefix+"/Notes", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return serve(h, r, user)
+	}
+
+	if w := put(`{"body": "first"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d, want 401", w.Code)
+	}
+	if w := put(`{"body": "first"}`, "vic"); w.Code != http.StatusForbidden {
+		t.Errorf("viewer: status %d, want 403", w.Code)
+	}
+
+	w := put(`{"body": "first"}`, "ann")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != apiPrefix+"/Notes" {
+		t.Fatalf("create: got %d to %q, want 201: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	w = put(`{"body": "second", "revision": 1, "tags": ["Go"]}`, "ann")
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if w := put(`{"body": "stale", "revision": 1}`, "ann"); w.Code != http.StatusConflict {
+		t.Errorf("stale revision: status %d, want 409", w.Code)
+	}
+	if w := put(`{"body": `, "ann"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid JSON: status %d, want 400", w.Code)
+	}
+
+	p, err := store.Get(context.Background(), "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Body) != "second" || p.Revision != 2 || formatTags(p.Tags) != "go" {
+		t.Errorf("stored %q at revision %d tagged %v", p.Body, p.Revision, p.Tags)
+	}
+}
+
+func TestAPIPutPageLocation(t *testing.T) {
+	h := newTestWiki(t, newMemStore())
+	r := httptest.NewRequest(http.MethodPut, apiPrefix+"/Notes/Caf%C3%A9%20menu", strings.NewReader(`{"body": "Soup."}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serve(h, r, "ann")
+	if want := apiPrefix + "/Notes/Caf%C3%A9%20menu"; w.Code != http.StatusCreated || w.Header().Get("Location") != want {
+		t.Errorf("got %d to %q, want 201 to %q: %s", w.Code, w.Header().Get("Location"), want, w.Body)
+	}
+}
+
+func TestSync(t *testing.T) {
+	master := newMemStore(&Page{Title: "Home", Body: []byte("Welcome.")}, &Page{Title: "Docs/Travel", Body: []byte("Book early.")})
+	replica := newMemStore()
+	from := httptest.NewServer(newTestWiki(t, master))
+	defer from.Close()
+	to := httptest.NewServer(newTestWiki(t, replica))
+	defer to.Close()
+	s := &syncer{
+		wikis: [2]*wikiClient{
+			{base: from.URL, user: "ann", password: testPassword, client: from.Client()},
+			{base: to.URL, user: "ada", password: testPassword, client: to.Client()},
+		},
+		policy: syncSkip,
+		state:  &syncState{Pages: map[string][2]time.Time{}},
+	}
+	body := func(store PageStore, title string) string {
+		p, err := store.Get(context.Background(), title)
+		if err != nil {
+			return ""
+		}
+		return string(p.Body)
+	}
+	edit := func(store PageStore, title, text string) {
+		if err := store.Put(context.Background(), &Page{Title: title, Body: []byte(text), Updated: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.round(false); err != nil {
+		t.Fatal(err)
+	}
+	if body(replica, "Home") != "Welcome." || s.copied != 2 {
+		t.Fatalf("first round copied %d pages, Home is %q", s.copied, body(replica, "Home"))
+	}
+
+	edit(master, "Home", "Welcome back.")
+	edit(replica, "Local", "Only here.")
+	edit(master, "Docs/Travel", "Book late.")
+	edit(replica, "Docs/Travel", "Book whenever.")
+	s.copied, s.conflicts = 0, 0
+	if err := s.round(false); err != nil {
+		t.Fatal(err)
+	}
+	if body(replica, "Home") != "Welcome back." || body(replica, "Docs/Travel") != "Book whenever." || s.conflicts != 1 {
+		t.Fatalf("Home %q, Docs/Travel %q, %d conflicts", body(replica, "Home"), body(replica, "Docs/Travel"), s.conflicts)
+	}
+	if body(master, "Local") != "" {
+		t.Error("a page of the replica was copied back without -two-way")
+	}
+
+	s.policy = syncKeepFrom
+	if err := master.Delete(context.Background(), "Home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.round(false); err != nil {
+		t.Fatal(err)
+	}
+	if body(replica, "Docs/Travel") != "Book late." || body(replica, "Home") != "" {
+		t.Errorf("with -conflict=from: Docs/Travel %q, Home %q", body(replica, "Docs/Travel"), body(replica, "Home"))
+	}
+
+	if err := s.round(true); err != nil {
+		t.Fatal(err)
+	}
+	if body(master, "Local") != "Only here." {
+		t.Error("the page of the replica was not copied back with -two-way")
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// App is a configured wiki. openApp connects it to MongoDB unless pages
+// are kept in files, and NewApp makes one serving a page store alone. Handlers find the App serving
+// them with appFrom.
+type App struct {
+	cfg    *Config
+	client *mongo.Client
+	// secondary is connected with -mongo-secondary-uri and readPref set
+	// with -mongo-read-tags, for reads while the primary is down.
+	secondary *mongo.Client
+	readPref  *readpref.ReadPref
+
+	// pages holds the page bodies. router is the store underneath
+	// routing namespaces elsewhere with -storage-routes, if any.
+	pages  PageStore
+	router *routedStore
+	// db is what is kept in MongoDB, nil for wikis without a database.
+	// Lookups in it then find nothing and records are not written.
+	db        *database
+	templates *template.Template
+	// static is served under /static/ and read by the offline bundle.
+	static fs.FS
+	// users are the accounts of a wiki without a database, which sign
+	// in with HTTP basic authentication. They are given to NewApp or
+	// read from -users-file.
+	users    map[string]User
+	limiter  *rateLimiter
+	rendered *renderCache
+	// ctx carries the App to what it runs outside of requests.
+	ctx context.Context
+
+	// The parts of the wiki set up from cfg by newApp. remote and
+	// translator are nil unless configured.
+	titles       *titleRules
+	restrictions []ReadRestriction
+	protected    []string
+	hotlink      *hotlinkRules
+	shortcuts    []Shortcut
+	remote       *RemoteWiki
+	translator   Translator
+	issues       *issueLinker
+	repos        map[string]*CodeRepo
+	secrets      *secretScanner
+	announcers   []*Announcer
+	dictionary   *spellDictionary
+}
+
+// database is the MongoDB database of a wiki and its collections, named
+// after what they keep. pages is the collection of the mongo page
+// store; pages are read and written through App.pages.
+type database struct {
+	*mongo.Database
+	pages, views, referrers, searchMisses, redirects, pending *mongo.Collection
+	announcements, trash, revisions, users, sessions, audit   *mongo.Collection
+	idempotency, events, counters, submissions, watchlists    *mongo.Collection
+	snapshots, snapshotPages, legalHolds, retention, links    *mongo.Collection
+	archive                                                   *mongo.Collection
+	attachments                                               *gridfs.Bucket
+}
+
+// newDatabase returns the collections of the wiki kept in d.
+func newDatabase(d *mongo.Database) (*database, error) {
+	db := &database{
+		Database:      d,
+		pages:         d.Collection("Pages"),
+		views:         d.Collection("PageViews"),
+		referrers:     d.Collection("Referrers"),
+		searchMisses:  d.Collection("SearchMisses"),
+		redirects:     d.Collection("Redirects"),
+		pending:       d.Collection("PendingEdits"),
+		announcements: d.Collection("Announcements"),
+		trash:         d.Collection("Trash"),
+		revisions:     d.Collection("Revisions"),
+		users:         d.Collection("Users"),
+		sessions:      d.Collection("Sessions"),
+		audit:         d.Collection("AuditLog"),
+		idempotency:   d.Collection("IdempotencyKeys"),
+		events:        d.Collection("Events"),
+		counters:      d.Collection("Counters"),
+		submissions:   d.Collection("FormSubmissions"),
+		watchlists:    d.Collection("Watchlists"),
+		snapshots:     d.Collection("Snapshots"),
+		snapshotPages: d.Collection("SnapshotPages"),
+		legalHolds:    d.Collection("LegalHolds"),
+		retention:     d.Collection("RetentionPolicies"),
+		links:         d.Collection("Links"),
+		archive:       d.Collection("Archive"),
+	}
+	var err error
+	db.attachments, err = gridfs.NewBucket(d, options.GridFSBucket().SetName("attachments"))
+	return db, err
+}
+
+// appKey is the context key of the App serving a request.
+type appKey struct{}
+
+// newApp returns the App configured with cfg, with no pages yet. It
+// applies the settings that need no database.
+func newApp(cfg *Config) (*App, error) {
+	if !validRole(cfg.DefaultRole) {
+		return nil, fmt.Errorf("unknown role %q", cfg.DefaultRole)
+	}
+	a := &App{
+		cfg:        cfg,
+		static:     assetFS(embeddedStatic, "Static", cfg.StaticDir),
+		users:      map[string]User{},
+		limiter:    newRateLimiter(cfg.WriteRate, cfg.WriteBurst),
+		rendered:   newRenderCache(),
+		dictionary: &spellDictionary{path: cfg.Dictionary},
+	}
+	a.ctx = context.WithValue(context.Background(), appKey{}, a)
+
+	var err error
+	if a.titles, err = newTitleRules(cfg.Titles); err != nil {
+		return nil, err
+	}
+	if a.restrictions, err = parseReadRestrictions(cfg.ReadRestricted, a.titles); err != nil {
+		return nil, err
+	}
+	a.protected = splitList(cfg.ProtectedNamespaces)
+	if a.hotlink, err = newHotlinkRules(cfg); err != nil {
+		return nil, err
+	}
+	if a.shortcuts, err = loadShortcuts(cfg); err != nil {
+		return nil, err
+	}
+	if a.remote, err = newRemoteWiki(cfg.RemotePrefix, cfg.RemoteURL); err != nil {
+		return nil, err
+	}
+	if a.translator, err = newTranslator(cfg.Translator, cfg.TranslatorURL, cfg.TranslatorKey); err != nil {
+		return nil, err
+	}
+	if a.issues, err = newIssueLinker(cfg); err != nil {
+		return nil, err
+	}
+	if a.repos, err = parseCodeRepos(cfg.CodeRepos); err != nil {
+		return nil, err
+	}
+	if a.secrets, err = newSecretScanner(cfg); err != nil {
+		return nil, err
+	}
+	if a.announcers, err = newAnnouncers(cfg); err != nil {
+		return nil, err
+	}
+	if a.templates, err = a.parseTemplates(cfg.TemplateDir); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// appFrom returns the App c belongs to: the one serving a request, or
+// for commands and other work outside of requests its ctx.
+func appFrom(c context.Context) *App {
+	if a, ok := c.Value(appKey{}).(*App); ok {
+		return a
+	}
+	panic("no wiki in context")
+}
+
+// withApp makes a the App of the requests passed to h.
+func (a *App) withApp(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), appKey{}, a)))
+	})
+}
+
+// openApp applies cfg, connects to MongoDB and prepares everything the
+// handlers use. With -storage=fs it does not connect to MongoDB at all
+// and serves what needs no database, like NewApp, with the accounts in
+// -users-file.
+func openApp(cfg *Config) (*App, error) {
+	app, err := newApp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage == "fs" {
+		if cfg.MongoReadTags != "" {
+			return nil, errors.New("-mongo-read-tags needs the mongo page store")
+		}
+		if cfg.UsersFile != "" {
+			users, err := loadUsersFile(cfg.UsersFile)
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range users {
+				app.users[u.Name] = u
+			}
+		}
+	} else {
+		if cfg.UsersFile != "" {
+			return nil, errors.New("-users-file is for -storage=fs; accounts are kept in MongoDB")
+		}
+		if err := app.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := newPageStore(cfg.Storage, cfg.StorageDir, app.db)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	if cfg.MongoSecondaryURI != "" {
+		mps, ok := store.(*mongoPageStore)
+		if !ok {
+			app.Close()
+			return nil, fmt.Errorf("-mongo-secondary-uri needs the mongo page store")
+		}
+		app.secondary, err = mongo.Connect(app.ctx, options.Client().ApplyURI(cfg.MongoSecondaryURI).SetMonitor(mongoMonitor))
+		if err != nil {
+			app.Close()
+			return nil, err
+		}
+		// The secondary may be down as well; the wiki starts anyway.
+		if err := app.secondary.Ping(app.ctx, nil); err != nil {
+			log.Printf("secondary database: %v", err)
+		}
+		store = &failoverStore{
+			primary:   mps,
+			secondary: &mongoPageStore{coll: app.secondary.Database(cfg.Database).Collection("Pages")},
+		}
+	} else {
+		// Pages are still read from the primary client, which reads
+		// from the secondaries matching -mongo-read-tags, if any.
+		store = &failoverStore{primary: store, secondary: store}
+	}
+	if cfg.StorageRoutes != "" {
+		routes, err := parseStorageRoutes(cfg.StorageRoutes, app.titles, cfg.S3, app.db)
+		if err != nil {
+			app.Close()
+			return nil, err
+		}
+		app.router = &routedStore{main: store, routes: routes}
+		store = app.router
+	}
+	app.pages = cacheStore(hookStore(store, observeStore), cfg.PageCache, cfg.PageCacheTTL)
+
+	return app, nil
+}
+
+// connect connects a to MongoDB and sets up the collections and their
+// indexes.
+func (a *App) connect() error {
+	cfg := a.cfg
+	tags, err := parseReadTags(cfg.MongoReadTags)
+	if err != nil {
+		return err
+	}
+	opts := options.Client().ApplyURI(cfg.MongoURI).SetMonitor(mongoMonitor)
+	if len(tags) > 0 {
+		a.readPref = failoverReadPref(tags)
+		opts.SetReadPreference(a.readPref)
+	}
+	client, err := mongo.Connect(a.ctx, opts)
+	if err != nil {
+		return err
+	}
+	a.client = client
+	if err := client.Ping(a.ctx, nil); err != nil {
+		a.Close()
+		return err
+	}
+
+	a.db, err = newDatabase(client.Database(cfg.Database))
+	if err != nil {
+		a.Close()
+		return err
+	}
+
+	if err := createSearchIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createTagIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createSnapshotIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createLinksIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createRevisionIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createUserIndex(a.ctx); err != nil {
+		a.Close()
+		return err
+	}
+	if err := createTTLIndexes(a.ctx, cfg.Retention); err != nil {
+		a.Close()
+		return err
+	}
+	return nil
+}
+
+// NewApp returns the wiki serving the pages in store, configured as
+// gowiki is without flags, without a database. Pages are rendered with
+// tmpl, or the built in templates if it is nil, and users are the
+// accounts clients may sign in as with HTTP basic authentication. What
+// is kept in MongoDB is off: there is no history, no trash and no sign
+// in with a session, and the pages showing them are not found. It serves
+// the wiki from a fake store in tests with httptest. The wikis it
+// returns share nothing, not even with a wiki connected to MongoDB in
+// the same process.
+func NewApp(store PageStore, tmpl *template.Template, users ...User) (http.Handler, error) {
+	cfg, _, err := loadConfig(nil)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newApp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl != nil {
+		a.templates = tmpl
+	}
+	a.pages = store
+	for _, u := range users {
+		a.users[u.Name] = u
+	}
+	return a.routes(), nil
+}
+
+// serve renders the most viewed pages if asked to with -warm-pages and
+// starts the janitor, both only with a database, then listens on the configured address until the
+// process receives SIGINT or SIGTERM. It then stops accepting
+// connections and waits up to the shutdown timeout for requests in
+// flight to finish.
+func (a *App) serve() error {
+	if a.cfg.WarmPages > 0 && a.hasDatabase() {
+		if err := a.warmUp(a.cfg.WarmPages); err != nil {
+			log.Printf("warming up: %v", err)
+		}
+	}
+	if a.cfg.FailoverInterval > 0 && a.hasDatabase() {
+		done := make(chan struct{})
+		defer close(done)
+		go a.watchPrimary(a.cfg.FailoverInterval, done)
+	}
+	if a.cfg.JanitorInterval > 0 && a.hasDatabase() {
+		done := make(chan struct{})
+		defer close(done)
+		go runJanitor(a.ctx, a.cfg.JanitorInterval, a.cfg.Retention, done)
+	}
+	if a.hasDatabase() {
+		// Runs after the server has shut down and the writer below has
+		// stopped, so the views of the last requests are kept.
+		defer flushViews(a.ctx)
+		done := make(chan struct{})
+		defer close(done)
+		go writeViews(a.ctx, viewFlushInterval, done)
+	}
+	srv := &http.Server{
+		Addr:              a.cfg.Addr,
+		Handler:           a.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		// Requests still running are cut off when the timeout expires.
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// Close waits for pending announcements and disconnects from the
+// databases.
+func (a *App) Close() error {
+	announcing.Wait()
+	if a.secondary != nil {
+		a.secondary.Disconnect(a.ctx)
+	}
+	if a.client == nil {
+		return nil
+	}
+	return a.client.Disconnect(a.ctx)
+}
+
+// route is a path the wiki serves, registered as a ServeMux pattern.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	// mongo is set for routes built on what is kept in MongoDB, which
+	// wikis without a database do not serve.
+	mongo bool
+}
+
+// routeTable lists the paths the wiki serves besides /static/.
+func (a *App) routeTable() []route {
+	return []route{
+		{"/view/", makeHandler(viewHandler), false},
+		{"/print/", makeHandler(printHandler), false},
+		{"/summary/", makeHandler(summaryHandler), false},
+		{"/translate/", allowMethods(makeHandler(requireRole(actionRole("translate"), translateHandler)), http.MethodPost), false},
+		{"/pending/", makeHandler(pendingHandler), true},
+		{"/approve/", allowMethods(makeHandler(requireRole(actionRole("approve"), approveHandler)), http.MethodPost), true},
+		{"/reject/", allowMethods(makeHandler(requireRole(actionRole("approve"), rejectHandler)), http.MethodPost), true},
+		{"/undelete/", allowMethods(makeHandler(requireRole(actionRole("undelete"), undeleteHandler)), http.MethodPost), true},
+		{"/history/", makeHandler(historyHandler), true},
+		{"/backlinks/", makeHandler(backlinksHandler), true},
+		{"/submissions/", makeHandler(requireLogin(submissionsHandler)), false},
+		{"/diff/", diffHandler, false},
+		{"/restore/", allowMethods(makeHandler(requireRole(actionRole("restore"), restoreHandler)), http.MethodPost), false},
+		{"/edit/", makeHandler(requireRole(actionRole("edit"), editHandler)), false},
+		{"/delete/", allowMethods(makeHandler(requireRole(actionRole("delete"), idempotent(deleteHandler))), http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete), false},
+		{"/move/", allowMethods(makeHandler(requireRole(actionRole("move"), idempotent(moveHandler))), http.MethodGet, http.MethodHead, http.MethodPost), true},
+		{"/preview/", allowMethods(makeHandler(requireRole(actionRole("edit"), previewHandler)), http.MethodPost), false},
+		{"/save/", allowMethods(makeHandler(requireRole(actionRole("edit"), idempotent(saveHandler))), http.MethodPost), false},
+		{"/attach/", allowMethods(makeHandler(requireRole(actionRole("attach"), idempotent(attachHandler))), http.MethodPost), false},
+		{"/files/", filesHandler, false},
+		{"/list", listHandler, false},
+		{"/search", searchHandler, false},
+		{"/recent", recentHandler, true},
+		{"/archive", allowMethods(archiveHandler, http.MethodGet, http.MethodHead, http.MethodPost), false},
+		{"/feed.atom", feedHandler, true},
+		{"/feed.rss", feedHandler, true},
+		{"/calendar.ics", calendarHandler, false},
+		{"/tags", tagsHandler, false},
+		{"/tag/", tagHandler, false},
+		{"/login", loginHandler, false},
+		{"/register", registerHandler, false},
+		{"/logout", allowMethods(logoutHandler, http.MethodPost), false},
+		{"/sessions", sessionsHandler, false},
+		{"/watchlist", watchlistHandler, true},
+		{"/watch/", allowMethods(makeHandler(requireLogin(watchHandler)), http.MethodPost), true},
+		{"/admin/users", adminUsersHandler, true},
+		{"/export", exportHandler, false},
+		{"/admin/import", allowMethods(importHandler, http.MethodGet, http.MethodHead, http.MethodPost), false},
+		{"/admin/verify", allowMethods(verifyHandler, http.MethodGet, http.MethodHead, http.MethodPost), true},
+		{"/admin/impersonate", allowMethods(impersonateHandler, http.MethodPost), false},
+		{apiPrefix, apiListHandler, false},
+		{apiPrefix + "/", apiPageHandler, false},
+		{"/events", eventsHandler, true},
+		{"/special/", specialHandler, false},
+		{"/shortcuts.json", allowMethods(shortcutsHandler, http.MethodGet, http.MethodHead, http.MethodPost), false},
+		{"/spellcheck", allowMethods(spellcheckHandler, http.MethodPost), false},
+		{"/metrics", metricsHandler, false},
+		{"/healthz", healthzHandler, false},
+		{"/readyz", a.readyzHandler, false},
+	}
+}
+
+// hasDatabase reports whether a is connected to MongoDB.
+func (a *App) hasDatabase() bool {
+	return a.client != nil
+}
+
+// pagesInMongo reports whether every page of a is in the Pages
+// collection, where lists, search and statistics can be queried. Pages
+// kept in files or routed to other stores are instead read one by one
+// through the page store with scanPages.
+func (a *App) pagesInMongo() bool {
+	return a.hasDatabase() && a.router == nil
+}
+
+// routes returns the handler serving the wiki. Paths it does not serve,
+// including those needing a database it does not have, are not found.
+func (a *App) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", notFound)
+	for _, rt := range a.routeTable() {
+		if rt.mongo && !a.hasDatabase() {
+			continue
+		}
+		mux.HandleFunc(rt.pattern, rt.handler)
+	}
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(a.static))))
+	return observeRequests(mux, a.withApp(resolveUserOnce(a.withLimits(a.limitWrites(refuseWritesWhileDegraded(checkCSRF(trackSessions(mux))))))))
+}
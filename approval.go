@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PendingEdit is an edit of a protected page waiting for approval.
+type PendingEdit struct {
+	Page      Page      `bson:"page"`
+	Author    string    `bson:"author"`
+	Submitted time.Time `bson:"submitted"`
+}
+
+// PendingReview pairs a pending edit with the live version it replaces.
+// Live is nil for pages that do not exist yet.
+type PendingReview struct {
+	Live    *Page
+	Pending *PendingEdit
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "PendingChanges",
+		Description: "Edits of protected pages waiting for approval.",
+		Handler:     pendingChangesHandler,
+		Mongo:       true,
+	})
+}
+
+// errPendingChanged is returned when the pending edit was replaced by
+// another one since the reviewer looked at it.
+var errPendingChanged = errors.New("the pending edit changed since it was reviewed")
+
+// isProtected reports whether edits of title need approval, that is
+// whether it is in one of the -protected-namespaces.
+func isProtected(c context.Context, title string) bool {
+	for _, ns := range appFrom(c).protected {
+		if title == ns || strings.HasPrefix(title, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoApproval is returned for edits of protected pages in a wiki
+// without a database, which has nowhere to keep them for approval.
+var errNoApproval = errors.New("protected pages cannot be edited without a database to keep edits for approval")
+
+// submitPendingEdit stores an edit for approval, replacing any earlier
+// pending edit of the same page.
+func submitPendingEdit(c context.Context, p *Page, author string) error {
+	if appFrom(c).db == nil {
+		return errNoApproval
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.pending.ReplaceOne(c,
+		bson.D{primitive.E{Key: "page.title", Value: p.Title}},
+		&PendingEdit{Page: *p, Author: author, Submitted: time.Now()},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func loadPendingEdit(c context.Context, title string) (*PendingEdit, error) {
+	if appFrom(c).db == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var pe PendingEdit
+	err := appFrom(c).db.pending.FindOne(c, bson.D{primitive.E{Key: "page.title", Value: title}}).Decode(&pe)
+	if err != nil {
+		return nil, err
+	}
+	return &pe, nil
+}
+
+// takePendingEdit removes the pending edit of title submitted at
+// submitted, the one the reviewer saw, and returns errPendingChanged if
+// it was replaced or is gone.
+func takePendingEdit(c context.Context, title string, submitted time.Time) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	res, err := appFrom(c).db.pending.DeleteOne(c, bson.D{
+		primitive.E{Key: "page.title", Value: title},
+		primitive.E{Key: "submitted", Value: submitted},
+	})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errPendingChanged
+	}
+	return nil
+}
+
+// returnPendingEdit puts back a pending edit taken by takePendingEdit
+// that could not be published, unless another edit was submitted since.
+func returnPendingEdit(c context.Context, pe *PendingEdit) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.pending.UpdateOne(c,
+		bson.D{primitive.E{Key: "page.title", Value: pe.Page.Title}},
+		bson.D{primitive.E{Key: "$setOnInsert", Value: pe}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// reviewedPendingEdit returns the pending edit of title the form of r
+// was shown for, identified by the time it was submitted.
+func reviewedPendingEdit(r *http.Request, title string) (*PendingEdit, error) {
+	pe, err := loadPendingEdit(r.Context(), title)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(r.FormValue("submitted"), 10, 64)
+	if err != nil || !pe.Submitted.Equal(time.Unix(0, n)) {
+		return nil, errPendingChanged
+	}
+	return pe, nil
+}
+
+// pendingError reports err from reviewedPendingEdit or takePendingEdit.
+func pendingError(w http.ResponseWriter, r *http.Request, title string, err error) {
+	switch err {
+	case mongo.ErrNoDocuments:
+		notFound(w, r)
+	case errPendingChanged:
+		http.Error(w, "The pending edit of "+title+" was replaced since you reviewed it. Review it again.", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// listPendingEdits returns the pending edits of the pages u may read,
+// oldest first.
+func listPendingEdits(c context.Context, u *User) ([]PendingEdit, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "page.body", Value: 0}}).
+		SetSort(bson.D{{Key: "submitted", Value: 1}})
+	cur, err := appFrom(c).db.pending.Find(c, readFilter(c, u, "page.title"), opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []PendingEdit{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+func pendingHandler(w http.ResponseWriter, r *http.Request, title string) {
+	pe, err := loadPendingEdit(r.Context(), title)
+	if err != nil {
+		http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+		return
+	}
+	review := &PendingReview{Pending: pe}
+	if p, err := loadPage(r.Context(), title); err == nil {
+		review.Live = p
+	}
+	renderTemplate(w, r, "pending", &pe.Page, review)
+}
+
+// approveHandler publishes a pending edit. The approver must be someone
+// other than the author of the edit, and it must be the edit they
+// reviewed: a new submission replaces the pending edit of a page.
+func approveHandler(w http.ResponseWriter, r *http.Request, title string) {
+	pe, err := reviewedPendingEdit(r, title)
+	if err != nil {
+		pendingError(w, r, title, err)
+		return
+	}
+	approver := userName(r)
+	if approver == "" || strings.EqualFold(approver, pe.Author) {
+		http.Error(w, "edits must be approved by someone other than their author", http.StatusForbidden)
+		return
+	}
+
+	// Taking the edit first makes sure no newer submission slipped in
+	// after the check above.
+	if err := takePendingEdit(r.Context(), title, pe.Submitted); err != nil {
+		pendingError(w, r, title, err)
+		return
+	}
+	p := pe.Page
+	p.Updated = time.Now()
+	if err := commitRevision(r.Context(), &p, pe.Author); err != nil {
+		if rerr := returnPendingEdit(r.Context(), pe); rerr != nil {
+			err = rerr
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordEvent(r.Context(), eventSaved, title, pe.Author, "Approved by "+approver); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "Approved and published the edit of "+title+".")
+	http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
+
+func rejectHandler(w http.ResponseWriter, r *http.Request, title string) {
+	pe, err := reviewedPendingEdit(r, title)
+	if err == nil {
+		err = takePendingEdit(r.Context(), title, pe.Submitted)
+	}
+	if err != nil {
+		pendingError(w, r, title, err)
+		return
+	}
+	addFlash(w, r, "Rejected the pending edit of "+title+".")
+	http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
+
+func pendingChangesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := listPendingEdits(r.Context(), currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "pendingchanges", nil, list)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Archiving a page, such as the namespace of a project that has ended,
+// leaves it and every page below it out of the page list, search and
+// tags without deleting anything. Archived pages can still be viewed,
+// edited and linked to, and restoring them lists them again. Editors
+// archive and restore pages at /archive, which also lists what is
+// archived.
+
+// ArchiveEntry archives the page called Title and the pages below it.
+type ArchiveEntry struct {
+	Title    string    `bson:"_id"`
+	By       string    `bson:"by"`
+	Archived time.Time `bson:"archived"`
+	// Pages are the archived pages, as listed on /archive.
+	Pages []string `bson:"-"`
+}
+
+// archiveEntry returns the entry archiving title, or nil if it is not
+// archived.
+func archiveEntry(c context.Context, title string) (*ArchiveEntry, error) {
+	if appFrom(c).db == nil {
+		return nil, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var e ArchiveEntry
+	err := appFrom(c).db.archive.FindOne(c, bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: titleAndParents(title)}}},
+	}).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// pageArchive is archiveEntry for templates, which show nothing if the
+// archive cannot be read.
+func pageArchive(c context.Context, title string) *ArchiveEntry {
+	e, _ := archiveEntry(c, title)
+	return e
+}
+
+func listArchive(c context.Context) ([]ArchiveEntry, error) {
+	if appFrom(c).db == nil {
+		return []ArchiveEntry{}, nil
+	}
+	cur, err := appFrom(c).db.archive.Find(c, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []ArchiveEntry{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// unlistedNamespaces returns the namespaces left out of what u sees in
+// page lists and search: those u may not read and the archived ones.
+func unlistedNamespaces(c context.Context, u *User) ([]string, error) {
+	list, err := listArchive(c)
+	if err != nil {
+		return nil, err
+	}
+	hidden := hiddenNamespaces(c, u)
+	for _, e := range list {
+		hidden = append(hidden, e.Title)
+	}
+	return hidden, nil
+}
+
+func archivePage(c context.Context, title, by string) error {
+	_, err := appFrom(c).db.archive.ReplaceOne(c,
+		bson.D{primitive.E{Key: "_id", Value: title}},
+		&ArchiveEntry{Title: title, By: by, Archived: time.Now()},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func unarchivePage(c context.Context, title string) error {
+	_, err := appFrom(c).db.archive.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: title}})
+	return err
+}
+
+// archiveHandler serves /archive. Posting "archive" with titles, one a
+// line, archives each of them with the pages below it; posting
+// "restore" with a title lists it again.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	titles, err := listPages(r.Context(), 0, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := currentUser(r)
+	titles = readableTitles(r.Context(), u, titles)
+
+	if r.Method == http.MethodPost {
+		if !checkRole(w, r, actionRole("archive")) {
+			return
+		}
+		if title := strings.TrimSpace(r.FormValue("restore")); title != "" {
+			if err := unarchivePage(r.Context(), title); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := recordEvent(r.Context(), eventUnarchived, title, userName(r), ""); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			addFlash(w, r, "Restored "+title+" from the archive.")
+			http.Redirect(w, r, "/archive", http.StatusSeeOther)
+			return
+		}
+
+		var archive []string
+		for _, line := range strings.Split(r.FormValue("titles"), "\n") {
+			title := strings.TrimSpace(line)
+			if title == "" {
+				continue
+			}
+			if !validTitle(r.Context(), title) || !canRead(r.Context(), u, title) {
+				http.Error(w, "cannot archive "+title, http.StatusBadRequest)
+				return
+			}
+			found := false
+			for _, t := range titles {
+				if inNamespace(t, title) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				http.Error(w, "there are no pages to archive at "+title, http.StatusBadRequest)
+				return
+			}
+			archive = append(archive, title)
+		}
+		if len(archive) == 0 {
+			http.Error(w, "nothing to archive", http.StatusBadRequest)
+			return
+		}
+		for _, title := range archive {
+			err := archivePage(r.Context(), title, userName(r))
+			if err == nil {
+				err = recordEvent(r.Context(), eventArchived, title, userName(r), "")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		addFlash(w, r, "Archived "+strings.Join(archive, ", ")+".")
+		http.Redirect(w, r, "/archive", http.StatusSeeOther)
+		return
+	}
+
+	list, err := listArchive(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := []ArchiveEntry{}
+	for _, e := range list {
+		if !canRead(r.Context(), u, e.Title) {
+			continue
+		}
+		for _, t := range titles {
+			if inNamespace(t, e.Title) {
+				e.Pages = append(e.Pages, t)
+			}
+		}
+		entries = append(entries, e)
+	}
+	renderTemplate(w, r, "archive", nil, entries)
+}
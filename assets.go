@@ -0,0 +1,46 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// The templates and static files are built into the binary, so gowiki
+// runs from any directory. A directory given with -templates or -static
+// overrides them file by file: a customized view.html there replaces
+// the built in one and every other file still comes from the binary.
+
+//go:embed Templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed Static
+var embeddedStatic embed.FS
+
+// overlayFS reads files from dir when they exist there and from base
+// otherwise. An empty dir reads everything from base.
+type overlayFS struct {
+	dir  string
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.dir != "" {
+		f, err := os.DirFS(o.dir).Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return o.base.Open(name)
+}
+
+// assetFS returns the embedded directory sub of files, overridden by
+// the files in dir.
+func assetFS(files embed.FS, sub, dir string) fs.FS {
+	base, err := fs.Sub(files, sub)
+	if err != nil {
+		panic(err)
+	}
+	return overlayFS{dir: dir, base: base}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Files attached to a page are kept in GridFS under the name
+// "{title}/{name}" and served from /files/{title}/{name}. Page bodies
+// refer to them as attachment:{name}, as in ![diagram](attachment:a.png).
+// Removed files go to a recycle bin, marked with the time they were
+// removed, and are purged with the trash.
+
+// attachmentScheme marks links to files attached to the page.
+const attachmentScheme = "attachment:"
+
+// maxAttachmentSize is the largest file that can be uploaded.
+const maxAttachmentSize = 10 << 20
+
+// attachmentNamePattern matches the file names attachments may have.
+var attachmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,99}$`)
+
+var errBadAttachmentName = errors.New("file names may only contain letters, digits, '.', '_' and '-'")
+
+var errAttachmentExists = errors.New("the page has a newer file of that name")
+
+// Attachment is a file attached to a page.
+type Attachment struct {
+	ID          primitive.ObjectID
+	Title       string
+	Name        string
+	ContentType string
+	Size        int64
+	Uploaded    time.Time
+	Uploader    string
+	// Checksum is the contentChecksum of the file, empty for files
+	// attached by older versions.
+	Checksum string
+}
+
+// URL is where the attachment is served.
+func (a Attachment) URL() string {
+	return attachmentURL(a.Title, a.Name)
+}
+
+// IsImage reports whether the attachment can be shown with an img tag.
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// attachmentFile is the GridFS files document of an attachment.
+type attachmentFile struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Length     int64              `bson:"length"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	Metadata   struct {
+		Title       string `bson:"title"`
+		Name        string `bson:"name"`
+		ContentType string `bson:"contentType"`
+		Uploader    string `bson:"uploader"`
+		Checksum    string `bson:"checksum"`
+		// Recycled is when the file was removed, zero for files
+		// attached to their page.
+		Recycled time.Time `bson:"recycled,omitempty"`
+	} `bson:"metadata"`
+}
+
+func (f *attachmentFile) attachment() Attachment {
+	return Attachment{
+		ID:          f.ID,
+		Title:       f.Metadata.Title,
+		Name:        f.Metadata.Name,
+		ContentType: f.Metadata.ContentType,
+		Size:        f.Length,
+		Uploaded:    f.UploadDate,
+		Uploader:    f.Metadata.Uploader,
+		Checksum:    f.Metadata.Checksum,
+	}
+}
+
+func attachmentURL(title, name string) string {
+	return pageURL("files", title) + "/" + url.PathEscape(name)
+}
+
+// cleanAttachmentName turns the file name sent by a browser into the
+// name of an attachment, dropping any directories and using dashes for
+// spaces.
+func cleanAttachmentName(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Join(strings.Fields(name), "-")
+	if !attachmentNamePattern.MatchString(name) {
+		return "", errBadAttachmentName
+	}
+	return name, nil
+}
+
+// attachmentType returns the content type a file is served with.
+func attachmentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func findAttachments(c context.Context, filter bson.D) ([]Attachment, error) {
+	files, err := findAttachmentFiles(c, filter)
+	if err != nil {
+		return nil, err
+	}
+	list := []Attachment{}
+	for i := range files {
+		list = append(list, files[i].attachment())
+	}
+	return list, nil
+}
+
+func findAttachmentFiles(c context.Context, filter bson.D) ([]attachmentFile, error) {
+	if appFrom(c).db == nil {
+		return nil, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.attachments.Find(filter, options.GridFSFind().SetSort(bson.D{{Key: "metadata.name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var files []attachmentFile
+	err = cur.All(c, &files)
+	return files, err
+}
+
+// notRecycled matches the files attached to their page.
+var notRecycled = primitive.E{Key: "metadata.recycled", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}
+
+// listAttachments returns the files attached to a page, by name.
+func listAttachments(c context.Context, title string) ([]Attachment, error) {
+	return findAttachments(c, bson.D{primitive.E{Key: "metadata.title", Value: title}, notRecycled})
+}
+
+// findAttachment returns the newest upload of a page's attachment.
+func findAttachment(c context.Context, title, name string) (*Attachment, error) {
+	list, err := findAttachments(c, bson.D{
+		primitive.E{Key: "metadata.title", Value: title},
+		primitive.E{Key: "metadata.name", Value: name},
+		notRecycled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latestAttachment(list)
+}
+
+// latestAttachment returns the newest upload in list.
+func latestAttachment(list []Attachment) (*Attachment, error) {
+	if len(list) == 0 {
+		return nil, gridfs.ErrFileNotFound
+	}
+	latest := list[0]
+	for _, a := range list[1:] {
+		if a.Uploaded.After(latest.Uploaded) {
+			latest = a
+		}
+	}
+	return &latest, nil
+}
+
+// saveAttachment stores a file attached to a page, replacing an earlier
+// file of the same name.
+func saveAttachment(c context.Context, title, name, uploader string, r io.Reader) error {
+	old, err := listAttachments(c, title)
+	if err != nil {
+		return err
+	}
+	meta := bson.D{
+		primitive.E{Key: "title", Value: title},
+		primitive.E{Key: "name", Value: name},
+		primitive.E{Key: "contentType", Value: attachmentType(name)},
+		primitive.E{Key: "uploader", Value: uploader},
+	}
+	h := sha256.New()
+	id, err := appFrom(c).db.attachments.UploadFromStream(title+"/"+name, io.TeeReader(r, h), options.GridFSUpload().SetMetadata(meta))
+	if err != nil {
+		return err
+	}
+	// The checksum is only known once the file is stored.
+	_, err = appFrom(c).db.Collection("attachments.files").UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: id}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "metadata.checksum", Value: hashChecksum(h)}}}})
+	if err != nil {
+		return err
+	}
+	for _, a := range old {
+		if a.Name == name {
+			if err := appFrom(c).db.attachments.Delete(a.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recycleAttachment removes a file from a page, keeping it in the
+// recycle bin.
+func recycleAttachment(c context.Context, title, name string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.Collection("attachments.files").UpdateMany(c,
+		bson.D{
+			primitive.E{Key: "metadata.title", Value: title},
+			primitive.E{Key: "metadata.name", Value: name},
+			notRecycled,
+		},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "metadata.recycled", Value: time.Now()}}}})
+	return err
+}
+
+// restoreAttachment attaches the file last removed from a page under
+// name to it again, unless a file of that name was attached since.
+func restoreAttachment(c context.Context, title, name string) error {
+	if _, err := findAttachment(c, title, name); err == nil {
+		return errAttachmentExists
+	} else if err != gridfs.ErrFileNotFound {
+		return err
+	}
+	list, err := findAttachments(c, bson.D{
+		primitive.E{Key: "metadata.title", Value: title},
+		primitive.E{Key: "metadata.name", Value: name},
+	})
+	if err != nil {
+		return err
+	}
+	a, err := latestAttachment(list)
+	if err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err = appFrom(c).db.Collection("attachments.files").UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: a.ID}},
+		bson.D{primitive.E{Key: "$unset", Value: bson.D{primitive.E{Key: "metadata.recycled", Value: ""}}}})
+	return err
+}
+
+// purgeRecycledAttachments deletes the files in the recycle bin kept
+// longer than deleted pages are kept in the trash, unless under legal
+// hold, and returns how many.
+func purgeRecycledAttachments(c context.Context, now time.Time, def time.Duration) (int64, error) {
+	expired, err := trashExpiry(c, now, def)
+	if err != nil {
+		return 0, err
+	}
+	files, err := findAttachmentFiles(c, bson.D{
+		primitive.E{Key: "metadata.recycled", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, f := range files {
+		if !expired(f.Metadata.Title, f.Metadata.Recycled) {
+			continue
+		}
+		if err := appFrom(c).db.attachments.Delete(f.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// attachHandler uploads a file to a page, or removes one when the form
+// names a file to delete. Both come from the edit page, which the
+// client is sent back to.
+func attachHandler(w http.ResponseWriter, r *http.Request, title string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+
+	if name := r.FormValue("delete"); name != "" {
+		removeAttachmentHandler(w, r, title, name)
+		return
+	}
+	if name := r.FormValue("restore"); name != "" {
+		switch err := restoreAttachment(r.Context(), title, name); err {
+		case nil:
+		case gridfs.ErrFileNotFound:
+			notFound(w, r)
+			return
+		case errAttachmentExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addFlash(w, r, "Restored "+name+" to "+title+".")
+		http.Redirect(w, r, pageURL("edit", title), http.StatusSeeOther)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "no file uploaded: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxAttachmentSize {
+		http.Error(w, "files may be at most "+strconv.Itoa(maxAttachmentSize>>20)+" MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	name, err := cleanAttachmentName(header.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveAttachment(r.Context(), title, name, userName(r), file); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "Attached "+name+" to "+title+". Refer to it as "+attachmentScheme+name+".")
+	http.Redirect(w, r, pageURL("edit", title), http.StatusSeeOther)
+}
+
+// filesHandler serves /files/{title}/{name}. Only images are shown in
+// the browser; other files are downloaded, so that uploaded HTML cannot
+// run as part of the wiki.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/files/")
+	i := strings.LastIndex(rest, "/")
+	if i < 0 || !validTitle(r.Context(), rest[:i]) || !attachmentNamePattern.MatchString(rest[i+1:]) {
+		notFound(w, r)
+		return
+	}
+	if !checkRead(w, r, rest[:i]) {
+		return
+	}
+	if !appFrom(r.Context()).hotlink.allows(r, rest[:i], rest[i+1:]) {
+		http.Error(w, "this file may only be shown on the wiki", http.StatusForbidden)
+		return
+	}
+	a, err := findAttachment(r.Context(), rest[:i], rest[i+1:])
+	if err == gridfs.ErrFileNotFound {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stream, err := appFrom(r.Context()).db.attachments.OpenDownloadStream(a.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Last-Modified", a.Uploaded.UTC().Format(http.TimeFormat))
+	if !a.IsImage() || a.ContentType == "image/svg+xml" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	}
+	io.Copy(w, stream)
+}
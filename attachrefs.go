@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// What is done with the images and links pointing at a removed file.
+const (
+	// keepReferences leaves them, showing as broken until the file is
+	// restored.
+	keepReferences = "keep"
+	// unlinkReferences replaces them by their text.
+	unlinkReferences = "unlink"
+	// commentReferences puts them in <!-- --> comments, which are not
+	// shown, so they can be brought back by hand.
+	commentReferences = "comment"
+)
+
+// AttachmentRemoval asks what to do with the pages referring to a file
+// before removing it.
+type AttachmentRemoval struct {
+	Name string
+	// References are the titles of the pages the reader can see that
+	// show or link to the file.
+	References []string
+}
+
+// attachmentRefPattern matches the Markdown images and links in the
+// body of page that point at the file called name attached to title:
+// attachment:name on title itself, its /files/ URL anywhere.
+func attachmentRefPattern(page, title, name string) *regexp.Regexp {
+	target := regexp.QuoteMeta(attachmentURL(title, name))
+	if page == title {
+		target += "|" + regexp.QuoteMeta(attachmentScheme+name)
+	}
+	return regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*<?(?:` + target + `)>?(?:\s+"[^"]*")?\s*\)`)
+}
+
+// rewriteAttachmentRefs returns body with the references to the file
+// unlinked or commented out, as how says, or nil if it has none.
+func rewriteAttachmentRefs(body []byte, page, title, name, how string) []byte {
+	re := attachmentRefPattern(page, title, name)
+	if !re.Match(body) {
+		return nil
+	}
+	return re.ReplaceAllFunc(body, func(ref []byte) []byte {
+		if how == commentReferences {
+			return []byte("<!-- " + string(ref) + " -->")
+		}
+		return re.FindSubmatch(ref)[2]
+	})
+}
+
+// attachmentReferences returns the titles of the pages u can read that
+// show or link to the file called name attached to title.
+func attachmentReferences(c context.Context, title, name string, u *User) ([]string, error) {
+	titles, err := listPages(c, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	refs := []string{}
+	for _, t := range readableTitles(c, u, titles) {
+		p, err := loadPage(c, t)
+		if err != nil {
+			continue
+		}
+		if attachmentRefPattern(t, title, name).Match(p.Body) {
+			refs = append(refs, t)
+		}
+	}
+	return refs, nil
+}
+
+// removeAttachmentHandler moves a file attached to title to the recycle
+// bin. Files still shown or linked to by pages are only removed once
+// the client confirms, saying what to do with the references.
+func removeAttachmentHandler(w http.ResponseWriter, r *http.Request, title, name string) {
+	u := currentUser(r)
+	refs, err := attachmentReferences(r.Context(), title, name, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	how := r.FormValue("references")
+	if len(refs) > 0 && r.FormValue("confirm") == "" {
+		p, err := loadPage(r.Context(), title)
+		if err != nil {
+			p = &Page{Title: title}
+		}
+		renderTemplate(w, r, "attachremove", p, &AttachmentRemoval{Name: name, References: refs})
+		return
+	}
+	switch how {
+	case "", keepReferences, unlinkReferences, commentReferences:
+	default:
+		http.Error(w, "references must be kept, unlinked or commented out", http.StatusBadRequest)
+		return
+	}
+
+	if err := recycleAttachment(r.Context(), title, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg := "Removed " + name + " from " + title + "."
+	if len(refs) > 0 && (how == unlinkReferences || how == commentReferences) {
+		summary := "Links to " + name + " removed"
+		if how == commentReferences {
+			summary = "Links to " + name + " commented out"
+		}
+		changed, pending, err := rewritePages(r.Context(), u, userName(r), summary, func(page string, body []byte) []byte {
+			return rewriteAttachmentRefs(body, page, title, name, how)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(changed) > 0 {
+			msg += " Updated the references in " + strconv.Itoa(len(changed)) + " pages."
+		}
+		if len(pending) > 0 {
+			msg += " The references in " + strconv.Itoa(len(pending)) + " protected pages wait for approval."
+		}
+	}
+	addFlashAction(w, r, msg, pageURL("attach", title)+"?restore="+url.QueryEscape(name), "Undo")
+	http.Redirect(w, r, pageURL("edit", title), http.StatusSeeOther)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// auditLogLength is the number of entries the audit log page shows.
+const auditLogLength = 200
+
+// AuditEntry records something an admin did that is not a page change,
+// such as viewing the wiki as another user.
+type AuditEntry struct {
+	Time   time.Time `bson:"time"`
+	Actor  string    `bson:"actor"`
+	Action string    `bson:"action"`
+	Detail string    `bson:"detail,omitempty"`
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "AuditLog",
+		Description: "What admins did while viewing the wiki as someone else.",
+		Handler:     auditLogHandler,
+		Mongo:       true,
+		Role:        roleAdmin,
+	})
+}
+
+// recordAudit adds an entry to the audit log. Failures are logged, so
+// they are not lost, but do not stop the action being audited.
+func recordAudit(c context.Context, actor, action, detail string) {
+	if appFrom(c).db == nil {
+		log.Printf("audit: %s %s %s", actor, action, detail)
+		return
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.audit.InsertOne(c, &AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Detail: detail,
+	})
+	if err != nil {
+		log.Printf("audit: %s %s %s: %v", actor, action, detail, err)
+	}
+}
+
+func auditLog(c context.Context, limit int64) ([]AuditEntry, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetLimit(limit)
+	cur, err := appFrom(c).db.audit.Find(c, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []AuditEntry{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := auditLog(r.Context(), auditLogLength)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "auditlog", nil, list)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookie holds the token of the signed in user's session.
+const sessionCookie = "session"
+
+// defaultSessionLifetime is how long a session stays valid after sign
+// in, unless the user asked to be remembered or -session-lifetime says
+// otherwise.
+const defaultSessionLifetime = 12 * time.Hour
+
+// defaultRememberLifetime is how long a remembered session stays valid
+// after it was last used, unless -remember-lifetime says otherwise.
+const defaultRememberLifetime = 30 * 24 * time.Hour
+
+// minPasswordLength is the shortest password accepted at registration.
+const minPasswordLength = 8
+
+var validUserName = regexp.MustCompile(`^[a-zA-Z0-9_-]{2,32}$`)
+
+var errBadLogin = errors.New("unknown user name or wrong password")
+var errUserExists = errors.New("that user name is taken")
+var errNoAccounts = errors.New("this wiki has no database to keep accounts and sessions in")
+
+// User is a registered account.
+type User struct {
+	Name         string    `bson:"name"`
+	PasswordHash []byte    `bson:"passwordHash"`
+	Role         string    `bson:"role,omitempty"`
+	Created      time.Time `bson:"created"`
+	// ShortcutsOff is set when the user has switched keyboard shortcuts
+	// off.
+	ShortcutsOff bool `bson:"shortcutsOff,omitempty"`
+}
+
+// Session ties a browser to a signed in user. Only a hash of the session
+// token is stored, so the Sessions collection cannot be used to log in.
+// Remembered sessions outlive the browser session and have their token
+// replaced every sessionRotation.
+type Session struct {
+	TokenHash string    `bson:"_id"`
+	User      string    `bson:"user"`
+	Created   time.Time `bson:"created"`
+	Expires   time.Time `bson:"expires"`
+	Remember  bool      `bson:"remember"`
+	Rotated   time.Time `bson:"rotated"`
+	LastSeen  time.Time `bson:"lastSeen"`
+	UserAgent string    `bson:"userAgent"`
+	Address   string    `bson:"address"`
+	// ViewAs is the user an admin views the wiki as, if any.
+	ViewAs string `bson:"viewAs,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadUser returns the account called name. A wiki without a database
+// has the accounts it was given instead of a Users collection.
+func loadUser(c context.Context, name string) (*User, error) {
+	if appFrom(c).db == nil {
+		u, ok := appFrom(c).users[name]
+		if !ok {
+			return nil, mongo.ErrNoDocuments
+		}
+		return &u, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var u User
+	err := appFrom(c).db.users.FindOne(c, bson.D{primitive.E{Key: "name", Value: name}}).Decode(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// registerUser creates an account with a bcrypt hash of password.
+func registerUser(c context.Context, name, password string) (*User, error) {
+	if appFrom(c).db == nil {
+		return nil, errNoAccounts
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	if !validUserName.MatchString(name) {
+		return nil, errors.New("user names are 2 to 32 letters, digits, dashes or underscores")
+	}
+	if len(password) < minPasswordLength {
+		return nil, errors.New("passwords must be at least 8 characters long")
+	}
+	if _, err := loadUser(c, name); err == nil {
+		return nil, errUserExists
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	role, err := newUserRole(c)
+	if err != nil {
+		return nil, err
+	}
+	u := &User{Name: name, PasswordHash: hash, Role: role, Created: time.Now()}
+	if _, err := appFrom(c).db.users.InsertOne(c, u); err != nil {
+		if isDuplicateKey(err) {
+			// Someone took the name since the check above.
+			return nil, errUserExists
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// createUserIndex makes user names unique, so of two registrations of
+// the same name only the first creates an account.
+func createUserIndex(c context.Context) error {
+	_, err := appFrom(c).db.users.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetName("name").SetUnique(true),
+	})
+	return err
+}
+
+// loadUsersFile reads the accounts of a wiki without a database from
+// path, one name:hash[:role] a line with a bcrypt hash, as htpasswd -B
+// writes them. Blank lines and lines starting with # are skipped.
+func loadUsersFile(path string) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, ":")
+		if len(f) < 2 || len(f) > 3 || !validUserName.MatchString(f[0]) {
+			return nil, fmt.Errorf("%s:%d: not of the form name:hash[:role]", path, i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(f[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		u := User{Name: f[0], PasswordHash: []byte(f[1]), Role: defaultRole}
+		if len(f) == 3 {
+			if !validRole(f[2]) {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", path, i+1, f[2])
+			}
+			u.Role = f[2]
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// authenticate checks a user name and password.
+func authenticate(c context.Context, name, password string) (*User, error) {
+	u, err := loadUser(c, name)
+	if err != nil {
+		return nil, errBadLogin
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return nil, errBadLogin
+	}
+	return u, nil
+}
+
+// isHTTPS reports whether the client reached the wiki over HTTPS,
+// directly or through a proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setSessionCookie hands token to the browser. The cookie of a
+// remembered session is kept until the session expires, others are
+// dropped when the browser is closed.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, s *Session) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.Remember {
+		c.Expires = s.Expires
+	}
+	http.SetCookie(w, c)
+}
+
+// startSession signs u in and sets the session cookie.
+func startSession(w http.ResponseWriter, r *http.Request, u *User, remember bool) error {
+	if appFrom(r.Context()).db == nil {
+		return errNoAccounts
+	}
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	cfg := appFrom(r.Context()).cfg
+	now := time.Now()
+	s := &Session{
+		TokenHash: hashToken(token),
+		User:      u.Name,
+		Created:   now,
+		Expires:   now.Add(cfg.SessionLifetime),
+		Remember:  remember,
+		Rotated:   now,
+		LastSeen:  now,
+		UserAgent: r.UserAgent(),
+		Address:   remoteHost(r),
+	}
+	if remember {
+		s.Expires = now.Add(cfg.RememberLifetime)
+	}
+	if _, err := appFrom(c).db.sessions.InsertOne(c, s); err != nil {
+		return err
+	}
+	setSessionCookie(w, r, token, s)
+	return nil
+}
+
+// endSession signs the client out.
+func endSession(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || appFrom(r.Context()).db == nil {
+		return nil
+	}
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	_, err = appFrom(c).db.sessions.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: hashToken(cookie.Value)}})
+	return err
+}
+
+// userKey is the context key of the requestUser of a request.
+type userKey struct{}
+
+// requestUser holds the user of a request once currentUser has looked
+// them up.
+type requestUser struct {
+	once sync.Once
+	u    *User
+}
+
+// resolveUserOnce makes currentUser look up the user of each request
+// passed to h only once, however many handlers and templates ask for
+// it. Checking basic auth credentials costs a bcrypt comparison.
+func resolveUserOnce(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rctx := context.WithValue(r.Context(), userKey{}, &requestUser{})
+		h.ServeHTTP(w, r.WithContext(rctx))
+	})
+}
+
+// currentUser returns the signed in user, or nil for anonymous clients.
+// Scripts may send their credentials with HTTP basic authentication
+// instead of signing in. While an admin views the wiki as someone else,
+// that is who is returned.
+func currentUser(r *http.Request) *User {
+	ru, ok := r.Context().Value(userKey{}).(*requestUser)
+	if !ok {
+		return lookupUser(r)
+	}
+	ru.once.Do(func() { ru.u = lookupUser(r) })
+	return ru.u
+}
+
+// lookupUser finds the user of r for currentUser.
+func lookupUser(r *http.Request) *User {
+	if name, password, ok := r.BasicAuth(); ok {
+		u, err := authenticate(r.Context(), name, password)
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+	s := currentSession(r)
+	if s == nil {
+		return nil
+	}
+	name := s.User
+	if s.ViewAs == viewAsAnonymous {
+		return nil
+	}
+	if s.ViewAs != "" {
+		name = s.ViewAs
+	}
+	u, err := loadUser(r.Context(), name)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// userName returns the name of the signed in user, or "" if there is
+// none.
+func userName(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// requireLogin wraps handlers that any signed in user may use, so that
+// anonymous clients are sent to the login page first. Handlers needing
+// a particular role use requireRole instead.
+func requireLogin(fn func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, title string) {
+		if currentUser(r) == nil {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+			return
+		}
+		fn(w, r, title)
+	}
+}
+
+// localTarget returns next if it is a path on this wiki, and "/list"
+// otherwise, so the login form cannot redirect to other sites.
+func localTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/list"
+	}
+	return next
+}
+
+// LoginForm is shown by the login and registration pages.
+type LoginForm struct {
+	Name  string
+	Next  string
+	Error string
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	form := &LoginForm{Next: localTarget(r.FormValue("next"))}
+	if r.Method == http.MethodPost {
+		form.Name = strings.TrimSpace(r.FormValue("name"))
+		u, err := authenticate(r.Context(), form.Name, r.FormValue("password"))
+		if err == nil {
+			err = startSession(w, r, u, r.FormValue("remember") != "")
+		}
+		if err == nil {
+			addFlash(w, r, "Signed in as "+u.Name+".")
+			http.Redirect(w, r, form.Next, http.StatusFound)
+			return
+		}
+		form.Error = err.Error()
+	}
+	renderTemplate(w, r, "login", nil, form)
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	form := &LoginForm{Next: localTarget(r.FormValue("next"))}
+	if r.Method == http.MethodPost {
+		form.Name = strings.TrimSpace(r.FormValue("name"))
+		u, err := registerUser(r.Context(), form.Name, r.FormValue("password"))
+		if err == nil {
+			err = startSession(w, r, u, false)
+		}
+		if err == nil {
+			addFlash(w, r, "Welcome, "+u.Name+".")
+			http.Redirect(w, r, form.Next, http.StatusFound)
+			return
+		}
+		form.Error = err.Error()
+	}
+	renderTemplate(w, r, "register", nil, form)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := endSession(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "Signed out.")
+	http.Redirect(w, r, "/list", http.StatusFound)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// /calendar.ics is an iCalendar feed (RFC 5545) of the dates maintainers
+// have to keep in mind, for subscribing to from a calendar app:
+//
+//   - review deadlines: owned pages are due for review staleAfter after
+//     their last edit, unless front matter sets "review: 2026-03-01"
+//   - "publish" and "expires" dates set in front matter, for content
+//     planned to go out or become outdated on a given day
+//
+// The wiki does not act on publish and expires dates itself; the
+// calendar reminds people to. ?owner=name limits the feed to the pages
+// someone owns or reviews.
+
+// calendarPast is how far back dates are still listed, so overdue
+// reviews stay visible for a while without the feed growing forever.
+const calendarPast = 30 * 24 * time.Hour
+
+// calendarDateKeys are the front matter keys read as dates, with the
+// text their entries start with.
+var calendarDateKeys = []struct {
+	Key, Label string
+}{
+	{"review", "Review due"},
+	{"publish", "Publish"},
+	{"expires", "Expires"},
+}
+
+// CalendarEntry is one day in the calendar feed.
+type CalendarEntry struct {
+	Kind  string
+	Title string
+	Date  time.Time
+	Label string
+	Owner string
+}
+
+// pageCalendarEntries returns the dates of p. Only the date part of the
+// time of p.Updated is used.
+func pageCalendarEntries(p *Page) []CalendarEntry {
+	var list []CalendarEntry
+	explicitReview := false
+	for _, f := range parseFrontMatter(p.Body) {
+		for _, k := range calendarDateKeys {
+			if f.Key != k.Key {
+				continue
+			}
+			s, ok := f.Value.(string)
+			if !ok {
+				continue
+			}
+			d, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				continue
+			}
+			if k.Key == "review" {
+				explicitReview = true
+			}
+			list = append(list, CalendarEntry{Kind: k.Key, Title: p.Title, Date: d, Label: k.Label, Owner: p.Owner})
+		}
+	}
+	if !explicitReview && (p.Owner != "" || p.Reviewer != "") && !p.Updated.IsZero() {
+		due := p.Updated.Add(staleAfter).UTC()
+		list = append(list, CalendarEntry{
+			Kind:  "review",
+			Title: p.Title,
+			Date:  time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, time.UTC),
+			Label: "Review due",
+			Owner: p.Owner,
+		})
+	}
+	return list
+}
+
+// calendarEntries returns the dates of every page u may read, or of
+// those that owner owns or reviews, from calendarPast before now on, by
+// date.
+func calendarEntries(c context.Context, owner string, u *User, now time.Time) ([]CalendarEntry, error) {
+	list := []CalendarEntry{}
+	from := now.Add(-calendarPast)
+	add := func(p *Page) error {
+		for _, e := range pageCalendarEntries(p) {
+			if !e.Date.Before(from) {
+				list = append(list, e)
+			}
+		}
+		return nil
+	}
+
+	if !appFrom(c).pagesInMongo() {
+		err := scanPages(c, hiddenNamespaces(c, u), func(p *Page) error {
+			if owner != "" && p.Owner != owner && p.Reviewer != owner {
+				return nil
+			}
+			return add(p)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		filter := readFilter(c, u, "title")
+		if owner != "" {
+			filter = append(filter, primitive.E{Key: "$or", Value: bson.A{
+				bson.D{primitive.E{Key: "owner", Value: owner}},
+				bson.D{primitive.E{Key: "reviewer", Value: owner}},
+			}})
+		}
+		cur, err := appFrom(c).db.pages.Find(c, filter)
+		if err != nil {
+			return nil, err
+		}
+		defer cur.Close(c)
+		for cur.Next(c) {
+			var p Page
+			if err := cur.Decode(&p); err != nil {
+				return nil, err
+			}
+			add(&p)
+		}
+		if err := cur.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Date.Before(list[j].Date) })
+	return list, nil
+}
+
+// icsText escapes a TEXT value.
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "").Replace(s)
+}
+
+// writeICSLine writes a content line, folded after 75 octets without
+// splitting UTF-8 sequences.
+func writeICSLine(w io.Writer, line string) {
+	for len(line) > 75 {
+		n := 75
+		for n > 0 && line[n]&0xC0 == 0x80 {
+			n--
+		}
+		io.WriteString(w, line[:n]+"\r\n ")
+		line = line[n:]
+	}
+	io.WriteString(w, line+"\r\n")
+}
+
+// writeCalendar writes entries as an iCalendar of all-day events. host
+// makes the event UIDs unique; base is the address pages are linked
+// under.
+func writeCalendar(w io.Writer, entries []CalendarEntry, base, host string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//gowiki//calendar//EN")
+	writeICSLine(w, "CALSCALE:GREGORIAN")
+	writeICSLine(w, "X-WR-CALNAME:"+icsText(site.Name+" deadlines"))
+	for _, e := range entries {
+		day := e.Date.Format("20060102")
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, fmt.Sprintf("UID:%s-%s-%s@%s", e.Kind, day, url.PathEscape(e.Title), host))
+		writeICSLine(w, "DTSTAMP:"+stamp)
+		writeICSLine(w, "DTSTART;VALUE=DATE:"+day)
+		writeICSLine(w, "DTEND;VALUE=DATE:"+e.Date.AddDate(0, 0, 1).Format("20060102"))
+		writeICSLine(w, "SUMMARY:"+icsText(e.Label+": "+e.Title))
+		if e.Owner != "" {
+			writeICSLine(w, "DESCRIPTION:"+icsText("Owner: "+e.Owner))
+		}
+		writeICSLine(w, "URL:"+base+pageURL("view", e.Title))
+		writeICSLine(w, "TRANSP:TRANSPARENT")
+		writeICSLine(w, "END:VEVENT")
+	}
+	writeICSLine(w, "END:VCALENDAR")
+}
+
+// calendarHandler serves /calendar.ics.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	base, err := siteURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	site, err := url.Parse(base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := calendarEntries(r.Context(), strings.TrimSpace(r.FormValue("owner")), currentUser(r), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	writeCalendar(w, entries, base, site.Hostname(), now)
+}
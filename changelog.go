@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultChangelogDays is how many days a changelog covers unless asked
+// for more with ?days=N, up to maxChangelogDays.
+const (
+	defaultChangelogDays = 30
+	maxChangelogDays     = 366
+)
+
+// ChangelogDay holds the changes of one day, newest first.
+type ChangelogDay struct {
+	Date    time.Time
+	Changes []Event
+}
+
+// Changelog is the data of Special:Changelog.
+type Changelog struct {
+	Namespace string
+	Days      int
+	Log       []ChangelogDay
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Changelog",
+		Description: "Changes to the pages of a namespace, by day. Link to Special:Changelog/Namespace.",
+		Handler:     changelogHandler,
+	})
+}
+
+// namespaceChanges returns the events of the pages in ns, and of ns
+// itself, since since, newest first, leaving out pages u may not read.
+func namespaceChanges(c context.Context, ns string, since time.Time, u *User) ([]Event, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	filter := bson.D{
+		primitive.E{Key: "title", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(ns) + "(/|$)"}},
+		primitive.E{Key: "time", Value: bson.D{primitive.E{Key: "$gte", Value: since}}},
+	}
+	// Conditions on the same field would replace each other, so the
+	// hidden namespaces are left out with $and.
+	if hidden := readFilter(c, u, "title"); len(hidden) > 0 {
+		filter = append(filter, primitive.E{Key: "$and", Value: bson.A{hidden}})
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+	cur, err := appFrom(c).db.events.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Event{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// groupByDay splits events, newest first, into days in loc.
+func groupByDay(events []Event, loc *time.Location) []ChangelogDay {
+	days := []ChangelogDay{}
+	for _, e := range events {
+		t := e.Time.In(loc)
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if n := len(days); n == 0 || !days[n-1].Date.Equal(day) {
+			days = append(days, ChangelogDay{Date: day})
+		}
+		days[len(days)-1].Changes = append(days[len(days)-1].Changes, e)
+	}
+	return days
+}
+
+// changelogHandler serves Special:Changelog/{namespace}. Without a
+// namespace it asks for one.
+func changelogHandler(w http.ResponseWriter, r *http.Request) {
+	cl := &Changelog{Days: defaultChangelogDays}
+	path := strings.TrimPrefix(r.URL.Path, "/special/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		cl.Namespace = path[i+1:]
+	}
+	if ns := strings.TrimSpace(r.FormValue("ns")); ns != "" {
+		http.Redirect(w, r, pageURL("special", "Changelog/"+ns), http.StatusFound)
+		return
+	}
+	if v := r.FormValue("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangelogDays {
+			http.Error(w, "days must be between 1 and "+strconv.Itoa(maxChangelogDays), http.StatusBadRequest)
+			return
+		}
+		cl.Days = n
+	}
+	if cl.Namespace != "" {
+		if !validTitle(r.Context(), cl.Namespace) {
+			notFound(w, r)
+			return
+		}
+		if !checkRead(w, r, cl.Namespace) {
+			return
+		}
+		events, err := namespaceChanges(r.Context(), cl.Namespace, time.Now().AddDate(0, 0, -cl.Days), currentUser(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cl.Log = groupByDay(events, time.Local)
+	}
+	renderTemplate(w, r, "changelog", nil, cl)
+}
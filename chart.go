@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A ```chart block draws its data as an SVG chart:
+//
+//	```chart bar
+//	Month, Opened, Closed
+//	Jan, 12, 9
+//	Feb, 7, 11
+//	```
+//
+// The first line names the series, each following line gives a label
+// and one value per series. The kind after "chart" is bar, line or pie;
+// pie charts show the first series only.
+
+const (
+	chartWidth  = 480
+	chartHeight = 240
+	chartMargin = 30
+)
+
+var chartColors = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#ff9da7"}
+
+// chartData is the parsed content of a chart block.
+type chartData struct {
+	series []string
+	labels []string
+	values [][]float64 // values[row][series]
+}
+
+func parseChart(lines []string) (*chartData, error) {
+	r := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 || len(records[0]) < 2 {
+		return nil, fmt.Errorf("a chart needs a header line and at least one row of data")
+	}
+	d := &chartData{series: records[0][1:]}
+	for i, rec := range records[1:] {
+		row := make([]float64, len(d.series))
+		for s := range row {
+			if s+1 >= len(rec) || strings.TrimSpace(rec[s+1]) == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(rec[s+1]), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("line %d: %q is not a number", i+2, rec[s+1])
+			}
+			row[s] = v
+		}
+		d.labels = append(d.labels, rec[0])
+		d.values = append(d.values, row)
+	}
+	return d, nil
+}
+
+// renderChart writes a ```chart block as an inline SVG image. Invalid
+// data is reported in place of the chart.
+func renderChart(b *strings.Builder, blk mdBlock) {
+	kind := "bar"
+	if args := strings.Fields(blk.args); len(args) > 0 {
+		kind = args[0]
+	}
+	d, err := parseChart(blk.lines)
+	if err == nil && kind != "bar" && kind != "line" && kind != "pie" {
+		err = fmt.Errorf("unknown chart kind %q", kind)
+	}
+	if err != nil {
+		b.WriteString(`<p class="error">` + template.HTMLEscapeString("Invalid chart: "+err.Error()) + "</p>\n")
+		return
+	}
+
+	fmt.Fprintf(b, `<figure class="chart"><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" role="img">`,
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	switch kind {
+	case "bar":
+		barChart(b, d)
+	case "line":
+		lineChart(b, d)
+	case "pie":
+		pieChart(b, d)
+	}
+	b.WriteString("</svg>")
+	if kind != "pie" && len(d.series) > 1 {
+		chartLegend(b, d.series)
+	}
+	b.WriteString("</figure>\n")
+}
+
+// chartScale returns the value range shown on the y axis, which always
+// includes zero.
+func chartScale(d *chartData) (lo, hi float64) {
+	for _, row := range d.values {
+		for _, v := range row {
+			lo = math.Min(lo, v)
+			hi = math.Max(hi, v)
+		}
+	}
+	if hi == lo {
+		hi = lo + 1
+	}
+	return lo, hi
+}
+
+func chartAxes(b *strings.Builder, lo, hi float64, y func(float64) float64) {
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`, chartMargin, chartMargin/2, chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#888"/>`, chartMargin, y(0), chartWidth-chartMargin/2, y(0))
+	for _, v := range []float64{lo, hi} {
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" font-size="10" text-anchor="end">%s</text>`, chartMargin-3, y(v)+3, template.HTMLEscapeString(formatValue(v)))
+	}
+}
+
+func chartLabel(b *strings.Builder, x float64, label string) {
+	fmt.Fprintf(b, `<text x="%.1f" y="%d" font-size="10" text-anchor="middle">%s</text>`, x, chartHeight-chartMargin+14, template.HTMLEscapeString(label))
+}
+
+func barChart(b *strings.Builder, d *chartData) {
+	lo, hi := chartScale(d)
+	plot := float64(chartHeight - chartMargin*3/2)
+	y := func(v float64) float64 { return float64(chartMargin/2) + (hi-v)/(hi-lo)*plot }
+	chartAxes(b, lo, hi, y)
+
+	slot := float64(chartWidth-chartMargin*3/2) / float64(len(d.labels))
+	bar := slot * 0.8 / float64(len(d.series))
+	for i, row := range d.values {
+		x0 := float64(chartMargin) + float64(i)*slot + slot*0.1
+		for s, v := range row {
+			top, bottom := y(math.Max(v, 0)), y(math.Min(v, 0))
+			fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s</title></rect>`,
+				x0+float64(s)*bar, top, bar, bottom-top, chartColors[s%len(chartColors)],
+				template.HTMLEscapeString(d.labels[i]+", "+d.series[s]+": "+formatValue(v)))
+		}
+		chartLabel(b, x0+slot*0.4, d.labels[i])
+	}
+}
+
+func lineChart(b *strings.Builder, d *chartData) {
+	lo, hi := chartScale(d)
+	plot := float64(chartHeight - chartMargin*3/2)
+	y := func(v float64) float64 { return float64(chartMargin/2) + (hi-v)/(hi-lo)*plot }
+	chartAxes(b, lo, hi, y)
+
+	step := float64(chartWidth-chartMargin*2) / math.Max(float64(len(d.labels)-1), 1)
+	x := func(i int) float64 { return float64(chartMargin) + step/2 + float64(i)*step }
+	if len(d.labels) == 1 {
+		step = 0
+	}
+	for s := range d.series {
+		var pts []string
+		for i, row := range d.values {
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(i), y(row[s])))
+		}
+		color := chartColors[s%len(chartColors)]
+		fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(pts, " "), color)
+		for i, row := range d.values {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s</title></circle>`, x(i), y(row[s]), color,
+				template.HTMLEscapeString(d.labels[i]+", "+d.series[s]+": "+formatValue(row[s])))
+		}
+	}
+	for i, label := range d.labels {
+		chartLabel(b, x(i), label)
+	}
+}
+
+func pieChart(b *strings.Builder, d *chartData) {
+	total := 0.0
+	for _, row := range d.values {
+		total += math.Max(row[0], 0)
+	}
+	cx, cy := float64(chartHeight)/2, float64(chartHeight)/2
+	radius := float64(chartHeight)/2 - 10
+	angle := -math.Pi / 2
+	for i, row := range d.values {
+		v := math.Max(row[0], 0)
+		color := chartColors[i%len(chartColors)]
+		tip := template.HTMLEscapeString(d.labels[i] + ": " + formatValue(v))
+		if total > 0 && v == total {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"><title>%s</title></circle>`, cx, cy, radius, color, tip)
+		} else if total > 0 && v > 0 {
+			sweep := v / total * 2 * math.Pi
+			large := 0
+			if sweep > math.Pi {
+				large = 1
+			}
+			x1, y1 := cx+radius*math.Cos(angle), cy+radius*math.Sin(angle)
+			angle += sweep
+			x2, y2 := cx+radius*math.Cos(angle), cy+radius*math.Sin(angle)
+			fmt.Fprintf(b, `<path d="M%.1f,%.1f L%.1f,%.1f A%.1f,%.1f 0 %d 1 %.1f,%.1f Z" fill="%s"><title>%s</title></path>`,
+				cx, cy, x1, y1, radius, radius, large, x2, y2, color, tip)
+		}
+		fmt.Fprintf(b, `<rect x="%.1f" y="%d" width="10" height="10" fill="%s"/>`, 2*cx+10, 20+i*16, color)
+		fmt.Fprintf(b, `<text x="%.1f" y="%d" font-size="11">%s</text>`, 2*cx+26, 29+i*16, tip)
+	}
+}
+
+func chartLegend(b *strings.Builder, series []string) {
+	b.WriteString(`<figcaption>`)
+	for s, name := range series {
+		fmt.Fprintf(b, `<span class="legend" style="border-color: %s">%s</span> `, chartColors[s%len(chartColors)], template.HTMLEscapeString(name))
+	}
+	b.WriteString("</figcaption>")
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CodeRepo is a source repository pages may embed files from with
+//
+//	{{embed name:path/to/file.go#L10-L20}}
+//
+// on a line of its own. The line range is optional.
+type CodeRepo struct {
+	Name string
+	// URL is the web address of a GitHub or GitLab project, such as
+	// https://github.com/acme/wiki. Hosts other than github.com are
+	// assumed to run GitLab.
+	URL string
+	Ref string
+}
+
+// codeCacheTTL is how long a fetched file is used before it is fetched
+// again.
+const codeCacheTTL = time.Hour
+
+// codeMaxSize is the largest file that is embedded.
+const codeMaxSize = 1 << 20
+
+var codeClient = &http.Client{Timeout: 10 * time.Second}
+
+// embedPattern matches an embed directive.
+var embedPattern = regexp.MustCompile(`^ {0,3}\{\{embed\s+([\w.-]+):([^#\s}]+)(?:#L(\d+)(?:-L?(\d+))?)?\s*\}\}\s*$`)
+
+// parseCodeRepos parses the -code-repos setting: space separated
+// entries of the form name=url or name=url@ref. The ref defaults to the
+// default branch.
+func parseCodeRepos(spec string) (map[string]*CodeRepo, error) {
+	repos := map[string]*CodeRepo{}
+	for _, entry := range strings.Fields(spec) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("code repo %q is not of the form name=url", entry)
+		}
+		repo := &CodeRepo{Name: entry[:i], URL: entry[i+1:], Ref: "HEAD"}
+		if at := strings.LastIndex(repo.URL, "@"); at > strings.Index(repo.URL, "://")+2 {
+			repo.URL, repo.Ref = repo.URL[:at], repo.URL[at+1:]
+		}
+		repo.URL = strings.TrimSuffix(strings.TrimRight(repo.URL, "/"), ".git")
+		u, err := url.Parse(repo.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("code repo %q: invalid URL", entry)
+		}
+		repos[repo.Name] = repo
+	}
+	return repos, nil
+}
+
+// rawURL returns the address of the raw contents of file.
+func (r *CodeRepo) rawURL(file string) string {
+	u, _ := url.Parse(r.URL)
+	if u.Host == "github.com" {
+		return "https://raw.githubusercontent.com" + u.Path + "/" + r.Ref + "/" + file
+	}
+	return r.URL + "/-/raw/" + r.Ref + "/" + file
+}
+
+// webURL returns the address showing file, and lines from-to if from is
+// not 0, on the repository's web site.
+func (r *CodeRepo) webURL(file string, from, to int) string {
+	u, _ := url.Parse(r.URL)
+	s := r.URL + "/blob/" + r.Ref + "/" + file
+	if u.Host != "github.com" {
+		s = r.URL + "/-/blob/" + r.Ref + "/" + file
+	}
+	if from > 0 {
+		s += "#L" + strconv.Itoa(from)
+		if to > from {
+			if u.Host == "github.com" {
+				s += "-L" + strconv.Itoa(to)
+			} else {
+				s += "-" + strconv.Itoa(to)
+			}
+		}
+	}
+	return s
+}
+
+type cachedFile struct {
+	lines   []string
+	fetched time.Time
+}
+
+var (
+	codeCacheMu sync.Mutex
+	codeCache   = map[string]*cachedFile{}
+)
+
+// codeLines returns the lines of a file in a repository, fetching it
+// when it is not cached or the cached copy has expired. A stale copy is
+// used if the repository cannot be reached.
+func codeLines(r *CodeRepo, file string) ([]string, error) {
+	src := r.rawURL(file)
+	codeCacheMu.Lock()
+	cached := codeCache[src]
+	codeCacheMu.Unlock()
+	if cached != nil && time.Since(cached.fetched) < codeCacheTTL {
+		return cached.lines, nil
+	}
+
+	lines, err := fetchCode(src)
+	if err != nil {
+		if cached != nil {
+			return cached.lines, nil
+		}
+		return nil, err
+	}
+	codeCacheMu.Lock()
+	codeCache[src] = &cachedFile{lines: lines, fetched: time.Now()}
+	codeCacheMu.Unlock()
+	return lines, nil
+}
+
+func fetchCode(src string) ([]string, error) {
+	res, err := codeClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", src, res.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, codeMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return splitLines([]byte(strings.TrimSuffix(string(body), "\n"))), nil
+}
+
+// renderEmbed writes the code an embed directive refers to, highlighted
+// by the file's extension, with a caption linking to its source. Errors
+// are shown in place of the code. repos are the repositories pages can
+// embed code from, by name.
+func renderEmbed(b *strings.Builder, line string, repos map[string]*CodeRepo) {
+	m := embedPattern.FindStringSubmatch(line)
+	name, file := m[1], strings.TrimPrefix(m[2], "/")
+	from, _ := strconv.Atoi(m[3])
+	to, _ := strconv.Atoi(m[4])
+	if from > 0 && to == 0 {
+		to = from
+	}
+
+	fail := func(msg string) {
+		b.WriteString(`<p class="error">` + template.HTMLEscapeString("Cannot embed "+name+":"+file+": "+msg) + "</p>\n")
+	}
+	repo := repos[name]
+	if repo == nil {
+		fail("unknown repository")
+		return
+	}
+	if strings.Contains("/"+file+"/", "/../") {
+		fail("invalid path")
+		return
+	}
+	lines, err := codeLines(repo, file)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if from > 0 {
+		if from > len(lines) || to < from {
+			fail("no such lines")
+			return
+		}
+		if to > len(lines) {
+			to = len(lines)
+		}
+		lines = lines[from-1 : to]
+	}
+
+	lang := strings.TrimPrefix(path.Ext(file), ".")
+	caption := name + ":" + file
+	if from > 0 {
+		caption += " lines " + strconv.Itoa(from) + "–" + strconv.Itoa(to)
+	}
+	b.WriteString(`<figure class="embed"><pre><code class="language-` + template.HTMLEscapeString(lang) + `">`)
+	highlightCode(b, strings.Join(lines, "\n")+"\n", lang)
+	b.WriteString("</code></pre>\n")
+	b.WriteString(`<figcaption><a href="` + template.HTMLEscapeString(repo.webURL(file, from, to)) + `">` + template.HTMLEscapeString(caption) + "</a></figcaption></figure>\n")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Viewed pages carry an ETag and a Last-Modified time, so browsers
+// asking again get 304 Not Modified without the page being rendered or
+// sent. A view shows more than the page: who is signed in, their CSRF
+// token, announcements, the sidebar, header and footer, whether the
+// page is archived and whether the wiki is read only, so the ETag covers
+// all of them. Rendered bodies link
+// to other pages depending on whether they exist, which is only checked
+// every renderCacheTTL, so the ETag changes that often too.
+//
+// Views are sent with "Cache-Control: private, no-cache", making
+// browsers ask every time, unless -html-cache says otherwise.
+
+// viewCacheControl is sent with views when -html-cache is not set.
+const viewCacheControl = "private, no-cache"
+
+// viewValidators returns the ETag and modification time of the view of
+// p r would be shown. It returns false when the view has to be rendered
+// anyway: while browsing a snapshot, when flashes are waiting to be
+// shown, or when the client has no CSRF token yet, which rendering
+// hands out.
+func viewValidators(r *http.Request, p *Page) (string, time.Time, bool) {
+	if browsingSnapshot(r) != "" || readFlashes(r) != nil {
+		return "", time.Time{}, false
+	}
+	token, err := r.Cookie(csrfCookie)
+	if err != nil || token.Value == "" {
+		return "", time.Time{}, false
+	}
+
+	h := sha256.New()
+	field := func(v ...interface{}) {
+		fmt.Fprintln(h, v...)
+	}
+	modified := p.Updated
+	later := func(t time.Time) {
+		if t.After(modified) {
+			modified = t
+		}
+	}
+
+	field(startTime.UnixNano(), time.Now().Truncate(renderCacheTTL).Unix())
+	body := sha256.Sum256(p.Body)
+	field(p.Title, p.Revision, p.Updated.UnixNano(), p.Fetched.UnixNano(), p.Lang, p.Owner, p.Reviewer, formatTags(p.Tags))
+	field(hex.EncodeToString(body[:]))
+	field(token.Value, databaseDegraded())
+	if u := currentUser(r); u != nil {
+		field("user", u.Name, u.UserRole())
+	}
+	if imp := currentImpersonation(r); imp != nil {
+		field("impersonation", imp.Admin, imp.ViewAs)
+	}
+	for _, a := range currentAnnouncements(r.Context()) {
+		field("announcement", a.ID.Hex(), a.Start.UnixNano())
+		later(a.Start)
+	}
+	for _, name := range []string{sidebarTitle, headerTitle, footerTitle} {
+		if np, err := loadNearest(r.Context(), p.Title, name); err == nil {
+			field(name, np.Title, np.Updated.UnixNano())
+			later(np.Updated)
+		}
+	}
+	if e := pageArchive(r.Context(), p.Title); e != nil {
+		field("archived", e.Title, e.Archived.UnixNano())
+		later(e.Archived)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, modified, true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag,
+// comparing weakly as RFC 7232 asks for GET requests.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sends the validators of a view and reports whether the
+// client already has it, in which case 304 has been answered.
+// If-Modified-Since is only looked at without If-None-Match, as RFC 7232
+// asks, since the ETag also tells who the page was shown to.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", viewCacheControl)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Cookie")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		match = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		match = err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	if match {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return match
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the settings gowiki is started with.
+type Config struct {
+	Addr            string
+	ShutdownTimeout time.Duration
+	WarmPages       int
+	PageCache       int
+	PageCacheTTL    time.Duration
+	ReadyTimeout    time.Duration
+
+	HTML   RouteLimits
+	API    RouteLimits
+	Static RouteLimits
+
+	WriteRate  float64
+	WriteBurst int
+
+	MongoURI    string
+	Database    string
+	TemplateDir string
+	StaticDir   string
+	Dictionary  string
+
+	MongoSecondaryURI string
+	MongoReadTags     string
+	FailoverInterval  time.Duration
+
+	Storage       string
+	StorageDir    string
+	StorageRoutes string
+	UsersFile     string
+	S3            S3Credentials
+
+	Titles TitlePolicy
+
+	Translator    string
+	TranslatorURL string
+	TranslatorKey string
+
+	RemotePrefix string
+	RemoteURL    string
+
+	MailAllow string
+
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	MailFrom     string
+
+	DefaultRole      string
+	SessionLifetime  time.Duration
+	RememberLifetime time.Duration
+
+	Retention       Retention
+	JanitorInterval time.Duration
+	UndoWindow      time.Duration
+
+	BaseURL     string
+	Hosts       string
+	FeedExcerpt int
+
+	HotlinkNamespaces string
+	HotlinkHosts      string
+	HotlinkSecret     string
+	HotlinkTokenTTL   time.Duration
+
+	IssueLinks  string
+	IssueStatus bool
+	IssueToken  string
+
+	CodeRepos string
+
+	ShortcutsFile string
+
+	ReadRestricted      string
+	ProtectedNamespaces string
+
+	SecretScan      string
+	SecretDetectors string
+	SecretPatterns  string
+
+	TelegramToken      string
+	TelegramChat       string
+	TelegramNamespaces string
+
+	IRCServer     string
+	IRCChannel    string
+	IRCNick       string
+	IRCTLS        bool
+	IRCNamespaces string
+}
+
+// envName returns the environment variable that sets a flag, such as
+// GOWIKI_MONGO_URI for -mongo-uri.
+func envName(flagName string) string {
+	return "GOWIKI_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig reads the configuration from the environment and then from
+// the command line flags in args, so flags win over environment
+// variables. Every flag can be set through the variable named by
+// envName. The arguments left after the flags are returned as well.
+func loadConfig(args []string) (*Config, []string, error) {
+	c := &Config{
+		Titles: defaultTitlePolicy,
+		HTML:   RouteLimits{Timeout: 30 * time.Second, MaxBody: 16 << 20},
+		API:    RouteLimits{Timeout: 30 * time.Second, MaxBody: 4 << 20},
+		Static: RouteLimits{CacheControl: "public, max-age=3600"},
+
+		Retention: defaultRetention,
+	}
+	fs := flag.NewFlagSet("gowiki", flag.ContinueOnError)
+	fs.StringVar(&c.Addr, "addr", ":8080", "address to listen on")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long to wait for requests to finish when stopping")
+	fs.DurationVar(&c.ReadyTimeout, "ready-timeout", 2*time.Second, "how long /readyz waits for the database to answer")
+	fs.IntVar(&c.WarmPages, "warm-pages", 0, "number of most viewed pages to render before serving, 0 to skip")
+	fs.IntVar(&c.PageCache, "page-cache", 1000, "number of pages kept in memory, 0 to read every page from the store")
+	fs.DurationVar(&c.PageCacheTTL, "page-cache-ttl", time.Minute, "how long a page is kept in memory, 0 until it changes")
+	routeLimitFlags(fs, "html", &c.HTML)
+	routeLimitFlags(fs, "api", &c.API)
+	routeLimitFlags(fs, "static", &c.Static)
+	fs.Float64Var(&c.WriteRate, "write-rate", 30, "page saves and deletions allowed a minute from each client address, 0 for no limit")
+	fs.IntVar(&c.WriteBurst, "write-burst", 10, "page saves and deletions allowed at once from each client address")
+	fs.StringVar(&c.MongoURI, "mongo-uri", "mongodb://localhost:27017/", "MongoDB connection string")
+	fs.StringVar(&c.MongoSecondaryURI, "mongo-secondary-uri", "", "MongoDB connection string pages are read from while the primary is down")
+	fs.StringVar(&c.MongoReadTags, "mongo-read-tags", "", "comma separated key:value replica set tags of the members read from while the primary is down, such as dc:east")
+	fs.DurationVar(&c.FailoverInterval, "failover-interval", 5*time.Second, "how often the primary database is checked, turning the wiki read only while it is down, 0 never")
+	fs.StringVar(&c.Database, "db", "golang", "MongoDB database name")
+	fs.StringVar(&c.TemplateDir, "templates", "", "directory of HTML templates overriding the built in ones")
+	fs.StringVar(&c.StaticDir, "static", "", "directory of static files overriding the built in ones")
+	fs.StringVar(&c.Dictionary, "dictionary", defaultDictionary, "hunspell dictionary used for spellchecking")
+	fs.StringVar(&c.Storage, "storage", "mongo", `page store, "mongo" or "fs"`)
+	fs.StringVar(&c.StorageDir, "storage-dir", "pages", "directory used by the fs page store")
+	fs.StringVar(&c.UsersFile, "users-file", "", "file of name:bcrypt-hash[:role] lines, the accounts of a wiki with -storage=fs, which has no database to keep them in")
+	fs.StringVar(&c.StorageRoutes, "storage-routes", "", "space separated namespace=kind:location stores of namespaces, such as Archive=s3:https://s3.amazonaws.com/bucket/pages, Drafts=fs:drafts or Old=mongo:OldPages")
+	fs.StringVar(&c.S3.Region, "s3-region", "us-east-1", "region of the S3 buckets pages are routed to")
+	fs.StringVar(&c.S3.AccessKey, "s3-access-key", "", "access key id for the S3 buckets pages are routed to")
+	fs.StringVar(&c.S3.SecretKey, "s3-secret-key", "", "secret access key for the S3 buckets pages are routed to")
+	fs.StringVar(&c.Titles.Segment, "title-segment", c.Titles.Segment, "pattern each title segment must match")
+	fs.IntVar(&c.Titles.MaxDepth, "title-max-depth", c.Titles.MaxDepth, "maximum number of title segments")
+	fs.IntVar(&c.Titles.MaxLength, "title-max-length", c.Titles.MaxLength, "maximum title length")
+	fs.StringVar(&c.Translator, "translator", "", `machine translation provider, "libretranslate", "deepl" or "google"`)
+	fs.StringVar(&c.TranslatorURL, "translator-url", "", "translation provider endpoint")
+	fs.StringVar(&c.TranslatorKey, "translator-key", "", "translation provider API key")
+	fs.StringVar(&c.RemotePrefix, "remote-prefix", "", "namespace mirrored from a remote wiki")
+	fs.StringVar(&c.RemoteURL, "remote-url", "", "raw page URL of the remote wiki, with {title} for the title")
+	fs.StringVar(&c.MailAllow, "mail-allow", "", `comma separated senders, or "@domain", allowed to post by mail`)
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", "", "SMTP server host:port digests are sent through")
+	fs.StringVar(&c.SMTPUser, "smtp-user", "", "user name to sign in to the SMTP server with, if it needs one")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", "", "password to sign in to the SMTP server with")
+	fs.StringVar(&c.MailFrom, "mail-from", "", "sender address of digests")
+	fs.StringVar(&c.DefaultRole, "default-role", defaultRole, `role of new accounts, "viewer", "editor" or "admin"`)
+	fs.DurationVar(&c.SessionLifetime, "session-lifetime", defaultSessionLifetime, "how long a sign in lasts")
+	fs.DurationVar(&c.RememberLifetime, "remember-lifetime", defaultRememberLifetime, `how long a "remember me" sign in lasts after its last use`)
+	fs.DurationVar(&c.Retention.Sessions, "retain-sessions", c.Retention.Sessions, "how long expired sessions are kept")
+	fs.DurationVar(&c.Retention.Idempotency, "retain-idempotency", c.Retention.Idempotency, "how long idempotency keys are kept, at least 24h")
+	fs.DurationVar(&c.Retention.Trash, "retain-trash", c.Retention.Trash, "how long deleted pages and attachments are kept in the trash unless a retention policy says otherwise, 0 for ever")
+	fs.DurationVar(&c.Retention.Audit, "retain-audit", c.Retention.Audit, "how long audit log entries are kept, 0 for ever")
+	fs.DurationVar(&c.JanitorInterval, "janitor-interval", time.Hour, "how often leftovers are cleaned up while serving, 0 never")
+	fs.DurationVar(&c.UndoWindow, "undo-window", 10*time.Minute, "how long deleting a page or restoring a revision can be undone with the button shown after it")
+	fs.StringVar(&c.BaseURL, "base-url", "", "public address of the wiki, used in links sent elsewhere")
+	fs.StringVar(&c.Hosts, "hosts", "localhost,127.0.0.1", "comma separated host names the wiki is reached at, which links sent elsewhere use when -base-url is not set")
+	fs.StringVar(&c.HotlinkNamespaces, "hotlink-namespaces", "", `comma separated namespaces whose attachments other sites may not embed, "*" for every page`)
+	fs.StringVar(&c.HotlinkHosts, "hotlink-hosts", "", "comma separated hosts that may embed protected attachments all the same")
+	fs.StringVar(&c.HotlinkSecret, "hotlink-secret", "", "key signing the wiki's links to protected attachments, which are then only served without a Referer when signed")
+	fs.DurationVar(&c.HotlinkTokenTTL, "hotlink-token-ttl", 24*time.Hour, "how long signed links to protected attachments last")
+	fs.IntVar(&c.FeedExcerpt, "feed-excerpt", excerptLength, "characters of page text shown in each feed entry, 0 for the edit summary only")
+	fs.StringVar(&c.IssueLinks, "issue-links", "", "space separated pattern=url issue references to link, such as #([0-9]+)=https://github.com/o/r/issues/$1")
+	fs.BoolVar(&c.IssueStatus, "issue-status", false, "show the status of linked GitHub and Jira issues")
+	fs.StringVar(&c.IssueToken, "issue-token", "", "bearer token for fetching issue status")
+	fs.StringVar(&c.ReadRestricted, "read-restricted", "", "space separated namespace=role pairs, such as HR=admin, only users with the role may read")
+	fs.StringVar(&c.ProtectedNamespaces, "protected-namespaces", "Policy", "comma separated namespaces whose edits go live only once someone else approves them")
+	fs.StringVar(&c.SecretScan, "secret-scan", secretsWarn, `what to do with saves that seem to contain credentials, "off", "warn" or "block"`)
+	fs.StringVar(&c.SecretDetectors, "secret-detectors", "", "space separated secret detectors to scan with, such as aws-access-key private-key, all if empty")
+	fs.StringVar(&c.SecretPatterns, "secret-patterns", "", "space separated name=regexp secret detectors to scan with as well, such as internal-key=ik_[0-9a-f]{32}")
+	fs.StringVar(&c.ShortcutsFile, "shortcuts-file", "", "JSON file of {key, description, url} keyboard shortcuts replacing the built in ones")
+	fs.StringVar(&c.CodeRepos, "code-repos", "", "space separated name=url[@ref] GitHub or GitLab repositories pages may embed code from")
+	fs.StringVar(&c.TelegramToken, "telegram-token", "", "Telegram bot token for announcing changes")
+	fs.StringVar(&c.TelegramChat, "telegram-chat", "", "Telegram chat id or @channel to announce changes in")
+	fs.StringVar(&c.TelegramNamespaces, "telegram-namespaces", "", "comma separated namespaces announced on Telegram, all if empty")
+	fs.StringVar(&c.IRCServer, "irc-server", "", "IRC server host:port for announcing changes")
+	fs.StringVar(&c.IRCChannel, "irc-channel", "", "IRC channel to announce changes in")
+	fs.StringVar(&c.IRCNick, "irc-nick", "gowiki", "IRC nick used for announcements")
+	fs.BoolVar(&c.IRCTLS, "irc-tls", false, "connect to the IRC server over TLS")
+	fs.StringVar(&c.IRCNamespaces, "irc-namespaces", "", "comma separated namespaces announced on IRC, all if empty")
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), serr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
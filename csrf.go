@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Forms are protected against cross-site request forgery with a token
+// kept in a cookie and repeated in each form, in a hidden "csrf" field,
+// or by scripts in the X-CSRF-Token header. Other sites can make a
+// browser post to the wiki but cannot read the cookie to repeat it.
+//
+// API clients that sign in with basic auth on every request and send no
+// session cookie are not checked, as nothing a browser sends on its own
+// signs them in.
+
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the token of the client, handing it a new one if it
+// has none yet. It must be called before anything is written to w.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Later calls for the same request, such as a second template,
+	// must see the same token.
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return token
+}
+
+// validCSRF reports whether r repeats the token in its cookie.
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = r.PostFormValue(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) == 1
+}
+
+// checkCSRF refuses requests that change something and do not carry
+// the client's CSRF token.
+func checkCSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+			return
+		}
+		if isAPIPath(r.URL.Path) {
+			if _, err := r.Cookie(sessionCookie); err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		if !validCSRF(r) {
+			http.Error(w, "the form has expired or was sent from another site; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// renderCSVTable writes a fenced ```csv block as a table. The first
+// record is the header. With the "sortable" option the table can be
+// sorted by clicking a column heading; see Static/tables.js. Numeric
+// columns are aligned right. Malformed CSV is shown as a code block
+// with the parse error.
+func renderCSVTable(b *strings.Builder, blk mdBlock) {
+	r := csv.NewReader(strings.NewReader(strings.Join(blk.lines, "\n")))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		if err != nil {
+			b.WriteString(`<p class="error">` + template.HTMLEscapeString("Invalid CSV: "+err.Error()) + "</p>\n")
+		}
+		blk.info = ""
+		renderBlocks(b, []mdBlock{blk}, nil)
+		return
+	}
+
+	header, rows := records[0], records[1:]
+	cols := len(header)
+	for _, row := range rows {
+		if len(row) > cols {
+			cols = len(row)
+		}
+	}
+	numeric := make([]bool, cols)
+	for c := range numeric {
+		numeric[c] = len(rows) > 0
+		for _, row := range rows {
+			if c < len(row) && row[c] != "" && !isNumber(row[c]) {
+				numeric[c] = false
+				break
+			}
+		}
+	}
+
+	class := "csv"
+	if hasOption(blk.args, "sortable") {
+		class += " sortable"
+	}
+	b.WriteString(`<table class="` + class + `">` + "\n<thead><tr>")
+	for c := 0; c < cols; c++ {
+		cell := ""
+		if c < len(header) {
+			cell = header[c]
+		}
+		b.WriteString("<th" + numClass(numeric[c]) + ">" + template.HTMLEscapeString(cell) + "</th>")
+	}
+	b.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range rows {
+		b.WriteString("<tr>")
+		for c := 0; c < cols; c++ {
+			cell := ""
+			if c < len(row) {
+				cell = row[c]
+			}
+			b.WriteString("<td" + numClass(numeric[c]) + ">" + template.HTMLEscapeString(cell) + "</td>")
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSuffix(strings.ReplaceAll(s, ",", ""), "%"), 64)
+	return err == nil
+}
+
+func numClass(numeric bool) string {
+	if numeric {
+		return ` class="num"`
+	}
+	return ""
+}
+
+// hasOption reports whether the words after a fence's info string
+// include opt.
+func hasOption(args, opt string) bool {
+	for _, a := range strings.Fields(args) {
+		if a == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// DeleteImpact summarises what deleting a page affects, shown on the
+// delete confirmation page.
+type DeleteImpact struct {
+	Size         int
+	Translations []Variant
+	PendingEdit  *PendingEdit
+	// Backlinks are the pages the reader can see whose links to the
+	// page will be broken.
+	Backlinks   []string
+	Attachments []Attachment
+	Revisions   int64
+	// Hold is the legal hold keeping the page from being deleted.
+	Hold *LegalHold
+}
+
+func deleteImpact(c context.Context, p *Page, u *User) *DeleteImpact {
+	impact := &DeleteImpact{Size: len(p.Body)}
+	if variants, err := languageVariants(c, p); err == nil {
+		for _, v := range variants {
+			if v.Title != p.Title {
+				impact.Translations = append(impact.Translations, v)
+			}
+		}
+	}
+	if pe, err := loadPendingEdit(c, p.Title); err == nil {
+		impact.PendingEdit = pe
+	}
+	impact.Hold, _ = legalHoldOn(c, p.Title)
+	if appFrom(c).db == nil {
+		return impact
+	}
+	impact.Backlinks, _ = backlinks(c, p.Title, u)
+	impact.Attachments, _ = listAttachments(c, p.Title)
+	impact.Revisions, _ = countRevisions(c, p.Title)
+	return impact
+}
+
+// deleteHandler asks for confirmation on GET and moves the page to the
+// trash on a confirmed POST or a DELETE.
+func deleteHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		renderTemplate(w, r, "delete", p, deleteImpact(r.Context(), p, currentUser(r)))
+		return
+	}
+	// A DELETE request is confirmation enough; the form has a checkbox.
+	if r.Method == http.MethodPost && r.FormValue("confirm") == "" {
+		http.Error(w, "deleting a page must be confirmed", http.StatusBadRequest)
+		return
+	}
+
+	err = trashPage(r.Context(), title)
+	if err == errLegalHold {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = recordEvent(r.Context(), eventDeleted, title, userName(r), "")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlashAction(w, r, "Deleted "+title+".", pageURL("undelete", title), "Undo")
+	http.Redirect(w, r, "/list", http.StatusFound)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Users watch pages and namespaces and get one email a day or a week
+// listing what changed in them, rather than a message per edit. The
+// digests are sent by "gowiki digest", which is meant to be run nightly
+// by cron; weekly digests go out on the first run a week after the last.
+
+// digestPeriods maps the digest frequencies users can choose to how
+// often they are sent.
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// digestSlack lets a digest go out a little early, so a cron job that
+// starts a few minutes sooner than the day before does not skip a day.
+const digestSlack = time.Hour
+
+// Watchlist holds what a user watches and where and how often their
+// digest is sent. Frequency is empty for no digest.
+type Watchlist struct {
+	User       string    `bson:"_id"`
+	Email      string    `bson:"email"`
+	Frequency  string    `bson:"frequency"`
+	Pages      []string  `bson:"pages"`
+	Namespaces []string  `bson:"namespaces"`
+	LastSent   time.Time `bson:"lastSent"`
+}
+
+// watches reports whether title is one of the watched pages or in one
+// of the watched namespaces.
+func (wl *Watchlist) watches(title string) bool {
+	for _, p := range wl.Pages {
+		if p == title {
+			return true
+		}
+	}
+	for _, ns := range wl.Namespaces {
+		if title == ns || strings.HasPrefix(title, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// due reports whether the digest of wl should be sent at now.
+func (wl *Watchlist) due(now time.Time) bool {
+	period, ok := digestPeriods[wl.Frequency]
+	return ok && wl.Email != "" && now.Sub(wl.LastSent) >= period-digestSlack
+}
+
+// loadWatchlist returns the watchlist of user, which is empty if they
+// have not watched anything yet.
+func loadWatchlist(c context.Context, user string) (*Watchlist, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	wl := &Watchlist{User: user}
+	err := appFrom(c).db.watchlists.FindOne(c, bson.D{primitive.E{Key: "_id", Value: user}}).Decode(wl)
+	if err == mongo.ErrNoDocuments {
+		return wl, nil
+	}
+	return wl, err
+}
+
+func saveWatchlist(c context.Context, wl *Watchlist) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.watchlists.ReplaceOne(c,
+		bson.D{primitive.E{Key: "_id", Value: wl.User}}, wl,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// watchPage adds title to the pages user watches.
+func watchPage(c context.Context, user, title string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.watchlists.UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: user}},
+		bson.D{primitive.E{Key: "$addToSet", Value: bson.D{primitive.E{Key: "pages", Value: title}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// changesBetween returns the events recorded from since until until,
+// oldest first.
+func changesBetween(c context.Context, since, until time.Time) ([]Event, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := appFrom(c).db.events.Find(c, bson.D{primitive.E{Key: "time", Value: bson.D{
+		primitive.E{Key: "$gte", Value: since},
+		primitive.E{Key: "$lt", Value: until},
+	}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Event{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// digestText lists the changes in events that wl watches, grouped by
+// page, leaving out the user's own. Pages are linked from base, the
+// public address of the wiki, unless it is empty. It returns "" if there
+// are none.
+func digestText(wl *Watchlist, events []Event, base string) string {
+	byTitle := map[string][]Event{}
+	var titles []string
+	for _, e := range events {
+		if !wl.watches(e.Title) || strings.EqualFold(e.Author, wl.User) {
+			continue
+		}
+		if byTitle[e.Title] == nil {
+			titles = append(titles, e.Title)
+		}
+		byTitle[e.Title] = append(byTitle[e.Title], e)
+	}
+	if len(titles) == 0 {
+		return ""
+	}
+	sort.Strings(titles)
+
+	var b strings.Builder
+	for _, title := range titles {
+		fmt.Fprintln(&b, title)
+		for _, e := range byTitle[title] {
+			fmt.Fprintf(&b, "  %s %s", e.Time.Format("2006-01-02 15:04"), strings.TrimPrefix(e.Kind, "page."))
+			if e.Author != "" {
+				fmt.Fprintf(&b, " by %s", e.Author)
+			}
+			if e.Summary != "" {
+				fmt.Fprintf(&b, ": %s", e.Summary)
+			}
+			fmt.Fprintln(&b)
+		}
+		if base != "" {
+			fmt.Fprintf(&b, "  %s%s\n", strings.TrimRight(base, "/"), pageURL("view", title))
+		}
+		fmt.Fprintln(&b)
+	}
+	if base != "" {
+		fmt.Fprintf(&b, "Change what you watch at %s/watchlist\n", strings.TrimRight(base, "/"))
+	}
+	return b.String()
+}
+
+// digestMessage returns the email carrying text to wl.
+func digestMessage(from string, wl *Watchlist, text string, now time.Time) []byte {
+	subject := fmt.Sprintf("%s: %s digest of changes", site.Name, wl.Frequency)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", wl.Email)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(to string, msg []byte) error
+}
+
+// smtpMailer sends email through an SMTP server, signing in if it has
+// a user name.
+type smtpMailer struct {
+	addr     string
+	from     string
+	user     string
+	password string
+}
+
+func (m *smtpMailer) Send(to string, msg []byte) error {
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.user, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, msg)
+}
+
+// sendDigests mails every digest due at now. A digest that fails is
+// logged and tried again on the next run; the others are still sent.
+// It returns the number of digests sent.
+func sendDigests(c context.Context, m Mailer, from string, now time.Time) (int, error) {
+	cur, err := appFrom(c).db.watchlists.Find(c, bson.D{primitive.E{Key: "frequency", Value: bson.D{primitive.E{Key: "$ne", Value: ""}}}})
+	if err != nil {
+		return 0, err
+	}
+	list := []Watchlist{}
+	if err := cur.All(c, &list); err != nil {
+		return 0, err
+	}
+
+	sent, failed := 0, 0
+	for i := range list {
+		wl := &list[i]
+		if !wl.due(now) {
+			continue
+		}
+		since := wl.LastSent
+		if earliest := now.Add(-digestPeriods[wl.Frequency]); since.Before(earliest) {
+			since = earliest
+		}
+		events, err := changesBetween(c, since, now)
+		if err != nil {
+			return sent, err
+		}
+		// Accounts that are gone get what visitors may read.
+		u, _ := loadUser(c, wl.User)
+		events = readableEvents(c, u, events)
+		if text := digestText(wl, events, appFrom(c).cfg.BaseURL); text != "" {
+			if err := m.Send(wl.Email, digestMessage(from, wl, text, now)); err != nil {
+				log.Printf("digest for %s: %v", wl.User, err)
+				failed++
+				continue
+			}
+			sent++
+		}
+		_, err = appFrom(c).db.watchlists.UpdateOne(c,
+			bson.D{primitive.E{Key: "_id", Value: wl.User}},
+			bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "lastSent", Value: now}}}},
+		)
+		if err != nil {
+			return sent, err
+		}
+	}
+	if failed > 0 {
+		return sent, fmt.Errorf("%d digests could not be sent", failed)
+	}
+	return sent, nil
+}
+
+// digestCommand implements "gowiki digest".
+func digestCommand(c context.Context, cfg *Config) error {
+	if cfg.SMTPAddr == "" || cfg.MailFrom == "" {
+		return errors.New("digests need -smtp-addr and -mail-from")
+	}
+	m := &smtpMailer{addr: cfg.SMTPAddr, from: cfg.MailFrom, user: cfg.SMTPUser, password: cfg.SMTPPassword}
+	sent, err := sendDigests(c, m, cfg.MailFrom, time.Now())
+	fmt.Fprintf(os.Stdout, "sent %d digests\n", sent)
+	return err
+}
+
+// lineList splits text into its non-empty, trimmed lines.
+func lineList(text string) []string {
+	list := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// watchlistHandler serves /watchlist, where users choose what they
+// watch and how often they hear about it.
+func watchlistHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login?next=/watchlist", http.StatusFound)
+		return
+	}
+	wl, err := loadWatchlist(r.Context(), u.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost {
+		wl.Email = strings.TrimSpace(r.FormValue("email"))
+		wl.Frequency = r.FormValue("frequency")
+		wl.Pages = lineList(r.FormValue("pages"))
+		wl.Namespaces = lineList(r.FormValue("namespaces"))
+		if _, ok := digestPeriods[wl.Frequency]; !ok && wl.Frequency != "" {
+			http.Error(w, "unknown digest frequency", http.StatusBadRequest)
+			return
+		}
+		if wl.Email != "" {
+			addr, err := mail.ParseAddress(wl.Email)
+			if err != nil {
+				http.Error(w, "invalid email address: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			wl.Email = addr.Address
+		} else if wl.Frequency != "" {
+			http.Error(w, "digests need an email address", http.StatusBadRequest)
+			return
+		}
+		if err := saveWatchlist(r.Context(), wl); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addFlash(w, r, "Saved your watchlist.")
+		http.Redirect(w, r, "/watchlist", http.StatusSeeOther)
+		return
+	}
+	renderTemplate(w, r, "watchlist", nil, wl)
+}
+
+// watchHandler adds a page to the watchlist of the signed in user.
+func watchHandler(w http.ResponseWriter, r *http.Request, title string) {
+	u := currentUser(r)
+	if err := watchPage(r.Context(), u.Name, title); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "You are watching "+title+". Changes to it are in your digest.")
+	http.Redirect(w, r, pageURL("view", title), http.StatusSeeOther)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of page events.
+const (
+	eventSaved      = "page.saved"
+	eventDeleted    = "page.deleted"
+	eventUndeleted  = "page.undeleted"
+	eventRestored   = "page.restored"
+	eventMoved      = "page.moved"
+	eventArchived   = "page.archived"
+	eventUnarchived = "page.unarchived"
+)
+
+// maxEventBatch is the largest number of events returned at once.
+const maxEventBatch = 500
+
+// Event is an entry in the append-only log of page changes. Seq numbers
+// start at 1 and increase by one with every event, so a consumer that
+// remembers the last Seq it processed can pick up where it left off.
+type Event struct {
+	Seq     int64     `bson:"_id" json:"seq"`
+	Kind    string    `bson:"kind" json:"kind"`
+	Title   string    `bson:"title" json:"title"`
+	Author  string    `bson:"author,omitempty" json:"author,omitempty"`
+	Summary string    `bson:"summary,omitempty" json:"summary,omitempty"`
+	Time    time.Time `bson:"time" json:"time"`
+}
+
+// EventBatch is the response of the replay endpoint. Next is the cursor
+// to pass as "after" to fetch the following batch.
+type EventBatch struct {
+	Events []Event `json:"events"`
+	Next   int64   `json:"next"`
+}
+
+// nextSequence atomically increments and returns the counter called
+// name.
+func nextSequence(c context.Context, name string) (int64, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var counter struct {
+		Value int64 `bson:"value"`
+	}
+	err := appFrom(c).db.counters.FindOneAndUpdate(c,
+		bson.D{primitive.E{Key: "_id", Value: name}},
+		bson.D{primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "value", Value: 1}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Value, err
+}
+
+// eventWriter gives out sequence numbers and inserts the events under
+// one lock. Were the two steps left to run concurrently, event N+1
+// could be committed before N, and a consumer reading after N-1 in
+// between would move its cursor past N for good.
+type eventWriter struct {
+	mu     sync.Mutex
+	next   func(ctx context.Context) (int64, error)
+	insert func(ctx context.Context, e *Event) error
+}
+
+// write numbers e and appends it to the log.
+func (w *eventWriter) write(ctx context.Context, e *Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seq, err := w.next(ctx)
+	if err != nil {
+		return err
+	}
+	e.Seq = seq
+	return w.insert(ctx, e)
+}
+
+var eventLog = &eventWriter{
+	next: func(ctx context.Context) (int64, error) {
+		return nextSequence(ctx, "events")
+	},
+	insert: func(ctx context.Context, e *Event) error {
+		_, err := appFrom(ctx).db.events.InsertOne(ctx, e)
+		return err
+	},
+}
+
+// recordEvent appends an event to the log. summary describes the change
+// and may be empty.
+func recordEvent(c context.Context, kind, title, author, summary string) error {
+	if appFrom(c).db == nil {
+		return nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	e := &Event{
+		Kind:    kind,
+		Title:   title,
+		Author:  author,
+		Summary: summary,
+		Time:    time.Now(),
+	}
+	if err := eventLog.write(c, e); err != nil {
+		return err
+	}
+	announce(c, e)
+	return nil
+}
+
+// eventsAfter returns up to limit events following the sequence number
+// after, oldest first.
+func eventsAfter(c context.Context, after int64, limit int64) ([]Event, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit)
+	filter := bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$gt", Value: after}}}}
+	cur, err := appFrom(c).db.events.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Event{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// eventsHandler serves /events?after=N&limit=M for indexers and sync
+// tools replaying the event log.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if v := r.FormValue("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := int64(100)
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > maxEventBatch {
+			n = maxEventBatch
+		}
+		limit = n
+	}
+
+	list, err := eventsAfter(r.Context(), after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	batch := EventBatch{Events: readableEvents(r.Context(), currentUser(r), list), Next: after}
+	// The cursor moves past events left out, so they are not asked for
+	// again.
+	if len(list) > 0 {
+		batch.Next = list[len(list)-1].Seq
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(batch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
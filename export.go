@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// An export is a zip archive of every page as a Markdown file, named
+// after its title, as in pages/Policy/Travel.md, plus manifest.json
+// listing each page's metadata. It is meant for backups that do not
+// need MongoDB to read. Admins download it from /export; cron jobs run
+// "gowiki export -o wiki.zip". Either can apply redaction rules, for an
+// export to be shared outside the organization.
+
+// exportManifestName is the name of the manifest in an export.
+const exportManifestName = "manifest.json"
+
+// ExportManifest describes an export.
+type ExportManifest struct {
+	Site     string        `json:"site"`
+	Exported time.Time     `json:"exported"`
+	Pages    []ExportEntry `json:"pages"`
+	// Redaction is set when pages were left out or masked.
+	Redaction *RedactionSummary `json:"redaction,omitempty"`
+}
+
+// ExportEntry is the metadata of one exported page. SHA256 is the hash
+// of the file, for checking a backup.
+type ExportEntry struct {
+	Title    string    `json:"title"`
+	File     string    `json:"file"`
+	Lang     string    `json:"lang,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	Reviewer string    `json:"reviewer,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Updated  time.Time `json:"updated"`
+	Revision int       `json:"revision,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Size     int       `json:"size"`
+	SHA256   string    `json:"sha256"`
+}
+
+// exportFileName returns where the page called title is in an export.
+// Titles cannot contain "..", so the name stays below pages/.
+func exportFileName(title string) string {
+	return "pages/" + title + ".md"
+}
+
+// writeExport writes every page and the manifest to zw, redacted by rr
+// if it is not nil.
+func writeExport(c context.Context, zw *zip.Writer, now time.Time, rr *RedactionRules) error {
+	m := &ExportManifest{Site: site.Name, Exported: now, Pages: []ExportEntry{}, Redaction: rr.summary()}
+	err := forEachPage(c, func(p *Page) error {
+		if rr.strips(p) {
+			m.Redaction.PagesLeftOut++
+			return nil
+		}
+		if r := rr.redact(p); r != p {
+			if !bytes.Equal(r.Body, p.Body) || r.Owner != p.Owner || r.Reviewer != p.Reviewer {
+				m.Redaction.PagesMasked++
+			}
+			p = r
+		}
+		name := exportFileName(p.Title)
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: p.Updated})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(p.Body); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(p.Body)
+		m.Pages = append(m.Pages, ExportEntry{
+			Title:    p.Title,
+			File:     name,
+			Lang:     p.Lang,
+			Owner:    p.Owner,
+			Reviewer: p.Reviewer,
+			Tags:     p.Tags,
+			Updated:  p.Updated,
+			Revision: p.Revision,
+			Remote:   p.Remote,
+			Size:     len(p.Body),
+			SHA256:   hex.EncodeToString(sum[:]),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: exportManifestName, Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// exportName is the file name exports are offered as.
+func exportName(now time.Time, redacted bool) string {
+	if redacted {
+		return fmt.Sprintf("%s-export-%s-redacted.zip", site.Name, now.Format("20060102"))
+	}
+	return fmt.Sprintf("%s-export-%s.zip", site.Name, now.Format("20060102"))
+}
+
+// exportHandler serves /export, the export of the whole wiki, to admins.
+// ?strip-tags= and ?strip-namespaces= leave out pages and ?mask= names
+// the masks to apply, each space separated; ?mask-patterns= has regular
+// expressions of other text to mask, one a line.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkRole(w, r, roleAdmin) {
+		return
+	}
+	var patterns []string
+	for _, line := range strings.Split(r.FormValue("mask-patterns"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			patterns = append(patterns, line)
+		}
+	}
+	rr, err := newRedactionRules(appFrom(r.Context()).titles,
+		strings.Fields(r.FormValue("strip-tags")),
+		strings.Fields(r.FormValue("strip-namespaces")),
+		strings.Fields(r.FormValue("mask")),
+		patterns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportName(now, rr != nil)+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	zw := zip.NewWriter(w)
+	if err := writeExport(r.Context(), zw, now, rr); err != nil {
+		// Headers are already sent, so the best we can do is to leave
+		// a truncated archive that fails to open.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// exportCommand implements "gowiki export", which writes the export to
+// the file given with -o, or to standard output.
+func exportCommand(c context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "file to write the export to, standard output if empty")
+	stripTags := fs.String("strip-tags", "", "space separated tags whose pages are left out")
+	stripNamespaces := fs.String("strip-namespaces", "", "space separated namespaces whose pages are left out")
+	masks := fs.String("mask", "", "space separated masks to apply: emails, secrets")
+	pattern := fs.String("mask-pattern", "", "regular expression of other text to mask")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var patterns []string
+	if *pattern != "" {
+		patterns = []string{*pattern}
+	}
+	rr, err := newRedactionRules(appFrom(c).titles, strings.Fields(*stripTags), strings.Fields(*stripNamespaces), strings.Fields(*masks), patterns)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return exportTo(c, os.Stdout, rr)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := exportTo(c, f, rr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func exportTo(c context.Context, w io.Writer, rr *RedactionRules) error {
+	zw := zip.NewWriter(w)
+	if err := writeExport(c, zw, time.Now(), rr); err != nil {
+		return err
+	}
+	return zw.Close()
+}
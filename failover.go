@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// The primary MongoDB server is pinged every -failover-interval. While
+// it does not answer the wiki is read only: every page says so, and
+// requests that would change something are answered 503 Service
+// Unavailable with a Retry-After header instead of waiting for the
+// database to time out. Views and session activity are not recorded
+// meanwhile.
+//
+// Reads can go on elsewhere. With -mongo-read-tags, reads are sent to
+// the members of the primary's replica set matching the tags while it
+// is down. With -mongo-secondary-uri, pages are read from that
+// deployment, such as a replica kept in another data center, which may
+// lag behind. /readyz keeps answering as long as one of them does.
+
+// primaryDown is 1 while the primary does not answer.
+var primaryDown int32
+
+// errReadOnly is returned by page writes while the primary is down.
+var errReadOnly = errors.New("the wiki is read only while its database is unavailable")
+
+// readOnlyRetry is the Retry-After sent with writes refused while the
+// primary is down, in seconds.
+const readOnlyRetry = "30"
+
+// databaseDegraded reports whether the primary is down, which makes the
+// wiki read only.
+func databaseDegraded() bool {
+	return atomic.LoadInt32(&primaryDown) == 1
+}
+
+// setPrimaryDown records whether the primary answered, logging when
+// that changes.
+func setPrimaryDown(err error) {
+	var down int32
+	if err != nil {
+		down = 1
+	}
+	if atomic.SwapInt32(&primaryDown, down) == down {
+		return
+	}
+	if err != nil {
+		log.Printf("primary database unavailable, serving read only: %v", err)
+	} else {
+		log.Printf("primary database is back, accepting changes")
+	}
+}
+
+// parseReadTags parses comma separated key:value replica set tags, such
+// as "dc:east,usage:reporting", into the pairs readpref.WithTags takes.
+func parseReadTags(spec string) ([]string, error) {
+	var tags []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("read tag %q is not of the form key:value", entry)
+		}
+		tags = append(tags, entry[:i], entry[i+1:])
+	}
+	return tags, nil
+}
+
+// failoverReadPref returns the read preference reading from the primary
+// and, while it is down, from the secondaries carrying tags.
+func failoverReadPref(tags []string) *readpref.ReadPref {
+	return readpref.PrimaryPreferred(readpref.WithTags(tags...))
+}
+
+// failoverStore reads pages from primary and, while the primary is down,
+// from secondary. Pages are only written to primary, and not at all
+// while it is down.
+type failoverStore struct {
+	primary   PageStore
+	secondary PageStore
+}
+
+func (f *failoverStore) reader() PageStore {
+	if databaseDegraded() {
+		return f.secondary
+	}
+	return f.primary
+}
+
+func (f *failoverStore) Get(ctx context.Context, title string) (*Page, error) {
+	return f.reader().Get(ctx, title)
+}
+
+func (f *failoverStore) Put(ctx context.Context, p *Page) error {
+	if databaseDegraded() {
+		return errReadOnly
+	}
+	return f.primary.Put(ctx, p)
+}
+
+func (f *failoverStore) PutAt(ctx context.Context, p *Page, base int) error {
+	if databaseDegraded() {
+		return errReadOnly
+	}
+	return putAt(ctx, f.primary, p, base)
+}
+
+func (f *failoverStore) Delete(ctx context.Context, title string) error {
+	if databaseDegraded() {
+		return errReadOnly
+	}
+	return f.primary.Delete(ctx, title)
+}
+
+func (f *failoverStore) Rename(ctx context.Context, from, to string) error {
+	if databaseDegraded() {
+		return errReadOnly
+	}
+	return f.primary.Rename(ctx, from, to)
+}
+
+func (f *failoverStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	return f.reader().List(ctx, offset, limit)
+}
+
+func (f *failoverStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	return f.reader().Summaries(ctx, q)
+}
+
+func (f *failoverStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	return f.reader().Count(ctx, q)
+}
+
+// watchPrimary pings the primary every interval until done is closed,
+// turning the wiki read only while it does not answer.
+func (a *App) watchPrimary(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		c, cancel := context.WithTimeout(a.ctx, a.cfg.ReadyTimeout)
+		setPrimaryDown(a.client.Ping(c, readpref.Primary()))
+		cancel()
+	}
+}
+
+// pingReplica pings what reads fail over to, if anything.
+func (a *App) pingReplica(c context.Context) error {
+	switch {
+	case a.secondary != nil:
+		return a.secondary.Ping(c, nil)
+	case a.readPref != nil:
+		return a.client.Ping(c, a.readPref)
+	}
+	return errors.New("no secondary database is configured")
+}
+
+// refuseWritesWhileDegraded answers requests that would change something
+// with 503 Service Unavailable while the primary is down.
+func refuseWritesWhileDegraded(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !databaseDegraded() || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", readOnlyRetry)
+		if strings.HasPrefix(r.URL.Path, apiPrefix) {
+			apiError(w, http.StatusServiceUnavailable, errReadOnly.Error())
+			return
+		}
+		http.Error(w, "The wiki is read only while its database is unavailable. Please try again later.", http.StatusServiceUnavailable)
+	})
+}
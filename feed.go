@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedLength is the number of changes in the feeds.
+const feedLength = 50
+
+// atomFeed is an Atom 1.0 feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Link    atomLink   `xml:"link"`
+	Author  atomPerson `xml:"author"`
+	Summary string     `xml:"summary,omitempty"`
+	Content *atomText  `xml:"content"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+// rssFeed is an RSS 2.0 feed.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Author      string  `xml:"dc:creator,omitempty"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// errUnknownHost is returned for links leaving the wiki when it is
+// requested at a host it was not configured with.
+var errUnknownHost = errors.New("the wiki is not served at this host, see -base-url and -hosts")
+
+// siteURL returns the address of the wiki for links leaving it: the
+// configured base URL, or else the address the request was made to,
+// provided its host is one of the -hosts. The Host header is up to the
+// client, so it is not trusted by itself.
+func siteURL(r *http.Request) (string, error) {
+	cfg := appFrom(r.Context()).cfg
+	if cfg.BaseURL != "" {
+		return strings.TrimRight(cfg.BaseURL, "/"), nil
+	}
+	host := hostname(r.Host)
+	for _, h := range splitList(strings.ToLower(cfg.Hosts)) {
+		if h == host {
+			scheme := "http"
+			if isHTTPS(r) {
+				scheme = "https"
+			}
+			return scheme + "://" + r.Host, nil
+		}
+	}
+	return "", errUnknownHost
+}
+
+// changeTitle describes an event in a feed, such as "Home edited".
+func changeTitle(e Event) string {
+	return e.Title + " " + strings.TrimPrefix(e.Kind, "page.")
+}
+
+// changeID identifies a change in the feeds by its place in the event
+// log.
+func changeID(base string, e Event) string {
+	return base + "/events#" + strconv.FormatInt(e.Seq, 10)
+}
+
+// changeLink is where a feed entry points to. Deleted pages link to
+// the recent changes, since the page itself is gone.
+func changeLink(base string, e Event) string {
+	if e.Kind == eventDeleted {
+		return base + "/recent"
+	}
+	return base + pageURL("view", e.Title)
+}
+
+// feedExcerpts renders the beginning of the pages changed in list, at
+// most max characters of each, keyed by the sequence number of the
+// change. A page changed several times is shown once, with its newest
+// change, and deleted pages not at all.
+func feedExcerpts(c context.Context, base string, list []Event, max int) map[int64]string {
+	excerpts := map[int64]string{}
+	if max <= 0 {
+		return excerpts
+	}
+	seen := map[string]bool{}
+	for _, e := range list {
+		if seen[e.Title] {
+			continue
+		}
+		seen[e.Title] = true
+		if e.Kind == eventDeleted {
+			continue
+		}
+		p, err := loadPage(c, e.Title)
+		if err != nil {
+			continue
+		}
+		excerpts[e.Seq] = absoluteURLs(htmlExcerpt(c, p, max), base+pageURL("view", p.Title))
+	}
+	return excerpts
+}
+
+// htmlExcerpt renders the leading blocks of p holding at most max
+// characters of text, cutting the paragraph that goes over at a word.
+func htmlExcerpt(c context.Context, p *Page, max int) string {
+	blocks, _ := parseBody(p.Body)
+	n := 0
+	for i := range blocks {
+		size := blockLength(blocks[i])
+		if n+size <= max {
+			n += size
+			continue
+		}
+		if blocks[i].kind == paragraphBlock && max-n > 0 {
+			blocks[i].lines = []string{excerpt([]byte(strings.Join(blocks[i].lines, " ")), max-n)}
+			i++
+		}
+		blocks = blocks[:i]
+		break
+	}
+	links := resolveLinks(c, p.Body, viewLink)
+	links.Title = p.Title
+	var b strings.Builder
+	renderBlocks(&b, blocks, links)
+	return b.String()
+}
+
+// blockLength is the number of characters of text in blk.
+func blockLength(blk mdBlock) int {
+	n := 0
+	for _, l := range blk.lines {
+		n += len([]rune(l))
+	}
+	for _, item := range blk.items {
+		for _, l := range item {
+			n += len([]rune(l))
+		}
+	}
+	return n
+}
+
+// urlAttrPattern matches the link and image addresses written by the
+// renderer, which always quotes them with double quotes.
+var urlAttrPattern = regexp.MustCompile(`(href|src)="([^"]*)"`)
+
+// absoluteURLs resolves the addresses in rendered HTML against page, so
+// links and images keep working when read outside the wiki.
+func absoluteURLs(s, page string) string {
+	base, err := url.Parse(page)
+	if err != nil {
+		return s
+	}
+	return urlAttrPattern.ReplaceAllStringFunc(s, func(attr string) string {
+		m := urlAttrPattern.FindStringSubmatch(attr)
+		u, err := url.Parse(html.UnescapeString(m[2]))
+		if err != nil {
+			return attr
+		}
+		return m[1] + `="` + html.EscapeString(base.ResolveReference(u).String()) + `"`
+	})
+}
+
+// excerptHTML is the description of an RSS item: the edit summary,
+// followed by the page excerpt if there is one.
+func excerptHTML(e Event, text string) string {
+	if text == "" || e.Summary == "" {
+		return e.Summary + text
+	}
+	return "<p><em>" + html.EscapeString(e.Summary) + "</em></p>\n" + text
+}
+
+func newAtomFeed(base string, list []Event, excerpts map[int64]string) *atomFeed {
+	f := &atomFeed{
+		ID:    base + "/recent",
+		Title: "Recent changes - " + site.Name,
+		Links: []atomLink{
+			{Rel: "self", Href: base + "/feed.atom"},
+			{Rel: "alternate", Href: base + "/recent"},
+		},
+		Entries: []atomEntry{},
+	}
+	updated := time.Unix(0, 0)
+	for _, e := range list {
+		if e.Time.After(updated) {
+			updated = e.Time
+		}
+		entry := atomEntry{
+			ID:      changeID(base, e),
+			Title:   changeTitle(e),
+			Updated: e.Time.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: changeLink(base, e)},
+			Author:  atomPerson{Name: feedAuthor(e)},
+			Summary: e.Summary,
+		}
+		if text, ok := excerpts[e.Seq]; ok {
+			entry.Content = &atomText{Type: "html", Value: text}
+		}
+		f.Entries = append(f.Entries, entry)
+	}
+	f.Updated = updated.UTC().Format(time.RFC3339)
+	return f
+}
+
+func newRSSFeed(base string, list []Event, excerpts map[int64]string) *rssFeed {
+	f := &rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       "Recent changes - " + site.Name,
+			Link:        base + "/recent",
+			Description: "The latest changes to " + site.Name,
+			Items:       []rssItem{},
+		},
+	}
+	for _, e := range list {
+		f.Channel.Items = append(f.Channel.Items, rssItem{
+			Title:       changeTitle(e),
+			Link:        changeLink(base, e),
+			GUID:        rssGUID{Value: changeID(base, e)},
+			PubDate:     e.Time.UTC().Format(time.RFC1123Z),
+			Author:      e.Author,
+			Description: excerptHTML(e, excerpts[e.Seq]),
+		})
+	}
+	return f
+}
+
+// feedAuthor is the author of an entry. Atom requires one, so changes
+// made without signing in are credited to "anonymous".
+func feedAuthor(e Event) string {
+	if e.Author == "" {
+		return "anonymous"
+	}
+	return e.Author
+}
+
+// feedHandler serves /feed.atom and /feed.rss, the recent changes as a
+// feed.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := recentChanges(r.Context(), feedLength, currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base, err := siteURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	excerpts := feedExcerpts(r.Context(), base, list, appFrom(r.Context()).cfg.FeedExcerpt)
+	var feed interface{}
+	contentType := "application/atom+xml; charset=utf-8"
+	if r.URL.Path == "/feed.rss" {
+		feed = newRSSFeed(base, list, excerpts)
+		contentType = "application/rss+xml; charset=utf-8"
+	} else {
+		feed = newAtomFeed(base, list, excerpts)
+	}
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// flashCookie holds the messages to show on the next rendered page.
+const flashCookie = "flash"
+
+// Flash is a one-off message shown after a redirect. Messages may offer
+// a follow-up action, such as undo, which is posted to ActionURL.
+type Flash struct {
+	Message     string `json:"m"`
+	ActionURL   string `json:"u,omitempty"`
+	ActionLabel string `json:"l,omitempty"`
+}
+
+// addFlash queues a message to be shown on the next page the client
+// renders, typically the target of a redirect.
+func addFlash(w http.ResponseWriter, r *http.Request, msg string) {
+	pushFlash(w, r, Flash{Message: msg})
+}
+
+// addFlashAction queues a message with a button posting to url.
+func addFlashAction(w http.ResponseWriter, r *http.Request, msg, url, label string) {
+	pushFlash(w, r, Flash{Message: msg, ActionURL: url, ActionLabel: label})
+}
+
+func pushFlash(w http.ResponseWriter, r *http.Request, f Flash) {
+	flashes := append(readFlashes(r), f)
+	value, err := json.Marshal(flashes)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readFlashes(r *http.Request) []Flash {
+	c, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	value, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	var flashes []Flash
+	if err := json.Unmarshal(value, &flashes); err != nil {
+		return nil
+	}
+	return flashes
+}
+
+// popFlashes returns the queued messages and clears them.
+func popFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	flashes := readFlashes(r)
+	if flashes != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:   flashCookie,
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+	return flashes
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A ```form block declares a form readers can fill in, one field per
+// line:
+//
+//	```form signup
+//	Name*: text
+//	Email*: email
+//	Team: select Red | Blue | Green
+//	Notes: textarea
+//	```
+//
+// A "*" after the label makes the field required. The word after
+// "form" names the form, so a page can hold several; it defaults to
+// "form". Forms are posted back to the page's /view/ address and each
+// submission is stored as a record, listed for signed in users under
+// /submissions/{title}.
+
+// maxFieldLength is the longest value accepted for a form field.
+const maxFieldLength = 10000
+
+// formFieldTypes are the field types forms may use.
+var formFieldTypes = map[string]bool{
+	"text": true, "email": true, "number": true, "date": true,
+	"textarea": true, "select": true, "checkbox": true,
+}
+
+// FormField is one input of a form.
+type FormField struct {
+	Name     string
+	Label    string
+	Type     string
+	Required bool
+	Options  []string
+}
+
+// FormDef is a form declared on a page.
+type FormDef struct {
+	Name   string
+	Fields []FormField
+}
+
+// FormValue is the value given for one field in a submission.
+type FormValue struct {
+	Name  string `bson:"name"`
+	Value string `bson:"value"`
+}
+
+// FormSubmission is a stored response to a form.
+type FormSubmission struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Title     string             `bson:"title"`
+	Form      string             `bson:"form"`
+	Values    []FormValue        `bson:"values"`
+	Author    string             `bson:"author"`
+	Submitted time.Time          `bson:"submitted"`
+}
+
+// Value returns the value given for the field called name.
+func (s FormSubmission) Value(name string) string {
+	for _, v := range s.Values {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// Submissions lists the records of one form on a page.
+type Submissions struct {
+	Title       string
+	Form        *FormDef
+	Forms       []string
+	Submissions []FormSubmission
+}
+
+func formName(blk mdBlock) string {
+	if args := strings.Fields(blk.args); len(args) > 0 {
+		return args[0]
+	}
+	return "form"
+}
+
+// parseForm reads the field declarations of a ```form block.
+func parseForm(blk mdBlock) (*FormDef, error) {
+	f := &FormDef{Name: formName(blk)}
+	seen := map[string]bool{}
+	for _, line := range blk.lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not of the form Label: type", line)
+		}
+		field := FormField{Label: strings.TrimSpace(line[:i])}
+		if strings.HasSuffix(field.Label, "*") {
+			field.Required = true
+			field.Label = strings.TrimSpace(strings.TrimSuffix(field.Label, "*"))
+		}
+		spec := strings.TrimSpace(line[i+1:])
+		field.Type = spec
+		if j := strings.IndexByte(spec, ' '); j >= 0 {
+			field.Type = spec[:j]
+			for _, o := range strings.Split(spec[j+1:], "|") {
+				if o = strings.TrimSpace(o); o != "" {
+					field.Options = append(field.Options, o)
+				}
+			}
+		}
+		if !formFieldTypes[field.Type] {
+			return nil, fmt.Errorf("unknown field type %q", field.Type)
+		}
+		if field.Type == "select" && len(field.Options) == 0 {
+			return nil, fmt.Errorf("select field %q has no options", field.Label)
+		}
+		field.Name = slugify(field.Label)
+		if field.Name == "" || seen[field.Name] {
+			return nil, fmt.Errorf("field labels must be unique and not empty")
+		}
+		seen[field.Name] = true
+		f.Fields = append(f.Fields, field)
+	}
+	if len(f.Fields) == 0 {
+		return nil, fmt.Errorf("form %q has no fields", f.Name)
+	}
+	return f, nil
+}
+
+// pageForms returns the forms declared in a page body, in order.
+func pageForms(body []byte) []*FormDef {
+	var forms []*FormDef
+	blocks, _ := parseBody(body)
+	for _, blk := range blocks {
+		if blk.kind == codeBlock && blk.info == "form" {
+			if f, err := parseForm(blk); err == nil {
+				forms = append(forms, f)
+			}
+		}
+	}
+	return forms
+}
+
+func findForm(body []byte, name string) *FormDef {
+	for _, f := range pageForms(body) {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// renderForm writes a ```form block as an HTML form.
+func renderForm(b *strings.Builder, blk mdBlock) {
+	f, err := parseForm(blk)
+	if err != nil {
+		b.WriteString(`<p class="error">` + template.HTMLEscapeString("Invalid form: "+err.Error()) + "</p>\n")
+		return
+	}
+	esc := template.HTMLEscapeString
+	b.WriteString(`<form class="wikiform" method="POST">` + "\n")
+	b.WriteString(`<input type="hidden" name="form" value="` + esc(f.Name) + `" />` + "\n")
+	for _, field := range f.Fields {
+		name := `name="f.` + esc(field.Name) + `"`
+		if field.Required {
+			name += " required"
+		}
+		label := esc(field.Label)
+		if field.Required {
+			label += " *"
+		}
+		b.WriteString("<div><label>" + label + " ")
+		switch field.Type {
+		case "textarea":
+			b.WriteString("<textarea " + name + ` rows="4" cols="60"></textarea>`)
+		case "select":
+			b.WriteString("<select " + name + ">")
+			if !field.Required {
+				b.WriteString(`<option value=""></option>`)
+			}
+			for _, o := range field.Options {
+				b.WriteString("<option>" + esc(o) + "</option>")
+			}
+			b.WriteString("</select>")
+		case "checkbox":
+			b.WriteString(`<input type="checkbox" ` + name + ` value="yes" />`)
+		default:
+			b.WriteString(`<input type="` + field.Type + `" ` + name + " />")
+		}
+		b.WriteString("</label></div>\n")
+	}
+	b.WriteString(`<div><input type="submit" value="Submit" /></div>` + "\n</form>\n")
+}
+
+// validate checks the values posted for f and returns them in field
+// order.
+func (f *FormDef) validate(r *http.Request) ([]FormValue, error) {
+	values := []FormValue{}
+	for _, field := range f.Fields {
+		v := strings.TrimSpace(r.PostFormValue("f." + field.Name))
+		if len(v) > maxFieldLength {
+			return nil, fmt.Errorf("%s is too long", field.Label)
+		}
+		if v == "" {
+			if field.Required {
+				return nil, fmt.Errorf("%s is required", field.Label)
+			}
+			values = append(values, FormValue{Name: field.Name})
+			continue
+		}
+		var err error
+		switch field.Type {
+		case "email":
+			_, err = mail.ParseAddress(v)
+		case "number":
+			_, err = strconv.ParseFloat(v, 64)
+		case "date":
+			_, err = time.Parse("2006-01-02", v)
+		case "checkbox":
+			if v != "yes" {
+				err = fmt.Errorf("unexpected value")
+			}
+		case "select":
+			err = fmt.Errorf("not one of the options")
+			for _, o := range field.Options {
+				if v == o {
+					err = nil
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid value", field.Label)
+		}
+		values = append(values, FormValue{Name: field.Name, Value: v})
+	}
+	return values, nil
+}
+
+// submitFormHandler stores a form posted to a page's /view/ address.
+func submitFormHandler(w http.ResponseWriter, r *http.Request, title string) {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	f := findForm(p.Body, r.PostFormValue("form"))
+	if f == nil {
+		http.Error(w, "no such form on this page", http.StatusBadRequest)
+		return
+	}
+	values, err := f.validate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = appFrom(c).db.submissions.InsertOne(c, &FormSubmission{
+		Title:     title,
+		Form:      f.Name,
+		Values:    values,
+		Author:    userName(r),
+		Submitted: time.Now(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "Thank you, your answers have been recorded.")
+	http.Redirect(w, r, pageURL("view", title), http.StatusSeeOther)
+}
+
+func listSubmissions(c context.Context, title, form string) ([]FormSubmission, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "submitted", Value: 1}})
+	cur, err := appFrom(c).db.submissions.Find(c, bson.D{
+		primitive.E{Key: "title", Value: title},
+		primitive.E{Key: "form", Value: form},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []FormSubmission{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// submissionsHandler lists the submissions of a form on a page, as a
+// table or, with ?format=csv, as a CSV download.
+func submissionsHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	forms := pageForms(p.Body)
+	if len(forms) == 0 {
+		notFound(w, r)
+		return
+	}
+	s := &Submissions{Title: title, Form: forms[0]}
+	for _, f := range forms {
+		s.Forms = append(s.Forms, f.Name)
+		if f.Name == r.FormValue("form") {
+			s.Form = f
+		}
+	}
+	s.Submissions, err = listSubmissions(r.Context(), title, s.Form.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("format") != "csv" {
+		renderTemplate(w, r, "submissions", p, s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	filename := strings.ReplaceAll(title, "/", "_") + "-" + s.Form.Name + ".csv"
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	cw := csv.NewWriter(w)
+	header := []string{"Submitted", "Author"}
+	for _, field := range s.Form.Fields {
+		header = append(header, field.Label)
+	}
+	cw.Write(header)
+	for _, sub := range s.Submissions {
+		row := []string{sub.Submitted.Format(time.RFC3339), sub.Author}
+		for _, field := range s.Form.Fields {
+			row = append(row, sub.Value(field.Name))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A page may start with front matter: "key: value" lines between two
+// "---" lines, such as
+//
+//	---
+//	owner: ops
+//	replicas: 3
+//	enabled: true
+//	regions: [eu-west, us-east]
+//	---
+//
+// Values are numbers, true or false, lists in brackets, or strings,
+// which may be quoted. Front matter is shown as a table above the body
+// and served as JSON from /api/v1/pages/{title}/data, so pages can be
+// used as simple configuration.
+
+const frontMatterFence = "---"
+
+// FrontMatterField is one key of a page's front matter.
+type FrontMatterField struct {
+	Key   string
+	Value interface{}
+}
+
+// splitFrontMatter returns the front matter lines of a body and the
+// rest of it. Bodies without front matter are returned unchanged.
+func splitFrontMatter(body []byte) ([]string, []byte) {
+	lines := splitLines(body)
+	if len(lines) < 2 || strings.TrimSpace(lines[0]) != frontMatterFence {
+		return nil, body
+	}
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == frontMatterFence {
+			return lines[1:i], []byte(strings.Join(lines[i+1:], "\n"))
+		}
+		if !isBlank(lines[i]) && !strings.Contains(lines[i], ":") {
+			break
+		}
+	}
+	return nil, body
+}
+
+// parseFrontMatter returns the fields of a body's front matter, in the
+// order they are written. Later keys replace earlier ones.
+func parseFrontMatter(body []byte) []FrontMatterField {
+	lines, _ := splitFrontMatter(body)
+	fields := []FrontMatterField{}
+	index := map[string]int{}
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		f := FrontMatterField{Key: key, Value: frontMatterValue(strings.TrimSpace(line[i+1:]))}
+		if j, ok := index[key]; ok {
+			fields[j] = f
+			continue
+		}
+		index[key] = len(fields)
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func frontMatterValue(s string) interface{} {
+	switch {
+	case s == "true":
+		return true
+	case s == "false":
+		return false
+	case len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\''):
+		if u, err := strconv.Unquote(`"` + s[1:len(s)-1] + `"`); err == nil {
+			return u
+		}
+		return s[1 : len(s)-1]
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		list := []interface{}{}
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, frontMatterValue(item))
+			}
+		}
+		return list
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// renderFrontMatter writes front matter as a table.
+func renderFrontMatter(b *strings.Builder, fields []FrontMatterField) {
+	if len(fields) == 0 {
+		return
+	}
+	b.WriteString(`<table class="frontmatter">` + "\n")
+	for _, f := range fields {
+		b.WriteString("<tr><th>" + template.HTMLEscapeString(f.Key) + "</th><td>" + template.HTMLEscapeString(formatFrontMatter(f.Value)) + "</td></tr>\n")
+	}
+	b.WriteString("</table>\n")
+}
+
+func formatFrontMatter(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatFrontMatter(item)
+		}
+		return strings.Join(items, ", ")
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// apiPageData serves GET /api/v1/pages/{title}/data, the front matter
+// of a page as a JSON object.
+func apiPageData(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	data := map[string]interface{}{}
+	for _, f := range parseFrontMatter(p.Body) {
+		data[f.Key] = f.Value
+	}
+	writeJSON(w, http.StatusOK, data)
+}
@@ -2,4 +2,8 @@ module gowiki
 
 go 1.16
 
-require go.mongodb.org/mongo-driver v1.4.6
+require (
+	github.com/pmezard/go-difflib v1.0.0
+	go.mongodb.org/mongo-driver v1.4.6
+	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
+)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// /healthz and /readyz are for Kubernetes probes and load balancers.
+// /healthz answers as long as the process serves requests, so a failing
+// liveness probe means it should be restarted. /readyz also pings
+// MongoDB, so traffic is sent elsewhere while the database is down
+// without the process being restarted over it, unless reads fail over
+// to a secondary that answers, which keeps the wiki serving read only.
+
+// healthzHandler serves /healthz.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler serves /readyz, answering 503 Service Unavailable if
+// neither MongoDB nor what reads fail over to answers a ping within the
+// ready timeout.
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if a.client == nil {
+		// Made with NewApp, without a database to wait for.
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	c, cancel := context.WithTimeout(r.Context(), a.cfg.ReadyTimeout)
+	defer cancel()
+	if err := a.client.Ping(c, nil); err != nil {
+		if a.pingReplica(c) == nil {
+			fmt.Fprintf(w, "read only, primary database: %v\n", err)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "database: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// syntax describes a programming language well enough to colour its
+// keywords, strings, numbers and comments. It does not try to be a full
+// lexer; anything it does not recognise is shown as plain text.
+type syntax struct {
+	lineComment  []string
+	blockComment [2]string
+	quotes       string
+	keywords     map[string]bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+var (
+	goSyntax = &syntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords: keywordSet(`break case chan const continue default defer else fallthrough
+			for func go goto if import interface map package range return select struct
+			switch type var nil true false iota`),
+	}
+	cSyntax = &syntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+		keywords: keywordSet(`auto break case char class const continue default delete do
+			double else enum extern float for goto if inline int long namespace new
+			private protected public return short signed sizeof static struct switch
+			template this throw try catch typedef union unsigned using virtual void
+			volatile while true false nullptr NULL bool`),
+	}
+	javaSyntax = &syntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+		keywords: keywordSet(`abstract boolean break byte case catch char class const
+			continue default do double else enum extends final finally float for if
+			implements import instanceof int interface long native new package private
+			protected public return short static super switch synchronized this throw
+			throws try void volatile while true false null var val fun when object`),
+	}
+	jsSyntax = &syntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords: keywordSet(`async await break case catch class const continue debugger
+			default delete do else export extends finally for from function if import
+			in instanceof interface let new of return static super switch this throw
+			try type typeof var void while yield true false null undefined`),
+	}
+	rustSyntax = &syntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"",
+		keywords: keywordSet(`as async await break const continue crate else enum extern
+			false fn for if impl in let loop match mod move mut pub ref return self Self
+			static struct super trait true type unsafe use where while`),
+	}
+	pythonSyntax = &syntax{
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords: keywordSet(`and as assert async await break class continue def del elif
+			else except finally for from global if import in is lambda nonlocal not or
+			pass raise return try while with yield True False None`),
+	}
+	shellSyntax = &syntax{
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords: keywordSet(`case do done elif else esac export fi for function if in
+			local return then until while`),
+	}
+	sqlSyntax = &syntax{
+		lineComment:  []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"",
+		keywords: keywordSet(`select from where and or not insert into values update set
+			delete create table index drop alter join left right inner outer on group by
+			order having limit as distinct null is in like primary key
+			SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE
+			TABLE INDEX DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING
+			LIMIT AS DISTINCT NULL IS IN LIKE PRIMARY KEY`),
+	}
+)
+
+// syntaxes maps fenced code info strings and file extensions to their
+// language.
+var syntaxes = map[string]*syntax{
+	"go":         goSyntax,
+	"c":          cSyntax,
+	"h":          cSyntax,
+	"cpp":        cSyntax,
+	"cc":         cSyntax,
+	"hpp":        cSyntax,
+	"java":       javaSyntax,
+	"kt":         javaSyntax,
+	"kotlin":     javaSyntax,
+	"js":         jsSyntax,
+	"ts":         jsSyntax,
+	"javascript": jsSyntax,
+	"typescript": jsSyntax,
+	"rs":         rustSyntax,
+	"rust":       rustSyntax,
+	"py":         pythonSyntax,
+	"python":     pythonSyntax,
+	"sh":         shellSyntax,
+	"bash":       shellSyntax,
+	"shell":      shellSyntax,
+	"sql":        sqlSyntax,
+}
+
+// highlightCode writes code as HTML, wrapping the tokens of lang in spans
+// with the classes kw, str, num and com. Unknown languages are escaped
+// without markup.
+func highlightCode(b *strings.Builder, code, lang string) {
+	syn := syntaxes[strings.ToLower(lang)]
+	if syn == nil {
+		b.WriteString(template.HTMLEscapeString(code))
+		return
+	}
+	span := func(class, text string) {
+		b.WriteString(`<span class="` + class + `">` + template.HTMLEscapeString(text) + "</span>")
+	}
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		if open := syn.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := strings.Index(rest[len(open):], syn.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(open) + end + len(syn.blockComment[1])
+			}
+			span("com", rest[:n])
+			i += n
+			continue
+		}
+		if lineCommentAt(syn, rest) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			span("com", rest[:n])
+			i += n
+			continue
+		}
+		c := code[i]
+		switch {
+		case strings.IndexByte(syn.quotes, c) >= 0:
+			n := 1
+			for n < len(rest) && rest[n] != c {
+				if rest[n] == '\\' && c != '`' {
+					n++
+				} else if rest[n] == '\n' && c != '`' {
+					break
+				}
+				n++
+			}
+			if n < len(rest) && rest[n] == c {
+				n++
+			}
+			if n > len(rest) {
+				n = len(rest)
+			}
+			span("str", rest[:n])
+			i += n
+		case c >= '0' && c <= '9' && (i == 0 || !isWordByte(code[i-1])):
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			span("num", rest[:n])
+			i += n
+		case isWordByte(c) && (i == 0 || !isWordByte(code[i-1])):
+			n := 1
+			for n < len(rest) && isWordByte(rest[n]) {
+				n++
+			}
+			if syn.keywords[rest[:n]] {
+				span("kw", rest[:n])
+			} else {
+				b.WriteString(template.HTMLEscapeString(rest[:n]))
+			}
+			i += n
+		default:
+			b.WriteString(template.HTMLEscapeString(rest[:1]))
+			i++
+		}
+	}
+}
+
+func lineCommentAt(syn *syntax, s string) bool {
+	for _, c := range syn.lineComment {
+		if strings.HasPrefix(s, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files attached to pages in the -hotlink-namespaces are only served to
+// pages of the wiki itself and of the -hotlink-hosts, going by the
+// Referer header, so other sites cannot embed them. Browsers leave the
+// header out for privacy too, so requests without one are served,
+// unless -hotlink-secret is set: the wiki then signs the links to such
+// files in the pages it renders, and only signed links are served
+// without a Referer. Signatures last -hotlink-token-ttl.
+
+// hotlinkTokenParam is the query parameter carrying the signature.
+const hotlinkTokenParam = "t"
+
+// hotlinkRules say which attachments are protected and who may show them.
+type hotlinkRules struct {
+	// namespaces are protected, every page for "*".
+	namespaces []string
+	// hosts may show protected files besides the one the wiki is
+	// requested at; the host of -base-url is one of them.
+	hosts  []string
+	secret []byte
+	ttl    time.Duration
+}
+
+// newHotlinkRules returns the hotlink protection configured in cfg.
+func newHotlinkRules(cfg *Config) (*hotlinkRules, error) {
+	h := &hotlinkRules{
+		namespaces: splitList(cfg.HotlinkNamespaces),
+		hosts:      splitList(strings.ToLower(cfg.HotlinkHosts)),
+		secret:     []byte(cfg.HotlinkSecret),
+		ttl:        cfg.HotlinkTokenTTL,
+	}
+	if cfg.BaseURL != "" {
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		h.hosts = append(h.hosts, strings.ToLower(u.Hostname()))
+	}
+	if len(h.secret) > 0 && h.ttl < renderCacheTTL {
+		return nil, errors.New("-hotlink-token-ttl must be at least " + renderCacheTTL.String() + ", as long as pages are rendered for")
+	}
+	return h, nil
+}
+
+// protects reports whether the files attached to title are protected.
+func (h *hotlinkRules) protects(title string) bool {
+	for _, ns := range h.namespaces {
+		if ns == "*" || inNamespace(title, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileURL returns the address of the file called name attached to
+// title, signed if the wiki signs links to it.
+func (h *hotlinkRules) fileURL(title, name string, now time.Time) string {
+	u := attachmentURL(title, name)
+	if len(h.secret) == 0 || !h.protects(title) {
+		return u
+	}
+	// Links are valid from one to two TTLs, so pages rendered, and
+	// cached, at about the same time carry the same ones.
+	expires := now.Truncate(h.ttl).Add(2 * h.ttl).Unix()
+	return u + "?" + hotlinkTokenParam + "=" + h.token(title, name, expires)
+}
+
+// token signs the link to a file until expires, in Unix seconds.
+func (h *hotlinkRules) token(title, name string, expires int64) string {
+	exp := strconv.FormatInt(expires, 10)
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(exp + "\n" + title + "\n" + name))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validToken reports whether token signs the link to a file and has not
+// expired by now.
+func (h *hotlinkRules) validToken(title, name, token string, now time.Time) bool {
+	i := strings.Index(token, ".")
+	if len(h.secret) == 0 || i < 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(h.token(title, name, expires)))
+}
+
+// allows reports whether r may be served the file called name attached
+// to title.
+func (h *hotlinkRules) allows(r *http.Request, title, name string) bool {
+	if !h.protects(title) {
+		return true
+	}
+	if h.validToken(title, name, r.URL.Query().Get(hotlinkTokenParam), time.Now()) {
+		return true
+	}
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return len(h.secret) == 0
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	from := strings.ToLower(u.Hostname())
+	if from == hostname(r.Host) {
+		return true
+	}
+	for _, host := range h.hosts {
+		if from == host {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname returns the lower case host of a Host header, without the
+// port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// idempotencyHeader carries a client chosen key identifying a write, so
+// that a retried request is answered from the first attempt instead of
+// being applied twice.
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyWindow is how long a key is remembered.
+const idempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKey is the longest key accepted.
+const maxIdempotencyKey = 255
+
+// maxStoredResponse is the largest response body kept for replay.
+const maxStoredResponse = 64 << 10
+
+// IdempotentResponse is the stored outcome of a request made with an
+// idempotency key. Done is false while the first request is running.
+type IdempotentResponse struct {
+	ID          string    `bson:"_id"`
+	Method      string    `bson:"method"`
+	Path        string    `bson:"path"`
+	Done        bool      `bson:"done"`
+	Status      int       `bson:"status"`
+	Location    string    `bson:"location"`
+	ContentType string    `bson:"contentType"`
+	Body        []byte    `bson:"body"`
+	Created     time.Time `bson:"created"`
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.body.Len()+len(b) <= maxStoredResponse {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func isDuplicateKey(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimIdempotencyKey reserves id for this request. It returns the
+// stored response if the key was used before, or nil if the request
+// should go ahead.
+func claimIdempotencyKey(id string, r *http.Request) (*IdempotentResponse, error) {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+	var prev IdempotentResponse
+	err := appFrom(c).db.idempotency.FindOne(c, filter).Decode(&prev)
+	if err == nil && time.Since(prev.Created) > idempotencyWindow {
+		if _, err := appFrom(c).db.idempotency.DeleteOne(c, filter); err != nil {
+			return nil, err
+		}
+	} else if err == nil {
+		return &prev, nil
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	_, err = appFrom(c).db.idempotency.InsertOne(c, &IdempotentResponse{
+		ID:      id,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Created: time.Now(),
+	})
+	if isDuplicateKey(err) {
+		// Another request with the same key got in first.
+		return &IdempotentResponse{ID: id, Method: r.Method, Path: r.URL.Path}, nil
+	}
+	return nil, err
+}
+
+// idempotent wraps a write handler so that requests carrying an
+// Idempotency-Key header take effect at most once. Keys are scoped to
+// the signed in user. Repeating a key replays the first response;
+// reusing it for a different request, or while the first is still
+// running, is refused.
+func idempotent(fn func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, title string) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			fn(w, r, title)
+			return
+		}
+		if !appFrom(r.Context()).hasDatabase() {
+			// Keys are remembered in MongoDB.
+			http.Error(w, "idempotency keys need a database", http.StatusNotImplemented)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "idempotency key too long", http.StatusBadRequest)
+			return
+		}
+		id := userName(r) + "\x00" + key
+
+		prev, err := claimIdempotencyKey(id, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if prev != nil {
+			switch {
+			case prev.Method != r.Method || prev.Path != r.URL.Path:
+				http.Error(w, "idempotency key was used for a different request", http.StatusUnprocessableEntity)
+			case !prev.Done:
+				http.Error(w, "a request with this idempotency key is in progress", http.StatusConflict)
+			default:
+				if prev.Location != "" {
+					w.Header().Set("Location", prev.Location)
+				}
+				if prev.ContentType != "" {
+					w.Header().Set("Content-Type", prev.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(prev.Status)
+				w.Write(prev.Body)
+			}
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		fn(rw, r, title)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		// The outcome is recorded even if the client has gone away, for
+		// when it retries.
+		c, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+		filter := bson.D{primitive.E{Key: "_id", Value: id}}
+		if rw.status >= 500 {
+			// Let the client retry failed requests with the same key.
+			appFrom(c).db.idempotency.DeleteOne(c, filter)
+			return
+		}
+		appFrom(c).db.idempotency.UpdateOne(c, filter, bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "done", Value: true},
+			primitive.E{Key: "status", Value: rw.status},
+			primitive.E{Key: "location", Value: w.Header().Get("Location")},
+			primitive.E{Key: "contentType", Value: w.Header().Get("Content-Type")},
+			primitive.E{Key: "body", Value: rw.body.Bytes()},
+		}}})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Admins can view the wiki as another user, or as a visitor who is not
+// signed in, to see what they see. The session then acts as that user
+// for reading only: anything but GET and HEAD is refused until the
+// admin stops. Starting, stopping and every page seen in between are
+// written to the audit log.
+
+// viewAsAnonymous is stored as the user viewed as for a visitor who is
+// not signed in. It is not a valid user name.
+const viewAsAnonymous = "~anonymous"
+
+// Impersonation is shown in a banner while an admin views the wiki as
+// someone else.
+type Impersonation struct {
+	Admin  string
+	ViewAs string
+}
+
+// Anonymous reports whether the admin views the wiki as a visitor who
+// is not signed in.
+func (i *Impersonation) Anonymous() bool {
+	return i.ViewAs == viewAsAnonymous
+}
+
+// currentImpersonation returns who the client's session views the wiki
+// as, or nil.
+func currentImpersonation(r *http.Request) *Impersonation {
+	if _, _, ok := r.BasicAuth(); ok {
+		return nil
+	}
+	s := currentSession(r)
+	if s == nil || s.ViewAs == "" {
+		return nil
+	}
+	return &Impersonation{Admin: s.User, ViewAs: s.ViewAs}
+}
+
+// impersonationAllows reports whether a request may be made while
+// viewing the wiki as someone else.
+func impersonationAllows(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead ||
+		r.URL.Path == "/admin/impersonate" || r.URL.Path == "/logout"
+}
+
+// auditImpersonation refuses changes made while viewing the wiki as
+// someone else and records every page seen.
+func auditImpersonation(w http.ResponseWriter, r *http.Request, s *Session) bool {
+	if !impersonationAllows(r) {
+		http.Error(w, "you are viewing the wiki as "+s.ViewAs+"; stop to make changes", http.StatusForbidden)
+		return false
+	}
+	if r.URL.Path != "/admin/impersonate" {
+		recordAudit(r.Context(), s.User, "impersonate.view", s.ViewAs+" "+r.Method+" "+r.URL.RequestURI())
+	}
+	return true
+}
+
+func setViewAs(c context.Context, s *Session, viewAs string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.sessions.UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: s.TokenHash}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "viewAs", Value: viewAs}}}},
+	)
+	return err
+}
+
+// impersonateHandler serves POST /admin/impersonate. With a user name
+// in "name", or "anonymous" set, an admin starts viewing the wiki as
+// that user; with "stop" set, as themselves again.
+func impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	s := currentSession(r)
+	if s == nil {
+		http.Redirect(w, r, "/login?next=/admin/users", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("stop") != "" {
+		if s.ViewAs == "" {
+			http.Redirect(w, r, "/list", http.StatusSeeOther)
+			return
+		}
+		if err := setViewAs(r.Context(), s, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r.Context(), s.User, "impersonate.stop", s.ViewAs)
+		addFlash(w, r, "You are viewing the wiki as yourself again.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	admin, err := loadUser(r.Context(), s.User)
+	if err != nil || !admin.Can(roleAdmin) {
+		http.Error(w, "only admins can view the wiki as someone else", http.StatusForbidden)
+		return
+	}
+	viewAs := viewAsAnonymous
+	label := "a visitor who is not signed in"
+	if r.FormValue("anonymous") == "" {
+		viewAs = strings.TrimSpace(r.FormValue("name"))
+		if _, err := loadUser(r.Context(), viewAs); err != nil || viewAs == s.User {
+			http.Error(w, "no other user called "+viewAs, http.StatusBadRequest)
+			return
+		}
+		label = viewAs
+	}
+	if err := setViewAs(r.Context(), s, viewAs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), s.User, "impersonate.start", viewAs)
+	addFlash(w, r, "You are now viewing the wiki as "+label+". Changes are disabled until you stop.")
+	http.Redirect(w, r, "/list", http.StatusSeeOther)
+}
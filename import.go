@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An import reads Markdown files into the wiki, creating or updating a
+// page for each. It takes an export, or any directory or zip archive of
+// .md files named after their titles, as in Policy/Travel.md. When the
+// import has a manifest.json, as exports do, the titles, languages,
+// owners, reviewers and tags of pages come from it; otherwise pages
+// that already exist keep theirs.
+//
+// Imported pages are scanned for credentials and go through approval in
+// protected namespaces, as saves do.
+//
+// A dry run reports what would happen without changing anything. Admins
+// upload archives at /admin/import; "gowiki import wiki.zip" imports a
+// file or directory from the command line.
+
+// ImportResult is what happened to one file of an import. Action is
+// "created", "updated", "pending" for edits of protected pages waiting
+// for approval, "unchanged" or "failed"; on a dry run it is what would
+// have happened. Warning says why a page imported anyway may need a
+// look.
+type ImportResult struct {
+	File    string
+	Title   string
+	Action  string
+	Error   string
+	Warning string
+}
+
+// ImportReport is the outcome of an import.
+type ImportReport struct {
+	Source  string
+	DryRun  bool
+	Results []ImportResult
+	// Counts maps each action to its number of files.
+	Counts map[string]int
+}
+
+// Failed reports whether any file could not be imported.
+func (rep *ImportReport) Failed() bool {
+	return rep.Counts["failed"] > 0
+}
+
+func (rep *ImportReport) add(res ImportResult) {
+	rep.Results = append(rep.Results, res)
+	rep.Counts[res.Action]++
+}
+
+// importManifest reads the manifest of an import, keyed by file name.
+// Imports without one get an empty map.
+func importManifest(fsys fs.FS) (map[string]ExportEntry, error) {
+	entries := map[string]ExportEntry{}
+	b, err := fs.ReadFile(fsys, exportManifestName)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m ExportManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", exportManifestName, err)
+	}
+	for _, e := range m.Pages {
+		entries[e.File] = e
+	}
+	return entries, nil
+}
+
+// importTitle returns the title of the page a file holds: the one in
+// its manifest entry, or its name without the pages/ directory of
+// exports and the .md extension.
+func importTitle(name string, entry ExportEntry, ok bool) string {
+	if ok && entry.Title != "" {
+		return entry.Title
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "pages/"), ".md")
+}
+
+// importPage creates or updates the page a file holds. Nothing is saved
+// on a dry run.
+func importPage(c context.Context, fsys fs.FS, name string, entry ExportEntry, ok bool, author, source string, dryRun bool) ImportResult {
+	res := ImportResult{File: name, Title: importTitle(name, entry, ok)}
+	fail := func(err error) ImportResult {
+		res.Action, res.Error = "failed", err.Error()
+		return res
+	}
+	if !validTitle(c, res.Title) {
+		return fail(fmt.Errorf("%q is not a valid title", res.Title))
+	}
+	body, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fail(err)
+	}
+
+	p := &Page{Title: res.Title, Body: body, Updated: time.Now()}
+	current, err := loadPage(c, res.Title)
+	exists := err == nil
+	if exists {
+		p.Lang, p.Owner, p.Reviewer, p.Tags = current.Lang, current.Owner, current.Reviewer, current.Tags
+	}
+	if ok {
+		if entry.Lang != "" && !validLanguage.MatchString(entry.Lang) {
+			return fail(fmt.Errorf("invalid language %q", entry.Lang))
+		}
+		tags, err := parseTags(strings.Join(entry.Tags, ","))
+		if err != nil {
+			return fail(err)
+		}
+		p.Lang, p.Owner, p.Reviewer, p.Tags = entry.Lang, entry.Owner, entry.Reviewer, tags
+	}
+
+	switch {
+	case !exists:
+		res.Action = "created"
+	case bytes.Equal(current.Body, p.Body) && current.Lang == p.Lang && current.Owner == p.Owner &&
+		current.Reviewer == p.Reviewer && formatTags(current.Tags) == formatTags(p.Tags):
+		res.Action = "unchanged"
+		return res
+	default:
+		res.Action = "updated"
+	}
+
+	// Dry runs are not audited, so they only preview the scan.
+	ss := appFrom(c).secrets
+	var secrets []SecretFinding
+	allowed := true
+	if dryRun {
+		secrets = ss.preview(p.Body)
+		allowed = secrets == nil || ss.policy != secretsBlock
+	} else {
+		secrets, allowed = ss.screen(c, p, author)
+	}
+	if !allowed {
+		return fail(fmt.Errorf("the page seems to contain credentials: %s", describeSecrets(secrets)))
+	}
+	if secrets != nil {
+		res.Warning = "the page seems to contain credentials: " + describeSecrets(secrets)
+	}
+	protected := isProtected(c, p.Title)
+	if protected {
+		res.Action = "pending"
+	}
+	if dryRun {
+		return res
+	}
+	if protected {
+		if err := submitPendingEdit(c, p, author); err != nil {
+			return fail(err)
+		}
+		return res
+	}
+	if err := commitRevision(c, p, author); err != nil {
+		return fail(err)
+	}
+	if err := recordEvent(c, eventSaved, p.Title, author, "Imported from "+source); err != nil {
+		return fail(err)
+	}
+	return res
+}
+
+// importFrom imports every .md file in fsys, in lexical order. Files
+// that fail are reported and do not stop the others.
+func importFrom(c context.Context, fsys fs.FS, author, source string, dryRun bool) (*ImportReport, error) {
+	entries, err := importManifest(fsys)
+	if err != nil {
+		return nil, err
+	}
+	rep := &ImportReport{Source: source, DryRun: dryRun, Results: []ImportResult{}, Counts: map[string]int{}}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(name) != ".md" {
+			return nil
+		}
+		entry, ok := entries[name]
+		rep.add(importPage(c, fsys, name, entry, ok, author, source, dryRun))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// importHandler serves /admin/import, where admins upload a zip archive
+// to import.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkRole(w, r, roleAdmin) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "import", nil, nil)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "no file uploaded: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		http.Error(w, "not a zip archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rep, err := importFrom(r.Context(), zr, userName(r), header.Filename, r.FormValue("dryrun") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renderTemplate(w, r, "import", nil, rep)
+}
+
+// importCommand implements "gowiki import [-n] [-author name] path",
+// which imports a directory or zip archive and prints what happened to
+// each file.
+func importCommand(c context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "report what would be imported without changing anything")
+	author := fs.String("author", "import", "author recorded for the revisions made")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gowiki import [-n] [-author name] directory|file.zip")
+	}
+	src := fs.Arg(0)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	var rep *ImportReport
+	if fi.IsDir() {
+		rep, err = importFrom(c, os.DirFS(src), *author, src, *dryRun)
+	} else {
+		zr, zerr := zip.OpenReader(src)
+		if zerr != nil {
+			return zerr
+		}
+		rep, err = importFrom(c, zr, *author, filepath.Base(src), *dryRun)
+		zr.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, res := range rep.Results {
+		switch {
+		case res.Error != "":
+			fmt.Printf("%-9s %s: %s\n", res.Action, res.File, res.Error)
+		case res.Warning != "":
+			fmt.Printf("%-9s %s: %s\n", res.Action, res.Title, res.Warning)
+		default:
+			fmt.Printf("%-9s %s\n", res.Action, res.Title)
+		}
+	}
+	fmt.Printf("%d created, %d updated, %d pending approval, %d unchanged, %d failed\n",
+		rep.Counts["created"], rep.Counts["updated"], rep.Counts["pending"], rep.Counts["unchanged"], rep.Counts["failed"])
+	if rep.Failed() {
+		return fmt.Errorf("%d files could not be imported", rep.Counts["failed"])
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Every revision records the checksum of its body, and every attachment
+// that of its file. "gowiki verify", or an admin at /admin/verify, reads
+// all stored content back and checks it against them: each revision,
+// each page against the revision it is at, and each attachment. Running
+// it before taking a backup finds corruption while there are still good
+// copies to restore from. Revisions and attachments stored by older
+// versions have no checksum until "gowiki migrate" records one.
+
+// contentChecksum returns the hex encoded SHA-256 digest of b.
+func contentChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashChecksum is contentChecksum of what was written to h, which must
+// be a SHA-256 hash.
+func hashChecksum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IntegrityProblem is stored content that cannot be read or does not
+// match its checksum.
+type IntegrityProblem struct {
+	Title string
+	// Revision is the number of the revision, or Attachment the name of
+	// the file, the problem is in. Both are empty for the page itself.
+	Revision   int
+	Attachment string
+	Detail     string
+}
+
+func (ip IntegrityProblem) String() string {
+	switch {
+	case ip.Attachment != "":
+		return fmt.Sprintf("%s: attachment %s %s", ip.Title, ip.Attachment, ip.Detail)
+	case ip.Revision != 0:
+		return fmt.Sprintf("%s: revision %d %s", ip.Title, ip.Revision, ip.Detail)
+	}
+	return fmt.Sprintf("%s: page %s", ip.Title, ip.Detail)
+}
+
+// IntegrityReport is what verifyContent found.
+type IntegrityReport struct {
+	Checked     time.Time
+	Revisions   int
+	Pages       int
+	Attachments int
+	// Unverified counts the revisions and attachments without a
+	// checksum, which were only read.
+	Unverified int
+	Problems   []IntegrityProblem
+}
+
+// verifyContent reads back every revision, page and attachment and
+// checks them against their checksums.
+func verifyContent(c context.Context) (*IntegrityReport, error) {
+	ir := &IntegrityReport{Checked: time.Now()}
+	sums, err := verifyRevisions(c, ir)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyPages(c, ir, sums); err != nil {
+		return nil, err
+	}
+	if err := verifyAttachments(c, ir); err != nil {
+		return nil, err
+	}
+	return ir, nil
+}
+
+// revisionKey identifies a revision in the checksums collected by
+// verifyRevisions.
+func revisionKey(title string, number int) string {
+	return title + "#" + strconv.Itoa(number)
+}
+
+// verifyRevisions checks every revision and returns their checksums.
+func verifyRevisions(c context.Context, ir *IntegrityReport) (map[string]string, error) {
+	cur, err := appFrom(c).db.revisions.Find(c, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(c)
+	sums := map[string]string{}
+	for cur.Next(c) {
+		var rev Revision
+		if err := cur.Decode(&rev); err != nil {
+			return nil, err
+		}
+		ir.Revisions++
+		if rev.Checksum == "" {
+			ir.Unverified++
+			continue
+		}
+		sums[revisionKey(rev.Title, rev.Number)] = rev.Checksum
+		if contentChecksum(rev.Body) != rev.Checksum {
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: rev.Title, Revision: rev.Number, Detail: "does not match its checksum"})
+		}
+	}
+	return sums, cur.Err()
+}
+
+// verifyPages checks that every page can be read from the page store and
+// has the body of the revision it is at.
+func verifyPages(c context.Context, ir *IntegrityReport, sums map[string]string) error {
+	titles, err := listPages(c, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, title := range titles {
+		p, err := loadPage(c, title)
+		if err == errPageNotFound {
+			continue
+		}
+		ir.Pages++
+		if err != nil {
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: title, Detail: "cannot be read: " + err.Error()})
+			continue
+		}
+		sum, ok := sums[revisionKey(title, p.Revision)]
+		if ok && contentChecksum(p.Body) != sum {
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: title, Detail: fmt.Sprintf("differs from revision %d", p.Revision)})
+		}
+	}
+	return nil
+}
+
+// verifyAttachments reads every attached file back, checking its length
+// and checksum.
+func verifyAttachments(c context.Context, ir *IntegrityReport) error {
+	list, err := findAttachments(c, bson.D{})
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		ir.Attachments++
+		sum, n, err := attachmentChecksum(c, a)
+		switch {
+		case err != nil:
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: a.Title, Attachment: a.Name, Detail: "cannot be read: " + err.Error()})
+		case n != a.Size:
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: a.Title, Attachment: a.Name, Detail: fmt.Sprintf("is %d bytes instead of %d", n, a.Size)})
+		case a.Checksum == "":
+			ir.Unverified++
+		case sum != a.Checksum:
+			ir.Problems = append(ir.Problems, IntegrityProblem{Title: a.Title, Attachment: a.Name, Detail: "does not match its checksum"})
+		}
+	}
+	return nil
+}
+
+// attachmentChecksum reads the file attached as a and returns its
+// checksum and length.
+func attachmentChecksum(c context.Context, a Attachment) (string, int64, error) {
+	stream, err := appFrom(c).db.attachments.OpenDownloadStream(a.ID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer stream.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, stream)
+	if err != nil {
+		return "", n, err
+	}
+	return hashChecksum(h), n, nil
+}
+
+// recordChecksums records the checksums of the revisions and attachments
+// stored by versions that did not, reporting to out. With dryRun set it
+// only counts them.
+func recordChecksums(c context.Context, out io.Writer, dryRun bool) error {
+	missing := bson.D{primitive.E{Key: "checksum", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+	n, err := appFrom(c).db.revisions.CountDocuments(c, missing)
+	if err != nil {
+		return fmt.Errorf("checksums: %v", err)
+	}
+	files, err := findAttachments(c, bson.D{primitive.E{Key: "metadata.checksum", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}})
+	if err != nil {
+		return fmt.Errorf("checksums: %v", err)
+	}
+	fmt.Fprintf(out, "checksums: %d revisions and %d attachments to record\n", n, len(files))
+	if dryRun {
+		return nil
+	}
+
+	cur, err := appFrom(c).db.revisions.Find(c, missing)
+	if err != nil {
+		return fmt.Errorf("checksums: %v", err)
+	}
+	defer cur.Close(c)
+	for cur.Next(c) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Revision `bson:",inline"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return fmt.Errorf("checksums: %v", err)
+		}
+		_, err := appFrom(c).db.revisions.UpdateOne(c,
+			bson.D{primitive.E{Key: "_id", Value: doc.ID}},
+			bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "checksum", Value: contentChecksum(doc.Body)}}}})
+		if err != nil {
+			return fmt.Errorf("checksums: %s revision %d: %v", doc.Title, doc.Number, err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("checksums: %v", err)
+	}
+	for _, a := range files {
+		sum, _, err := attachmentChecksum(c, a)
+		if err == nil {
+			_, err = appFrom(c).db.Collection("attachments.files").UpdateOne(c,
+				bson.D{primitive.E{Key: "_id", Value: a.ID}},
+				bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "metadata.checksum", Value: sum}}}})
+		}
+		if err != nil {
+			return fmt.Errorf("checksums: %s attachment %s: %v", a.Title, a.Name, err)
+		}
+	}
+	fmt.Fprintf(out, "checksums: recorded %d revisions and %d attachments\n", n, len(files))
+	return nil
+}
+
+// writeIntegrityReport prints ir for the verify command.
+func writeIntegrityReport(out io.Writer, ir *IntegrityReport) {
+	fmt.Fprintf(out, "verified %d revisions, %d pages and %d attachments\n", ir.Revisions, ir.Pages, ir.Attachments)
+	if ir.Unverified > 0 {
+		fmt.Fprintf(out, "%d revisions and attachments have no checksum, run gowiki migrate to record them\n", ir.Unverified)
+	}
+	for _, p := range ir.Problems {
+		fmt.Fprintln(out, p)
+	}
+}
+
+// verifyCommand implements "gowiki verify", which fails if any stored
+// content is corrupt, so backup scripts can stop before exporting it.
+func verifyCommand(c context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ir, err := verifyContent(c)
+	if err != nil {
+		return err
+	}
+	writeIntegrityReport(os.Stdout, ir)
+	if len(ir.Problems) > 0 {
+		return fmt.Errorf("found %d integrity problems", len(ir.Problems))
+	}
+	return nil
+}
+
+// verifyHandler shows the verify form and, on POST, verifies the stored
+// content and shows what was found.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkRole(w, r, roleAdmin) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "verify", nil, nil)
+		return
+	}
+	ir, err := verifyContent(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), userName(r), "verify", fmt.Sprintf("%d revisions, %d pages, %d attachments, %d problems",
+		ir.Revisions, ir.Pages, ir.Attachments, len(ir.Problems)))
+	renderTemplate(w, r, "verify", nil, ir)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IssueTracker turns references such as ABC-123 or #456 in page text
+// into links. Pattern is matched at word boundaries and URL is expanded
+// with regexp.Expand, so $1 is the first group of the match.
+type IssueTracker struct {
+	Pattern *regexp.Regexp
+	URL     string
+}
+
+// issueLinker links the issues referenced in page text, set up with
+// -issue-links, -issue-status and -issue-token.
+type issueLinker struct {
+	trackers []*IssueTracker
+	// status turns on status badges, fetched from the tracker API of
+	// links that point at GitHub issues or Jira.
+	status bool
+	// token is sent as a bearer token when fetching issue status.
+	token string
+
+	mu    sync.Mutex
+	cache map[string]*cachedStatus
+}
+
+// issueStatusTTL is how long a fetched issue status is shown.
+const issueStatusTTL = 10 * time.Minute
+
+var issueClient = &http.Client{Timeout: 10 * time.Second}
+
+// parseIssueTrackers parses the -issue-links setting: space separated
+// entries of the form pattern=url, such as
+//
+//	[A-Z]+-[0-9]+=https://jira.example.com/browse/$0
+//	#([0-9]+)=https://github.com/acme/wiki/issues/$1
+//
+// The pattern ends at the first "=", which RE2 syntax rarely needs.
+func parseIssueTrackers(spec string) ([]*IssueTracker, error) {
+	var list []*IssueTracker
+	for _, entry := range strings.Fields(spec) {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("issue link %q is not of the form pattern=url", entry)
+		}
+		re, err := regexp.Compile(`^(?:` + entry[:i] + `)`)
+		if err != nil {
+			return nil, fmt.Errorf("issue link %q: %v", entry, err)
+		}
+		list = append(list, &IssueTracker{Pattern: re, URL: entry[i+1:]})
+	}
+	return list, nil
+}
+
+// newIssueLinker returns the issue linker configured in cfg.
+func newIssueLinker(cfg *Config) (*issueLinker, error) {
+	trackers, err := parseIssueTrackers(cfg.IssueLinks)
+	if err != nil {
+		return nil, err
+	}
+	return &issueLinker{
+		trackers: trackers,
+		status:   cfg.IssueStatus,
+		token:    cfg.IssueToken,
+		cache:    map[string]*cachedStatus{},
+	}, nil
+}
+
+// render writes a link for an issue reference starting at s[i]
+// and returns the length consumed, or 0 if there is none.
+func (il *issueLinker) render(b *strings.Builder, s string, i int) int {
+	if i > 0 && isWordByte(s[i-1]) {
+		return 0
+	}
+	for _, t := range il.trackers {
+		m := t.Pattern.FindStringSubmatchIndex(s[i:])
+		if m == nil || m[1] == 0 {
+			continue
+		}
+		if end := i + m[1]; end < len(s) && isWordByte(s[end]) {
+			continue
+		}
+		ref := s[i : i+m[1]]
+		href := safeURL(string(t.Pattern.ExpandString(nil, t.URL, s[i:], m)))
+		if href == "" {
+			continue
+		}
+		b.WriteString(`<a class="issue" href="` + template.HTMLEscapeString(href) + `">` + template.HTMLEscapeString(ref) + "</a>")
+		if status := il.issueStatus(href); status != "" {
+			b.WriteString(` <span class="issue-status status-` + slugify(status) + `">` + template.HTMLEscapeString(status) + "</span>")
+		}
+		return m[1]
+	}
+	return 0
+}
+
+type cachedStatus struct {
+	status   string
+	fetched  time.Time
+	fetching bool
+}
+
+// issueStatus returns the cached status of the issue at href. Missing
+// and stale entries are refreshed in the background, so rendering a page
+// never waits for a tracker; the badge appears on a later view.
+func (il *issueLinker) issueStatus(href string) string {
+	if !il.status {
+		return ""
+	}
+	api, field := issueAPI(href)
+	if api == "" {
+		return ""
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	c := il.cache[href]
+	if c == nil {
+		c = &cachedStatus{}
+		il.cache[href] = c
+	}
+	if !c.fetching && time.Since(c.fetched) > issueStatusTTL {
+		c.fetching = true
+		go il.refreshStatus(href, api, field)
+	}
+	return c.status
+}
+
+func (il *issueLinker) refreshStatus(href, api string, field func(*issueResponse) string) {
+	status, err := il.fetchStatus(api, field)
+	if err != nil {
+		log.Printf("fetching status of %s: %v", href, err)
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	c := il.cache[href]
+	c.fetching = false
+	c.fetched = time.Now()
+	if err == nil {
+		c.status = status
+	}
+}
+
+// issueResponse holds the fields of GitHub and Jira issues that carry
+// the status.
+type issueResponse struct {
+	State  string `json:"state"`
+	Fields struct {
+		Status struct {
+			Name string `json:"name"`
+		} `json:"status"`
+	} `json:"fields"`
+}
+
+// issueAPI returns the API address describing the issue linked to by
+// href and how to read its status, or "" for unknown trackers.
+func issueAPI(href string) (string, func(*issueResponse) string) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "github.com" && len(parts) == 4 && (parts[2] == "issues" || parts[2] == "pull") {
+		api := "https://api.github.com/repos/" + parts[0] + "/" + parts[1] + "/issues/" + parts[3]
+		return api, func(r *issueResponse) string { return r.State }
+	}
+	if i := strings.LastIndex(u.Path, "/browse/"); i >= 0 {
+		key := u.Path[i+len("/browse/"):]
+		api := u.Scheme + "://" + u.Host + u.Path[:i] + "/rest/api/2/issue/" + url.PathEscape(key) + "?fields=status"
+		return api, func(r *issueResponse) string { return r.Fields.Status.Name }
+	}
+	return "", nil
+}
+
+func (il *issueLinker) fetchStatus(api string, field func(*issueResponse) string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, api, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if il.token != "" {
+		req.Header.Set("Authorization", "Bearer "+il.token)
+	}
+	res, err := issueClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("issue tracker: %s", res.Status)
+	}
+	var ir issueResponse
+	if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+		return "", err
+	}
+	return field(&ir), nil
+}
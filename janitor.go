@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Data the wiki only needs for a while is removed automatically. MongoDB
+// deletes expired sessions, idempotency keys, and, if retention is set
+// for them, audit entries itself, through TTL indexes created at
+// startup. What a TTL index cannot express, such as trashed pages,
+// which follow retention policies and legal holds, or the pages of a
+// snapshot that failed half way, is removed by the janitor, which runs
+// every -janitor-interval while the wiki serves.
+
+// Retention is how long each kind of data is kept.
+type Retention struct {
+	// Sessions are kept this long after they expire.
+	Sessions time.Duration
+	// Idempotency keys are kept this long after they were first used,
+	// at least idempotencyWindow.
+	Idempotency time.Duration
+	// Trash and Audit are how long deleted pages and files, and audit log
+	// entries, are kept. Zero keeps them forever. Trash is the default for
+	// namespaces without a retention policy.
+	Trash time.Duration
+	Audit time.Duration
+}
+
+var defaultRetention = Retention{
+	Sessions:    24 * time.Hour,
+	Idempotency: 2 * idempotencyWindow,
+}
+
+// janitorGrace is how old the pages of an unknown snapshot must be
+// before the janitor removes them, so snapshots being taken are left
+// alone.
+const janitorGrace = time.Hour
+
+// Codes MongoDB answers createIndexes with when an index of the same
+// name or keys exists with other options.
+const (
+	errIndexOptionsConflict  = 85
+	errIndexKeySpecsConflict = 86
+)
+
+// ensureTTLIndex makes MongoDB delete the documents of coll once field
+// is more than after in the past. A zero after drops the index, keeping
+// documents forever, unless keepZero is set, in which case they are
+// deleted as soon as field has passed.
+func ensureTTLIndex(c context.Context, coll *mongo.Collection, field string, after time.Duration, keepZero bool) error {
+	name := field + "_ttl"
+	if after <= 0 && !keepZero {
+		_, err := coll.Indexes().DropOne(c, name)
+		if cerr, ok := err.(mongo.CommandError); ok && (cerr.Name == "IndexNotFound" || cerr.Name == "NamespaceNotFound") {
+			return nil
+		}
+		return err
+	}
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(after / time.Second)),
+	}
+	_, err := coll.Indexes().CreateOne(c, model)
+	if cerr, ok := err.(mongo.CommandError); ok && (cerr.Code == errIndexOptionsConflict || cerr.Code == errIndexKeySpecsConflict) {
+		// The retention changed since the index was made.
+		if _, err := coll.Indexes().DropOne(c, name); err != nil {
+			return err
+		}
+		_, err = coll.Indexes().CreateOne(c, model)
+	}
+	return err
+}
+
+// createTTLIndexes applies the retention periods of r.
+func createTTLIndexes(c context.Context, r Retention) error {
+	if r.Idempotency < idempotencyWindow {
+		return fmt.Errorf("idempotency keys must be kept at least %v", idempotencyWindow)
+	}
+	if err := ensureTTLIndex(c, appFrom(c).db.sessions, "expires", r.Sessions, true); err != nil {
+		return err
+	}
+	if err := ensureTTLIndex(c, appFrom(c).db.idempotency, "created", r.Idempotency, true); err != nil {
+		return err
+	}
+	// The janitor purges the trash, as a TTL index cannot tell which
+	// pages are under legal hold. This drops the index of older
+	// versions.
+	if err := ensureTTLIndex(c, appFrom(c).db.trash, "deleted", 0, false); err != nil {
+		return err
+	}
+	return ensureTTLIndex(c, appFrom(c).db.audit, "time", r.Audit, false)
+}
+
+// runJanitor cleans up every interval until stop is closed, keeping
+// what r says.
+func runJanitor(c context.Context, interval time.Duration, r Retention, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := cleanUp(c, time.Now(), r); err != nil {
+				log.Printf("janitor: %v", err)
+			}
+		}
+	}
+}
+
+// cleanUp removes what the TTL indexes cannot.
+func cleanUp(c context.Context, now time.Time, r Retention) error {
+	n, err := purgeTrash(c, now, r.Trash)
+	if n > 0 {
+		log.Printf("janitor: purged %d pages from the trash", n)
+	}
+	if err != nil {
+		return err
+	}
+	n, err = purgeRecycledAttachments(c, now, r.Trash)
+	if n > 0 {
+		log.Printf("janitor: purged %d removed attachments", n)
+	}
+	if err != nil {
+		return err
+	}
+	n, err = removeOrphanedSnapshotPages(c, now.Add(-janitorGrace))
+	if n > 0 {
+		log.Printf("janitor: removed %d pages of unfinished snapshots", n)
+	}
+	return err
+}
+
+// removeOrphanedSnapshotPages removes the pages of snapshots that were
+// never listed, because taking them failed, if taken before before.
+func removeOrphanedSnapshotPages(c context.Context, before time.Time) (int64, error) {
+	names, err := appFrom(c).db.snapshotPages.Distinct(c, "snapshot", bson.D{
+		primitive.E{Key: "taken", Value: bson.D{primitive.E{Key: "$lt", Value: before}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, v := range names {
+		name, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if _, err := loadSnapshot(c, name); err != mongo.ErrNoDocuments {
+			if err != nil {
+				return removed, err
+			}
+			continue
+		}
+		res, err := appFrom(c).db.snapshotPages.DeleteMany(c, bson.D{
+			primitive.E{Key: "snapshot", Value: name},
+			primitive.E{Key: "taken", Value: bson.D{primitive.E{Key: "$lt", Value: before}}},
+		})
+		if err != nil {
+			return removed, err
+		}
+		removed += res.DeletedCount
+	}
+	return removed, nil
+}
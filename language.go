@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultLanguage is assumed for pages that do not declare a language.
+const defaultLanguage = "en"
+
+// validLanguage matches BCP 47 style tags such as "de" or "pt-BR".
+var validLanguage = regexp.MustCompile("^[a-z]{2,3}(-[A-Za-z0-9]{2,8})?$")
+
+// Variant is a language version of a page.
+type Variant struct {
+	Title string
+	Lang  string
+}
+
+// splitVariant splits "Setup/de" into the base title "Setup" and the
+// language "de". Titles without a language suffix are returned as is.
+func splitVariant(title string) (string, string) {
+	i := strings.LastIndex(title, "/")
+	if i < 0 || !validLanguage.MatchString(title[i+1:]) {
+		return title, ""
+	}
+	return title[:i], title[i+1:]
+}
+
+// pageLanguage returns the language of a page: the declared one, else
+// the one in its title suffix, else the wiki default.
+func pageLanguage(p *Page) string {
+	if p.Lang != "" {
+		return p.Lang
+	}
+	if _, lang := splitVariant(p.Title); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// languageVariants returns all language versions of a page, including
+// the page itself, ordered by title.
+func languageVariants(c context.Context, p *Page) ([]Variant, error) {
+	base, _ := splitVariant(p.Title)
+	// Variants are below the page, so only the store it is routed to is
+	// looked at. Listing every store on each view would be too slow.
+	a := appFrom(c)
+	store, route := a.pages, -1
+	if a.router != nil {
+		route = a.router.routeOf(base)
+		store = a.router.store(route)
+	}
+	var pages []Page
+	if !a.hasDatabase() || route >= 0 {
+		list, err := store.List(c, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, title := range list {
+			if b, _ := splitVariant(title); b != base {
+				continue
+			}
+			v, err := store.Get(c, title)
+			if err == errPageNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, *v)
+		}
+	} else {
+		filter := bson.D{primitive.E{Key: "title", Value: primitive.Regex{
+			Pattern: "^" + regexp.QuoteMeta(base) + "(/[a-zA-Z0-9-]+)?$",
+		}}}
+		opts := options.Find().
+			SetProjection(bson.D{{Key: "title", Value: 1}, {Key: "lang", Value: 1}}).
+			SetSort(bson.D{{Key: "title", Value: 1}})
+		cur, err := appFrom(c).db.pages.Find(c, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := cur.All(c, &pages); err != nil {
+			return nil, err
+		}
+	}
+
+	variants := []Variant{}
+	for i := range pages {
+		if b, _ := splitVariant(pages[i].Title); b != base {
+			continue
+		}
+		variants = append(variants, Variant{
+			Title: pages[i].Title,
+			Lang:  pageLanguage(&pages[i]),
+		})
+	}
+	return variants, nil
+}
+
+// renderVariants lists the other language versions of a page for the
+// language switcher. Pages without translations get an empty list.
+func renderVariants(c context.Context, p *Page) []Variant {
+	variants, err := languageVariants(c, p)
+	if err != nil || len(variants) < 2 {
+		return nil
+	}
+	return variants
+}
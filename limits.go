@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RouteLimits are the settings applied to every request of a group of
+// routes: the HTML pages, the JSON endpoints and the static files.
+type RouteLimits struct {
+	// Timeout bounds the database and outgoing calls made for a request
+	// by cancelling its context. Zero means no limit.
+	Timeout time.Duration
+	// MaxBody is the largest request body read, in bytes. Zero means no
+	// limit.
+	MaxBody int64
+	// CacheControl is sent as the Cache-Control header unless the
+	// handler sets its own. Empty sends none.
+	CacheControl string
+}
+
+// routeLimitFlags defines the flags for one route group, such as
+// -api-timeout, -api-max-body and -api-cache for the group "api".
+func routeLimitFlags(fs *flag.FlagSet, group string, l *RouteLimits) {
+	fs.DurationVar(&l.Timeout, group+"-timeout", l.Timeout, "time allowed for "+group+" requests, 0 for no limit")
+	fs.Int64Var(&l.MaxBody, group+"-max-body", l.MaxBody, "largest "+group+" request body in bytes, 0 for no limit")
+	fs.StringVar(&l.CacheControl, group+"-cache", l.CacheControl, "Cache-Control header for "+group+" responses")
+}
+
+// isAPIPath reports whether a path is served as JSON rather than HTML.
+func isAPIPath(path string) bool {
+	return path == apiPrefix || strings.HasPrefix(path, apiPrefix+"/") ||
+		path == "/events" || path == "/shortcuts.json" || path == "/spellcheck"
+}
+
+// routeLimits returns the limits of the group a request path belongs to.
+func (c *Config) routeLimits(path string) RouteLimits {
+	switch {
+	case strings.HasPrefix(path, "/static/"):
+		return c.Static
+	case isAPIPath(path):
+		return c.API
+	}
+	return c.HTML
+}
+
+// withLimits applies the route limits configured for each request's
+// path before passing it to h.
+func (a *App) withLimits(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := a.cfg.routeLimits(r.URL.Path)
+		if l.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), l.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if l.MaxBody > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxBody)
+		}
+		if l.CacheControl != "" {
+			w.Header().Set("Cache-Control", l.CacheControl)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The link graph records the titles every page links to with [[...]],
+// or lists as a sidebar, whichever store keeps the pages. It is updated
+// whenever a page is saved, deleted or moved, and answers
+// /backlinks/{title}, which lists the pages linking to a title whether
+// or not a page exists there, as well as Special:Orphans and
+// Special:Wanted. "gowiki migrate" builds it for pages saved by older
+// versions.
+
+// pageLinks is the document recording the links of one page.
+type pageLinks struct {
+	Title string   `bson:"_id"`
+	Links []string `bson:"links"`
+}
+
+// Backlinks is the data of the backlinks page.
+type Backlinks struct {
+	Title string
+	Pages []string
+}
+
+// WantedPage is a title linked to that has no page, with the number of
+// pages linking to it.
+type WantedPage struct {
+	Title string
+	Count int
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Orphans",
+		Description: "Pages no other page links to.",
+		Handler:     orphansHandler,
+		Mongo:       true,
+	})
+	registerSpecialPage(&SpecialPage{
+		Name:        "Wanted",
+		Description: "Pages linked to that do not exist yet, most wanted first.",
+		Handler:     wantedHandler,
+		Mongo:       true,
+	})
+}
+
+// pageLinkTargets returns the titles p links to: those of its [[...]]
+// links and, for sidebars, those of its entries.
+func pageLinkTargets(c context.Context, p *Page) []string {
+	links := linkedTitles(appFrom(c).titles, p.Body)
+	if path.Base(p.Title) == sidebarTitle {
+		seen := map[string]bool{}
+		for _, t := range links {
+			seen[t] = true
+		}
+		for _, e := range sidebarEntries(p.Body) {
+			if validTitle(c, e.Title) && !seen[e.Title] {
+				seen[e.Title] = true
+				links = append(links, e.Title)
+			}
+		}
+	}
+	return links
+}
+
+// isNavigationPage reports whether title is a sidebar, header or footer,
+// which are shown around other pages rather than linked to.
+func isNavigationPage(title string) bool {
+	switch path.Base(title) {
+	case sidebarTitle, headerTitle, footerTitle:
+		return true
+	}
+	return false
+}
+
+// createLinksIndex makes sure the pages linking to a title can be found
+// quickly.
+func createLinksIndex(c context.Context) error {
+	_, err := appFrom(c).db.links.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys:    bson.D{{Key: "links", Value: 1}},
+		Options: options.Index().SetName("links"),
+	})
+	return err
+}
+
+// updateLinks records the titles p links to.
+func updateLinks(c context.Context, p *Page) error {
+	if appFrom(c).db == nil {
+		return nil
+	}
+	links := pageLinkTargets(c, p)
+	if links == nil {
+		links = []string{}
+	}
+	_, err := appFrom(c).db.links.ReplaceOne(c,
+		bson.D{primitive.E{Key: "_id", Value: p.Title}},
+		&pageLinks{Title: p.Title, Links: links},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// removeLinks forgets the links of the page called title.
+func removeLinks(c context.Context, title string) error {
+	if appFrom(c).db == nil {
+		return nil
+	}
+	_, err := appFrom(c).db.links.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: title}})
+	return err
+}
+
+// backlinks returns the titles of the pages u can read that link to
+// title, in alphabetical order.
+func backlinks(c context.Context, title string, u *User) ([]string, error) {
+	filter := append(bson.D{primitive.E{Key: "links", Value: title}}, readFilter(c, u, "_id")...)
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}).SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := appFrom(c).db.links.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []pageLinks
+	if err := cur.All(c, &docs); err != nil {
+		return nil, err
+	}
+	titles := []string{}
+	for _, d := range docs {
+		titles = append(titles, d.Title)
+	}
+	return titles, nil
+}
+
+// linkGraph returns the links of every page.
+func linkGraph(c context.Context) ([]pageLinks, error) {
+	cur, err := appFrom(c).db.links.Find(c, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	list := []pageLinks{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// listedTitles returns every title and those u sees in page lists,
+// which leave out what u may not read and what is archived.
+func listedTitles(c context.Context, u *User) (all, listed []string, err error) {
+	all, err = listPages(c, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	hidden, err := unlistedNamespaces(c, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	listed = []string{}
+next:
+	for _, t := range all {
+		for _, ns := range hidden {
+			if inNamespace(t, ns) {
+				continue next
+			}
+		}
+		listed = append(listed, t)
+	}
+	return all, listed, nil
+}
+
+// orphanedPages returns the pages u sees in page lists that no other
+// page links to, leaving out sidebars, headers and footers.
+func orphanedPages(c context.Context, u *User) ([]string, error) {
+	_, listed, err := listedTitles(c, u)
+	if err != nil {
+		return nil, err
+	}
+	graph, err := linkGraph(c)
+	if err != nil {
+		return nil, err
+	}
+	linked := map[string]bool{}
+	for _, pl := range graph {
+		for _, t := range pl.Links {
+			if t != pl.Title {
+				linked[t] = true
+			}
+		}
+	}
+	orphans := []string{}
+	for _, t := range listed {
+		if !linked[t] && !isNavigationPage(t) {
+			orphans = append(orphans, t)
+		}
+	}
+	return orphans, nil
+}
+
+// wantedPages returns the titles without a page that the pages u sees
+// in page lists link to, the most linked first.
+func wantedPages(c context.Context, u *User) ([]WantedPage, error) {
+	all, listed, err := listedTitles(c, u)
+	if err != nil {
+		return nil, err
+	}
+	graph, err := linkGraph(c)
+	if err != nil {
+		return nil, err
+	}
+	exists := map[string]bool{}
+	for _, t := range all {
+		exists[t] = true
+	}
+	visible := map[string]bool{}
+	for _, t := range listed {
+		visible[t] = true
+	}
+	counts := map[string]int{}
+	for _, pl := range graph {
+		if !visible[pl.Title] {
+			continue
+		}
+		for _, t := range pl.Links {
+			if !exists[t] {
+				counts[t]++
+			}
+		}
+	}
+	wanted := []WantedPage{}
+	for t, n := range counts {
+		wanted = append(wanted, WantedPage{Title: t, Count: n})
+	}
+	sort.Slice(wanted, func(i, j int) bool {
+		if wanted[i].Count != wanted[j].Count {
+			return wanted[i].Count > wanted[j].Count
+		}
+		return wanted[i].Title < wanted[j].Title
+	})
+	return wanted, nil
+}
+
+// rebuildLinks records the links of every page and forgets those of
+// pages that no longer exist, reporting to out. With dryRun set it only
+// counts the pages.
+func rebuildLinks(c context.Context, out io.Writer, dryRun bool) error {
+	titles, err := listPages(c, 0, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "link graph: %d pages to scan\n", len(titles))
+	if dryRun {
+		return nil
+	}
+	for _, title := range titles {
+		p, err := loadPage(c, title)
+		if err == errPageNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("link graph: %s: %v", title, err)
+		}
+		if err := updateLinks(c, p); err != nil {
+			return fmt.Errorf("link graph: %s: %v", title, err)
+		}
+	}
+	res, err := appFrom(c).db.links.DeleteMany(c, bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$nin", Value: titles}}},
+	})
+	if err != nil {
+		return fmt.Errorf("link graph: %v", err)
+	}
+	fmt.Fprintf(out, "link graph: recorded %d pages, removed %d deleted ones\n", len(titles), res.DeletedCount)
+	return nil
+}
+
+// backlinksHandler lists the pages linking to title.
+func backlinksHandler(w http.ResponseWriter, r *http.Request, title string) {
+	list, err := backlinks(r.Context(), title, currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "backlinks", nil, &Backlinks{Title: title, Pages: list})
+}
+
+func orphansHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := orphanedPages(r.Context(), currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "orphans", nil, list)
+}
+
+func wantedHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := wantedPages(r.Context(), currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "wanted", nil, list)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadOp is one kind of request made by the load test.
+type loadOp struct {
+	name   string
+	weight int
+	do     func(lt *loadTest, page string) (*http.Response, error)
+}
+
+// loadOps are the requests the load test mixes, with their default
+// share of the total.
+var loadOps = []loadOp{
+	{"view", 70, func(lt *loadTest, page string) (*http.Response, error) {
+		return lt.get(pageURL("view", page))
+	}},
+	{"search", 15, func(lt *loadTest, page string) (*http.Response, error) {
+		return lt.get("/search?q=" + url.QueryEscape(loadWords[rand.Intn(len(loadWords))]))
+	}},
+	{"edit", 10, func(lt *loadTest, page string) (*http.Response, error) {
+		return lt.get(pageURL("edit", page))
+	}},
+	{"save", 5, func(lt *loadTest, page string) (*http.Response, error) {
+		return lt.save(page)
+	}},
+}
+
+// loadWords make up the bodies of the test pages and the search queries.
+var loadWords = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+
+// loadTest runs requests against a wiki and collects their latencies.
+type loadTest struct {
+	base     string
+	user     string
+	password string
+	csrf     string
+	client   *http.Client
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func (lt *loadTest) do(req *http.Request) (*http.Response, error) {
+	if lt.user != "" {
+		req.SetBasicAuth(lt.user, lt.password)
+	}
+	if req.Method != http.MethodGet {
+		// Any token passes as long as cookie and header agree.
+		req.AddCookie(&http.Cookie{Name: csrfCookie, Value: lt.csrf})
+		req.Header.Set(csrfHeader, lt.csrf)
+	}
+	res, err := lt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Read the whole response, as a browser would, so rendering time
+	// is part of the latency.
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return res, nil
+}
+
+func (lt *loadTest) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, lt.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lt.do(req)
+}
+
+func (lt *loadTest) save(page string) (*http.Response, error) {
+	words := make([]string, 200)
+	for i := range words {
+		words[i] = loadWords[rand.Intn(len(loadWords))]
+	}
+	form := url.Values{
+		"body":    {"# " + page + "\n\n" + strings.Join(words, " ")},
+		"summary": {"load test"},
+	}
+	req, err := http.NewRequest(http.MethodPost, lt.base+pageURL("save", page), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return lt.do(req)
+}
+
+func (lt *loadTest) record(op string, d time.Duration, failed bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.latencies[op] = append(lt.latencies[op], d)
+	if failed {
+		lt.errors[op]++
+	}
+}
+
+// pickOp chooses an operation at random according to the weights.
+func pickOp(ops []loadOp, total int) loadOp {
+	n := rand.Intn(total)
+	for _, op := range ops {
+		if n < op.weight {
+			return op
+		}
+		n -= op.weight
+	}
+	return ops[len(ops)-1]
+}
+
+// parseMix reads weights such as "view=80,save=20". Operations left out
+// are not run.
+func parseMix(s string) ([]loadOp, error) {
+	if s == "" {
+		return loadOps, nil
+	}
+	weights := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("mix entry %q is not of the form op=weight", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid weight in %q", part)
+		}
+		weights[strings.TrimSpace(kv[0])] = n
+	}
+	var ops []loadOp
+	for _, op := range loadOps {
+		if w, ok := weights[op.name]; ok {
+			delete(weights, op.name)
+			if w > 0 {
+				op.weight = w
+				ops = append(ops, op)
+			}
+		}
+	}
+	for name := range weights {
+		return nil, fmt.Errorf("unknown operation %q", name)
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("the mix runs no operations")
+	}
+	return ops, nil
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// report writes a table of latency percentiles per operation.
+func (lt *loadTest) report(w io.Writer, elapsed time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\terrors\tp50\tp90\tp99\tmax\t")
+	var names []string
+	total := 0
+	for name := range lt.latencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := lt.latencies[name]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		total += len(l)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t\n", name, len(l), lt.errors[name],
+			percentile(l, 50).Round(time.Microsecond), percentile(l, 90).Round(time.Microsecond),
+			percentile(l, 99).Round(time.Microsecond), percentile(l, 100).Round(time.Microsecond))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d requests in %v, %.1f requests/s\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+}
+
+// loadtestCommand implements "gowiki loadtest", which measures how fast
+// a running wiki serves views, searches, edit forms and saves:
+//
+//	gowiki loadtest -url http://localhost:8080 -user bob -password ... -c 20 -n 5000
+//
+// It writes to the pages LoadTest/Page1 to LoadTest/PageN, creating
+// them first, so point it at a test instance, started with -write-rate 0
+// so saves are not rate limited. Saving needs an editor's credentials;
+// without them edit and save requests count as errors.
+func loadtestCommand(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8080", "address of the wiki to test")
+	user := fs.String("user", "", "user name to sign in with")
+	password := fs.String("password", "", "password to sign in with")
+	concurrency := fs.Int("c", 10, "number of concurrent clients")
+	requests := fs.Int("n", 1000, "total number of requests")
+	duration := fs.Duration("d", 0, "run for this long instead of a number of requests")
+	nPages := fs.Int("pages", 20, "number of test pages")
+	mix := fs.String("mix", "", "weights of the operations, such as view=70,search=15,edit=10,save=5")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ops, err := parseMix(*mix)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *nPages < 1 {
+		return errors.New("-c and -pages must be at least 1")
+	}
+	totalWeight := 0
+	for _, op := range ops {
+		totalWeight += op.weight
+	}
+
+	csrf, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	lt := &loadTest{
+		csrf:     csrf,
+		base:     strings.TrimRight(*base, "/"),
+		user:     *user,
+		password: *password,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// Redirects, such as the one after saving, are not followed
+			// so every request measures a single handler.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			Transport:     &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+	}
+	pageNames := make([]string, *nPages)
+	for i := range pageNames {
+		pageNames[i] = "LoadTest/Page" + strconv.Itoa(i+1)
+	}
+	if *user != "" {
+		fmt.Fprintf(os.Stdout, "creating %d test pages\n", len(pageNames))
+		for _, page := range pageNames {
+			res, err := lt.save(page)
+			if err != nil {
+				return err
+			}
+			if res.StatusCode >= 400 {
+				return fmt.Errorf("creating %s: %s", page, res.Status)
+			}
+		}
+	}
+
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	var mu sync.Mutex
+	remaining := *requests
+	next := func() bool {
+		if !deadline.IsZero() {
+			return time.Now().Before(deadline)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		remaining--
+		return remaining >= 0
+	}
+
+	fmt.Fprintf(os.Stdout, "running with %d clients against %s\n", *concurrency, lt.base)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next() {
+				op := pickOp(ops, totalWeight)
+				t := time.Now()
+				res, err := op.do(lt, pageNames[rand.Intn(len(pageNames))])
+				lt.record(op.name, time.Since(t), err != nil || res.StatusCode >= 400)
+			}
+		}()
+	}
+	wg.Wait()
+	lt.report(os.Stdout, time.Since(start))
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxMailSize is the largest message the mail gateway accepts.
+const maxMailSize = 10 << 20
+
+var errMailSender = errors.New("sender is not allowed to post to the wiki")
+
+// MailGateway turns incoming email into wiki pages. The subject becomes
+// the title and the plain text body the content. Mail about an existing
+// page is appended to it as a new section. Mail to protected pages is
+// submitted for approval like any other edit and replaces the page.
+//
+// Messages are read from standard input by "gowiki mail", which is meant
+// to be run by the mail server for the gateway's address, for example
+// through an alias such as `wiki: "|/usr/local/bin/gowiki mail"`.
+type MailGateway struct {
+	// Allowed lists the addresses, or domains written as "@example.org",
+	// that may post. Mail from anyone else is refused.
+	Allowed []string
+}
+
+// MailImport describes what the gateway did with a message.
+type MailImport struct {
+	Title       string
+	Created     bool
+	Pending     bool
+	Attachments []string
+}
+
+// allows reports whether addr may post through the gateway.
+func (g *MailGateway) allows(addr string) bool {
+	addr = strings.ToLower(addr)
+	for _, a := range g.Allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+		if a == addr || strings.HasPrefix(a, "@") && strings.HasSuffix(addr, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// mailTitle turns a subject such as "Re: meeting notes, 3 May" into a
+// title such as "MeetingNotes3May".
+func mailTitle(subject string) string {
+	for {
+		lower := strings.ToLower(subject)
+		trimmed := false
+		for _, prefix := range []string{"re:", "fwd:", "fw:", "aw:", "wg:"} {
+			if strings.HasPrefix(lower, prefix) {
+				subject = strings.TrimSpace(subject[len(prefix):])
+				trimmed = true
+				break
+			}
+		}
+		if !trimmed {
+			break
+		}
+	}
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(subject, func(r rune) bool {
+		return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))
+	}) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// decodePart undoes the content transfer encoding of a message part.
+// multipart.Reader already decodes quoted-printable parts itself.
+func decodePart(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// mailContent extracts the first plain text part of a message and the
+// file names of its attachments.
+func mailContent(header mail.Header, body io.Reader) (string, []string, error) {
+	var text string
+	var attachments []string
+	var walk func(contentType, encoding string, r io.Reader) error
+	walk = func(contentType, encoding string, r io.Reader) error {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = "text/plain"
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(r, params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if name := part.FileName(); name != "" {
+					attachments = append(attachments, name)
+					continue
+				}
+				ct := part.Header.Get("Content-Type")
+				if ct == "" {
+					ct = "text/plain"
+				}
+				if err := walk(ct, part.Header.Get("Content-Transfer-Encoding"), part); err != nil {
+					return err
+				}
+			}
+		}
+		if mediaType == "text/plain" && text == "" {
+			b, err := ioutil.ReadAll(decodePart(r, encoding))
+			if err != nil {
+				return err
+			}
+			text = strings.ReplaceAll(string(b), "\r\n", "\n")
+		}
+		return nil
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	err := walk(contentType, header.Get("Content-Transfer-Encoding"), body)
+	return strings.TrimSpace(text), attachments, err
+}
+
+// Import reads one message and saves it to the wiki.
+func (g *MailGateway) Import(c context.Context, r io.Reader) (*MailImport, error) {
+	msg, err := mail.ReadMessage(io.LimitReader(r, maxMailSize))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("From: %v", err)
+	}
+	if !g.allows(from.Address) {
+		return nil, errMailSender
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	title := mailTitle(subject)
+	if !validTitle(c, title) {
+		return nil, fmt.Errorf("subject %q does not make a valid page title", subject)
+	}
+
+	text, attachments, err := mailContent(msg.Header, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) > 0 {
+		text += "\n\nAttachments not imported: " + strings.Join(attachments, ", ")
+	}
+
+	if secrets, ok := appFrom(c).secrets.screen(c, &Page{Title: title, Body: []byte(text)}, from.Address); !ok {
+		return nil, fmt.Errorf("the message seems to contain credentials: %s", describeSecrets(secrets))
+	}
+
+	imp := &MailImport{Title: title, Attachments: attachments}
+	p, err := loadPage(c, title)
+	if isProtected(c, title) {
+		if err != nil {
+			p = &Page{Title: title}
+		}
+		p.Body = []byte(text)
+		p.Updated = time.Now()
+		imp.Pending = true
+		return imp, submitPendingEdit(c, p, from.Address)
+	}
+	if err != nil {
+		imp.Created = true
+		p = &Page{Title: title, Body: []byte(text), Updated: time.Now()}
+	} else {
+		date, derr := msg.Header.Date()
+		if derr != nil {
+			date = time.Now()
+		}
+		var b bytes.Buffer
+		b.Write(bytes.TrimRight(p.Body, "\n"))
+		fmt.Fprintf(&b, "\n\n## Mail from %s, %s\n\n%s\n", from.Address, date.Format("2006-01-02 15:04"), text)
+		p.Body = b.Bytes()
+		p.Updated = time.Now()
+	}
+	if err := commitRevision(c, p, from.Address); err != nil {
+		return nil, err
+	}
+	if err := recordEvent(c, eventSaved, title, from.Address, "By mail: "+subject); err != nil {
+		return nil, err
+	}
+	return imp, nil
+}
+
+// mailCommand implements "gowiki mail", importing one message from
+// standard input.
+func mailCommand(c context.Context, cfg *Config) error {
+	g := &MailGateway{Allowed: strings.Split(cfg.MailAllow, ",")}
+	imp, err := g.Import(c, os.Stdin)
+	if err != nil {
+		return err
+	}
+	verb := "updated"
+	switch {
+	case imp.Pending:
+		verb = "submitted for approval"
+	case imp.Created:
+		verb = "created"
+	}
+	fmt.Fprintf(os.Stdout, "%s %s\n", verb, imp.Title)
+	return nil
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Markdown renderer supports the commonly used subset of the
+// syntax: ATX headings, paragraphs, flat bullet and numbered lists,
+// block quotes, fenced code blocks, horizontal rules, and inline code,
+// emphasis, links, images and autolinks, plus [[Title]] and
+// [[Title|label]] links between wiki pages and references to the
+// configured issue trackers. Fenced code is highlighted for the
+// languages in syntaxes, ```csv blocks become tables, ```chart blocks
+// become SVG charts, ```form blocks become forms, and {{embed ...}} lines include code from the
+// configured repositories. Links and images may refer to files attached
+// to the page as attachment:{name}. Raw HTML is not supported;
+// all text is escaped, so the output is safe to embed as is.
+
+type blockKind int
+
+const (
+	paragraphBlock blockKind = iota
+	headingBlock
+	codeBlock
+	listBlock
+	quoteBlock
+	ruleBlock
+	embedBlock
+)
+
+type mdBlock struct {
+	kind    blockKind
+	level   int
+	ordered bool
+	start   int
+	info    string
+	args    string
+	lines   []string
+	items   [][]string
+	id      string
+}
+
+var (
+	fencePattern = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)([^`]*)")
+	rulePattern  = regexp.MustCompile(`^ {0,3}((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	itemPattern  = regexp.MustCompile(`^ {0,3}([-*+]|(\d{1,9})[.)])(\s+|$)`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// listItem reports whether line starts a list item and returns the
+// item text, whether the list is numbered and the item number.
+func listItem(line string) (text string, ordered bool, n int, ok bool) {
+	m := itemPattern.FindStringSubmatch(line)
+	if m == nil {
+		return "", false, 0, false
+	}
+	if m[2] != "" {
+		n, _ = strconv.Atoi(m[2])
+		ordered = true
+	}
+	return line[len(m[0]):], ordered, n, true
+}
+
+// parseBlocks splits Markdown source lines into blocks.
+func parseBlocks(lines []string) []mdBlock {
+	var blocks []mdBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case isBlank(line):
+			i++
+
+		case fencePattern.MatchString(line):
+			m := fencePattern.FindStringSubmatch(line)
+			fence := m[1]
+			b := mdBlock{kind: codeBlock, info: m[2], args: strings.TrimSpace(m[3])}
+			i++
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				b.lines = append(b.lines, lines[i])
+				i++
+			}
+			i++ // closing fence
+			blocks = append(blocks, b)
+
+		case embedPattern.MatchString(line):
+			blocks = append(blocks, mdBlock{kind: embedBlock, lines: []string{line}})
+			i++
+
+		case rulePattern.MatchString(line):
+			blocks = append(blocks, mdBlock{kind: ruleBlock})
+			i++
+
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			var quoted []string
+			for i < len(lines) && strings.HasPrefix(strings.TrimLeft(lines[i], " "), ">") {
+				l := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+				quoted = append(quoted, strings.TrimPrefix(l, " "))
+				i++
+			}
+			blocks = append(blocks, mdBlock{kind: quoteBlock, lines: quoted})
+
+		default:
+			if level, text := parseHeading(line); level > 0 {
+				blocks = append(blocks, mdBlock{kind: headingBlock, level: level, lines: []string{text}})
+				i++
+				continue
+			}
+			if _, ordered, n, ok := listItem(line); ok {
+				b := mdBlock{kind: listBlock, ordered: ordered, start: n}
+				for i < len(lines) {
+					text, o, _, ok := listItem(lines[i])
+					if ok && o == b.ordered {
+						b.items = append(b.items, []string{text})
+					} else if !ok && len(b.items) > 0 && !isBlank(lines[i]) && strings.HasPrefix(lines[i], " ") {
+						last := len(b.items) - 1
+						b.items[last] = append(b.items[last], strings.TrimSpace(lines[i]))
+					} else {
+						break
+					}
+					i++
+				}
+				blocks = append(blocks, b)
+				continue
+			}
+
+			b := mdBlock{kind: paragraphBlock}
+			for i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]) {
+				b.lines = append(b.lines, lines[i])
+				i++
+			}
+			if len(b.lines) == 0 {
+				// A line that starts a block but was not parsed as one,
+				// e.g. a numbered item interrupting a bullet list.
+				b.lines = append(b.lines, lines[i])
+				i++
+			}
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	if level, _ := parseHeading(line); level > 0 {
+		return true
+	}
+	if _, _, _, ok := listItem(line); ok {
+		return true
+	}
+	return fencePattern.MatchString(line) || rulePattern.MatchString(line) || embedPattern.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+func splitLines(body []byte) []string {
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	return strings.Split(text, "\n")
+}
+
+// renderBlocks writes the HTML for blocks to b.
+func renderBlocks(b *strings.Builder, blocks []mdBlock, links *wikiLinks) {
+	for _, blk := range blocks {
+		switch blk.kind {
+		case headingBlock:
+			// Page titles are h1, so body headings start one level below.
+			level := blk.level + 1
+			if level > 6 {
+				level = 6
+			}
+			tag := "h" + strconv.Itoa(level)
+			b.WriteString("<" + tag)
+			if blk.id != "" {
+				b.WriteString(` id="` + template.HTMLEscapeString(blk.id) + `"`)
+			}
+			b.WriteString(">")
+			renderInline(b, blk.lines[0], links)
+			b.WriteString("</" + tag + ">\n")
+
+		case paragraphBlock:
+			b.WriteString("<p>")
+			for i, line := range blk.lines {
+				if i > 0 {
+					if strings.HasSuffix(blk.lines[i-1], "  ") {
+						b.WriteString("<br>")
+					}
+					b.WriteString("\n")
+				}
+				renderInline(b, strings.TrimSpace(line), links)
+			}
+			b.WriteString("</p>\n")
+
+		case codeBlock:
+			if blk.info == "csv" {
+				renderCSVTable(b, blk)
+				continue
+			}
+			if blk.info == "chart" {
+				renderChart(b, blk)
+				continue
+			}
+			if blk.info == "form" {
+				renderForm(b, blk)
+				continue
+			}
+			b.WriteString("<pre><code")
+			if blk.info != "" {
+				b.WriteString(` class="language-` + template.HTMLEscapeString(blk.info) + `"`)
+			}
+			b.WriteString(">")
+			if len(blk.lines) > 0 {
+				highlightCode(b, strings.Join(blk.lines, "\n")+"\n", blk.info)
+			}
+			b.WriteString("</code></pre>\n")
+
+		case listBlock:
+			if blk.ordered {
+				b.WriteString("<ol")
+				if blk.start != 1 {
+					b.WriteString(` start="` + strconv.Itoa(blk.start) + `"`)
+				}
+				b.WriteString(">\n")
+			} else {
+				b.WriteString("<ul>\n")
+			}
+			for _, item := range blk.items {
+				b.WriteString("<li>")
+				renderInline(b, strings.Join(item, " "), links)
+				b.WriteString("</li>\n")
+			}
+			if blk.ordered {
+				b.WriteString("</ol>\n")
+			} else {
+				b.WriteString("</ul>\n")
+			}
+
+		case quoteBlock:
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, parseBlocks(blk.lines), links)
+			b.WriteString("</blockquote>\n")
+
+		case ruleBlock:
+			b.WriteString("<hr>\n")
+
+		case embedBlock:
+			renderEmbed(b, blk.lines[0], links.app.repos)
+		}
+	}
+}
+
+// safeURL returns url if it is relative or uses a harmless scheme, and
+// an empty string otherwise, so that links cannot run scripts.
+func safeURL(url string) string {
+	url = strings.TrimSpace(url)
+	i := strings.IndexAny(url, ":/?#")
+	if i < 0 || url[i] != ':' {
+		return url
+	}
+	switch strings.ToLower(url[:i]) {
+	case "http", "https", "mailto":
+		return url
+	}
+	return ""
+}
+
+// findClosing returns the index in s of the bracket closing the one
+// just before s, honouring nesting, or -1.
+func findClosing(s string, open, close byte) int {
+	depth := 1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseLink parses "[text](url)" at the start of s and returns the
+// parts and the length consumed, or ok false.
+func parseLink(s string) (text, url string, n int, ok bool) {
+	if !strings.HasPrefix(s, "[") {
+		return "", "", 0, false
+	}
+	end := findClosing(s[1:], '[', ']')
+	if end < 0 || 2+end >= len(s) || s[2+end] != '(' {
+		return "", "", 0, false
+	}
+	text = s[1 : 1+end]
+	rest := s[3+end:]
+	close := findClosing(rest, '(', ')')
+	if close < 0 {
+		return "", "", 0, false
+	}
+	url = strings.TrimSpace(rest[:close])
+	// Drop an optional title: [text](url "title").
+	if j := strings.IndexAny(url, " \t"); j >= 0 {
+		url = url[:j]
+	}
+	return text, strings.Trim(url, "<>"), 3 + end + close + 1, true
+}
+
+var autolinkPattern = regexp.MustCompile(`^<((?:https?|mailto):[^<>\s]+)>`)
+
+const mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// renderInline writes the HTML for inline Markdown in s to b.
+func renderInline(b *strings.Builder, s string, links *wikiLinks) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) >= 0:
+			b.WriteString(template.HTMLEscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			n := 0
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			fence := s[i : i+n]
+			if end := strings.Index(s[i+n:], fence); end >= 0 {
+				b.WriteString("<code>")
+				b.WriteString(template.HTMLEscapeString(strings.TrimSpace(s[i+n : i+n+end])))
+				b.WriteString("</code>")
+				i += n + end + n
+				continue
+			}
+			b.WriteString(fence)
+			i += n
+			continue
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if alt, url, n, ok := parseLink(s[i+1:]); ok {
+				b.WriteString(`<img src="` + template.HTMLEscapeString(links.resolveURL(url)) + `" alt="` + template.HTMLEscapeString(alt) + `">`)
+				i += 1 + n
+				continue
+			}
+
+		case c == '[' && strings.HasPrefix(s[i:], "[["):
+			if m := wikiLinkPattern.FindStringSubmatch(s[i:]); m != nil && links.app.titles.valid(strings.TrimSpace(m[1])) {
+				links.render(b, strings.TrimSpace(m[1]), strings.TrimSpace(m[2]))
+				i += len(m[0])
+				continue
+			}
+
+		case c == '[':
+			if text, url, n, ok := parseLink(s[i:]); ok {
+				b.WriteString(`<a href="` + template.HTMLEscapeString(links.resolveURL(url)) + `">`)
+				inner := *links
+				inner.inLink = true
+				renderInline(b, text, &inner)
+				b.WriteString("</a>")
+				i += n
+				continue
+			}
+
+		case c == '<':
+			// Comments are left out, as they are in HTML.
+			if strings.HasPrefix(s[i:], "<!--") {
+				if end := strings.Index(s[i+4:], "-->"); end >= 0 {
+					i += 4 + end + 3
+					continue
+				}
+			}
+			if m := autolinkPattern.FindStringSubmatch(s[i:]); m != nil {
+				b.WriteString(`<a href="` + template.HTMLEscapeString(m[1]) + `">` + template.HTMLEscapeString(m[1]) + "</a>")
+				i += len(m[0])
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if n := renderEmphasis(b, s, i, links); n > 0 {
+				i += n
+				continue
+			}
+		}
+
+		if !links.inLink {
+			if n := links.app.issues.render(b, s, i); n > 0 {
+				i += n
+				continue
+			}
+		}
+
+		b.WriteString(template.HTMLEscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+// renderEmphasis renders *em*, **strong** and their underscore forms
+// starting at s[i] and returns the length consumed, or 0 if the
+// delimiters do not form emphasis.
+func renderEmphasis(b *strings.Builder, s string, i int, links *wikiLinks) int {
+	c := s[i]
+	n := 1
+	if i+1 < len(s) && s[i+1] == c {
+		n = 2
+	}
+	delim := s[i : i+n]
+	// Opening delimiters must be followed by text, and underscores must
+	// not be inside a word, as in snake_case.
+	if i+n >= len(s) || s[i+n] == ' ' {
+		return 0
+	}
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return 0
+	}
+	end := strings.Index(s[i+n:], delim)
+	for end >= 0 {
+		j := i + n + end
+		closeOK := end > 0 && s[j-1] != ' '
+		if c == '_' && j+n < len(s) && isWordByte(s[j+n]) {
+			closeOK = false
+		}
+		if closeOK {
+			tag := "em"
+			if n == 2 {
+				tag = "strong"
+			}
+			b.WriteString("<" + tag + ">")
+			renderInline(b, s[i+n:j], links)
+			b.WriteString("</" + tag + ">")
+			return j + n - i
+		}
+		next := strings.Index(s[j+1:], delim)
+		if next < 0 {
+			break
+		}
+		end = j + 1 + next - (i + n)
+	}
+	return 0
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// wikiLinkPattern matches [[Title]] and [[Title|label]] at the start of
+// a string.
+var wikiLinkPattern = regexp.MustCompile(`^\[\[([^\[\]|]+)(?:\|([^\[\]]+))?\]\]`)
+
+// wikiLinks resolves [[Title]] links while a body is rendered. Exists
+// holds the linked titles that exist; links to other titles are shown
+// as missing so that readers can create the page.
+type wikiLinks struct {
+	// app is the wiki rendering, whose title policy, issue trackers
+	// and code repositories apply.
+	app    *App
+	Exists map[string]bool
+	Href   func(title string, exists bool) string
+	// Title is the page being rendered, whose attachments are linked
+	// as attachment:{name}.
+	Title string
+
+	// inLink is set while rendering the text of a link, which must
+	// not contain issue links of its own.
+	inLink bool
+}
+
+// linkedTitles returns the titles a body links to with [[...]] that
+// rules allow.
+func linkedTitles(rules *titleRules, body []byte) []string {
+	var titles []string
+	seen := map[string]bool{}
+	text := string(body)
+	for i := strings.Index(text, "[["); i >= 0; i = strings.Index(text, "[[") {
+		text = text[i:]
+		m := wikiLinkPattern.FindStringSubmatch(text)
+		if m == nil {
+			text = text[2:]
+			continue
+		}
+		title := strings.TrimSpace(m[1])
+		if rules.valid(title) && !seen[title] {
+			seen[title] = true
+			titles = append(titles, title)
+		}
+		text = text[len(m[0]):]
+	}
+	return titles
+}
+
+// resolveLinks looks up which of the pages body links to exist.
+func resolveLinks(c context.Context, body []byte, href func(title string, exists bool) string) *wikiLinks {
+	links := &wikiLinks{app: appFrom(c), Exists: map[string]bool{}, Href: href}
+	for _, title := range linkedTitles(links.app.titles, body) {
+		if _, err := loadPage(c, title); err == nil {
+			links.Exists[title] = true
+		}
+	}
+	return links
+}
+
+// viewLink links existing pages to their view and missing pages to the
+// editor, where they can be created.
+func viewLink(title string, exists bool) string {
+	if exists {
+		return pageURL("view", title)
+	}
+	return pageURL("edit", title)
+}
+
+// resolveURL returns the address a Markdown link or image points to,
+// mapping attachment:{name} to the file attached to the page.
+func (l *wikiLinks) resolveURL(u string) string {
+	if name := strings.TrimPrefix(strings.TrimSpace(u), attachmentScheme); name != strings.TrimSpace(u) && l.Title != "" {
+		return l.app.hotlink.fileURL(l.Title, name, time.Now())
+	}
+	return safeURL(u)
+}
+
+func (l *wikiLinks) render(b *strings.Builder, title, label string) {
+	if label == "" {
+		label = title
+	}
+	exists := l.Exists[title]
+	class := "wikilink"
+	if !exists {
+		class += " missing"
+	}
+	b.WriteString(`<a class="` + class + `" href="` + template.HTMLEscapeString(l.Href(title, exists)) + `">`)
+	b.WriteString(template.HTMLEscapeString(label))
+	b.WriteString("</a>")
+}
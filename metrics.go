@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// /metrics serves counters in the Prometheus text format, for scraping
+// into dashboards such as Grafana:
+//
+//	gowiki_http_requests_total{route,method,code}
+//	gowiki_http_request_duration_seconds{route}      histogram
+//	gowiki_store_operation_duration_seconds{op}      histogram
+//	gowiki_store_errors_total{op}
+//	gowiki_mongo_command_duration_seconds{command}   histogram
+//	gowiki_mongo_command_errors_total{command}
+//	gowiki_pages                                     number of pages
+//	gowiki_goroutines
+//	gowiki_start_time_seconds
+//
+// Routes are the patterns of the request multiplexer, such as "/view/",
+// so the number of series stays small however many pages there are.
+
+// metricBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var startTime = time.Now()
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricBuckets))
+	}
+	for i, b := range metricBuckets {
+		if seconds <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type requestKey struct {
+	route, method string
+	code          int
+}
+
+// metrics holds everything /metrics reports that is counted as it
+// happens.
+var metrics = struct {
+	sync.Mutex
+	requests    map[requestKey]uint64
+	latency     map[string]*histogram
+	store       map[string]*histogram
+	storeErrors map[string]uint64
+	mongo       map[string]*histogram
+	mongoErrors map[string]uint64
+}{
+	requests:    map[requestKey]uint64{},
+	latency:     map[string]*histogram{},
+	store:       map[string]*histogram{},
+	storeErrors: map[string]uint64{},
+	mongo:       map[string]*histogram{},
+	mongoErrors: map[string]uint64{},
+}
+
+func observeHistogram(m map[string]*histogram, key string, d time.Duration) {
+	h := m[key]
+	if h == nil {
+		h = &histogram{}
+		m[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeStore is the page store hook recording store operations.
+func observeStore(op string, took time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	observeHistogram(metrics.store, op, took)
+	if err != nil && err != errPageNotFound {
+		metrics.storeErrors[op]++
+	}
+}
+
+// mongoMonitor records the duration of every command sent to MongoDB.
+var mongoMonitor = &event.CommandMonitor{
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		observeMongo(&e.CommandFinishedEvent, false)
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		observeMongo(&e.CommandFinishedEvent, true)
+	},
+}
+
+func observeMongo(e *event.CommandFinishedEvent, failed bool) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	observeHistogram(metrics.mongo, e.CommandName, time.Duration(e.DurationNanos))
+	if failed {
+		metrics.mongoErrors[e.CommandName]++
+	}
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// observeRequests counts the requests served by h and how long they
+// took, labelled with the mux pattern they matched.
+func observeRequests(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(sw, r)
+		took := time.Since(start)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metrics.Lock()
+		metrics.requests[requestKey{route, r.Method, sw.status}]++
+		observeHistogram(metrics.latency, route, took)
+		metrics.Unlock()
+	})
+}
+
+// labelValue escapes a Prometheus label value.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func writeHistogram(w io.Writer, name, label string, m map[string]*histogram) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := m[k]
+		l := label + `="` + labelValue(k) + `"`
+		for i, b := range metricBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, l, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+	}
+}
+
+func writeCounter(w io.Writer, name, label string, m map[string]uint64) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelValue(k), m[k])
+	}
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+// pageCount is the number of pages, or -1 if it could not be found.
+func writeMetrics(w io.Writer, pageCount int) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	fmt.Fprintln(w, "# HELP gowiki_http_requests_total HTTP requests served.")
+	fmt.Fprintln(w, "# TYPE gowiki_http_requests_total counter")
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for k := range metrics.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "gowiki_http_requests_total{route=\"%s\",method=\"%s\",code=\"%d\"} %d\n",
+			labelValue(k.route), labelValue(k.method), k.code, metrics.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP gowiki_http_request_duration_seconds Time taken to serve HTTP requests.")
+	fmt.Fprintln(w, "# TYPE gowiki_http_request_duration_seconds histogram")
+	writeHistogram(w, "gowiki_http_request_duration_seconds", "route", metrics.latency)
+
+	fmt.Fprintln(w, "# HELP gowiki_store_operation_duration_seconds Time taken by page store operations.")
+	fmt.Fprintln(w, "# TYPE gowiki_store_operation_duration_seconds histogram")
+	writeHistogram(w, "gowiki_store_operation_duration_seconds", "op", metrics.store)
+
+	fmt.Fprintln(w, "# HELP gowiki_store_errors_total Page store operations that failed.")
+	fmt.Fprintln(w, "# TYPE gowiki_store_errors_total counter")
+	writeCounter(w, "gowiki_store_errors_total", "op", metrics.storeErrors)
+
+	fmt.Fprintln(w, "# HELP gowiki_mongo_command_duration_seconds Time taken by MongoDB commands.")
+	fmt.Fprintln(w, "# TYPE gowiki_mongo_command_duration_seconds histogram")
+	writeHistogram(w, "gowiki_mongo_command_duration_seconds", "command", metrics.mongo)
+
+	fmt.Fprintln(w, "# HELP gowiki_mongo_command_errors_total MongoDB commands that failed.")
+	fmt.Fprintln(w, "# TYPE gowiki_mongo_command_errors_total counter")
+	writeCounter(w, "gowiki_mongo_command_errors_total", "command", metrics.mongoErrors)
+
+	if pageCount >= 0 {
+		fmt.Fprintln(w, "# HELP gowiki_pages Number of pages.")
+		fmt.Fprintln(w, "# TYPE gowiki_pages gauge")
+		fmt.Fprintf(w, "gowiki_pages %d\n", pageCount)
+	}
+	fmt.Fprintln(w, "# HELP gowiki_goroutines Number of goroutines.")
+	fmt.Fprintln(w, "# TYPE gowiki_goroutines gauge")
+	fmt.Fprintf(w, "gowiki_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP gowiki_start_time_seconds When the process started, in seconds since the epoch.")
+	fmt.Fprintln(w, "# TYPE gowiki_start_time_seconds gauge")
+	fmt.Fprintf(w, "gowiki_start_time_seconds %d\n", startTime.Unix())
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	pageCount := -1
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	if n, err := appFrom(c).pages.Count(c, ListQuery{}); err == nil {
+		pageCount = n
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, pageCount)
+}
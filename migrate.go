@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration backfills a field on page documents written by older
+// versions of the wiki. Filter selects the documents missing it and
+// Update is applied to each of them. Values MongoDB cannot compute
+// itself are set by Each instead, which returns the fields to set on
+// one page.
+type Migration struct {
+	Name   string
+	Filter bson.D
+	Update interface{}
+	Each   func(p *Page) bson.D
+}
+
+func missing(field string) bson.D {
+	return bson.D{primitive.E{Key: field, Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+}
+
+// migrations are run in order by the migrate command. Each must be safe
+// to run again on already migrated documents.
+var migrations = []Migration{
+	{
+		Name:   "updated timestamp from document creation time",
+		Filter: missing("updated"),
+		Update: mongo.Pipeline{
+			{{Key: "$set", Value: bson.D{{Key: "updated", Value: bson.D{{Key: "$toDate", Value: "$_id"}}}}}},
+		},
+	},
+	{
+		Name:   "empty language",
+		Filter: missing("lang"),
+		Update: bson.D{{Key: "$set", Value: bson.D{{Key: "lang", Value: ""}}}},
+	},
+	{
+		Name:   "empty owner and reviewer",
+		Filter: missing("owner"),
+		Update: bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: ""}, {Key: "reviewer", Value: ""}}}},
+	},
+	{
+		Name:   "search text from body",
+		Filter: missing("text"),
+		Each: func(p *Page) bson.D {
+			return bson.D{{Key: "text", Value: string(p.Body)}}
+		},
+	},
+}
+
+// updateEach applies m.Each to every document matching m.Filter.
+func updateEach(c context.Context, m Migration) (int64, error) {
+	cur, err := appFrom(c).db.pages.Find(c, m.Filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(c)
+	var n int64
+	for cur.Next(c) {
+		var doc struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Page `bson:",inline"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return n, err
+		}
+		_, err := appFrom(c).db.pages.UpdateOne(c,
+			bson.D{primitive.E{Key: "_id", Value: doc.ID}},
+			bson.D{primitive.E{Key: "$set", Value: m.Each(&doc.Page)}},
+		)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, cur.Err()
+}
+
+// runMigrations applies every migration to the pages collection, records
+// missing checksums, moves pages to the stores they are routed to and
+// rebuilds the link graph, reporting progress to out. With dryRun
+// set it only counts the documents each migration would change.
+func runMigrations(c context.Context, out io.Writer, dryRun bool) error {
+	for i, m := range migrations {
+		n, err := appFrom(c).db.pages.CountDocuments(c, m.Filter)
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.Name, err)
+		}
+		fmt.Fprintf(out, "[%d/%d] %s: %d documents to update\n", i+1, len(migrations), m.Name, n)
+		if dryRun || n == 0 {
+			continue
+		}
+		var updated int64
+		if m.Each != nil {
+			updated, err = updateEach(c, m)
+		} else {
+			var res *mongo.UpdateResult
+			res, err = appFrom(c).db.pages.UpdateMany(c, m.Filter, m.Update)
+			if err == nil {
+				updated = res.ModifiedCount
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.Name, err)
+		}
+		fmt.Fprintf(out, "[%d/%d] %s: updated %d documents\n", i+1, len(migrations), m.Name, updated)
+	}
+	if err := recordChecksums(c, out, dryRun); err != nil {
+		return err
+	}
+	if err := relocatePages(c, out, dryRun); err != nil {
+		return err
+	}
+	return rebuildLinks(c, out, dryRun)
+}
+
+// migrateCommand implements "gowiki migrate [-dry-run]".
+func migrateCommand(c context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be changed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintln(os.Stdout, "dry run, nothing will be written")
+	}
+	return runMigrations(c, os.Stdout, *dryRun)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Moving a page gives it a new title. Its history, attachments, pending
+// edit and place on watchlists go with it, and the old title redirects
+// to the new one until a page is created there again. Links to the old
+// title in other pages can be rewritten as part of the move, each page
+// changed getting a revision of its own; in protected namespaces the
+// change waits for approval like any other edit. Pages under legal hold
+// cannot be moved, as that would remove them from their title, and only
+// admins move pages into or out of protected namespaces, which would
+// publish or unpublish them without review.
+
+// MoveForm is the data of the move page.
+type MoveForm struct {
+	To    string
+	Links bool
+	Error string
+	// Hold is the legal hold keeping the page from being moved.
+	Hold *LegalHold
+}
+
+// movePage renames the page called from to to and carries everything
+// kept by title along. With links set, [[from]] links in the pages u
+// can read are rewritten; the titles of the pages saved and of those
+// whose change waits for approval are returned.
+func movePage(c context.Context, from, to string, u *User, links bool) (changed, pending []string, err error) {
+	author := ""
+	if u != nil {
+		author = u.Name
+	}
+	hold, err := legalHoldOn(c, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hold != nil {
+		return nil, nil, errLegalHold
+	}
+	if moveNeedsAdmin(c, from, to) && !u.Can(roleAdmin) {
+		return nil, nil, errProtectedMove
+	}
+	if err := appFrom(c).pages.Rename(c, from, to); err != nil {
+		return nil, nil, err
+	}
+	p, err := loadPage(c, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := removeLinks(c, from); err != nil {
+		return nil, nil, err
+	}
+	if err := updateLinks(c, p); err != nil {
+		return nil, nil, err
+	}
+
+	set := func(field string) bson.D {
+		return bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: field, Value: to}}}}
+	}
+	if _, err := appFrom(c).db.revisions.UpdateMany(c, bson.D{primitive.E{Key: "title", Value: from}}, set("title")); err != nil {
+		return nil, nil, err
+	}
+	if _, err := appFrom(c).db.pending.UpdateMany(c, bson.D{primitive.E{Key: "page.title", Value: from}}, set("page.title")); err != nil {
+		return nil, nil, err
+	}
+	if _, err := appFrom(c).db.Collection("attachments.files").UpdateMany(c, bson.D{primitive.E{Key: "metadata.title", Value: from}}, set("metadata.title")); err != nil {
+		return nil, nil, err
+	}
+	if _, err := appFrom(c).db.watchlists.UpdateMany(c, bson.D{primitive.E{Key: "pages", Value: from}}, set("pages.$")); err != nil {
+		return nil, nil, err
+	}
+	if err := redirectMovedPage(c, from, to); err != nil {
+		return nil, nil, err
+	}
+	if err := recordEvent(c, eventMoved, to, author, "Moved from "+from); err != nil {
+		return nil, nil, err
+	}
+	if !links {
+		return nil, nil, nil
+	}
+	return rewriteLinksTo(c, from, to, u, author)
+}
+
+// errProtectedMove is returned when someone other than an admin moves a
+// page into or out of a protected namespace.
+var errProtectedMove = errors.New("only admins move pages into or out of protected namespaces")
+
+// moveNeedsAdmin reports whether moving from to to takes a page into or
+// out of a protected namespace. Moves within one need no admin, as the
+// page stays under review.
+func moveNeedsAdmin(c context.Context, from, to string) bool {
+	return isProtected(c, from) != isProtected(c, to)
+}
+
+// redirectMovedPage redirects the old title of a moved page to the new
+// one. Redirects to the old title are pointed at the new one, so they
+// do not chain, and a redirect away from the new title, left by moving
+// the page from there before, is removed.
+func redirectMovedPage(c context.Context, from, to string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	source, target := "/view/"+from, pageURL("view", to)
+	_, err := appFrom(c).db.redirects.DeleteMany(c, bson.D{
+		primitive.E{Key: "pattern", Value: false},
+		primitive.E{Key: "source", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{source, "/view/" + to}}}},
+	})
+	if err == nil {
+		_, err = appFrom(c).db.redirects.UpdateMany(c,
+			bson.D{
+				primitive.E{Key: "pattern", Value: false},
+				primitive.E{Key: "target", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{source, pageURL("view", from)}}}},
+			},
+			bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "target", Value: target}}}})
+	}
+	if err == nil {
+		err = addRedirect(c, &Redirect{Source: source, Target: target})
+	}
+	invalidateRedirectRules()
+	return err
+}
+
+// rewriteLinksTo saves a new revision of every page u can read that
+// links to from, linking to to instead, and returns their titles.
+// Protected pages are submitted for approval instead and their titles
+// returned as pending.
+func rewriteLinksTo(c context.Context, from, to string, u *User, author string) (changed, pending []string, err error) {
+	return rewritePages(c, u, author, "Links to "+from+" moved to "+to, func(title string, body []byte) []byte {
+		return rewriteLinks(body, from, to)
+	})
+}
+
+// rewritePages saves a new revision, described by summary, of every
+// page u can read whose body rewrite changes, and returns their titles.
+// rewrite is given the title and body of each page and returns nil for
+// those it leaves alone. Protected pages are
+// submitted for approval instead and their titles returned as pending.
+func rewritePages(c context.Context, u *User, author, summary string, rewrite func(title string, body []byte) []byte) (changed, pending []string, err error) {
+	titles, err := listPages(c, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed, pending = []string{}, []string{}
+	for _, title := range readableTitles(c, u, titles) {
+		p, err := loadPage(c, title)
+		if err != nil {
+			continue
+		}
+		var pe *PendingEdit
+		if isProtected(c, title) {
+			pe, _ = loadPendingEdit(c, title)
+		}
+		p, by, review := rewrittenPage(c, p, pe, author, rewrite)
+		switch {
+		case p == nil:
+			continue
+		case review:
+			if err := submitPendingEdit(c, p, by); err != nil {
+				return changed, pending, err
+			}
+			pending = append(pending, title)
+			continue
+		}
+		if err := commitRevision(c, p, by); err != nil {
+			return changed, pending, err
+		}
+		if err := recordEvent(c, eventSaved, title, by, summary); err != nil {
+			return changed, pending, err
+		}
+		changed = append(changed, title)
+	}
+	return changed, pending, nil
+}
+
+// rewrittenPage returns p with its body changed by rewrite, and who the
+// change is by, or nil if rewrite finds nothing to change and returns
+// nil. review is set if the page is protected, so the change must be
+// approved. pe is the pending edit of a protected page, if any: it is
+// rewritten rather than p, so that it is not lost, and it stays its
+// author's.
+func rewrittenPage(c context.Context, p *Page, pe *PendingEdit, author string, rewrite func(title string, body []byte) []byte) (rewritten *Page, by string, review bool) {
+	review = isProtected(c, p.Title)
+	by = author
+	if review && pe != nil {
+		page := pe.Page
+		p, by = &page, pe.Author
+	}
+	body := rewrite(p.Title, p.Body)
+	if body == nil {
+		return nil, "", false
+	}
+	p.Body = body
+	return p, by, review
+}
+
+// rewriteLinks returns body with [[from]] and [[from|label]] links
+// pointing at to, keeping their labels, or nil if it has none.
+func rewriteLinks(body []byte, from, to string) []byte {
+	var b strings.Builder
+	found := false
+	text := string(body)
+	for i := strings.Index(text, "[["); i >= 0; i = strings.Index(text, "[[") {
+		b.WriteString(text[:i])
+		text = text[i:]
+		m := wikiLinkPattern.FindStringSubmatch(text)
+		if m == nil || strings.TrimSpace(m[1]) != from {
+			b.WriteString("[[")
+			text = text[2:]
+			continue
+		}
+		found = true
+		b.WriteString("[[" + to)
+		if m[2] != "" {
+			b.WriteString("|" + m[2])
+		}
+		b.WriteString("]]")
+		text = text[len(m[0]):]
+	}
+	if !found {
+		return nil
+	}
+	b.WriteString(text)
+	return []byte(b.String())
+}
+
+// moveHandler shows the move form on GET and moves the page on POST.
+func moveHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	form := &MoveForm{To: title, Links: true}
+	if form.Hold, err = legalHoldOn(r.Context(), title); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		renderTemplate(w, r, "move", p, form)
+		return
+	}
+
+	form.To = strings.TrimSpace(r.FormValue("to"))
+	form.Links = r.FormValue("links") != ""
+	u := currentUser(r)
+	switch {
+	case !validTitle(r.Context(), form.To):
+		form.Error = "That is not a valid title."
+	case form.To == title:
+		form.Error = "The page already has that title."
+	case !canRead(r.Context(), u, form.To):
+		form.Error = "You cannot move pages to " + form.To + "."
+	case moveNeedsAdmin(r.Context(), title, form.To) && !u.Can(roleAdmin):
+		form.Error = "Only admins move pages into or out of protected namespaces, as that is not reviewed."
+	}
+	if form.Error != "" {
+		renderTemplate(w, r, "move", p, form)
+		return
+	}
+
+	changed, pending, err := movePage(r.Context(), title, form.To, u, form.Links)
+	switch err {
+	case nil:
+	case errLegalHold:
+		http.Error(w, "the page is under legal hold and cannot be moved", http.StatusForbidden)
+		return
+	case errProtectedMove:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errPageExists:
+		form.Error = "A page called " + form.To + " already exists."
+		renderTemplate(w, r, "move", p, form)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg := "Moved " + title + " to " + form.To + "."
+	if len(changed) > 0 {
+		msg += " Updated the links in " + strconv.Itoa(len(changed)) + " pages."
+	}
+	if len(pending) > 0 {
+		msg += " The links in " + strconv.Itoa(len(pending)) + " protected pages wait for approval."
+	}
+	addFlash(w, r, msg)
+	http.Redirect(w, r, pageURL("view", form.To), http.StatusSeeOther)
+}
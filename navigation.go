@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"strings"
+)
+
+// sidebarTitle is the page whose content is rendered as the site menu.
+// A namespace can override it with its own "<namespace>/Sidebar" page.
+const sidebarTitle = "Sidebar"
+
+// headerTitle and footerTitle are pages rendered above and below every
+// viewed page. Namespaces can override them like the sidebar.
+const (
+	headerTitle = "Header"
+	footerTitle = "Footer"
+)
+
+// Crumb is a single breadcrumb entry.
+type Crumb struct {
+	Title string
+	Label string
+}
+
+// breadcrumbs derives the trail of parent namespaces for a title,
+// e.g. "Team/Docs/Setup" yields Team, Team/Docs and Team/Docs/Setup.
+func breadcrumbs(title string) []Crumb {
+	parts := strings.Split(title, "/")
+	crumbs := make([]Crumb, 0, len(parts))
+	for i, part := range parts {
+		crumbs = append(crumbs, Crumb{
+			Title: strings.Join(parts[:i+1], "/"),
+			Label: part,
+		})
+	}
+	return crumbs
+}
+
+// namespaceOf returns everything before the last "/" of a title,
+// or an empty string for top level pages.
+func namespaceOf(title string) string {
+	i := strings.LastIndex(title, "/")
+	if i < 0 {
+		return ""
+	}
+	return title[:i]
+}
+
+// loadNearest finds the page called name closest to title, walking up
+// the namespaces before falling back to the top level page. It is used
+// for pages like Sidebar that namespaces can override.
+func loadNearest(c context.Context, title, name string) (*Page, error) {
+	for ns := namespaceOf(title); ns != ""; ns = namespaceOf(ns) {
+		p, err := loadPage(c, ns+"/"+name)
+		if err == nil {
+			return p, nil
+		}
+	}
+	return loadPage(c, name)
+}
+
+// renderSidebar renders the sidebar page as a menu. Every non-empty
+// line of the page is a link to the page of the same title; text after
+// a "|" is used as the link label instead.
+func renderSidebar(c context.Context, title string) template.HTML {
+	p, err := loadNearest(c, title, sidebarTitle)
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("<ul>")
+	for _, e := range sidebarEntries(p.Body) {
+		b.WriteString(`<li><a href="`)
+		b.WriteString(template.HTMLEscapeString(pageURL("view", e.Title)))
+		b.WriteString(`">`)
+		b.WriteString(template.HTMLEscapeString(e.Label))
+		b.WriteString("</a></li>")
+	}
+	b.WriteString("</ul>")
+
+	return template.HTML(b.String())
+}
+
+// sidebarEntries returns the pages a sidebar links to with their labels.
+func sidebarEntries(body []byte) []Crumb {
+	var entries []Crumb
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		target, label := line, line
+		if i := strings.Index(line, "|"); i >= 0 {
+			target = strings.TrimSpace(line[:i])
+			label = strings.TrimSpace(line[i+1:])
+		}
+		entries = append(entries, Crumb{Title: target, Label: label})
+	}
+	return entries
+}
+
+// renderSnippet renders the nearest page called name for title, or
+// nothing if there is none. The snippet page itself is not decorated
+// with its own content.
+func renderSnippet(c context.Context, title, name string) template.HTML {
+	p, err := loadNearest(c, title, name)
+	if err != nil || p.Title == title {
+		return ""
+	}
+	return renderBody(c, p.Title, p.Body)
+}
+
+func renderHeader(c context.Context, title string) template.HTML {
+	return renderSnippet(c, title, headerTitle)
+}
+
+func renderFooter(c context.Context, title string) template.HTML {
+	return renderSnippet(c, title, footerTitle)
+}
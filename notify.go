@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyTimeout bounds the time spent delivering one announcement.
+const notifyTimeout = 30 * time.Second
+
+// Notifier announces page changes to a chat.
+type Notifier interface {
+	Notify(ctx context.Context, text string) error
+}
+
+// Announcer sends the events of some namespaces to a Notifier. An empty
+// Namespaces list announces changes to all pages.
+type Announcer struct {
+	Name       string
+	Notifier   Notifier
+	Namespaces []string
+}
+
+// announcing tracks deliveries still in flight.
+var announcing sync.WaitGroup
+
+// splitList splits a comma separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// newAnnouncers returns the announcers configured in cfg.
+func newAnnouncers(cfg *Config) ([]*Announcer, error) {
+	var list []*Announcer
+	if cfg.TelegramToken != "" || cfg.TelegramChat != "" {
+		if cfg.TelegramToken == "" || cfg.TelegramChat == "" {
+			return nil, fmt.Errorf("telegram needs both a bot token and a chat")
+		}
+		list = append(list, &Announcer{
+			Name:       "telegram",
+			Notifier:   &telegramNotifier{token: cfg.TelegramToken, chat: cfg.TelegramChat},
+			Namespaces: splitList(cfg.TelegramNamespaces),
+		})
+	}
+	if cfg.IRCServer != "" || cfg.IRCChannel != "" {
+		if cfg.IRCServer == "" || cfg.IRCChannel == "" {
+			return nil, fmt.Errorf("irc needs both a server and a channel")
+		}
+		list = append(list, &Announcer{
+			Name:       "irc",
+			Notifier:   &ircNotifier{server: cfg.IRCServer, channel: cfg.IRCChannel, nick: cfg.IRCNick, tls: cfg.IRCTLS},
+			Namespaces: splitList(cfg.IRCNamespaces),
+		})
+	}
+	return list, nil
+}
+
+// wants reports whether a announces changes to title.
+func (a *Announcer) wants(title string) bool {
+	if len(a.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range a.Namespaces {
+		if title == ns || strings.HasPrefix(title, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// eventText describes an event in one line, linking to the page from
+// base, the public address of the wiki, unless it is empty.
+func eventText(e *Event, base string) string {
+	verb := strings.TrimPrefix(e.Kind, "page.")
+	text := fmt.Sprintf("[%s] %s %s", site.Name, e.Title, verb)
+	if e.Author != "" {
+		text += " by " + e.Author
+	}
+	if e.Summary != "" {
+		text += ": " + e.Summary
+	}
+	if base != "" && e.Kind != eventDeleted {
+		text += " " + strings.TrimRight(base, "/") + pageURL("view", e.Title)
+	}
+	return text
+}
+
+// announce sends e to every interested announcer of the wiki c belongs
+// to in the background. Delivery failures are logged and do not affect
+// the change itself.
+func announce(c context.Context, e *Event) {
+	app := appFrom(c)
+	for _, a := range app.announcers {
+		if !a.wants(e.Title) {
+			continue
+		}
+		announcing.Add(1)
+		go func(a *Announcer) {
+			defer announcing.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := a.Notifier.Notify(ctx, eventText(e, app.cfg.BaseURL)); err != nil {
+				log.Printf("announcing %s of %s to %s: %v", e.Kind, e.Title, a.Name, err)
+			}
+		}(a)
+	}
+}
+
+// telegramNotifier posts messages through the Telegram Bot API.
+type telegramNotifier struct {
+	token string
+	chat  string
+}
+
+func (t *telegramNotifier) Notify(ctx context.Context, text string) error {
+	var res struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	endpoint := "https://api.telegram.org/bot" + url.PathEscape(t.token) + "/sendMessage"
+	err := postJSON(ctx, endpoint, map[string]interface{}{
+		"chat_id":                  t.chat,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("telegram: %s", res.Description)
+	}
+	return nil
+}
+
+// ircNotifier connects to an IRC server for each message, joins the
+// channel, says the message and quits. This keeps no connection open
+// between changes, at the cost of a join and part per announcement.
+type ircNotifier struct {
+	server  string
+	channel string
+	nick    string
+	tls     bool
+}
+
+func (n *ircNotifier) Notify(ctx context.Context, text string) error {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if n.tls {
+		host, _, _ := net.SplitHostPort(n.server)
+		conn, err = tls.DialWithDialer(&d, "tcp", n.server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", n.server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	nick := n.nick
+	if nick == "" {
+		nick = "gowiki"
+	}
+	fmt.Fprintf(conn, "NICK %s\r\nUSER %s 0 * :%s\r\n", nick, nick, site.Name)
+
+	// Wait for the welcome message before joining; answer pings meanwhile.
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "PING" {
+			fmt.Fprintf(conn, "PONG %s\r\n", strings.Join(fields[1:], " "))
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "001" {
+			break
+		}
+		if len(fields) > 1 && fields[1] == "433" {
+			return fmt.Errorf("irc: nick %s is in use", nick)
+		}
+	}
+
+	text = strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+	_, err = fmt.Fprintf(conn, "JOIN %s\r\nPRIVMSG %s :%s\r\nQUIT\r\n", n.channel, n.channel, text)
+	return err
+}
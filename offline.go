@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OfflinePage is the data the offline bundle templates are executed with.
+type OfflinePage struct {
+	Site  *SiteInfo
+	Page  *Page
+	Pages []OfflineEntry
+}
+
+// OfflineEntry is a page as listed in the bundle index and search index.
+type OfflineEntry struct {
+	Title string `json:"t"`
+	File  string `json:"f"`
+	Text  string `json:"x"`
+}
+
+// offlineAssets are copied from staticFiles into the bundle's assets folder.
+var offlineAssets = []string{"wiki.css", "offline-search.js"}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "OfflineBundle",
+		Description: "Download the whole wiki as HTML with a search index, for reading without a connection.",
+		Handler:     offlineBundleHandler,
+	})
+}
+
+// forEachPage calls fn for every page in title order.
+func forEachPage(c context.Context, fn func(*Page) error) error {
+	if !appFrom(c).pagesInMongo() {
+		return scanPages(c, nil, fn)
+	}
+	cur, err := appFrom(c).db.pages.Find(c, bson.D{}, options.Find().SetSort(bson.D{{Key: "title", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(c)
+	for cur.Next(c) {
+		var p Page
+		if err := cur.Decode(&p); err != nil {
+			return err
+		}
+		if err := fn(&p); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// offlineLink points wiki links in the bundle at the linked page's
+// file, next to the linking page. Pages missing from the bundle are
+// linked anyway so the link text stays visible.
+func offlineLink(title string, exists bool) string {
+	return strings.TrimPrefix(offlineFileName(title), "pages/")
+}
+
+// renderOffline renders a body for the offline bundle.
+func renderOffline(c context.Context, title string, body []byte) template.HTML {
+	return renderBodyLinks(c, title, body, offlineLink)
+}
+
+// offlineFileName maps a title to a flat file name in the bundle, so
+// that pages can link to each other without knowing their depth.
+func offlineFileName(title string) string {
+	return "pages/" + strings.ReplaceAll(title, "/", "__") + ".html"
+}
+
+// writeOfflineBundle writes a zip archive of the pages u, nil for a
+// visitor who is not signed in, may read, which can be read in a
+// browser straight from disk: one HTML file per page, an index with a
+// client-side search, and the stylesheets it needs.
+func writeOfflineBundle(c context.Context, zw *zip.Writer, u *User) error {
+	a := appFrom(c)
+	entries := []OfflineEntry{}
+	err := forEachPage(c, func(p *Page) error {
+		if !canRead(c, u, p.Title) {
+			return nil
+		}
+		entry := OfflineEntry{
+			Title: p.Title,
+			File:  offlineFileName(p.Title),
+			Text:  strings.Join(strings.Fields(string(p.Body)), " "),
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Deflate, Modified: p.Updated})
+		if err != nil {
+			return err
+		}
+		err = a.templates.ExecuteTemplate(f, "offline_page.html", &OfflinePage{Site: site, Page: p})
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := zw.Create("index.html")
+	if err != nil {
+		return err
+	}
+	err = a.templates.ExecuteTemplate(f, "offline_index.html", &OfflinePage{Site: site, Pages: entries})
+	if err != nil {
+		return err
+	}
+
+	// The index is a script rather than JSON because browsers do not let
+	// pages opened from disk fetch other files.
+	f, err = zw.Create("assets/search-index.js")
+	if err != nil {
+		return err
+	}
+	index, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "var SEARCH_INDEX = %s;\n", index); err != nil {
+		return err
+	}
+
+	for _, name := range offlineAssets {
+		data, err := fs.ReadFile(a.static, name)
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create("assets/" + name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func offlineBundleHandler(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("%s-offline-%s.zip", site.Name, time.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	zw := zip.NewWriter(w)
+	if err := writeOfflineBundle(r.Context(), zw, currentUser(r)); err != nil {
+		// Headers are already sent, so the best we can do is to leave
+		// a truncated archive that fails to open.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// staleAfter is how long a page may go without edits before it is
+// reported to its owner as stale.
+const staleAfter = 180 * 24 * time.Hour
+
+// recentlyChanged is the period for which edits are reported to owners.
+const recentlyChanged = 7 * 24 * time.Hour
+
+// OwnerDigest lists the pages owned or reviewed by someone that need
+// their attention.
+type OwnerDigest struct {
+	Owner   string
+	Changed []Page
+	Stale   []Page
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "OwnedPages",
+		Description: "Pages an owner or reviewer should look at: recent changes and stale content.",
+		Handler:     ownedPagesHandler,
+	})
+}
+
+// ownedPages returns pages owned or reviewed by owner matching filter
+// that u may read.
+func ownedPages(c context.Context, owner string, u *User, filter bson.D) ([]Page, error) {
+	filter = append(filter, readFilter(c, u, "title")...)
+	filter = append(filter, primitive.E{Key: "$or", Value: bson.A{
+		bson.D{primitive.E{Key: "owner", Value: owner}},
+		bson.D{primitive.E{Key: "reviewer", Value: owner}},
+	}})
+	opts := options.Find().
+		SetProjection(withoutBody).
+		SetSort(bson.D{{Key: "updated", Value: -1}})
+
+	cur, err := appFrom(c).db.pages.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	pages := []Page{}
+	err = cur.All(c, &pages)
+	return pages, err
+}
+
+// ownerDigest collects the pages owned by owner that changed recently
+// or have not been touched for a long time, of those u may read, most
+// recently changed first.
+func ownerDigest(c context.Context, owner string, u *User, now time.Time) (*OwnerDigest, error) {
+	d := &OwnerDigest{Owner: owner}
+	if !appFrom(c).pagesInMongo() {
+		d.Changed, d.Stale = []Page{}, []Page{}
+		err := scanPages(c, hiddenNamespaces(c, u), func(p *Page) error {
+			if p.Owner != owner && p.Reviewer != owner {
+				return nil
+			}
+			p.Body = nil
+			switch {
+			case !p.Updated.Before(now.Add(-recentlyChanged)):
+				d.Changed = append(d.Changed, *p)
+			case p.Updated.Before(now.Add(-staleAfter)):
+				d.Stale = append(d.Stale, *p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range [][]Page{d.Changed, d.Stale} {
+			list := list
+			sort.SliceStable(list, func(i, j int) bool { return list[i].Updated.After(list[j].Updated) })
+		}
+		return d, nil
+	}
+
+	var err error
+
+	d.Changed, err = ownedPages(c, owner, u, bson.D{primitive.E{Key: "updated", Value: bson.D{
+		primitive.E{Key: "$gte", Value: now.Add(-recentlyChanged)},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+
+	d.Stale, err = ownedPages(c, owner, u, bson.D{primitive.E{Key: "updated", Value: bson.D{
+		primitive.E{Key: "$lt", Value: now.Add(-staleAfter)},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func ownedPagesHandler(w http.ResponseWriter, r *http.Request) {
+	d := &OwnerDigest{Owner: strings.TrimSpace(r.FormValue("owner"))}
+	if d.Owner != "" {
+		var err error
+		d, err = ownerDigest(r.Context(), d.Owner, currentUser(r), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderTemplate(w, r, "ownedpages", nil, d)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"html/template"
+	"log"
+	"sync"
+	"time"
+)
+
+// Pages read from the page store are kept in memory so popular pages,
+// like the home page, are not read from the database on every view. The
+// -page-cache most recently read pages are kept for -page-cache-ttl, and
+// a page is forgotten as soon as it is saved, deleted or moved through
+// this process. Other processes sharing the database, such as "gowiki
+// mail", change pages behind its back, which the TTL bounds.
+//
+// Rendered page bodies are kept in memory too, so popular pages are not
+// rendered again on every view. An entry is used as long as the body is
+// unchanged and it is younger than renderCacheTTL, after which it is
+// rendered again so links to pages created or deleted since are right.
+
+// cacheStore returns a PageStore reading pages from s through a cache
+// of size pages kept for ttl, or for as long as they are unchanged if
+// ttl is 0. With size 0 it returns s.
+func cacheStore(s PageStore, size int, ttl time.Duration) PageStore {
+	if size <= 0 {
+		return s
+	}
+	return &cachedStore{
+		PageStore: s,
+		size:      size,
+		ttl:       ttl,
+		lru:       list.New(),
+		titles:    map[string]*list.Element{},
+	}
+}
+
+// cachedStore caches the pages got from the PageStore it embeds, which
+// answers everything else.
+type cachedStore struct {
+	PageStore
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	// lru holds a *cachedPage for every page kept, the most recently
+	// used first, and titles the element of each.
+	lru    *list.List
+	titles map[string]*list.Element
+	// writes counts the pages changed, so a page read while one was
+	// changed is not kept, as it may be the old one.
+	writes uint64
+}
+
+type cachedPage struct {
+	title   string
+	page    *Page
+	fetched time.Time
+}
+
+// clonePage returns a copy of p that can be changed without changing p.
+func clonePage(p *Page) *Page {
+	c := *p
+	c.Body = append([]byte(nil), p.Body...)
+	c.Tags = append([]string(nil), p.Tags...)
+	return &c
+}
+
+func (cs *cachedStore) Get(ctx context.Context, title string) (*Page, error) {
+	cs.mu.Lock()
+	if e, ok := cs.titles[title]; ok {
+		cp := e.Value.(*cachedPage)
+		if cs.ttl == 0 || time.Since(cp.fetched) < cs.ttl {
+			cs.lru.MoveToFront(e)
+			cs.mu.Unlock()
+			return clonePage(cp.page), nil
+		}
+		cs.lru.Remove(e)
+		delete(cs.titles, title)
+	}
+	writes := cs.writes
+	cs.mu.Unlock()
+
+	p, err := cs.PageStore.Get(ctx, title)
+	if err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.writes != writes {
+		return p, nil
+	}
+	cp := &cachedPage{title: title, page: clonePage(p), fetched: time.Now()}
+	if e, ok := cs.titles[title]; ok {
+		e.Value = cp
+		cs.lru.MoveToFront(e)
+		return p, nil
+	}
+	cs.titles[title] = cs.lru.PushFront(cp)
+	if cs.lru.Len() > cs.size {
+		oldest := cs.lru.Back()
+		cs.lru.Remove(oldest)
+		delete(cs.titles, oldest.Value.(*cachedPage).title)
+	}
+	return p, nil
+}
+
+// forget drops the pages called titles. It is called after they are
+// written, whether or not that worked, as a failed write may still have
+// changed them.
+func (cs *cachedStore) forget(titles ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.writes++
+	for _, title := range titles {
+		if e, ok := cs.titles[title]; ok {
+			cs.lru.Remove(e)
+			delete(cs.titles, title)
+		}
+	}
+}
+
+func (cs *cachedStore) Put(ctx context.Context, p *Page) error {
+	err := cs.PageStore.Put(ctx, p)
+	cs.forget(p.Title)
+	return err
+}
+
+func (cs *cachedStore) PutAt(ctx context.Context, p *Page, base int) error {
+	err := putAt(ctx, cs.PageStore, p, base)
+	cs.forget(p.Title)
+	return err
+}
+
+func (cs *cachedStore) SummariesCount(ctx context.Context, q ListQuery) ([]PageEntry, int, error) {
+	return summariesCount(ctx, cs.PageStore, q)
+}
+
+func (cs *cachedStore) Delete(ctx context.Context, title string) error {
+	err := cs.PageStore.Delete(ctx, title)
+	cs.forget(title)
+	return err
+}
+
+func (cs *cachedStore) Rename(ctx context.Context, from, to string) error {
+	err := cs.PageStore.Rename(ctx, from, to)
+	cs.forget(from, to)
+	return err
+}
+
+// renderCacheTTL is how long a rendered body is used.
+const renderCacheTTL = 5 * time.Minute
+
+// maxRenderCache is the number of rendered bodies kept.
+const maxRenderCache = 1000
+
+type renderedBody struct {
+	body     []byte
+	html     template.HTML
+	rendered time.Time
+}
+
+// renderCache holds the rendered bodies of the pages of an App.
+type renderCache struct {
+	sync.Mutex
+	pages map[string]*renderedBody
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{pages: map[string]*renderedBody{}}
+}
+
+// renderPage renders the body of a stored page, using the cached
+// rendering when there is a current one.
+func (a *App) renderPage(p *Page) template.HTML {
+	rc := a.rendered
+	rc.Lock()
+	c := rc.pages[p.Title]
+	rc.Unlock()
+	if c != nil && bytes.Equal(c.body, p.Body) && time.Since(c.rendered) < renderCacheTTL {
+		return c.html
+	}
+
+	c = &renderedBody{body: p.Body, html: renderBody(a.ctx, p.Title, p.Body), rendered: time.Now()}
+	rc.Lock()
+	if _, ok := rc.pages[p.Title]; !ok && len(rc.pages) >= maxRenderCache {
+		for title := range rc.pages {
+			delete(rc.pages, title)
+			break
+		}
+	}
+	rc.pages[p.Title] = c
+	rc.Unlock()
+	return c.html
+}
+
+// warmUp renders the n most viewed pages of the analytics period into
+// the cache, so the first visitors after a restart do not wait for them.
+func (a *App) warmUp(n int) error {
+	start := time.Now()
+	since := time.Now().AddDate(0, 0, -analyticsDays+1).Format(dayFormat)
+	cur, err := sumByField(a.ctx, a.db.views, since, "title", byViews, n)
+	if err != nil {
+		return err
+	}
+	var top []NamedCount
+	if err := cur.All(a.ctx, &top); err != nil {
+		return err
+	}
+	warmed := 0
+	for _, t := range top {
+		p, err := loadPage(a.ctx, t.Name)
+		if err != nil {
+			continue
+		}
+		a.renderPage(p)
+		warmed++
+	}
+	log.Printf("warmed up %d pages in %v", warmed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pageActions lists what can be done to a page and the role each needs,
+// "" for anyone, including visitors who are not signed in. The routes
+// look the roles up here, so Special:Permissions explains the same
+// rules that are enforced. Namespaces restricted with -read-restricted
+// need their role for every action, starting with viewing.
+var pageActions = []struct {
+	Name, Role string
+}{
+	{"view", ""},
+	{"history", ""},
+	{"edit", roleEditor},
+	{"attach", roleEditor},
+	{"restore", roleEditor},
+	{"translate", roleEditor},
+	{"approve", roleEditor}, // and reject
+	{"move", roleEditor},
+	{"archive", roleEditor}, // and restore from the archive
+	{"delete", roleAdmin},
+	{"undelete", roleAdmin},
+}
+
+// actionRole returns the role needed for a page action. It panics for
+// actions not in pageActions, which is a mistake in the routes.
+func actionRole(action string) string {
+	for _, a := range pageActions {
+		if a.Name == action {
+			return a.Role
+		}
+	}
+	panic("unknown page action: " + action)
+}
+
+// PermissionCheck explains whether a user may do something to a page.
+// Rules lists every rule that was looked at, in order; the last one
+// decided.
+type PermissionCheck struct {
+	Action  string
+	Allowed bool
+	Rules   []string
+}
+
+// PermissionReport is the data of Special:Permissions. User is empty
+// for a visitor who is not signed in.
+type PermissionReport struct {
+	User   string
+	Title  string
+	Role   string
+	Error  string
+	Checks []PermissionCheck
+}
+
+// ReadRestriction limits reading the pages of a namespace, and the
+// namespace page itself, to users with Role.
+type ReadRestriction struct {
+	Namespace string
+	Role      string
+}
+
+// parseReadRestrictions parses space separated namespace=role pairs,
+// such as "HR=admin Internal=viewer". Restricted namespaces cannot be
+// nested, so every page has at most one.
+func parseReadRestrictions(spec string, titles *titleRules) ([]ReadRestriction, error) {
+	var list []ReadRestriction
+	for _, entry := range strings.Fields(spec) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("read restriction %q is not of the form namespace=role", entry)
+		}
+		rr := ReadRestriction{Namespace: entry[:i], Role: entry[i+1:]}
+		if !titles.valid(rr.Namespace) {
+			return nil, fmt.Errorf("read restriction %q: invalid namespace", entry)
+		}
+		if !validRole(rr.Role) {
+			return nil, fmt.Errorf("read restriction %q: unknown role", entry)
+		}
+		for _, o := range list {
+			if inNamespace(rr.Namespace, o.Namespace) || inNamespace(o.Namespace, rr.Namespace) {
+				return nil, fmt.Errorf("read restrictions of %s and %s overlap", o.Namespace, rr.Namespace)
+			}
+		}
+		list = append(list, rr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Namespace < list[j].Namespace })
+	return list, nil
+}
+
+// inNamespace reports whether title is ns or a page in it.
+func inNamespace(title, ns string) bool {
+	return title == ns || strings.HasPrefix(title, ns+"/")
+}
+
+// readRole returns the role needed to read title, "" for anyone.
+// Namespaces are restricted with -read-restricted; everything else can
+// be read by anyone.
+func readRole(c context.Context, title string) string {
+	for _, rr := range appFrom(c).restrictions {
+		if inNamespace(title, rr.Namespace) {
+			return rr.Role
+		}
+	}
+	return ""
+}
+
+// canRead reports whether u, nil for a visitor who is not signed in,
+// may read title. Everything that shows pages, their titles or their
+// changes asks this, or filters its queries with readFilter.
+func canRead(c context.Context, u *User, title string) bool {
+	role := readRole(c, title)
+	return role == "" || u.Can(role)
+}
+
+// readableTitles returns the titles in list that u may read.
+func readableTitles(c context.Context, u *User, list []string) []string {
+	if len(appFrom(c).restrictions) == 0 {
+		return list
+	}
+	out := []string{}
+	for _, t := range list {
+		if canRead(c, u, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// readableEvents returns the events in list about pages u may read.
+func readableEvents(c context.Context, u *User, list []Event) []Event {
+	if len(appFrom(c).restrictions) == 0 {
+		return list
+	}
+	out := []Event{}
+	for _, e := range list {
+		if canRead(c, u, e.Title) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// hiddenNamespaces returns the namespaces u may not read.
+func hiddenNamespaces(c context.Context, u *User) []string {
+	var list []string
+	for _, rr := range appFrom(c).restrictions {
+		if !u.Can(rr.Role) {
+			list = append(list, rr.Namespace)
+		}
+	}
+	return list
+}
+
+// namespaceFilter returns a query condition leaving out documents whose
+// field holds the title of a page in one of namespaces. It is empty if
+// there are none, so it can always be appended to a filter.
+func namespaceFilter(field string, namespaces []string) bson.D {
+	if len(namespaces) == 0 {
+		return bson.D{}
+	}
+	quoted := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		quoted[i] = regexp.QuoteMeta(ns)
+	}
+	re := primitive.Regex{Pattern: "^(" + strings.Join(quoted, "|") + ")(/|$)"}
+	return bson.D{primitive.E{Key: field, Value: bson.D{primitive.E{Key: "$not", Value: re}}}}
+}
+
+// readFilter returns the query condition leaving out the pages u may
+// not read, whose titles are in field.
+func readFilter(c context.Context, u *User, field string) bson.D {
+	return namespaceFilter(field, hiddenNamespaces(c, u))
+}
+
+// checkRead reports whether the client may read title. If not it has
+// been answered like checkRole does.
+func checkRead(w http.ResponseWriter, r *http.Request, title string) bool {
+	role := readRole(r.Context(), title)
+	return role == "" || checkRole(w, r, role)
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Permissions",
+		Description: "Why a user may or may not view, edit or delete a page.",
+		Handler:     permissionsHandler,
+		Role:        roleAdmin,
+	})
+}
+
+// explainPermissions checks every page action for u, nil for a visitor
+// who is not signed in, on title.
+func explainPermissions(c context.Context, u *User, title string) []PermissionCheck {
+	var pending *PendingEdit
+	protected := isProtected(c, title)
+	if protected {
+		pending, _ = loadPendingEdit(c, title)
+	}
+	rr := readRole(c, title)
+	checks := make([]PermissionCheck, 0, len(pageActions))
+	for _, a := range pageActions {
+		c := PermissionCheck{Action: a.Name, Allowed: true}
+		role := a.Role
+		if rr != "" && roleRank(rr) > roleRank(role) {
+			// Pages that cannot be read cannot be changed either.
+			role = rr
+			c.Rules = append(c.Rules, "the page is in a namespace only readable with the "+rr+" role")
+		}
+		switch {
+		case role == "":
+			c.Rules = append(c.Rules, "anyone may, signed in or not")
+		case u == nil:
+			c.Allowed = false
+			c.Rules = append(c.Rules, "needs the "+role+" role, so visitors are asked to sign in")
+		default:
+			c.Allowed = u.Can(role)
+			c.Rules = append(c.Rules, "needs the "+role+" role; "+u.Name+" is "+articleFor(u.UserRole())+" "+u.UserRole())
+		}
+		if c.Allowed {
+			switch a.Name {
+			case "edit":
+				if protected {
+					c.Rules = append(c.Rules, "the page is in a protected namespace, so edits wait for someone else to approve them")
+				}
+			case "approve":
+				switch {
+				case !protected:
+					c.Allowed = false
+					c.Rules = append(c.Rules, "the page is not in a protected namespace, so there is nothing to approve")
+				case pending == nil:
+					c.Rules = append(c.Rules, "no edit of the page is waiting for approval now")
+				case strings.EqualFold(u.Name, pending.Author):
+					c.Allowed = false
+					c.Rules = append(c.Rules, "the edit waiting for approval is by "+pending.Author+", who cannot approve their own edit")
+				default:
+					c.Rules = append(c.Rules, "the edit waiting for approval is by "+pending.Author+", someone else")
+				}
+			}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func articleFor(role string) string {
+	if role == roleAdmin || role == roleEditor {
+		return "an"
+	}
+	return "a"
+}
+
+// permissionsHandler serves Special:Permissions, where admins check
+// why a user may or may not do something to a page.
+func permissionsHandler(w http.ResponseWriter, r *http.Request) {
+	report := &PermissionReport{
+		User:  strings.TrimSpace(r.FormValue("user")),
+		Title: strings.TrimSpace(r.FormValue("page")),
+	}
+	if report.Title != "" {
+		var u *User
+		if report.User != "" {
+			var err error
+			if u, err = loadUser(r.Context(), report.User); err != nil {
+				report.Error = "No user called " + report.User + "."
+			} else {
+				report.Role = u.UserRole()
+			}
+		}
+		if report.Error == "" {
+			report.Checks = explainPermissions(r.Context(), u, report.Title)
+		}
+	}
+	renderTemplate(w, r, "permissions", nil, report)
+}
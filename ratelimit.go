@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Saving and deleting pages, from the forms or the API, is rate limited
+// per client address, protecting the wiki from bots and misbehaving
+// scripts. Each address has a token bucket holding up to -write-burst
+// tokens and refilled with -write-rate tokens a minute; every write
+// takes one, and writes finding the bucket empty are answered 429 Too
+// Many Requests with a Retry-After header saying when to try again.
+
+// rateLimiter keeps a token bucket for every client address.
+type rateLimiter struct {
+	rate  float64 // tokens added a second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests a minute
+// and burst at once from every address, or nil if perMinute is 0.
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      perMinute / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// take takes a token from the bucket of addr at now. If there is none
+// it returns false and how long until there is.
+func (rl *rateLimiter) take(addr string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	b := rl.buckets[addr]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[addr] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets, once a minute, the buckets that have filled up again,
+// as they are no different from new ones.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for addr, b := range rl.buckets {
+		if now.Sub(b.last) >= full {
+			delete(rl.buckets, addr)
+		}
+	}
+}
+
+// isWriteRequest reports whether r saves or deletes a page. Every
+// method but GET and HEAD counts, so none can get around the limit.
+func isWriteRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/save/") || strings.HasPrefix(r.URL.Path, "/delete/") ||
+		strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// limitWrites answers writes beyond the rate allowed to their client
+// address with 429 Too Many Requests. The rate is set with -write-rate
+// and -write-burst.
+func (a *App) limitWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.limiter == nil || !isWriteRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := a.limiter.take(remoteHost(r), time.Now())
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		if strings.HasPrefix(r.URL.Path, apiPrefix) {
+			apiError(w, http.StatusTooManyRequests, "too many changes, try again later")
+			return
+		}
+		http.Error(w, "You are making changes too quickly. Please wait a moment and try again.", http.StatusTooManyRequests)
+	})
+}
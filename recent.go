@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSummaryLength is the longest edit summary kept, in characters.
+const maxSummaryLength = 200
+
+// defaultRecent is the number of changes /recent shows unless asked for
+// a different number.
+const defaultRecent = 50
+
+// editSummary cleans up the summary typed with an edit, collapsing
+// whitespace and cutting it to maxSummaryLength characters.
+func editSummary(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > maxSummaryLength {
+		s = string([]rune(s)[:maxSummaryLength])
+	}
+	return s
+}
+
+// recentChanges returns the last limit events across the wiki, newest
+// first. The event log, written on every save and delete, doubles as
+// the log of edits.
+func recentChanges(c context.Context, limit int64, u *User) ([]Event, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(limit)
+	cur, err := appFrom(c).db.events.Find(c, readFilter(c, u, "title"), opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Event{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// recentHandler serves /recent, the latest changes to any page.
+// ?limit=N shows up to maxEventBatch changes.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	limit := int64(defaultRecent)
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > maxEventBatch {
+			n = maxEventBatch
+		}
+		limit = n
+	}
+	list, err := recentChanges(r.Context(), limit, currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "recent", nil, list)
+}
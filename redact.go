@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Redaction rules sanitize an export meant to leave the organization.
+// Pages carrying one of the tags or in one of the namespaces are left
+// out, and text matching a mask, in bodies and in owner and reviewer
+// names, is replaced with redactedText. The manifest says that the
+// export was redacted and how many pages were, so whoever reads it
+// knows it is not complete, but not the rules: tag and namespace names
+// and mask patterns often name what was hidden.
+
+// redactedText replaces masked text.
+const redactedText = "[redacted]"
+
+// redactionMasks are the masks that can be asked for by name.
+var redactionMasks = map[string]*regexp.Regexp{
+	"emails": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	// Credentials found by the built in secret detectors.
+	"secrets": secretsPattern(secretDetectors),
+}
+
+// RedactionRules say what to leave out of an export and what to mask.
+// Masks are names from redactionMasks; Patterns are regular
+// expressions of other text to mask. They are never written to the
+// export.
+type RedactionRules struct {
+	Tags       []string `json:"-"`
+	Namespaces []string `json:"-"`
+	Masks      []string `json:"-"`
+	Patterns   []string `json:"-"`
+
+	masks []*regexp.Regexp
+}
+
+// newRedactionRules checks and prepares the rules. It returns nil if
+// there are none, as exports without rules are not redacted.
+func newRedactionRules(titles *titleRules, tags, namespaces, masks, patterns []string) (*RedactionRules, error) {
+	if len(tags)+len(namespaces)+len(masks)+len(patterns) == 0 {
+		return nil, nil
+	}
+	rr := &RedactionRules{Tags: tags, Namespaces: namespaces, Masks: masks, Patterns: patterns}
+	for _, ns := range namespaces {
+		if !titles.valid(ns) {
+			return nil, fmt.Errorf("invalid namespace %q", ns)
+		}
+	}
+	for _, name := range masks {
+		re, ok := redactionMasks[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown mask %q, use emails or secrets", name)
+		}
+		rr.masks = append(rr.masks, re)
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("mask pattern %q: %v", p, err)
+		}
+		rr.masks = append(rr.masks, re)
+	}
+	return rr, nil
+}
+
+// RedactionSummary is what the manifest of a redacted export says about
+// the redaction. Masks are the names of the built in masks applied,
+// which give nothing away; other patterns are only counted.
+type RedactionSummary struct {
+	Redacted     bool     `json:"redacted"`
+	Masks        []string `json:"masks,omitempty"`
+	Patterns     int      `json:"patterns,omitempty"`
+	PagesLeftOut int      `json:"pagesLeftOut"`
+	PagesMasked  int      `json:"pagesMasked"`
+}
+
+// summary returns the summary of rr for the manifest, to be filled in
+// with the pages redacted, or nil if rr is nil.
+func (rr *RedactionRules) summary() *RedactionSummary {
+	if rr == nil {
+		return nil
+	}
+	return &RedactionSummary{Redacted: true, Masks: rr.Masks, Patterns: len(rr.Patterns)}
+}
+
+// strips reports whether p is left out of the export.
+func (rr *RedactionRules) strips(p *Page) bool {
+	if rr == nil {
+		return false
+	}
+	for _, ns := range rr.Namespaces {
+		if inNamespace(p.Title, ns) {
+			return true
+		}
+	}
+	for _, tag := range rr.Tags {
+		for _, t := range p.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mask returns s with the text matching any mask replaced.
+func (rr *RedactionRules) mask(s string) string {
+	if rr == nil {
+		return s
+	}
+	for _, re := range rr.masks {
+		s = re.ReplaceAllLiteralString(s, redactedText)
+	}
+	return s
+}
+
+// redact returns the copy of p to export, with its body and the names
+// of its owner and reviewer masked.
+func (rr *RedactionRules) redact(p *Page) *Page {
+	if rr == nil || len(rr.masks) == 0 {
+		return p
+	}
+	c := *p
+	c.Body = []byte(rr.mask(string(p.Body)))
+	c.Owner = rr.mask(p.Owner)
+	c.Reviewer = rr.mask(p.Reviewer)
+	return &c
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Redirect maps a source path to a target URL. Pattern redirects treat
+// Source as a regular expression matched against the whole path and may
+// refer to its groups as $1, $2, ... in Target.
+type Redirect struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Source  string             `bson:"source"`
+	Target  string             `bson:"target"`
+	Pattern bool               `bson:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// redirectRules caches the redirect table. It is reloaded lazily after
+// every change made through Special:Redirects.
+var redirectRules struct {
+	sync.Mutex
+	loaded bool
+	exact  map[string]*Redirect
+	regexp []*Redirect
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Redirects",
+		Description: "Redirect rules for legacy and renamed URLs.",
+		Handler:     redirectsHandler,
+		Role:        roleAdmin,
+	})
+}
+
+// compile validates a redirect and prepares its pattern.
+func (rd *Redirect) compile() error {
+	if rd.Source == "" || rd.Target == "" {
+		return errors.New("source and target are required")
+	}
+	// Rules only lead elsewhere on the wiki, so they cannot be used to
+	// send visitors to other sites.
+	if localTarget(rd.Target) != rd.Target {
+		return errors.New("target must be a path on this wiki starting with /")
+	}
+	if !rd.Pattern {
+		if !strings.HasPrefix(rd.Source, "/") {
+			return errors.New("source must be a path starting with /")
+		}
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + rd.Source + ")$")
+	if err != nil {
+		return err
+	}
+	rd.re = re
+	return nil
+}
+
+func listRedirects(c context.Context) ([]*Redirect, error) {
+	if appFrom(c).db == nil {
+		return nil, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.redirects.Find(c, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []*Redirect{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+func loadRedirectRules(c context.Context) error {
+	list, err := listRedirects(c)
+	if err != nil {
+		return err
+	}
+	exact := map[string]*Redirect{}
+	patterns := []*Redirect{}
+	for _, rd := range list {
+		if err := rd.compile(); err != nil {
+			log.Printf("skipping redirect %s: %v", rd.Source, err)
+			continue
+		}
+		if rd.Pattern {
+			patterns = append(patterns, rd)
+		} else {
+			exact[rd.Source] = rd
+		}
+	}
+	redirectRules.exact = exact
+	redirectRules.regexp = patterns
+	redirectRules.loaded = true
+	return nil
+}
+
+func invalidateRedirectRules() {
+	redirectRules.Lock()
+	redirectRules.loaded = false
+	redirectRules.Unlock()
+}
+
+// findRedirect returns the target for a path, or an empty string if no
+// rule matches. Exact rules win over patterns; patterns are tried in the
+// order they were added.
+func findRedirect(c context.Context, path string) string {
+	redirectRules.Lock()
+	defer redirectRules.Unlock()
+
+	if !redirectRules.loaded {
+		if err := loadRedirectRules(c); err != nil {
+			log.Printf("loading redirects: %v", err)
+			return ""
+		}
+	}
+	if rd, ok := redirectRules.exact[path]; ok {
+		return rd.Target
+	}
+	for _, rd := range redirectRules.regexp {
+		if m := rd.re.FindStringSubmatchIndex(path); m != nil {
+			// A group at the start of the target could still expand
+			// to another site, such as //example.com.
+			target := string(rd.re.ExpandString(nil, rd.Target, path, m))
+			if localTarget(target) != target {
+				return ""
+			}
+			return target
+		}
+	}
+	return ""
+}
+
+// notFound redirects to the target of a matching redirect rule and
+// replies with 404 otherwise.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if target := findRedirect(r.Context(), r.URL.Path); target != "" {
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func addRedirect(c context.Context, rd *Redirect) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	if err := rd.compile(); err != nil {
+		return err
+	}
+	_, err := appFrom(c).db.redirects.InsertOne(c, rd)
+	invalidateRedirectRules()
+	return err
+}
+
+func deleteRedirect(c context.Context, id string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	_, err = appFrom(c).db.redirects.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: oid}})
+	invalidateRedirectRules()
+	return err
+}
+
+func redirectsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var err error
+		if id := r.FormValue("delete"); id != "" {
+			err = deleteRedirect(r.Context(), id)
+		} else {
+			err = addRedirect(r.Context(), &Redirect{
+				Source:  strings.TrimSpace(r.FormValue("source")),
+				Target:  strings.TrimSpace(r.FormValue("target")),
+				Pattern: r.FormValue("pattern") != "",
+			})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addFlash(w, r, "Redirects updated.")
+		http.Redirect(w, r, "/special/Redirects", http.StatusFound)
+		return
+	}
+
+	list, err := listRedirects(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "redirects", nil, list)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RemoteWiki describes another wiki whose pages are mirrored on demand
+// under a namespace of this one. URL is the address of a page's raw
+// source with "{title}" standing for the remote title, for example
+// "https://wiki.example.org/index.php?title={title}&action=raw".
+type RemoteWiki struct {
+	Prefix string
+	URL    string
+}
+
+// remoteCacheTTL is how long a fetched page is served from the local
+// copy before it is fetched again.
+const remoteCacheTTL = time.Hour
+
+// remoteMaxSize is the largest remote page body that is imported.
+const remoteMaxSize = 1 << 20
+
+var remoteClient = &http.Client{Timeout: 10 * time.Second}
+
+var errNotRemote = errors.New("page is not mirrored from a remote wiki")
+
+// newRemoteWiki returns the remote wiki mirrored under prefix, or nil
+// if neither setting is given.
+func newRemoteWiki(prefix, u string) (*RemoteWiki, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" && u == "" {
+		return nil, nil
+	}
+	if prefix == "" || u == "" {
+		return nil, errors.New("the remote prefix and URL must be set together")
+	}
+	if !strings.Contains(u, "{title}") {
+		return nil, errors.New("the remote URL must contain {title}")
+	}
+	return &RemoteWiki{Prefix: prefix, URL: u}, nil
+}
+
+// remoteTitle returns the title on the remote wiki of a local title, or
+// false if the title is not under the remote prefix.
+func (rw *RemoteWiki) remoteTitle(title string) (string, bool) {
+	if rw == nil || !strings.HasPrefix(title, rw.Prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(title, rw.Prefix+"/"), true
+}
+
+// sourceURL returns the address a remote title is fetched from.
+func (rw *RemoteWiki) sourceURL(remote string) string {
+	return strings.ReplaceAll(rw.URL, "{title}", url.QueryEscape(remote))
+}
+
+// fetch downloads the source of a remote page.
+func (rw *RemoteWiki) fetch(remote string) ([]byte, error) {
+	res, err := remoteClient.Get(rw.sourceURL(remote))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote wiki: %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, remoteMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// loadRemotePage returns a page under the remote prefix, fetching it
+// from the remote wiki when there is no local copy or the cached copy
+// has expired. Pages that have been edited locally are never refetched.
+// If the remote wiki cannot be reached, a stale copy is still served.
+func loadRemotePage(ctx context.Context, title string) (*Page, error) {
+	rw := appFrom(ctx).remote
+	remote, ok := rw.remoteTitle(title)
+	if !ok {
+		return nil, errNotRemote
+	}
+	cached, err := loadPage(ctx, title)
+	if err == nil && (cached.Remote == "" || time.Since(cached.Fetched) < remoteCacheTTL) {
+		return cached, nil
+	}
+
+	body, ferr := rw.fetch(remote)
+	if ferr != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, ferr
+	}
+
+	p := &Page{
+		Title:   title,
+		Body:    body,
+		Updated: time.Now(),
+		Remote:  rw.sourceURL(remote),
+		Fetched: time.Now(),
+	}
+	if cached != nil {
+		p.Lang, p.Owner, p.Reviewer = cached.Lang, cached.Owner, cached.Reviewer
+	}
+	if err := appFrom(ctx).pages.Put(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Heading is a section heading found in a page body.
+type Heading struct {
+	Level int
+	Text  string
+	ID    string
+}
+
+// parseHeading recognises lines of the form "## Text" and returns the
+// heading level and text, or 0 if the line is not a heading.
+func parseHeading(line string) (int, string) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0, ""
+	}
+	return level, strings.TrimSpace(strings.TrimRight(line[level:], "#"))
+}
+
+// slugify turns heading text into a string usable as an HTML id.
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// parseBody parses a page body, after any front matter, as Markdown and
+// assigns unique ids to its top level headings, which are returned for
+// the table of contents.
+func parseBody(body []byte) ([]mdBlock, []Heading) {
+	_, rest := splitFrontMatter(body)
+	blocks := parseBlocks(splitLines(rest))
+	list := []Heading{}
+	seen := map[string]int{}
+	for i := range blocks {
+		if blocks[i].kind != headingBlock {
+			continue
+		}
+		text := blocks[i].lines[0]
+		id := slugify(text)
+		if id == "" {
+			id = "section"
+		}
+		if n := seen[id]; n > 0 {
+			seen[id] = n + 1
+			id += "-" + strconv.Itoa(n)
+		} else {
+			seen[id] = 1
+		}
+		blocks[i].id = id
+		list = append(list, Heading{Level: blocks[i].level, Text: text, ID: id})
+	}
+	return blocks, list
+}
+
+// headings returns the headings of a body in document order, with the
+// ids renderBody gives them.
+func headings(body []byte) []Heading {
+	_, list := parseBody(body)
+	return list
+}
+
+// renderBody renders the body of the page called title, written in
+// Markdown, as HTML.
+func renderBody(c context.Context, title string, body []byte) template.HTML {
+	return renderBodyLinks(c, title, body, viewLink)
+}
+
+// renderBodyLinks renders a body with wiki links pointing to the URLs
+// returned by href.
+func renderBodyLinks(c context.Context, title string, body []byte, href func(title string, exists bool) string) template.HTML {
+	blocks, _ := parseBody(body)
+	links := resolveLinks(c, body, href)
+	links.Title = title
+	var b strings.Builder
+	renderFrontMatter(&b, parseFrontMatter(body))
+	renderBlocks(&b, blocks, links)
+	return template.HTML(b.String())
+}
+
+// tocMinHeadings is the number of headings from which a page gets a
+// table of contents.
+const tocMinHeadings = 3
+
+// tableOfContents returns the headings for the table of contents
+// sidebar, or nothing for pages too short to need one.
+func tableOfContents(body []byte) []Heading {
+	hs := headings(body)
+	if len(hs) < tocMinHeadings {
+		return nil
+	}
+	return hs
+}
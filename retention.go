@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A legal hold keeps a page, and every page below it, from being
+// deleted, and keeps what is already in the trash from being purged,
+// until an admin releases it. Retention policies say how many days the
+// trashed pages of a namespace are kept before the janitor purges them;
+// pages outside any policy follow -retain-trash. Holds win over both.
+// Admins manage holds and policies on Special:Retention.
+
+// LegalHold is a hold on the page called Title and the pages below it.
+type LegalHold struct {
+	Title  string    `bson:"_id"`
+	Reason string    `bson:"reason"`
+	By     string    `bson:"by"`
+	Placed time.Time `bson:"placed"`
+}
+
+// RetentionPolicy is how long the trashed pages of Namespace, and the
+// namespace page itself, are kept.
+type RetentionPolicy struct {
+	Namespace string    `bson:"_id"`
+	Days      int       `bson:"days"`
+	By        string    `bson:"by"`
+	Set       time.Time `bson:"set"`
+}
+
+// RetentionSettings is the data of Special:Retention.
+type RetentionSettings struct {
+	Holds        []LegalHold
+	Policies     []RetentionPolicy
+	DefaultTrash time.Duration
+}
+
+// DefaultTrashDays returns how many days trashed pages outside any
+// policy are kept, 0 for forever.
+func (rs *RetentionSettings) DefaultTrashDays() int {
+	return int(rs.DefaultTrash / (24 * time.Hour))
+}
+
+// maxRetentionDays bounds retention policies at about ten years.
+const maxRetentionDays = 3660
+
+// errLegalHold is returned when deleting a page under legal hold.
+var errLegalHold = errors.New("the page is under legal hold and cannot be deleted")
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Retention",
+		Description: "Legal holds on pages and how long deleted pages are kept.",
+		Handler:     retentionHandler,
+		Mongo:       true,
+		Role:        roleAdmin,
+	})
+}
+
+// titleAndParents returns title and every namespace it is in, such as
+// "A/B/C", "A/B" and "A" for "A/B/C".
+func titleAndParents(title string) []string {
+	list := []string{title}
+	for ns := namespaceOf(title); ns != ""; ns = namespaceOf(ns) {
+		list = append(list, ns)
+	}
+	return list
+}
+
+// legalHoldOn returns the hold covering title, or nil if there is none.
+func legalHoldOn(c context.Context, title string) (*LegalHold, error) {
+	if appFrom(c).db == nil {
+		return nil, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var h LegalHold
+	err := appFrom(c).db.legalHolds.FindOne(c, bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: titleAndParents(title)}}},
+	}).Decode(&h)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func listLegalHolds(c context.Context) ([]LegalHold, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.legalHolds.Find(c, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []LegalHold{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+func placeLegalHold(c context.Context, h *LegalHold) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.legalHolds.ReplaceOne(c,
+		bson.D{primitive.E{Key: "_id", Value: h.Title}}, h,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func releaseLegalHold(c context.Context, title string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.legalHolds.DeleteOne(c, bson.D{primitive.E{Key: "_id", Value: title}})
+	return err
+}
+
+func listRetentionPolicies(c context.Context) ([]RetentionPolicy, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.retention.Find(c, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []RetentionPolicy{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// setRetentionPolicy stores p, or removes the policy of its namespace
+// if p.Days is 0.
+func setRetentionPolicy(c context.Context, p *RetentionPolicy) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	filter := bson.D{primitive.E{Key: "_id", Value: p.Namespace}}
+	if p.Days == 0 {
+		_, err := appFrom(c).db.retention.DeleteOne(c, filter)
+		return err
+	}
+	_, err := appFrom(c).db.retention.ReplaceOne(c, filter, p, options.Replace().SetUpsert(true))
+	return err
+}
+
+// trashRetention returns how long the trashed page called title is
+// kept: the policy of the innermost namespace it is in that has one,
+// or def. Zero keeps it forever.
+func trashRetention(title string, policies map[string]int, def time.Duration) time.Duration {
+	for _, ns := range titleAndParents(title) {
+		if days, ok := policies[ns]; ok {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return def
+}
+
+// trashExpiry returns whether what was deleted from the page called
+// title at deleted is kept longer than its retention by now, and not
+// under legal hold, so it can be purged.
+func trashExpiry(c context.Context, now time.Time, def time.Duration) (func(title string, deleted time.Time) bool, error) {
+	list, err := listRetentionPolicies(c)
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]int{}
+	for _, p := range list {
+		policies[p.Namespace] = p.Days
+	}
+	holds, err := listLegalHolds(c)
+	if err != nil {
+		return nil, err
+	}
+	held := func(title string) bool {
+		for _, h := range holds {
+			if inNamespace(title, h.Title) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(title string, deleted time.Time) bool {
+		keep := trashRetention(title, policies, def)
+		return keep > 0 && now.Sub(deleted) > keep && !held(title)
+	}, nil
+}
+
+// purgeTrash removes the pages in the trash kept longer than their
+// retention, unless they are under legal hold, and returns how many.
+func purgeTrash(c context.Context, now time.Time, def time.Duration) (int64, error) {
+	expired, err := trashExpiry(c, now, def)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "page.title", Value: 1}, {Key: "deleted", Value: 1}})
+	cur, err := appFrom(c).db.trash.Find(c, bson.D{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(c)
+	var ids []primitive.ObjectID
+	for cur.Next(c) {
+		var tp TrashedPage
+		if err := cur.Decode(&tp); err != nil {
+			return 0, err
+		}
+		if expired(tp.Page.Title, tp.Deleted) {
+			ids = append(ids, tp.ID)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := appFrom(c).db.trash.DeleteMany(c, bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// retentionHandler serves Special:Retention. Posting "hold" with a title
+// and reason places a hold and "release" releases one; posting "policy"
+// with a namespace and days sets a retention policy, 0 days removing it.
+// Every change is recorded in the audit log.
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var err error
+		var action, detail, msg string
+		title := strings.TrimSpace(r.FormValue("title"))
+		switch {
+		case r.FormValue("hold") != "":
+			reason := strings.TrimSpace(r.FormValue("reason"))
+			if !validTitle(r.Context(), title) || reason == "" {
+				http.Error(w, "a hold needs a valid title and a reason", http.StatusBadRequest)
+				return
+			}
+			err = placeLegalHold(r.Context(), &LegalHold{Title: title, Reason: reason, By: userName(r), Placed: time.Now()})
+			action, detail = "legal hold placed", title+": "+reason
+			msg = "Placed " + title + " under legal hold."
+		case r.FormValue("release") != "":
+			err = releaseLegalHold(r.Context(), title)
+			action, detail = "legal hold released", title
+			msg = "Released the legal hold on " + title + "."
+		case r.FormValue("policy") != "":
+			ns := strings.TrimSpace(r.FormValue("namespace"))
+			days, derr := strconv.Atoi(r.FormValue("days"))
+			if !validTitle(r.Context(), ns) || derr != nil || days < 0 || days > maxRetentionDays {
+				http.Error(w, "a policy needs a valid namespace and 0 to "+strconv.Itoa(maxRetentionDays)+" days", http.StatusBadRequest)
+				return
+			}
+			err = setRetentionPolicy(r.Context(), &RetentionPolicy{Namespace: ns, Days: days, By: userName(r), Set: time.Now()})
+			action, detail = "retention policy set", ns+": "+strconv.Itoa(days)+" days"
+			msg = "Updated the retention of " + ns + "."
+		default:
+			http.Error(w, "nothing to do", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r.Context(), userName(r), action, detail)
+		addFlash(w, r, msg)
+		http.Redirect(w, r, "/special/Retention", http.StatusSeeOther)
+		return
+	}
+
+	rs := &RetentionSettings{DefaultTrash: appFrom(r.Context()).cfg.Retention.Trash}
+	var err error
+	if rs.Holds, err = listLegalHolds(r.Context()); err == nil {
+		rs.Policies, err = listRetentionPolicies(r.Context())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "retention", nil, rs)
+}
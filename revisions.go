@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Revision is a page body as it was saved at one point in time.
+// Revisions of a page are numbered from 1 in the order they were saved.
+type Revision struct {
+	Title  string    `bson:"title"`
+	Number int       `bson:"number"`
+	Body   []byte    `bson:"body"`
+	Lang   string    `bson:"lang"`
+	Author string    `bson:"author"`
+	Saved  time.Time `bson:"saved"`
+	// Checksum is the contentChecksum of Body, which "gowiki verify"
+	// checks the stored body against.
+	Checksum string `bson:"checksum,omitempty"`
+}
+
+// Previous returns the number of the revision before rev, or 0 for
+// the first one.
+func (rev Revision) Previous() int {
+	return rev.Number - 1
+}
+
+// History lists the revisions of a page, newest first.
+type History struct {
+	Latest    int
+	Revisions []Revision
+}
+
+// DiffLine is one line of a diff between two revisions. Op is "ins"
+// for added lines, "del" for removed lines and "eq" for context.
+type DiffLine struct {
+	Op   string
+	Text string
+}
+
+// RevisionDiff is the line-level difference between two revisions.
+type RevisionDiff struct {
+	From  *Revision
+	To    *Revision
+	Lines []DiffLine
+}
+
+// nextRevision returns the number the next revision of a page gets.
+func nextRevision(c context.Context, title string) (int, error) {
+	if appFrom(c).db == nil {
+		// Without a history, count on from the page itself.
+		p, err := loadPage(c, title)
+		if err != nil {
+			return 1, nil
+		}
+		return p.Revision + 1, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var last Revision
+	err := appFrom(c).db.revisions.FindOne(c, bson.D{primitive.E{Key: "title", Value: title}},
+		options.FindOne().SetSort(bson.D{primitive.E{Key: "number", Value: -1}}),
+	).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return last.Number + 1, nil
+}
+
+// maxRevisionTries is how often commitRevision looks for a free
+// revision number before giving up.
+const maxRevisionTries = 5
+
+// commitRevision saves p as the next revision of its page and records
+// that revision in the history. When another save takes the same number
+// first, it tries again with the one after.
+func commitRevision(c context.Context, p *Page, author string) error {
+	for tries := 1; ; tries++ {
+		number, err := nextRevision(c, p.Title)
+		if err != nil {
+			return err
+		}
+		p.Revision = number
+		err = recordRevision(c, p, author)
+		if err == nil {
+			break
+		}
+		if err != errEditConflict || tries == maxRevisionTries {
+			return err
+		}
+	}
+	if err := appFrom(c).pages.Put(c, p); err != nil {
+		dropRevision(c, p.Title, p.Revision)
+		return err
+	}
+	return updateLinks(c, p)
+}
+
+// commitEdit saves p as the revision after base, the revision the edit
+// started from, with 0 for a page that did not exist. It returns
+// errEditConflict if someone else saved the page since: the history
+// takes each revision number only once, and the page is only replaced
+// while it is still at base.
+func commitEdit(c context.Context, p *Page, author string, base int) error {
+	if base == 0 {
+		// A page created again after it was deleted carries on with
+		// the numbers of its history.
+		number, err := nextRevision(c, p.Title)
+		if err != nil {
+			return err
+		}
+		p.Revision = number
+	} else {
+		p.Revision = base + 1
+	}
+	if err := recordRevision(c, p, author); err != nil {
+		return err
+	}
+	if err := putAt(c, appFrom(c).pages, p, base); err != nil {
+		dropRevision(c, p.Title, p.Revision)
+		return err
+	}
+	return updateLinks(c, p)
+}
+
+// recordRevision stores the current state of p as revision p.Revision,
+// or returns errEditConflict if the page already has that revision.
+func recordRevision(c context.Context, p *Page, author string) error {
+	if appFrom(c).db == nil {
+		return nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.revisions.InsertOne(c, &Revision{
+		Title:  p.Title,
+		Number: p.Revision,
+		Body:   p.Body,
+		Lang:   p.Lang,
+		Author: author,
+		Saved:  p.Updated,
+
+		Checksum: contentChecksum(p.Body),
+	})
+	if isDuplicateKey(err) {
+		return errEditConflict
+	}
+	return err
+}
+
+// dropRevision removes a revision recorded for a save that then failed.
+func dropRevision(c context.Context, title string, number int) {
+	if appFrom(c).db == nil {
+		return
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.revisions.DeleteOne(c, bson.D{
+		primitive.E{Key: "title", Value: title},
+		primitive.E{Key: "number", Value: number},
+	})
+	if err != nil {
+		log.Printf("removing revision %d of %s: %v", number, title, err)
+	}
+}
+
+// createRevisionIndex makes revision numbers unique per page, so of two
+// saves taking the same number only the first is recorded.
+func createRevisionIndex(c context.Context) error {
+	_, err := appFrom(c).db.revisions.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "title", Value: 1},
+			{Key: "number", Value: 1},
+		},
+		Options: options.Index().SetName("title_number").SetUnique(true),
+	})
+	return err
+}
+
+func loadRevision(c context.Context, title string, number int) (*Revision, error) {
+	if appFrom(c).db == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var rev Revision
+	err := appFrom(c).db.revisions.FindOne(c, bson.D{
+		primitive.E{Key: "title", Value: title},
+		primitive.E{Key: "number", Value: number},
+	}).Decode(&rev)
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// listRevisions returns the revisions of a page, newest first, without
+// their bodies. Wikis without a database keep no revisions.
+func listRevisions(c context.Context, title string) ([]Revision, error) {
+	if appFrom(c).db == nil {
+		return []Revision{}, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "body", Value: 0}}).
+		SetSort(bson.D{{Key: "number", Value: -1}})
+	cur, err := appFrom(c).db.revisions.Find(c, bson.D{primitive.E{Key: "title", Value: title}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Revision{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// countRevisions returns how many revisions of a page are kept.
+func countRevisions(c context.Context, title string) (int64, error) {
+	if appFrom(c).db == nil {
+		return 0, nil
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	return appFrom(c).db.revisions.CountDocuments(c, bson.D{primitive.E{Key: "title", Value: title}})
+}
+
+// diffLines compares two bodies line by line.
+func diffLines(a, b []byte) []DiffLine {
+	al := difflib.SplitLines(string(a))
+	bl := difflib.SplitLines(string(b))
+	lines := []DiffLine{}
+	add := func(op string, src []string) {
+		for _, l := range src {
+			lines = append(lines, DiffLine{Op: op, Text: strings.TrimSuffix(l, "\n")})
+		}
+	}
+	for _, c := range difflib.NewMatcher(al, bl).GetOpCodes() {
+		switch c.Tag {
+		case 'e':
+			add("eq", al[c.I1:c.I2])
+		case 'd':
+			add("del", al[c.I1:c.I2])
+		case 'i':
+			add("ins", bl[c.J1:c.J2])
+		case 'r':
+			add("del", al[c.I1:c.I2])
+			add("ins", bl[c.J1:c.J2])
+		}
+	}
+	return lines
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request, title string) {
+	list, err := listRevisions(r.Context(), title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := &History{Revisions: list}
+	if len(list) > 0 {
+		h.Latest = list[0].Number
+	}
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		p = &Page{Title: title}
+	}
+	renderTemplate(w, r, "history", p, h)
+}
+
+// diffHandler serves /diff/{title}/{from}/{to}. Titles may contain
+// slashes, so the two revision numbers are taken from the end of the
+// path and the rest is checked like any other title.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		notFound(w, r)
+		return
+	}
+	n := len(parts)
+	from, err1 := strconv.Atoi(parts[n-2])
+	to, err2 := strconv.Atoi(parts[n-1])
+	path := strings.Join(parts[:n-2], "/")
+	_, title, ok := appFrom(r.Context()).titles.split(path)
+	if err1 != nil || err2 != nil || !ok {
+		notFound(w, r)
+		return
+	}
+	if !checkRead(w, r, title) {
+		return
+	}
+
+	a, err := loadRevision(r.Context(), title, from)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	b, err := loadRevision(r.Context(), title, to)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	renderTemplate(w, r, "diff", &Page{Title: title}, &RevisionDiff{
+		From:  a,
+		To:    b,
+		Lines: diffLines(a.Body, b.Body),
+	})
+}
+
+// EditConflict is shown when an edit was based on an older revision
+// than the page is at now. Theirs holds the changes others made since
+// Base, if that revision is known, and Mine the difference between the
+// current page and the edit. Summary is the edit summary typed with it.
+type EditConflict struct {
+	Base    int
+	Current *Page
+	Edit    *Page
+	Summary string
+	Theirs  []DiffLine
+	Mine    []DiffLine
+}
+
+// editConflict answers a save based on a stale revision with the
+// changes made in the meantime and the editor again, now based on the
+// current revision, so the edit can be merged by hand and resubmitted.
+func editConflict(w http.ResponseWriter, r *http.Request, current, edit *Page, base int) {
+	c := &EditConflict{
+		Base:    base,
+		Current: current,
+		Edit:    edit,
+		Summary: r.FormValue("summary"),
+		Mine:    diffLines(current.Body, edit.Body),
+	}
+	if rev, err := loadRevision(r.Context(), current.Title, base); err == nil {
+		c.Theirs = diffLines(rev.Body, current.Body)
+	}
+	renderTemplate(w, r, "conflict", current, c)
+}
+
+// restoreHandler makes an old revision the current version of a page.
+// The restore is itself recorded as a new revision. Restoring a
+// protected page goes through approval like any other edit.
+func restoreHandler(w http.ResponseWriter, r *http.Request, title string) {
+	number, err := strconv.Atoi(r.FormValue("rev"))
+	if err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	rev, err := loadRevision(r.Context(), title, number)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		p = &Page{Title: title}
+	}
+	// Undoing a restore puts back the revision it replaced, as long as
+	// the page has not changed since.
+	if v := r.FormValue("undo"); v != "" {
+		if v != strconv.Itoa(p.Revision) {
+			http.Error(w, errUndoChanged.Error(), http.StatusConflict)
+			return
+		}
+		if time.Since(p.Updated) > appFrom(r.Context()).cfg.UndoWindow {
+			http.Error(w, errUndoExpired.Error(), http.StatusGone)
+			return
+		}
+	}
+	replaced := p.Revision
+	p.Body = rev.Body
+	p.Lang = rev.Lang
+	p.Updated = time.Now()
+	// A restored mirror page is a local edit and must not be refetched.
+	p.Remote, p.Fetched = "", time.Time{}
+	author := userName(r)
+	if isProtected(r.Context(), title) {
+		if err := submitPendingEdit(r.Context(), p, author); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addFlash(w, r, "Restoring revision "+strconv.Itoa(number)+" of "+title+" is waiting for approval.")
+		http.Redirect(w, r, pageURL("pending", title), http.StatusFound)
+		return
+	}
+	if err := commitRevision(r.Context(), p, author); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordEvent(r.Context(), eventRestored, title, author, "Restored revision "+strconv.Itoa(number)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg := "Restored revision " + strconv.Itoa(number) + " of " + title + "."
+	if replaced == 0 || r.FormValue("undo") != "" {
+		addFlash(w, r, msg)
+	} else {
+		undo := pageURL("restore", title) + "?rev=" + strconv.Itoa(replaced) + "&undo=" + strconv.Itoa(p.Revision)
+		addFlashAction(w, r, msg, undo, "Undo")
+	}
+	http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
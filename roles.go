@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Roles of users, each allowed everything the ones before it are.
+// Viewers can read pages, editors can also change them and admins can
+// also delete pages and manage users and announcements.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+// roles lists the roles from least to most privileged.
+var roles = []string{roleViewer, roleEditor, roleAdmin}
+
+// defaultRole is given to new accounts unless -default-role names
+// another. The very first account becomes an admin instead, so that
+// someone can manage the others.
+const defaultRole = roleEditor
+
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func validRole(role string) bool {
+	return roleRank(role) > 0
+}
+
+// UserRole returns the role of u. Accounts created before roles existed
+// have none stored and are editors, as they could edit before.
+func (u *User) UserRole() string {
+	if u.Role == "" {
+		return roleEditor
+	}
+	return u.Role
+}
+
+// Can reports whether u has role or a more privileged one. A nil user,
+// someone not signed in, has no role.
+func (u *User) Can(role string) bool {
+	return u != nil && roleRank(u.UserRole()) >= roleRank(role)
+}
+
+// checkRole reports whether the client may go on to a page needing
+// role. If not it has been answered: anonymous clients are sent to
+// sign in and signed in users without the role are refused.
+func checkRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return false
+	}
+	if !u.Can(role) {
+		http.Error(w, "this needs the "+role+" role; yours is "+u.UserRole(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireRole wraps handlers that only users with role may use.
+func requireRole(role string, fn func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, title string) {
+		if checkRole(w, r, role) {
+			fn(w, r, title)
+		}
+	}
+}
+
+// newUserRole returns the role of an account about to be created in
+// the wiki c belongs to.
+func newUserRole(c context.Context) (string, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	n, err := appFrom(c).db.users.CountDocuments(c, bson.D{})
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return roleAdmin, nil
+	}
+	return appFrom(c).cfg.DefaultRole, nil
+}
+
+// listUsers returns every account, without password hashes, by name.
+func listUsers(c context.Context) ([]User, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "passwordHash", Value: 0}}).
+		SetSort(bson.D{{Key: "name", Value: 1}})
+	cur, err := appFrom(c).db.users.Find(c, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []User{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+func setUserRole(c context.Context, name, role string) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	res, err := appFrom(c).db.users.UpdateOne(c,
+		bson.D{primitive.E{Key: "name", Value: name}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "role", Value: role}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no user called %q", name)
+	}
+	return nil
+}
+
+// UserAdmin is the data of the user management page. Self is the name
+// of the admin looking at it.
+type UserAdmin struct {
+	Users []User
+	Roles []string
+	Self  string
+}
+
+// adminUsersHandler serves /admin/users, where admins give users their
+// roles. Admins cannot change their own role, so there is always one
+// left.
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkRole(w, r, roleAdmin) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		name := r.FormValue("name")
+		if name == userName(r) {
+			http.Error(w, "you cannot change your own role", http.StatusBadRequest)
+			return
+		}
+		if err := setUserRole(r.Context(), name, r.FormValue("role")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addFlash(w, r, "Changed the role of "+name+" to "+r.FormValue("role")+".")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	list, err := listUsers(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "adminusers", nil, &UserAdmin{Users: list, Roles: roles, Self: userName(r)})
+}
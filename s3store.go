@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3PageStore keeps each page as a JSON object in an S3 bucket, or any
+// service speaking its API such as MinIO, under the key
+// {prefix}{title}.json. It suits cold storage: reading a page takes a
+// request, and listing pages reads the whole listing of the bucket.
+// Requests are signed with AWS Signature Version 4.
+type s3PageStore struct {
+	// endpoint is the address of the service and bucket the bucket's
+	// name, addressed path-style as endpoint/bucket/key.
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	creds    S3Credentials
+	client   *http.Client
+}
+
+// S3Credentials sign requests to S3.
+type S3Credentials struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// newS3PageStore returns a store for a location such as
+// https://s3.eu-west-1.amazonaws.com/bucket/prefix, whose first path
+// segment is the bucket and the rest a prefix for the keys.
+func newS3PageStore(location string, creds S3Credentials) (*s3PageStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("s3 location %q is not an http or https address", location)
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("s3 location %q names no bucket", location)
+	}
+	bucket, prefix := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, prefix = path[:i], path[i+1:]+"/"
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil, fmt.Errorf("s3 location %q needs -s3-access-key and -s3-secret-key", location)
+	}
+	return &s3PageStore{
+		endpoint: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:   bucket,
+		prefix:   prefix,
+		creds:    creds,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s *s3PageStore) key(title string) string {
+	return s.prefix + title + pageFileExt
+}
+
+// do sends a signed request for key, the bucket itself if empty, and
+// returns the response if its status is one of ok.
+func (s *s3PageStore) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, ok ...int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	u.RawPath = "/" + awsEscape(s.bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + awsEscape(key, true)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3(req, body, s.creds, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			resp.Body = cancelOnClose{resp.Body, cancel}
+			return resp, nil
+		}
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	var e struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(b, &e)
+	return nil, &s3Error{Status: resp.StatusCode, Code: e.Code, Message: e.Message}
+}
+
+// cancelOnClose cancels the context of a request when its response body
+// is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// s3Error is an error response from S3.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (s *s3PageStore) Get(ctx context.Context, title string) (*Page, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(title), nil, nil, nil, http.StatusOK)
+	if e, ok := err.(*s3Error); ok && e.Status == http.StatusNotFound {
+		return nil, errPageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodePage(b)
+}
+
+func (s *s3PageStore) put(ctx context.Context, p *Page, header http.Header) error {
+	b, err := encodePage(p)
+	if err != nil {
+		return err
+	}
+	header.Set("Content-Type", "application/json")
+	resp, err := s.do(ctx, http.MethodPut, s.key(p.Title), nil, header, b, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3PageStore) Put(ctx context.Context, p *Page) error {
+	return s.put(ctx, p, http.Header{})
+}
+
+func (s *s3PageStore) Delete(ctx context.Context, title string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(title), nil, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Rename writes the page under its new key only if there is none there,
+// then deletes the old one. S3 cannot rename objects, so for a moment
+// the page is found under both titles.
+func (s *s3PageStore) Rename(ctx context.Context, from, to string) error {
+	p, err := s.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	p.Title = to
+	err = s.put(ctx, p, http.Header{"If-None-Match": {"*"}})
+	if e, ok := err.(*s3Error); ok && e.Status == http.StatusPreconditionFailed {
+		return errPageExists
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, from)
+}
+
+func (s *s3PageStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	list, err := s.Summaries(ctx, ListQuery{Sort: sortByTitle, Offset: offset, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Title
+	}
+	return names, nil
+}
+
+// Summaries takes the modification time of a page from its object,
+// which is written whenever the page is saved.
+func (s *s3PageStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	list, err := s.listAll(ctx, q.Hidden)
+	if err != nil {
+		return nil, err
+	}
+	return sliceEntries(list, q), nil
+}
+
+func (s *s3PageStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	list, err := s.listAll(ctx, q.Hidden)
+	return len(list), err
+}
+
+// listAll returns every page in the bucket not in the hidden
+// namespaces, by title, following the listing from page to page.
+func (s *s3PageStore) listAll(ctx context.Context, hidden []string) ([]PageEntry, error) {
+	list := []PageEntry{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	next:
+		for _, c := range result.Contents {
+			if !strings.HasSuffix(c.Key, pageFileExt) {
+				continue
+			}
+			title := strings.TrimSuffix(strings.TrimPrefix(c.Key, s.prefix), pageFileExt)
+			for _, ns := range hidden {
+				if inNamespace(title, ns) {
+					continue next
+				}
+			}
+			list = append(list, PageEntry{Title: title, Updated: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+	return list, nil
+}
+
+// signS3 signs req, whose body is body, with AWS Signature Version 4,
+// as of now.
+func signS3(req *http.Request, body []byte, creds S3Credentials, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + creds.Region + "/s3/aws4_request"
+	requestSum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	key := []byte("AWS4" + creds.SecretKey)
+	for _, part := range []string{day, creds.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes s as AWS expects in signed requests, leaving
+// slashes alone if keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by name, as AWS signs it.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, k := range names {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
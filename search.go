@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// searchLimit is the maximum number of search results shown.
+const searchLimit = 50
+
+// snippetContext is roughly how many characters of body text are shown
+// on either side of the first match in a result snippet.
+const snippetContext = 80
+
+// SearchResult is a page matching a search query.
+type SearchResult struct {
+	Title   string
+	Snippet template.HTML
+}
+
+// SearchResults is what the search page shows.
+type SearchResults struct {
+	Query   string
+	Results []SearchResult
+}
+
+// createSearchIndex makes sure the text index used by searchPages
+// exists. Matches in titles count five times as much as in bodies.
+func createSearchIndex(c context.Context) error {
+	_, err := appFrom(c).db.pages.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys: bson.D{{Key: "title", Value: "text"}, {Key: "text", Value: "text"}},
+		Options: options.Index().
+			SetName("search").
+			SetWeights(bson.D{{Key: "title", Value: 5}, {Key: "text", Value: 1}}),
+	})
+	return err
+}
+
+// searchPages runs a full-text query, best matches first, over the
+// pages u may read that are not archived.
+func searchPages(c context.Context, query string, u *User) ([]SearchResult, error) {
+	hidden, err := unlistedNamespaces(c, u)
+	if err != nil {
+		return nil, err
+	}
+	if !appFrom(c).pagesInMongo() {
+		return scanSearch(c, query, hidden)
+	}
+	score := bson.D{{Key: "$meta", Value: "textScore"}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "title", Value: 1}, {Key: "text", Value: 1}, {Key: "score", Value: score}}).
+		SetSort(bson.D{{Key: "score", Value: score}}).
+		SetLimit(searchLimit)
+	filter := bson.D{primitive.E{Key: "$text", Value: bson.D{primitive.E{Key: "$search", Value: query}}}}
+	filter = append(filter, namespaceFilter("title", hidden)...)
+	cur, err := appFrom(c).db.pages.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Title string `bson:"title"`
+		Text  string `bson:"text"`
+	}
+	if err := cur.All(c, &docs); err != nil {
+		return nil, err
+	}
+	terms := searchTerms(query)
+	results := []SearchResult{}
+	for _, d := range docs {
+		results = append(results, SearchResult{Title: d.Title, Snippet: highlight(d.Text, terms)})
+	}
+	return results, nil
+}
+
+// scanSearch answers a query by reading every page outside the hidden
+// namespaces from the page store, for pages that are not all in the
+// Pages collection and its text index. Like the text index it finds the
+// pages with any of the terms, all of the quoted phrases and none of the
+// negated terms, matching whole words without stemming. Matches in
+// titles count five times as much as in bodies.
+func scanSearch(c context.Context, query string, hidden []string) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	phrases, negated := queryPhrases(query)
+	type match struct {
+		result SearchResult
+		score  int
+	}
+	var matches []match
+	err := scanPages(c, hidden, func(p *Page) error {
+		title, body := strings.ToLower(p.Title), strings.ToLower(string(p.Body))
+		for _, n := range negated {
+			if countWord(title, n)+countWord(body, n) > 0 {
+				return nil
+			}
+		}
+		for _, ph := range phrases {
+			if !strings.Contains(title, ph) && !strings.Contains(body, ph) {
+				return nil
+			}
+		}
+		score := 0
+		for _, t := range terms {
+			score += 5*countWord(title, t) + countWord(body, t)
+		}
+		if score > 0 {
+			matches = append(matches, match{SearchResult{Title: p.Title, Snippet: highlight(string(p.Body), terms)}, score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	results := []SearchResult{}
+	for i := 0; i < len(matches) && i < searchLimit; i++ {
+		results = append(results, matches[i].result)
+	}
+	return results, nil
+}
+
+// queryPhrases returns the lower-cased quoted phrases of a query and
+// its negated terms, written with a leading "-".
+func queryPhrases(query string) (phrases, negated []string) {
+	query = strings.ToLower(query)
+	parts := strings.Split(query, `"`)
+	for i := 1; i < len(parts); i += 2 {
+		if ph := strings.Join(strings.Fields(parts[i]), " "); ph != "" {
+			phrases = append(phrases, ph)
+		}
+	}
+	for i := 0; i < len(parts); i += 2 {
+		for _, f := range strings.Fields(parts[i]) {
+			if n := strings.TrimPrefix(f, "-"); n != f && n != "" {
+				negated = append(negated, n)
+			}
+		}
+	}
+	return phrases, negated
+}
+
+// countWord returns how often word occurs in text as a whole word.
+func countWord(text, word string) int {
+	n := 0
+	for i := 0; ; {
+		at := strings.Index(text[i:], word)
+		if at < 0 {
+			return n
+		}
+		start, end := i+at, i+at+len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			n++
+		}
+		i = end
+	}
+}
+
+// isWordRune reports whether r is part of a word. utf8.RuneError, for
+// the start and end of text, is not.
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// searchTerms splits a query into the lower-cased words to highlight,
+// ignoring quotes and negated terms.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, f := range strings.Fields(strings.ToLower(query)) {
+		if strings.HasPrefix(f, "-") {
+			continue
+		}
+		f = strings.TrimFunc(f, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if f != "" {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// firstMatch returns the byte offset and length of the earliest term
+// found in lower, or -1.
+func firstMatch(lower string, terms []string) (int, int) {
+	at, length := -1, 0
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i >= 0 && (at < 0 || i < at) {
+			at, length = i, len(t)
+		}
+	}
+	return at, length
+}
+
+// highlight returns an excerpt of text around the first match of any
+// term, with every match wrapped in <mark>. Text without a match, such
+// as a page found by its title, gives its beginning.
+func highlight(text string, terms []string) template.HTML {
+	text = strings.Join(strings.Fields(text), " ")
+	// Lower-casing can change the byte length of some characters, in
+	// which case offsets into the lower-cased copy are not valid.
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		return template.HTML(template.HTMLEscapeString(excerpt([]byte(text), 2*snippetContext)))
+	}
+
+	start, end := 0, len(text)
+	if at, _ := firstMatch(lower, terms); at >= 0 {
+		start = at - snippetContext
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > start+2*snippetContext {
+		end = start + 2*snippetContext
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		at, n := firstMatch(lower[i:end], terms)
+		if at < 0 {
+			b.WriteString(template.HTMLEscapeString(text[i:end]))
+			break
+		}
+		b.WriteString(template.HTMLEscapeString(text[i : i+at]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(text[i+at:i+at+n]) + "</mark>")
+		i += at + n
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+// searchHandler serves /search?q=. Queries without results are
+// recorded for the content gap report.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	sr := &SearchResults{Query: strings.TrimSpace(r.FormValue("q"))}
+	if sr.Query != "" {
+		results, err := searchPages(r.Context(), sr.Query, currentUser(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(results) == 0 {
+			recordSearchMiss(r.Context(), sr.Query)
+		}
+		sr.Results = results
+	}
+	renderTemplate(w, r, "search", nil, sr)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// searchGapsLimit is the number of queries shown in the content gap report.
+const searchGapsLimit = 100
+
+// SearchMiss is a search query that returned no results.
+type SearchMiss struct {
+	Query    string    `bson:"query"`
+	Count    int64     `bson:"count"`
+	LastSeen time.Time `bson:"lastSeen"`
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "ContentGaps",
+		Description: "Searches that found nothing, most frequent first.",
+		Handler:     contentGapsHandler,
+		Mongo:       true,
+		Role:        roleAdmin,
+	})
+}
+
+// normalizeQuery folds case and whitespace so that trivially different
+// spellings of a query are counted together.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+// recordSearchMiss counts a search query that returned no results.
+func recordSearchMiss(c context.Context, query string) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	query = normalizeQuery(query)
+	if query == "" || appFrom(c).db == nil {
+		return
+	}
+	_, err := appFrom(c).db.searchMisses.UpdateOne(c,
+		bson.D{primitive.E{Key: "query", Value: query}},
+		bson.D{
+			primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "count", Value: 1}}},
+			primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "lastSeen", Value: time.Now()}}},
+		},
+		upsert,
+	)
+	if err != nil {
+		log.Printf("recording search miss %q: %v", query, err)
+	}
+}
+
+// listSearchMisses returns the most frequent unanswered queries.
+func listSearchMisses(c context.Context, limit int64) ([]SearchMiss, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "count", Value: -1}, {Key: "lastSeen", Value: -1}}).
+		SetLimit(limit)
+	cur, err := appFrom(c).db.searchMisses.Find(c, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	misses := []SearchMiss{}
+	err = cur.All(c, &misses)
+	return misses, err
+}
+
+func contentGapsHandler(w http.ResponseWriter, r *http.Request) {
+	misses, err := listSearchMisses(r.Context(), searchGapsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "contentgaps", nil, misses)
+}
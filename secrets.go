@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Bodies submitted from the edit form, the API and mail are scanned for
+// credentials pasted by mistake, such as AWS keys, private keys and
+// tokens. Depending on -secret-scan the save goes ahead with a warning
+// or is refused, and either way the finding is written to the audit log,
+// naming the detector and line but never the secret itself.
+// -secret-detectors picks the detectors used and -secret-patterns adds
+// detectors of its own.
+
+// Secret scanning policies.
+const (
+	secretsOff   = "off"
+	secretsWarn  = "warn"
+	secretsBlock = "block"
+)
+
+// SecretDetector finds one kind of credential.
+type SecretDetector struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// secretDetectors are the built in detectors, also masked by the
+// "secrets" export mask.
+var secretDetectors = []SecretDetector{
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----)?`)},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"bearer-token", regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{20,}=*`)},
+	// Values assigned to names that suggest a credential, as in
+	// "password: hunter2".
+	{"password", regexp.MustCompile(`(?i)\b(?:password|passwd|secret|api[_-]?key|token)\s*[:=]\s*\S+`)},
+}
+
+// secretScanner scans bodies with the policy and detectors set with
+// -secret-scan, -secret-detectors and -secret-patterns.
+type secretScanner struct {
+	policy    string
+	detectors []SecretDetector
+}
+
+// newSecretScanner returns the secret scanner configured in cfg.
+func newSecretScanner(cfg *Config) (*secretScanner, error) {
+	policy, err := parseSecretPolicy(cfg.SecretScan)
+	if err != nil {
+		return nil, err
+	}
+	detectors, err := parseSecretDetectors(cfg.SecretDetectors, cfg.SecretPatterns)
+	if err != nil {
+		return nil, err
+	}
+	return &secretScanner{policy: policy, detectors: detectors}, nil
+}
+
+// SecretFinding is a likely credential found in a body.
+type SecretFinding struct {
+	Detector string
+	Line     int
+}
+
+func (f SecretFinding) String() string {
+	return fmt.Sprintf("%s on line %d", f.Detector, f.Line)
+}
+
+// parseSecretPolicy checks a -secret-scan value.
+func parseSecretPolicy(policy string) (string, error) {
+	switch policy {
+	case secretsOff, secretsWarn, secretsBlock:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown secret scan policy %q, use off, warn or block", policy)
+}
+
+// parseSecretDetectors returns the built in detectors named in names,
+// space separated, or all of them if it is empty, followed by those of
+// patterns, space separated name=regexp pairs.
+func parseSecretDetectors(names, patterns string) ([]SecretDetector, error) {
+	var list []SecretDetector
+	if strings.TrimSpace(names) == "" {
+		list = append(list, secretDetectors...)
+	}
+	for _, name := range strings.Fields(names) {
+		found := false
+		for _, d := range secretDetectors {
+			if d.Name == name {
+				list = append(list, d)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown secret detector %q", name)
+		}
+	}
+	for _, entry := range strings.Fields(patterns) {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("secret pattern %q is not of the form name=regexp", entry)
+		}
+		re, err := regexp.Compile(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("secret pattern %q: %v", entry, err)
+		}
+		list = append(list, SecretDetector{Name: entry[:i], Pattern: re})
+	}
+	return list, nil
+}
+
+// secretsPattern combines detectors into one regular expression.
+func secretsPattern(detectors []SecretDetector) *regexp.Regexp {
+	parts := make([]string, len(detectors))
+	for i, d := range detectors {
+		parts[i] = "(?:" + d.Pattern.String() + ")"
+	}
+	return regexp.MustCompile(strings.Join(parts, "|"))
+}
+
+// scan returns what the detectors find in body, in the order of the
+// detectors.
+func (ss *secretScanner) scan(body []byte) []SecretFinding {
+	var found []SecretFinding
+	for _, d := range ss.detectors {
+		for _, m := range d.Pattern.FindAllIndex(body, -1) {
+			found = append(found, SecretFinding{
+				Detector: d.Name,
+				Line:     bytes.Count(body[:m[0]], []byte("\n")) + 1,
+			})
+		}
+	}
+	return found
+}
+
+// describeSecrets lists findings for messages and the audit log.
+func describeSecrets(found []SecretFinding) string {
+	list := make([]string, len(found))
+	for i, f := range found {
+		list[i] = f.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+// screen scans p before actor saves it, recording what it finds in the
+// audit log. It reports whether the save may go ahead, which it may not
+// if something was found and the policy is to block.
+func (ss *secretScanner) screen(c context.Context, p *Page, actor string) ([]SecretFinding, bool) {
+	if ss.policy == secretsOff {
+		return nil, true
+	}
+	found := ss.scan(p.Body)
+	if len(found) == 0 {
+		return nil, true
+	}
+	blocked := ss.policy == secretsBlock
+	outcome := "allowed"
+	if blocked {
+		outcome = "blocked"
+	}
+	recordAudit(c, actor, "secret detected", p.Title+": "+describeSecrets(found)+" ("+outcome+")")
+	return found, !blocked
+}
+
+// preview is scan for previews, which are not audited.
+func (ss *secretScanner) preview(body []byte) []SecretFinding {
+	if ss.policy == secretsOff {
+		return nil
+	}
+	return ss.scan(body)
+}
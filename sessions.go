@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionRotation is how often the token of a remembered session is
+// replaced, so a stolen cookie stops working once the owner has been
+// back.
+const sessionRotation = 24 * time.Hour
+
+// sessionGrace is how long a replaced token keeps working, for requests
+// the browser sent before it got the new one.
+const sessionGrace = time.Minute
+
+// lastSeenInterval is how often the last use of a session is recorded.
+const lastSeenInterval = 5 * time.Minute
+
+// DeviceSessions is the data of the sessions page.
+type DeviceSessions struct {
+	Sessions []Session
+	Current  string
+}
+
+// remoteHost returns the address the request came from, without the
+// port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// currentSession returns the unexpired session the request's cookie
+// belongs to, or nil.
+func currentSession(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" || appFrom(r.Context()).db == nil {
+		return nil
+	}
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	var s Session
+	err = appFrom(c).db.sessions.FindOne(c, bson.D{primitive.E{Key: "_id", Value: hashToken(cookie.Value)}}).Decode(&s)
+	if err != nil || time.Now().After(s.Expires) {
+		return nil
+	}
+	return &s
+}
+
+// rotateSession replaces the token of s with a new one, which also
+// extends a remembered session. The old token works for sessionGrace
+// more.
+func rotateSession(w http.ResponseWriter, r *http.Request, s *Session) error {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	next := *s
+	next.TokenHash = hashToken(token)
+	next.Rotated = now
+	next.LastSeen = now
+	next.Expires = now.Add(appFrom(r.Context()).cfg.RememberLifetime)
+	next.Address = remoteHost(r)
+	if _, err := appFrom(c).db.sessions.InsertOne(c, &next); err != nil {
+		return err
+	}
+	_, err = appFrom(c).db.sessions.UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: s.TokenHash}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "expires", Value: now.Add(sessionGrace)}}}},
+	)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, token, &next)
+	return nil
+}
+
+// touchSession records that s was used just now, from the address r
+// came from.
+func touchSession(r *http.Request, s *Session) error {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.sessions.UpdateOne(c,
+		bson.D{primitive.E{Key: "_id", Value: s.TokenHash}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "lastSeen", Value: time.Now()},
+			primitive.E{Key: "address", Value: remoteHost(r)},
+		}}},
+	)
+	return err
+}
+
+// trackSessions records when sessions were last used, rotates the
+// tokens of remembered sessions and audits admins viewing the wiki as
+// someone else before passing requests on to h.
+func trackSessions(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s := currentSession(r); s != nil {
+			var err error
+			switch {
+			case databaseDegraded():
+				// Sessions cannot be written while the wiki is read only.
+			case s.Remember && time.Since(s.Rotated) > sessionRotation:
+				err = rotateSession(w, r, s)
+			case time.Since(s.LastSeen) > lastSeenInterval:
+				err = touchSession(r, s)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if _, _, basic := r.BasicAuth(); s.ViewAs != "" && !basic && !auditImpersonation(w, r, s) {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// userSessions returns the unexpired sessions of a user, most recently
+// used first.
+func userSessions(c context.Context, user string) ([]Session, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "lastSeen", Value: -1}})
+	cur, err := appFrom(c).db.sessions.Find(c, bson.D{
+		primitive.E{Key: "user", Value: user},
+		primitive.E{Key: "expires", Value: bson.D{primitive.E{Key: "$gt", Value: time.Now()}}},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Session{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// sessionsHandler serves /sessions, where users see the devices they
+// are signed in on and sign out of them, one at a time or all but the
+// current one.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	c, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+	s := currentSession(r)
+	if s == nil {
+		http.Redirect(w, r, "/login?next=/sessions", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		filter := bson.D{primitive.E{Key: "user", Value: s.User}}
+		msg := "Signed out of the other devices."
+		if id := r.FormValue("revoke"); id != "" {
+			filter = append(filter, primitive.E{Key: "_id", Value: id})
+			msg = "Signed out of that device."
+		} else {
+			filter = append(filter, primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$ne", Value: s.TokenHash}}})
+		}
+		if _, err := appFrom(c).db.sessions.DeleteMany(c, filter); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addFlash(w, r, msg)
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+		return
+	}
+	list, err := userSessions(c, s.User)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "sessions", nil, &DeviceSessions{Sessions: list, Current: s.TokenHash})
+}
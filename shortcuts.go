@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Shortcut binds a single key to a wiki URL. The URL may contain
+// a {title} placeholder which is replaced with the current page title.
+type Shortcut struct {
+	Key         string `json:"key"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+// defaultShortcuts are the keyboard shortcuts of wikis without a
+// -shortcuts-file. The "?" help overlay is built in and cannot be
+// rebound.
+var defaultShortcuts = []Shortcut{
+	{Key: "e", Description: "Edit this page", URL: "/edit/{title}"},
+	{Key: "p", Description: "Printable version", URL: "/print/{title}"},
+	{Key: "h", Description: "Page history", URL: "/history/{title}"},
+	{Key: "l", Description: "List all pages", URL: "/list"},
+	{Key: "/", Description: "Search", URL: "/search"},
+	{Key: "s", Description: "Special pages", URL: "/special/"},
+}
+
+// ShortcutSettings is what /shortcuts.json tells the script.
+type ShortcutSettings struct {
+	Bindings []Shortcut `json:"bindings"`
+	Enabled  bool       `json:"enabled"`
+	// Saved is set when Enabled is kept with the account of the user,
+	// who may then switch shortcuts on and off. Visitors who are not
+	// signed in always have them on.
+	Saved bool `json:"saved"`
+}
+
+// loadShortcuts returns the bindings in the -shortcuts-file, a JSON list
+// of shortcuts, or the default ones.
+func loadShortcuts(cfg *Config) ([]Shortcut, error) {
+	if cfg.ShortcutsFile == "" {
+		return defaultShortcuts, nil
+	}
+	b, err := os.ReadFile(cfg.ShortcutsFile)
+	if err != nil {
+		return nil, err
+	}
+	var list []Shortcut
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ShortcutsFile, err)
+	}
+	seen := map[string]bool{}
+	for _, s := range list {
+		switch {
+		case utf8.RuneCountInString(s.Key) != 1:
+			return nil, fmt.Errorf("%s: shortcut %q is not a single key", cfg.ShortcutsFile, s.Key)
+		case s.Key == "?":
+			return nil, fmt.Errorf("%s: ? shows the shortcuts and cannot be rebound", cfg.ShortcutsFile)
+		case seen[s.Key]:
+			return nil, fmt.Errorf("%s: shortcut %q is bound twice", cfg.ShortcutsFile, s.Key)
+		case localTarget(s.URL) != s.URL:
+			return nil, fmt.Errorf("%s: shortcut %q does not lead to a page of the wiki", cfg.ShortcutsFile, s.Key)
+		}
+		seen[s.Key] = true
+	}
+	return list, nil
+}
+
+// setShortcutsOff keeps whether the user called name has switched
+// keyboard shortcuts off.
+func setShortcutsOff(c context.Context, name string, off bool) error {
+	if appFrom(c).db == nil {
+		return errNoAccounts
+	}
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	_, err := appFrom(c).db.users.UpdateOne(c,
+		bson.D{primitive.E{Key: "name", Value: name}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "shortcutsOff", Value: off}}}},
+	)
+	return err
+}
+
+// shortcutsHandler serves /shortcuts.json: the bindings and whether the
+// user has them on, which signed in users change by posting "enabled".
+func shortcutsHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	settings := ShortcutSettings{
+		Bindings: appFrom(r.Context()).shortcuts,
+		Enabled:  u == nil || !u.ShortcutsOff,
+		Saved:    u != nil && appFrom(r.Context()).db != nil,
+	}
+	if r.Method == http.MethodPost {
+		if !settings.Saved {
+			apiError(w, http.StatusForbidden, "sign in to switch keyboard shortcuts off")
+			return
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(r.FormValue("enabled")))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+		if err := setShortcutsOff(r.Context(), u.Name, !on); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		settings.Enabled = on
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A snapshot is a named label, such as "v2.3", on the revision every
+// page was at when it was taken, for documenting software releases.
+// Readers browse a snapshot with a cookie: while it is set, /view/
+// shows pages as they were in the snapshot and a banner says so. The
+// rest of the wiki, including editing, stays live.
+
+// snapshotCookie names the snapshot a browser is looking at.
+const snapshotCookie = "snapshot"
+
+// snapshotBatch is the number of pages written to a snapshot at once.
+const snapshotBatch = 500
+
+var validSnapshotName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+var errSnapshotExists = errors.New("a snapshot with that name already exists")
+
+// Snapshot is a named set of page revisions.
+type Snapshot struct {
+	Name    string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+	Author  string    `bson:"author"`
+	Pages   int       `bson:"pages"`
+}
+
+// SnapshotPage is a page in a snapshot. Pages saved before revisions
+// were kept have no revision to point to, so their body is copied in.
+type SnapshotPage struct {
+	Snapshot string    `bson:"snapshot"`
+	Title    string    `bson:"title"`
+	Revision int       `bson:"revision"`
+	Body     []byte    `bson:"body,omitempty"`
+	Lang     string    `bson:"lang,omitempty"`
+	Updated  time.Time `bson:"updated"`
+	// Taken is when the snapshot was taken, for the janitor to tell
+	// snapshots being taken from ones that failed.
+	Taken time.Time `bson:"taken"`
+}
+
+// SnapshotList is the data of Special:Snapshots. Snapshot and Pages are
+// set when one snapshot is shown.
+type SnapshotList struct {
+	Snapshots []Snapshot
+	Browsing  string
+	CanCreate bool
+	Snapshot  *Snapshot
+	Pages     []SnapshotPage
+}
+
+// SnapshotComparison lists how the pages of snapshot To differ from
+// those of snapshot From.
+type SnapshotComparison struct {
+	From, To *Snapshot
+	Added    []SnapshotPage
+	Removed  []SnapshotPage
+	Changed  []SnapshotChange
+}
+
+// SnapshotChange is a page in both snapshots of a comparison whose
+// content differs between them.
+type SnapshotChange struct {
+	Title    string
+	From, To int
+}
+
+// DiffURL returns the address of the diff between the two revisions,
+// or "" for pages saved before revisions were kept, which have none.
+func (c SnapshotChange) DiffURL() string {
+	if c.From == 0 || c.To == 0 {
+		return ""
+	}
+	return pageURL("diff", c.Title) + "/" + strconv.Itoa(c.From) + "/" + strconv.Itoa(c.To)
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Snapshots",
+		Description: "Named snapshots of every page, such as one per release, to browse the wiki as it was.",
+		Handler:     snapshotsHandler,
+		Mongo:       true,
+	})
+}
+
+// createSnapshot records the revision every page is at as the snapshot
+// called name.
+func createSnapshot(c context.Context, name, author string) (*Snapshot, error) {
+	n, err := appFrom(c).db.snapshots.CountDocuments(c, bson.D{primitive.E{Key: "_id", Value: name}})
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, errSnapshotExists
+	}
+
+	s := &Snapshot{Name: name, Created: time.Now(), Author: author}
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := appFrom(c).db.snapshotPages.InsertMany(c, batch)
+		batch = batch[:0]
+		return err
+	}
+	err = forEachPage(c, func(p *Page) error {
+		sp := &SnapshotPage{Snapshot: name, Title: p.Title, Revision: p.Revision, Updated: p.Updated, Taken: s.Created}
+		if p.Revision == 0 {
+			sp.Body, sp.Lang = p.Body, p.Lang
+		}
+		batch = append(batch, sp)
+		s.Pages++
+		if len(batch) == snapshotBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The snapshot is listed only once all its pages are in.
+	if _, err := appFrom(c).db.snapshots.InsertOne(c, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createSnapshotIndex makes sure the pages of a snapshot can be looked
+// up by title quickly.
+func createSnapshotIndex(c context.Context) error {
+	_, err := appFrom(c).db.snapshotPages.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys:    bson.D{{Key: "snapshot", Value: 1}, {Key: "title", Value: 1}},
+		Options: options.Index().SetName("snapshot_title").SetUnique(true),
+	})
+	return err
+}
+
+func loadSnapshot(c context.Context, name string) (*Snapshot, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var s Snapshot
+	err := appFrom(c).db.snapshots.FindOne(c, bson.D{primitive.E{Key: "_id", Value: name}}).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func listSnapshots(c context.Context) ([]Snapshot, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	cur, err := appFrom(c).db.snapshots.Find(c, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Snapshot{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// snapshotPages lists the pages in a snapshot that u may read by title,
+// without bodies.
+func snapshotPages(c context.Context, name string, u *User) ([]SnapshotPage, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "body", Value: 0}}).
+		SetSort(bson.D{{Key: "title", Value: 1}})
+	filter := append(bson.D{primitive.E{Key: "snapshot", Value: name}}, readFilter(c, u, "title")...)
+	cur, err := appFrom(c).db.snapshotPages.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []SnapshotPage{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// loadSnapshotPage returns the page called title as it was in the
+// snapshot called name.
+func loadSnapshotPage(c context.Context, name, title string) (*Page, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var sp SnapshotPage
+	err := appFrom(c).db.snapshotPages.FindOne(c, bson.D{
+		primitive.E{Key: "snapshot", Value: name},
+		primitive.E{Key: "title", Value: title},
+	}).Decode(&sp)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sp.Revision == 0 {
+		return &Page{Title: title, Body: sp.Body, Lang: sp.Lang, Updated: sp.Updated}, nil
+	}
+	rev, err := loadRevision(c, title, sp.Revision)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Title: title, Body: rev.Body, Lang: rev.Lang, Updated: rev.Saved, Revision: rev.Number}, nil
+}
+
+// compareSnapshots reports the pages u may read that were added,
+// removed and changed between snapshots from and to.
+func compareSnapshots(c context.Context, from, to *Snapshot, u *User) (*SnapshotComparison, error) {
+	a, err := snapshotPages(c, from.Name, u)
+	if err != nil {
+		return nil, err
+	}
+	b, err := snapshotPages(c, to.Name, u)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp := &SnapshotComparison{From: from, To: to, Added: []SnapshotPage{}, Removed: []SnapshotPage{}, Changed: []SnapshotChange{}}
+	// Both lists are sorted by title, so they are walked side by side.
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || i < len(a) && a[i].Title < b[j].Title:
+			cmp.Removed = append(cmp.Removed, a[i])
+			i++
+		case i == len(a) || b[j].Title < a[i].Title:
+			cmp.Added = append(cmp.Added, b[j])
+			j++
+		default:
+			changed, err := snapshotPageChanged(c, from.Name, to.Name, a[i], b[j])
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				cmp.Changed = append(cmp.Changed, SnapshotChange{Title: a[i].Title, From: a[i].Revision, To: b[j].Revision})
+			}
+			i++
+			j++
+		}
+	}
+	return cmp, nil
+}
+
+// snapshotPageChanged reports whether a page differs between two
+// snapshots. Pages at a revision differ when the revision does; the
+// bodies copied for older pages are compared.
+func snapshotPageChanged(c context.Context, from, to string, a, b SnapshotPage) (bool, error) {
+	if a.Revision != 0 || b.Revision != 0 {
+		return a.Revision != b.Revision, nil
+	}
+	pa, err := loadSnapshotPage(c, from, a.Title)
+	if err != nil {
+		return false, err
+	}
+	pb, err := loadSnapshotPage(c, to, b.Title)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(pa.Body, pb.Body), nil
+}
+
+// browsingSnapshot returns the name of the snapshot the client browses,
+// or "".
+func browsingSnapshot(r *http.Request) string {
+	c, err := r.Cookie(snapshotCookie)
+	if err != nil || !validSnapshotName.MatchString(c.Value) {
+		return ""
+	}
+	return c.Value
+}
+
+func setSnapshotCookie(w http.ResponseWriter, r *http.Request, name string) {
+	c := &http.Cookie{
+		Name:     snapshotCookie,
+		Value:    name,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if name == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// snapshotsHandler serves Special:Snapshots, listing the snapshots, and
+// Special:Snapshots/{name}, listing the pages of one. Posting "create"
+// with a name takes a snapshot; "browse" and "leave" start and stop
+// browsing one. Special:Snapshots/{name}?compare={other} lists what
+// changed from one snapshot to the other.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		name := strings.TrimSpace(r.FormValue("name"))
+		switch {
+		case r.FormValue("leave") != "":
+			setSnapshotCookie(w, r, "")
+			addFlash(w, r, "You are back on the live wiki.")
+			http.Redirect(w, r, "/special/Snapshots", http.StatusSeeOther)
+		case r.FormValue("browse") != "":
+			if _, err := loadSnapshot(r.Context(), name); err != nil {
+				http.Error(w, "no snapshot called "+name, http.StatusNotFound)
+				return
+			}
+			setSnapshotCookie(w, r, name)
+			addFlash(w, r, "Pages are shown as they were in "+name+".")
+			http.Redirect(w, r, "/special/Snapshots/"+name, http.StatusSeeOther)
+		case r.FormValue("create") != "":
+			if !checkRole(w, r, roleEditor) {
+				return
+			}
+			if !validSnapshotName.MatchString(name) {
+				http.Error(w, "snapshot names are letters, digits, dots, dashes and underscores, such as v2.3", http.StatusBadRequest)
+				return
+			}
+			s, err := createSnapshot(r.Context(), name, userName(r))
+			if err == errSnapshotExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			addFlash(w, r, "Took snapshot "+s.Name+" of "+strconv.Itoa(s.Pages)+" pages.")
+			http.Redirect(w, r, "/special/Snapshots/"+s.Name, http.StatusSeeOther)
+		default:
+			http.Error(w, "nothing to do", http.StatusBadRequest)
+		}
+		return
+	}
+
+	list := &SnapshotList{Browsing: browsingSnapshot(r), CanCreate: currentUser(r).Can(roleEditor)}
+	path := strings.TrimPrefix(r.URL.Path, "/special/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		s, err := loadSnapshot(r.Context(), path[i+1:])
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+		if other := r.FormValue("compare"); other != "" {
+			to, err := loadSnapshot(r.Context(), other)
+			if err != nil {
+				notFound(w, r)
+				return
+			}
+			cmp, err := compareSnapshots(r.Context(), s, to, currentUser(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			renderTemplate(w, r, "snapshotdiff", nil, cmp)
+			return
+		}
+		list.Snapshot = s
+		if list.Pages, err = snapshotPages(r.Context(), s.Name, currentUser(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var err error
+	if list.Snapshots, err = listSnapshots(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "snapshots", nil, list)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SpecialPage is a generated report page served as /special/{Name}
+// and displayed as "Special:{Name}".
+type SpecialPage struct {
+	Name        string
+	Description string
+	Handler     http.HandlerFunc
+	// Role, if set, is needed to see the page.
+	Role string
+	// Mongo is set for pages built on what is kept in MongoDB, which
+	// wikis without a database do not have.
+	Mongo bool
+}
+
+// specialPages holds every registered special page keyed by lower case
+// name, so /special/Statistics and /special/statistics are the same page.
+var specialPages = map[string]*SpecialPage{}
+
+// registerSpecialPage makes a special page reachable under /special/.
+// It is meant to be called from init functions.
+func registerSpecialPage(sp *SpecialPage) {
+	key := strings.ToLower(sp.Name)
+	if _, exists := specialPages[key]; exists {
+		panic("special page registered twice: " + sp.Name)
+	}
+	specialPages[key] = sp
+}
+
+// sortedSpecialPages returns the registered special pages ordered by
+// name, leaving out those needing MongoDB unless mongo is set.
+func sortedSpecialPages(mongo bool) []*SpecialPage {
+	list := make([]*SpecialPage, 0, len(specialPages))
+	for _, sp := range specialPages {
+		if sp.Mongo && !mongo {
+			continue
+		}
+		list = append(list, sp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func specialHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/special/")
+	name = strings.TrimPrefix(name, "Special:")
+	if name == "" {
+		specialIndexHandler(w, r)
+		return
+	}
+
+	// Special pages may take an argument after their name, as in
+	// Special:Changelog/Policy.
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	sp, ok := specialPages[strings.ToLower(name)]
+	if !ok || sp.Mongo && !appFrom(r.Context()).hasDatabase() {
+		notFound(w, r)
+		return
+	}
+	if sp.Role != "" && !checkRole(w, r, sp.Role) {
+		return
+	}
+	sp.Handler(w, r)
+}
+
+func specialIndexHandler(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, r, "special", nil, sortedSpecialPages(appFrom(r.Context()).hasDatabase()))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultDictionary is the hunspell dictionary used for spellchecking
+// unless -dictionary names another. Spellchecking is disabled when the
+// file does not exist.
+const defaultDictionary = "/usr/share/hunspell/en_US.dic"
+
+// customWordsTitle is the wiki page listing additional accepted words,
+// one per line.
+const customWordsTitle = "Dictionary"
+
+// maxSuggestions limits the corrections offered for a single word.
+const maxSuggestions = 5
+
+// Misspelling is a word not found in the dictionary.
+type Misspelling struct {
+	Word        string   `json:"word"`
+	Offset      int      `json:"offset"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// spellDictionary is a dictionary read on first use.
+type spellDictionary struct {
+	path  string
+	once  sync.Once
+	words map[string]bool
+}
+
+// loadDictionary reads the word stems of a hunspell .dic file. Affix
+// flags after "/" are ignored, so only the listed forms and simple
+// plurals are known.
+func loadDictionary(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			// The first line holds the approximate word count.
+			first = false
+			continue
+		}
+		if i := strings.IndexAny(line, "/\t "); i >= 0 {
+			line = line[:i]
+		}
+		if line != "" {
+			words[strings.ToLower(line)] = true
+		}
+	}
+	return words, scanner.Err()
+}
+
+func (d *spellDictionary) wordList() map[string]bool {
+	d.once.Do(func() {
+		words, err := loadDictionary(d.path)
+		if err != nil {
+			log.Printf("spellcheck disabled: %v", err)
+			return
+		}
+		d.words = words
+	})
+	return d.words
+}
+
+// customWords returns the words listed on the Dictionary page.
+func customWords(c context.Context) map[string]bool {
+	words := map[string]bool{}
+	p, err := loadPage(c, customWordsTitle)
+	if err != nil {
+		return words
+	}
+	for _, w := range strings.Fields(string(p.Body)) {
+		words[strings.ToLower(w)] = true
+	}
+	return words
+}
+
+// skipWord reports whether a word should not be checked at all:
+// acronyms and CamelCase page titles.
+func skipWord(word string) bool {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	return upper > 1
+}
+
+func known(word string, dict, custom map[string]bool) bool {
+	w := strings.ToLower(strings.Trim(word, "'"))
+	if dict[w] || custom[w] {
+		return true
+	}
+	for _, suffix := range []string{"s", "es", "'s"} {
+		if strings.HasSuffix(w, suffix) && dict[strings.TrimSuffix(w, suffix)] {
+			return true
+		}
+	}
+	return false
+}
+
+// suggest returns dictionary words one edit away from word.
+func suggest(word string, dict map[string]bool) []string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	w := strings.ToLower(word)
+	seen := map[string]bool{}
+	list := []string{}
+	try := func(c string) {
+		if len(list) < maxSuggestions && dict[c] && !seen[c] {
+			seen[c] = true
+			list = append(list, c)
+		}
+	}
+	for i := 0; i <= len(w); i++ {
+		if i < len(w) {
+			try(w[:i] + w[i+1:])
+		}
+		if i+1 < len(w) {
+			try(w[:i] + string(w[i+1]) + string(w[i]) + w[i+2:])
+		}
+		for _, c := range letters {
+			if i < len(w) {
+				try(w[:i] + string(c) + w[i+1:])
+			}
+			try(w[:i] + string(c) + w[i:])
+		}
+	}
+	return list
+}
+
+// checkSpelling returns the misspelled words of text with their byte
+// offsets.
+func checkSpelling(text string, dict, custom map[string]bool) []Misspelling {
+	list := []Misspelling{}
+	start := -1
+	for i, r := range text + " " {
+		inWord := unicode.IsLetter(r) || (r == '\'' && start >= 0)
+		if inWord && start < 0 {
+			start = i
+		}
+		if inWord || start < 0 {
+			continue
+		}
+		word := strings.TrimRight(text[start:i], "'")
+		if utf8.RuneCountInString(word) > 1 && !skipWord(word) && !known(word, dict, custom) {
+			list = append(list, Misspelling{
+				Word:        word,
+				Offset:      start,
+				Suggestions: suggest(word, dict),
+			})
+		}
+		start = -1
+	}
+	return list
+}
+
+func spellcheckHandler(w http.ResponseWriter, r *http.Request) {
+	dict := appFrom(r.Context()).dictionary.wordList()
+	if dict == nil {
+		http.Error(w, "spellcheck is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(checkSpelling(r.FormValue("text"), dict, customWords(r.Context())))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
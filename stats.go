@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// statsTTL is how long computed statistics are served from memory.
+const statsTTL = 5 * time.Minute
+
+// largestPagesLimit is the number of pages shown in the largest pages table.
+const largestPagesLimit = 10
+
+// activeEditorsLimit is the number of authors shown in the most active
+// editors list.
+const activeEditorsLimit = 10
+
+// PageSize is a page title with the size of its body in bytes.
+type PageSize struct {
+	Title string `bson:"title"`
+	Size  int64  `bson:"size"`
+}
+
+// WikiStats summarises the content of the wiki.
+type WikiStats struct {
+	Pages     int64
+	Revisions int64
+	Users     int64
+	// Editors is the number of distinct authors of revisions.
+	Editors int64
+	// Bytes and LargestPages are only computed when Sized is set, see
+	// sizeVersion.
+	Sized        bool
+	Bytes        int64
+	LargestPages []PageSize
+	// EditsPerDay counts the revisions saved on each of the last Days
+	// days that had any, and TopEditors the revisions of the authors
+	// who saved the most over the same period.
+	Days        int
+	EditsPerDay []DailyCount
+	MaxDaily    int64
+	TopEditors  []NamedCount
+	Computed    time.Time
+}
+
+var statsCache struct {
+	sync.Mutex
+	stats *WikiStats
+}
+
+func init() {
+	registerSpecialPage(&SpecialPage{
+		Name:        "Statistics",
+		Description: "Page, revision and user counts, edits per day, the most active editors and the largest pages of the wiki.",
+		Handler:     statisticsHandler,
+		Mongo:       true,
+	})
+}
+
+// sizeVersion is the first MongoDB release with $binarySize, which page
+// sizes are computed with. Older servers get the statistics without them.
+var sizeVersion = []int32{4, 4}
+
+// bodySize is an aggregation expression for the body length in bytes.
+var bodySize = bson.D{{Key: "$binarySize", Value: bson.D{
+	{Key: "$ifNull", Value: bson.A{"$body", ""}},
+}}}
+
+// computeStats counts what is in the wiki. Pages routed to other stores
+// are counted and sized through the page store, as they are not in the
+// Pages collection.
+func computeStats(c context.Context) (*WikiStats, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	stats := &WikiStats{Days: analyticsDays, Computed: time.Now()}
+
+	var err error
+	if !appFrom(c).pagesInMongo() {
+		err = scanPages(c, nil, func(p *Page) error {
+			stats.Pages++
+			stats.Bytes += int64(len(p.Body))
+			stats.LargestPages = append(stats.LargestPages, PageSize{Title: p.Title, Size: int64(len(p.Body))})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(stats.LargestPages, func(i, j int) bool {
+			return stats.LargestPages[i].Size > stats.LargestPages[j].Size
+		})
+		if len(stats.LargestPages) > largestPagesLimit {
+			stats.LargestPages = stats.LargestPages[:largestPagesLimit]
+		}
+		stats.Sized = true
+	} else if stats.Pages, err = appFrom(c).db.pages.CountDocuments(c, bson.D{}); err != nil {
+		return nil, err
+	}
+	if stats.Revisions, err = appFrom(c).db.revisions.CountDocuments(c, bson.D{}); err != nil {
+		return nil, err
+	}
+	if stats.Users, err = appFrom(c).db.users.CountDocuments(c, bson.D{}); err != nil {
+		return nil, err
+	}
+	if stats.Editors, err = countEditors(c); err != nil {
+		return nil, err
+	}
+	if err := editActivity(c, stats); err != nil {
+		return nil, err
+	}
+
+	if stats.Sized {
+		return stats, nil
+	}
+	if stats.Sized, err = serverAtLeast(c, sizeVersion); err != nil || !stats.Sized {
+		return stats, err
+	}
+	cur, err := appFrom(c).db.pages.Aggregate(c, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "bytes", Value: bson.D{{Key: "$sum", Value: bodySize}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var totals []struct {
+		Bytes int64 `bson:"bytes"`
+	}
+	if err := cur.All(c, &totals); err != nil {
+		return nil, err
+	}
+	if len(totals) > 0 {
+		stats.Bytes = totals[0].Bytes
+	}
+
+	cur, err = appFrom(c).db.pages.Aggregate(c, mongo.Pipeline{
+		{{Key: "$project", Value: bson.D{
+			{Key: "title", Value: 1},
+			{Key: "size", Value: bodySize},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "size", Value: -1}}}},
+		{{Key: "$limit", Value: largestPagesLimit}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(c, &stats.LargestPages); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// countEditors returns the number of distinct authors of revisions.
+func countEditors(c context.Context) (int64, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	cur, err := appFrom(c).db.revisions.Aggregate(c, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$author"}}}},
+		{{Key: "$count", Value: "editors"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var res []struct {
+		Editors int64 `bson:"editors"`
+	}
+	if err := cur.All(c, &res); err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0].Editors, nil
+}
+
+// editActivity fills in the edits per day and the most active editors
+// of stats, going by the revisions saved over the last stats.Days days.
+func editActivity(c context.Context, stats *WikiStats) error {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -stats.Days+1)
+	recent := bson.D{{Key: "$match", Value: bson.D{{Key: "saved", Value: bson.D{{Key: "$gte", Value: since}}}}}}
+
+	cur, err := appFrom(c).db.revisions.Aggregate(c, mongo.Pipeline{
+		recent,
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+				{Key: "format", Value: "%Y-%m-%d"},
+				{Key: "date", Value: "$saved"},
+			}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := cur.All(c, &stats.EditsPerDay); err != nil {
+		return err
+	}
+	for _, d := range stats.EditsPerDay {
+		if d.Count > stats.MaxDaily {
+			stats.MaxDaily = d.Count
+		}
+	}
+
+	cur, err = appFrom(c).db.revisions.Aggregate(c, mongo.Pipeline{
+		recent,
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$author"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: activeEditorsLimit}},
+	})
+	if err != nil {
+		return err
+	}
+	return cur.All(c, &stats.TopEditors)
+}
+
+// serverAtLeast reports whether the MongoDB server is at least the given
+// version, as major, minor.
+func serverAtLeast(c context.Context, version []int32) (bool, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var info struct {
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	err := appFrom(c).db.RunCommand(c, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+	if err != nil {
+		return false, err
+	}
+	for i, want := range version {
+		if i >= len(info.VersionArray) || info.VersionArray[i] < want {
+			return false, nil
+		}
+		if info.VersionArray[i] > want {
+			return true, nil
+		}
+	}
+	return true, nil
+}
+
+// loadStats returns cached statistics, recomputing them once statsTTL
+// has passed.
+func loadStats(c context.Context) (*WikiStats, error) {
+	statsCache.Lock()
+	defer statsCache.Unlock()
+
+	if statsCache.stats != nil && time.Since(statsCache.stats.Computed) < statsTTL {
+		return statsCache.stats, nil
+	}
+	stats, err := computeStats(c)
+	if err != nil {
+		return nil, err
+	}
+	statsCache.stats = stats
+	return stats, nil
+}
+
+func statisticsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := loadStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The statistics are shared, so the largest pages are left out here
+	// rather than in the query.
+	shown := *stats
+	shown.LargestPages = []PageSize{}
+	u := currentUser(r)
+	for _, ps := range stats.LargestPages {
+		if canRead(r.Context(), u, ps.Title) {
+			shown.LargestPages = append(shown.LargestPages, ps)
+		}
+	}
+	renderTemplate(w, r, "statistics", nil, &shown)
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PageStore keeps wiki pages by title. Every method stops when ctx is
+// cancelled, such as when the client making the request goes away.
+type PageStore interface {
+	// Get returns the page called title, or errPageNotFound.
+	Get(ctx context.Context, title string) (*Page, error)
+	// Put stores p under its title, creating the page if it does not
+	// exist yet.
+	Put(ctx context.Context, p *Page) error
+	// Delete removes the page called title. Deleting a page that does
+	// not exist is not an error.
+	Delete(ctx context.Context, title string) error
+	// Rename moves the page called from to the title to in one step,
+	// so readers find it under one title or the other. It returns
+	// errPageNotFound if from does not exist and errPageExists if to
+	// does.
+	Rename(ctx context.Context, from, to string) error
+	// List returns page titles in alphabetical order, skipping the
+	// first offset and returning at most limit. A limit of 0 returns
+	// all the rest.
+	List(ctx context.Context, offset, limit int) ([]string, error)
+	// Summaries returns the title and modification time of pages in
+	// the order q asks for, paged like List.
+	Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error)
+	// Count returns the number of pages q lists, ignoring its offset
+	// and limit.
+	Count(ctx context.Context, q ListQuery) (int, error)
+}
+
+// Orders pages can be listed in.
+const (
+	sortByTitle   = "title"   // alphabetical
+	sortByUpdated = "updated" // most recently changed first
+)
+
+// ListQuery selects a slice of the pages in an order. Pages in the
+// Hidden namespaces are left out.
+type ListQuery struct {
+	Sort          string
+	Offset, Limit int
+	Hidden        []string
+}
+
+// PageEntry is what page lists show of a page.
+type PageEntry struct {
+	Title   string    `bson:"title"`
+	Updated time.Time `bson:"updated"`
+}
+
+var errPageNotFound = errors.New("Page not found")
+
+// errPageExists is returned when renaming a page to a title in use.
+var errPageExists = errors.New("a page with this title already exists")
+
+// errEditConflict is returned when a page was saved by someone else
+// after the revision an edit started from.
+var errEditConflict = errors.New("the page was changed by someone else")
+
+// conditionalStore is implemented by page stores that can check the
+// revision of a page and replace it in one step.
+type conditionalStore interface {
+	// PutAt stores p if the stored page is at revision base, 0 meaning
+	// it does not exist yet, and returns errEditConflict otherwise.
+	PutAt(ctx context.Context, p *Page, base int) error
+}
+
+// putAtMu serialises the check and write of putAt for stores that are
+// not conditionalStores, which makes them atomic within this process.
+var putAtMu sync.Mutex
+
+// putAt stores p in s if the stored page is at revision base, 0 meaning
+// it does not exist yet, and returns errEditConflict otherwise.
+func putAt(ctx context.Context, s PageStore, p *Page, base int) error {
+	if cs, ok := s.(conditionalStore); ok {
+		return cs.PutAt(ctx, p, base)
+	}
+	putAtMu.Lock()
+	defer putAtMu.Unlock()
+	current, err := s.Get(ctx, p.Title)
+	switch {
+	case err == errPageNotFound:
+		if base != 0 {
+			return errEditConflict
+		}
+	case err != nil:
+		return err
+	case current.Revision != base:
+		return errEditConflict
+	}
+	return s.Put(ctx, p)
+}
+
+// pagingStore is implemented by page stores that can list a page of
+// summaries and count the pages from one listing.
+type pagingStore interface {
+	// SummariesCount returns what Summaries and Count return for q.
+	SummariesCount(ctx context.Context, q ListQuery) ([]PageEntry, int, error)
+}
+
+// summariesCount returns the summaries q asks for from s and the number
+// of pages q lists.
+func summariesCount(ctx context.Context, s PageStore, q ListQuery) ([]PageEntry, int, error) {
+	if ps, ok := s.(pagingStore); ok {
+		return ps.SummariesCount(ctx, q)
+	}
+	n, err := s.Count(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := s.Summaries(ctx, q)
+	return list, n, err
+}
+
+// dbTimeout bounds a single page store operation, so a stuck database
+// does not hold requests forever.
+const dbTimeout = 10 * time.Second
+
+// newPageStore returns the backend called kind. dir is where the
+// filesystem backend keeps its files, "pages" by default, and d the
+// database the mongo backend keeps its pages in.
+func newPageStore(kind, dir string, d *database) (PageStore, error) {
+	if dir == "" {
+		dir = "pages"
+	}
+	switch kind {
+	case "", "mongo":
+		return &mongoPageStore{coll: d.pages}, nil
+	case "fs":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &filePageStore{dir: dir}, nil
+	}
+	return nil, fmt.Errorf("unknown page store %q", kind)
+}
+
+// scanPages calls fn for every page outside the hidden namespaces in
+// title order, reading each from the page store. Pages deleted while
+// the scan runs are skipped.
+func scanPages(c context.Context, hidden []string, fn func(*Page) error) error {
+	store := appFrom(c).pages
+	list, err := store.Summaries(c, ListQuery{Sort: sortByTitle, Hidden: hidden})
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		p, err := store.Get(c, e.Title)
+		if err == errPageNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoreHook is told about every page store operation, for example to
+// record how long they take.
+type StoreHook func(op string, took time.Duration, err error)
+
+// hookStore returns a PageStore passing every operation to s and then
+// reporting it to hook.
+func hookStore(s PageStore, hook StoreHook) PageStore {
+	return &hookedStore{s: s, hook: hook}
+}
+
+type hookedStore struct {
+	s    PageStore
+	hook StoreHook
+}
+
+func (h *hookedStore) Get(ctx context.Context, title string) (*Page, error) {
+	start := time.Now()
+	p, err := h.s.Get(ctx, title)
+	h.hook("get", time.Since(start), err)
+	return p, err
+}
+
+func (h *hookedStore) Put(ctx context.Context, p *Page) error {
+	start := time.Now()
+	err := h.s.Put(ctx, p)
+	h.hook("put", time.Since(start), err)
+	return err
+}
+
+func (h *hookedStore) PutAt(ctx context.Context, p *Page, base int) error {
+	start := time.Now()
+	err := putAt(ctx, h.s, p, base)
+	h.hook("put", time.Since(start), err)
+	return err
+}
+
+func (h *hookedStore) Delete(ctx context.Context, title string) error {
+	start := time.Now()
+	err := h.s.Delete(ctx, title)
+	h.hook("delete", time.Since(start), err)
+	return err
+}
+
+func (h *hookedStore) Rename(ctx context.Context, from, to string) error {
+	start := time.Now()
+	err := h.s.Rename(ctx, from, to)
+	h.hook("rename", time.Since(start), err)
+	return err
+}
+
+func (h *hookedStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	start := time.Now()
+	names, err := h.s.List(ctx, offset, limit)
+	h.hook("list", time.Since(start), err)
+	return names, err
+}
+
+func (h *hookedStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	start := time.Now()
+	list, err := h.s.Summaries(ctx, q)
+	h.hook("summaries", time.Since(start), err)
+	return list, err
+}
+
+func (h *hookedStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	start := time.Now()
+	n, err := h.s.Count(ctx, q)
+	h.hook("count", time.Since(start), err)
+	return n, err
+}
+
+func (h *hookedStore) SummariesCount(ctx context.Context, q ListQuery) ([]PageEntry, int, error) {
+	start := time.Now()
+	list, n, err := summariesCount(ctx, h.s, q)
+	h.hook("summaries", time.Since(start), err)
+	return list, n, err
+}
+
+// mongoPageStore keeps pages as documents in a MongoDB collection.
+type mongoPageStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoPageStore) Get(ctx context.Context, title string) (*Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var result *Page
+	filter := bson.D{primitive.E{Key: "title", Value: title}}
+	err := s.coll.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *mongoPageStore) Put(ctx context.Context, p *Page) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	filter := bson.D{primitive.E{Key: "title", Value: p.Title}}
+	_, err := s.coll.ReplaceOne(ctx, filter, pageDocument(p), options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoPageStore) PutAt(ctx context.Context, p *Page, base int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var res *mongo.UpdateResult
+	var err error
+	if base == 0 {
+		filter := bson.D{primitive.E{Key: "title", Value: p.Title}}
+		update := bson.D{primitive.E{Key: "$setOnInsert", Value: pageDocument(p)}}
+		res, err = s.coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil && res.MatchedCount > 0 {
+			err = errEditConflict
+		}
+	} else {
+		filter := bson.D{
+			primitive.E{Key: "title", Value: p.Title},
+			primitive.E{Key: "revision", Value: base},
+		}
+		res, err = s.coll.ReplaceOne(ctx, filter, pageDocument(p))
+		if err == nil && res.MatchedCount == 0 {
+			err = errEditConflict
+		}
+	}
+	return err
+}
+
+// withoutBody is the projection for listing pages: everything but the
+// body and its copy kept for search.
+var withoutBody = bson.D{{Key: "body", Value: 0}, {Key: "text", Value: 0}}
+
+// pageDocument returns the MongoDB document for p. Bodies are stored as
+// binary, which text indexes skip, so a copy of the body is kept as a
+// string in the "text" field for full-text search.
+func pageDocument(p *Page) bson.D {
+	return bson.D{
+		primitive.E{Key: "title", Value: p.Title},
+		primitive.E{Key: "body", Value: p.Body},
+		primitive.E{Key: "lang", Value: p.Lang},
+		primitive.E{Key: "owner", Value: p.Owner},
+		primitive.E{Key: "reviewer", Value: p.Reviewer},
+		primitive.E{Key: "tags", Value: p.Tags},
+		primitive.E{Key: "updated", Value: p.Updated},
+		primitive.E{Key: "revision", Value: p.Revision},
+		primitive.E{Key: "remote", Value: p.Remote},
+		primitive.E{Key: "fetched", Value: p.Fetched},
+		primitive.E{Key: "text", Value: string(p.Body)},
+	}
+}
+
+func (s *mongoPageStore) Delete(ctx context.Context, title string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	filter := bson.D{primitive.E{Key: "title", Value: title}}
+	_, err := s.coll.DeleteOne(ctx, filter)
+	return err
+}
+
+// Rename changes the title of the page's document with a single update.
+// Titles are not indexed as unique, so a page created under to while
+// the rename runs is not noticed.
+func (s *mongoPageStore) Rename(ctx context.Context, from, to string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	n, err := s.coll.CountDocuments(ctx, bson.D{primitive.E{Key: "title", Value: to}})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errPageExists
+	}
+	res, err := s.coll.UpdateOne(ctx,
+		bson.D{primitive.E{Key: "title", Value: from}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "title", Value: to}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errPageNotFound
+	}
+	return nil
+}
+
+// List sorts and pages through the titles in the database, which only
+// sends back the titles rather than whole pages.
+func (s *mongoPageStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	pipeline := mongo.Pipeline{
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "title", Value: 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "title", Value: 1}}}},
+	}
+	if offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: offset}})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	cur, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Title string `bson:"title"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(docs))
+	for i, d := range docs {
+		names[i] = d.Title
+	}
+	return names, nil
+}
+
+// Summaries only fetches the title and modification time of the pages
+// asked for.
+func (s *mongoPageStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	sort := bson.D{{Key: "title", Value: 1}}
+	if q.Sort == sortByUpdated {
+		sort = bson.D{{Key: "updated", Value: -1}, {Key: "title", Value: 1}}
+	}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "_id", Value: 0}, {Key: "title", Value: 1}, {Key: "updated", Value: 1}}).
+		SetSort(sort).
+		SetSkip(int64(q.Offset))
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cur, err := s.coll.Find(ctx, namespaceFilter("title", q.Hidden), opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []PageEntry{}
+	err = cur.All(ctx, &list)
+	return list, err
+}
+
+// Count uses the collection's metadata when nothing is hidden, which
+// saves counting every document.
+func (s *mongoPageStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if len(q.Hidden) == 0 {
+		n, err := s.coll.EstimatedDocumentCount(ctx)
+		return int(n), err
+	}
+	n, err := s.coll.CountDocuments(ctx, namespaceFilter("title", q.Hidden))
+	return int(n), err
+}
+
+// filePageStore keeps each page as a JSON file below dir. Namespaces
+// become directories, so "Policy/Travel" is stored in
+// dir/Policy/Travel.json. Titles are checked by the title policy before
+// they get here, which keeps them inside dir.
+type filePageStore struct {
+	dir string
+}
+
+const pageFileExt = ".json"
+
+// pageFile is the on-disk form of a page. The body is stored as text
+// rather than base64 so that the files stay readable.
+type pageFile struct {
+	*Page
+	Body string
+}
+
+// encodePage returns the JSON of p as stored in a file.
+func encodePage(p *Page) ([]byte, error) {
+	return json.MarshalIndent(pageFile{Page: p, Body: string(p.Body)}, "", "  ")
+}
+
+// decodePage reads a page from the JSON encodePage returns.
+func decodePage(b []byte) (*Page, error) {
+	f := pageFile{Page: &Page{}}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	f.Page.Body = []byte(f.Body)
+	return f.Page, nil
+}
+
+func (s *filePageStore) path(title string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(title)+pageFileExt)
+}
+
+func (s *filePageStore) Get(ctx context.Context, title string) (*Page, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(s.path(title))
+	if os.IsNotExist(err) {
+		return nil, errPageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodePage(b)
+}
+
+// Put writes the page to a temporary file first and renames it into
+// place, so readers never see a partly written page.
+func (s *filePageStore) Put(ctx context.Context, p *Page) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(p.Title)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := encodePage(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".page-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *filePageStore) Delete(ctx context.Context, title string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(title))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Rename writes the page under its new title to a temporary file and
+// links that into place, which fails rather than replacing a page that
+// exists, before removing the old file.
+func (s *filePageStore) Rename(ctx context.Context, from, to string) error {
+	p, err := s.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	p.Title = to
+	path := s.path(to)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := encodePage(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".page-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return errPageExists
+		}
+		return err
+	}
+	return os.Remove(s.path(from))
+}
+
+func (s *filePageStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	list, err := s.Summaries(ctx, ListQuery{Sort: sortByTitle, Offset: offset, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Title
+	}
+	return names, nil
+}
+
+// Summaries takes the modification time of a page from its file, which
+// is written whenever the page is saved, so no file has to be read.
+func (s *filePageStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	list, err := s.walk(ctx, q.Hidden)
+	if err != nil {
+		return nil, err
+	}
+	return sliceEntries(list, q), nil
+}
+
+func (s *filePageStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	list, err := s.walk(ctx, q.Hidden)
+	return len(list), err
+}
+
+// sliceEntries sorts list, which is by title, as q asks and returns the
+// slice of it q asks for.
+func sliceEntries(list []PageEntry, q ListQuery) []PageEntry {
+	if q.Sort == sortByUpdated {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Updated.After(list[j].Updated) })
+	}
+	offset := q.Offset
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if q.Limit > 0 && q.Limit < len(list) {
+		list = list[:q.Limit]
+	}
+	return list
+}
+
+// walk returns every page below dir not in the hidden namespaces, by
+// title.
+func (s *filePageStore) walk(ctx context.Context, hidden []string) ([]PageEntry, error) {
+	list := []PageEntry{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, pageFileExt) || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		title := filepath.ToSlash(strings.TrimSuffix(rel, pageFileExt))
+		for _, ns := range hidden {
+			if inNamespace(title, ns) {
+				return nil
+			}
+		}
+		list = append(list, PageEntry{Title: title, Updated: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+	return list, nil
+}
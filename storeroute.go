@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// With -storage-routes, namespaces keep their pages in stores of their
+// own, such as Archive in an S3 bucket for cold storage while everything
+// else stays in MongoDB. routedStore sends every page to the store of
+// the most specific namespace it is in, or to the main store set with
+// -storage, and lists the pages of all of them together. Search, tags,
+// statistics and the other views querying the Pages collection then
+// read the pages of every store through it instead, see pagesInMongo,
+// which is slower but leaves no namespace out. "gowiki migrate" moves
+// pages to the store their namespace is routed to after the routes
+// change.
+
+// storeRoute keeps the pages of a namespace in a store.
+type storeRoute struct {
+	Namespace string
+	Store     PageStore
+}
+
+// routedStore sends pages to the stores of their namespaces. Routes are
+// identified by their index, -1 standing for the main store.
+type routedStore struct {
+	main PageStore
+	// routes are ordered most specific first.
+	routes []storeRoute
+}
+
+// parseStorageRoutes parses space separated namespace=kind:location
+// routes, such as "Archive=s3:https://s3.amazonaws.com/bucket/pages".
+// Kinds are mongo, with the name of a collection, fs, with a directory,
+// and s3, with the address of a bucket, signed with creds. Mongo routes
+// are collections of d, nil without a database.
+func parseStorageRoutes(spec string, titles *titleRules, creds S3Credentials, d *database) ([]storeRoute, error) {
+	var routes []storeRoute
+	seen := map[string]bool{}
+	for _, entry := range strings.Fields(spec) {
+		i := strings.Index(entry, "=")
+		j := strings.Index(entry[i+1:], ":") + i + 1
+		if i <= 0 || j <= i || j == len(entry)-1 {
+			return nil, fmt.Errorf("storage route %q is not of the form namespace=kind:location", entry)
+		}
+		ns, kind, location := entry[:i], entry[i+1:j], entry[j+1:]
+		if !titles.valid(ns) {
+			return nil, fmt.Errorf("storage route %q: invalid namespace", entry)
+		}
+		if seen[ns] {
+			return nil, fmt.Errorf("storage route %q: %s is routed twice", entry, ns)
+		}
+		seen[ns] = true
+		var store PageStore
+		switch kind {
+		case "mongo":
+			if d == nil {
+				return nil, fmt.Errorf("storage route %q: there is no database with -storage=fs", entry)
+			}
+			store = &mongoPageStore{coll: d.Collection(location)}
+		case "fs":
+			if err := os.MkdirAll(location, 0755); err != nil {
+				return nil, err
+			}
+			store = &filePageStore{dir: location}
+		case "s3":
+			s3, err := newS3PageStore(location, creds)
+			if err != nil {
+				return nil, fmt.Errorf("storage route %q: %v", entry, err)
+			}
+			store = s3
+		default:
+			return nil, fmt.Errorf("storage route %q: unknown kind %q, use mongo, fs or s3", entry, kind)
+		}
+		routes = append(routes, storeRoute{Namespace: ns, Store: store})
+	}
+	// Nested namespaces come after their children, so the first route a
+	// title is in is the most specific.
+	sort.SliceStable(routes, func(i, j int) bool {
+		return strings.Count(routes[i].Namespace, "/") > strings.Count(routes[j].Namespace, "/")
+	})
+	return routes, nil
+}
+
+// routeOf returns the route of the page called title.
+func (s *routedStore) routeOf(title string) int {
+	for i, r := range s.routes {
+		if inNamespace(title, r.Namespace) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *routedStore) store(route int) PageStore {
+	if route < 0 {
+		return s.main
+	}
+	return s.routes[route].Store
+}
+
+func (s *routedStore) Get(ctx context.Context, title string) (*Page, error) {
+	return s.store(s.routeOf(title)).Get(ctx, title)
+}
+
+func (s *routedStore) Put(ctx context.Context, p *Page) error {
+	return s.store(s.routeOf(p.Title)).Put(ctx, p)
+}
+
+func (s *routedStore) PutAt(ctx context.Context, p *Page, base int) error {
+	return putAt(ctx, s.store(s.routeOf(p.Title)), p, base)
+}
+
+func (s *routedStore) Delete(ctx context.Context, title string) error {
+	return s.store(s.routeOf(title)).Delete(ctx, title)
+}
+
+// Rename moves pages between stores by writing the page to the new one
+// and then deleting it from the old one, so for a moment it is found
+// under both titles.
+func (s *routedStore) Rename(ctx context.Context, from, to string) error {
+	src, dst := s.routeOf(from), s.routeOf(to)
+	if src == dst {
+		return s.store(src).Rename(ctx, from, to)
+	}
+	p, err := s.store(src).Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	_, err = s.store(dst).Get(ctx, to)
+	if err == nil {
+		return errPageExists
+	}
+	if err != errPageNotFound {
+		return err
+	}
+	p.Title = to
+	if err := s.store(dst).Put(ctx, p); err != nil {
+		return err
+	}
+	return s.store(src).Delete(ctx, from)
+}
+
+func (s *routedStore) List(ctx context.Context, offset, limit int) ([]string, error) {
+	list, err := s.Summaries(ctx, ListQuery{Sort: sortByTitle, Offset: offset, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Title
+	}
+	return names, nil
+}
+
+func (s *routedStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	list, _, err := s.merge(ctx, q, false)
+	return list, err
+}
+
+func (s *routedStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	n, err := s.main.Count(ctx, s.mainQuery(q))
+	if err != nil {
+		return 0, err
+	}
+	for route := range s.routes {
+		list, err := s.entries(ctx, route, q)
+		if err != nil {
+			return 0, err
+		}
+		n += len(list)
+	}
+	return n, nil
+}
+
+// SummariesCount lists each routed store once for both, where Summaries
+// and Count would list them twice.
+func (s *routedStore) SummariesCount(ctx context.Context, q ListQuery) ([]PageEntry, int, error) {
+	return s.merge(ctx, q, true)
+}
+
+// merge asks every store for the pages up to the end of the slice q
+// asks for and merges them. With count set it also returns the number
+// of pages q lists.
+func (s *routedStore) merge(ctx context.Context, q ListQuery, count bool) ([]PageEntry, int, error) {
+	head := q
+	head.Offset = 0
+	if q.Limit > 0 {
+		head.Limit = q.Offset + q.Limit
+	}
+	var all []PageEntry
+	var n int
+	var err error
+	if count {
+		all, n, err = summariesCount(ctx, s.main, s.mainQuery(head))
+	} else {
+		all, err = s.main.Summaries(ctx, s.mainQuery(head))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	for route := range s.routes {
+		list, err := s.entries(ctx, route, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += len(list)
+		if head.Limit > 0 && head.Limit < len(list) {
+			list = list[:head.Limit]
+		}
+		all = append(all, list...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Title < all[j].Title })
+	return sliceEntries(all, q), n, nil
+}
+
+// mainQuery returns q for the main store, hiding the routed namespaces.
+func (s *routedStore) mainQuery(q ListQuery) ListQuery {
+	hidden := append([]string(nil), q.Hidden...)
+	for _, r := range s.routes {
+		hidden = append(hidden, r.Namespace)
+	}
+	q.Hidden = hidden
+	return q
+}
+
+// entries returns the summaries of all the pages in the routed store
+// route that q lists, ignoring its offset and limit, in its order.
+// Pages the store keeps outside its namespace, left there when the
+// routes changed, are left out.
+func (s *routedStore) entries(ctx context.Context, route int, q ListQuery) ([]PageEntry, error) {
+	q.Offset, q.Limit = 0, 0
+	list, err := s.store(route).Summaries(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	mine := []PageEntry{}
+	for _, e := range list {
+		if s.routeOf(e.Title) == route {
+			mine = append(mine, e)
+		}
+	}
+	return mine, nil
+}
+
+// relocatePages moves the pages kept in a store other than the one
+// their namespace is routed to, reporting to out. With dryRun set it
+// only counts them.
+func relocatePages(c context.Context, out io.Writer, dryRun bool) error {
+	s := appFrom(c).router
+	if s == nil {
+		return nil
+	}
+	type misplaced struct {
+		title    string
+		from, to int
+	}
+	var moves []misplaced
+	for route := -1; route < len(s.routes); route++ {
+		titles, err := s.store(route).List(c, 0, 0)
+		if err != nil {
+			return fmt.Errorf("storage routes: %v", err)
+		}
+		for _, t := range titles {
+			if to := s.routeOf(t); to != route {
+				moves = append(moves, misplaced{title: t, from: route, to: to})
+			}
+		}
+	}
+	fmt.Fprintf(out, "storage routes: %d pages to move\n", len(moves))
+	if dryRun {
+		return nil
+	}
+	moved := 0
+	for _, m := range moves {
+		p, err := s.store(m.from).Get(c, m.title)
+		if err != nil {
+			return fmt.Errorf("storage routes: %s: %v", m.title, err)
+		}
+		if _, err := s.store(m.to).Get(c, m.title); err != errPageNotFound {
+			if err != nil {
+				return fmt.Errorf("storage routes: %s: %v", m.title, err)
+			}
+			fmt.Fprintf(out, "storage routes: %s is kept in two stores, remove one of them\n", m.title)
+			continue
+		}
+		if err := s.store(m.to).Put(c, p); err != nil {
+			return fmt.Errorf("storage routes: %s: %v", m.title, err)
+		}
+		if err := s.store(m.from).Delete(c, m.title); err != nil {
+			return fmt.Errorf("storage routes: %s: %v", m.title, err)
+		}
+		moved++
+	}
+	fmt.Fprintf(out, "storage routes: moved %d pages\n", moved)
+	return nil
+}
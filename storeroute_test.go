@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStorageRoutes(t *testing.T) {
+	titles, err := newTitleRules(defaultTitlePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	spec := "Archive=s3:https://s3.amazonaws.com/bucket/pages Drafts/Old=fs:" + filepath.Join(dir, "old") + " Drafts=fs:" + filepath.Join(dir, "drafts")
+	routes, err := parseStorageRoutes(spec, titles, exampleCreds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.Namespace)
+	}
+	if want := []string{"Drafts/Old", "Archive", "Drafts"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes %q, want the most specific first, %q", got, want)
+	}
+	if s, ok := routes[1].Store.(*s3PageStore); !ok || s.bucket != "bucket" || s.prefix != "pages/" {
+		t.Errorf("Archive is routed to %#v", routes[1].Store)
+	}
+	if s, ok := routes[2].Store.(*filePageStore); !ok || s.dir != filepath.Join(dir, "drafts") {
+		t.Errorf("Drafts is routed to %#v", routes[2].Store)
+	}
+
+	for _, tt := range []struct {
+		spec, err string
+	}{
+		{"Archive", "not of the form"},
+		{"=fs:dir", "not of the form"},
+		{"Archive=fs", "not of the form"},
+		{"Archive=fs:", "not of the form"},
+		{"../x=fs:" + dir, "invalid namespace"},
+		{"Archive=fs:" + dir + " Archive=fs:" + dir, "routed twice"},
+		{"Archive=ftp:host", "unknown kind"},
+		{"Archive=mongo:Archive", "no database"},
+		{"Archive=s3:https://s3.amazonaws.com/", "names no bucket"},
+	} {
+		if _, err := parseStorageRoutes(tt.spec, titles, exampleCreds, nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got %v, want an error about %q", tt.spec, err, tt.err)
+		}
+	}
+}
+
+// newTestRoutes returns a routedStore keeping the pages of Archive and
+// Archive/Old in stores of their own.
+func newTestRoutes() (s *routedStore, main, archive, old *memStore) {
+	main, archive, old = newMemStore(), newMemStore(), newMemStore()
+	s = &routedStore{main: main, routes: []storeRoute{
+		{Namespace: "Archive/Old", Store: old},
+		{Namespace: "Archive", Store: archive},
+	}}
+	return s, main, archive, old
+}
+
+func TestRoutedStorePrefixes(t *testing.T) {
+	s, main, archive, old := newTestRoutes()
+	c := context.Background()
+	for _, title := range []string{"Home", "Archived", "Archive", "Archive/2020", "Archive/Older", "Archive/Old", "Archive/Old/1999"} {
+		if err := s.Put(c, &Page{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		store *memStore
+		want  []string
+	}{
+		{main, []string{"Archived", "Home"}},
+		{archive, []string{"Archive", "Archive/2020", "Archive/Older"}},
+		{old, []string{"Archive/Old", "Archive/Old/1999"}},
+	} {
+		if got, _ := tt.store.List(c, 0, 0); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("store has %q, want %q", got, tt.want)
+		}
+	}
+	if p, err := s.Get(c, "Archive/Old/1999"); err != nil || p.Title != "Archive/Old/1999" {
+		t.Errorf("Get(Archive/Old/1999) = %v, %v", p, err)
+	}
+	if err := s.Delete(c, "Archive/2020"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.Get(c, "Archive/2020"); err != errPageNotFound {
+		t.Errorf("Archive/2020 not deleted from its store: %v", err)
+	}
+}
+
+func TestRoutedStoreRename(t *testing.T) {
+	s, main, archive, _ := newTestRoutes()
+	c := context.Background()
+	main.Put(c, &Page{Title: "Plans", Body: []byte("Old plans."), Revision: 3})
+	main.Put(c, &Page{Title: "Notes"})
+	archive.Put(c, &Page{Title: "Archive/Notes"})
+
+	if err := s.Rename(c, "Plans", "Archive/Plans"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := main.Get(c, "Plans"); err != errPageNotFound {
+		t.Errorf("Plans left in the main store: %v", err)
+	}
+	p, err := archive.Get(c, "Archive/Plans")
+	if err != nil || string(p.Body) != "Old plans." || p.Revision != 3 {
+		t.Errorf("Archive/Plans in the archive store is %v, %v", p, err)
+	}
+
+	if err := s.Rename(c, "Notes", "Archive/Notes"); err != errPageExists {
+		t.Errorf("renaming onto a page in another store: got %v, want errPageExists", err)
+	}
+	if _, err := main.Get(c, "Notes"); err != nil {
+		t.Errorf("Notes lost after a refused rename: %v", err)
+	}
+	if err := s.Rename(c, "Missing", "Archive/Missing"); err != errPageNotFound {
+		t.Errorf("renaming a missing page: got %v, want errPageNotFound", err)
+	}
+	if err := s.Rename(c, "Archive/Plans", "Archive/Plans 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.Get(c, "Archive/Plans 2"); err != nil {
+		t.Errorf("rename within a store: %v", err)
+	}
+}
+
+func TestRoutedStorePaging(t *testing.T) {
+	s, main, archive, old := newTestRoutes()
+	c := context.Background()
+	now := time.Now()
+	for i, title := range []string{"Alpha", "Archive", "Archive/B", "Archive/Old/C", "Beta", "Delta", "Drafts/E", "Gamma"} {
+		s.Put(c, &Page{Title: title, Updated: now.Add(time.Duration(i) * time.Minute)})
+	}
+	// Left in the wrong store when the routes changed.
+	old.Put(c, &Page{Title: "Beta"})
+	archive.Put(c, &Page{Title: "Stray"})
+	main.Put(c, &Page{Title: "Archive/Stray"})
+
+	all := []string{"Alpha", "Archive", "Archive/B", "Archive/Old/C", "Beta", "Delta", "Drafts/E", "Gamma"}
+	for _, tt := range []struct {
+		q     ListQuery
+		want  []string
+		total int
+	}{
+		{ListQuery{Sort: sortByTitle}, all, 8},
+		{ListQuery{Sort: sortByTitle, Offset: 2, Limit: 3}, all[2:5], 8},
+		{ListQuery{Sort: sortByTitle, Offset: 6, Limit: 5}, all[6:], 8},
+		{ListQuery{Sort: sortByTitle, Offset: 10, Limit: 5}, nil, 8},
+		{ListQuery{Sort: sortByUpdated, Limit: 3}, []string{"Gamma", "Drafts/E", "Delta"}, 8},
+		{ListQuery{Sort: sortByUpdated, Offset: 3, Limit: 2}, []string{"Beta", "Archive/Old/C"}, 8},
+		{ListQuery{Sort: sortByTitle, Hidden: []string{"Archive/Old", "Drafts"}}, []string{"Alpha", "Archive", "Archive/B", "Beta", "Delta", "Gamma"}, 6},
+	} {
+		list, n, err := summariesCount(c, s, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range list {
+			got = append(got, e.Title)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: listed %q, want %q", tt.q, got, tt.want)
+		}
+		count, err := s.Count(c, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.total || count != tt.total {
+			t.Errorf("%+v: counted %d and %d pages, want %d", tt.q, n, count, tt.total)
+		}
+		if summaries, _ := s.Summaries(c, tt.q); !reflect.DeepEqual(summaries, list) {
+			t.Errorf("%+v: Summaries and SummariesCount differ", tt.q)
+		}
+	}
+	if got, _ := s.List(c, 1, 2); !reflect.DeepEqual(got, all[1:3]) {
+		t.Errorf("List(1, 2) = %q, want %q", got, all[1:3])
+	}
+}
+
+// countingStore counts how often the store it wraps is listed.
+type countingStore struct {
+	PageStore
+	lists int
+}
+
+func (s *countingStore) Summaries(ctx context.Context, q ListQuery) ([]PageEntry, error) {
+	s.lists++
+	return s.PageStore.Summaries(ctx, q)
+}
+
+func TestRoutedStoreListsOnce(t *testing.T) {
+	archive := &countingStore{PageStore: newMemStore(&Page{Title: "Archive/A"}, &Page{Title: "Archive/B"})}
+	s := &routedStore{main: newMemStore(&Page{Title: "Home"}), routes: []storeRoute{{Namespace: "Archive", Store: archive}}}
+	// The wiki wraps the routes like this, see openApp.
+	store := cacheStore(hookStore(s, func(string, time.Duration, error) {}), 10, time.Minute)
+	list, n, err := summariesCount(context.Background(), store, ListQuery{Sort: sortByTitle, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || n != 3 {
+		t.Errorf("listed %d of %d pages, want 2 of 3", len(list), n)
+	}
+	if archive.lists != 1 {
+		t.Errorf("the archive store was listed %d times, want once", archive.lists)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// excerptLength is the maximum number of characters in a page excerpt.
+const excerptLength = 300
+
+// PageSummary is the short description of a page shown in link previews.
+type PageSummary struct {
+	Title   string `json:"title"`
+	Excerpt string `json:"excerpt"`
+	Size    int    `json:"size"`
+}
+
+// excerpt returns the beginning of a body with whitespace collapsed,
+// cut at a word boundary once it exceeds max characters.
+func excerpt(body []byte, max int) string {
+	text := strings.Join(strings.Fields(string(body)), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)[:max]
+	cut := string(runes)
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+func summaryHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(PageSummary{
+		Title:   p.Title,
+		Excerpt: excerpt(p.Body, excerptLength),
+		Size:    len(p.Body),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "gowiki sync" copies the page changes of one running wiki to another
+// over the JSON API, and with -two-way those of the other back. It
+// follows the /events log of each wiki and remembers, in the -state
+// file, how far it read and which version of every page it last copied
+// or found equal on both, so that a page changed on both wikis since is
+// told apart from one changed on one of them: that is a conflict,
+// settled by the -conflict policy. Attachments, accounts and the
+// history of pages are not copied; each copy is a new revision on the
+// wiki it is written to.
+
+// Conflict policies of "gowiki sync".
+const (
+	// syncKeepFrom overwrites the page on the -to wiki.
+	syncKeepFrom = "from"
+	// syncKeepTo leaves the page on the -to wiki alone.
+	syncKeepTo = "to"
+	// syncKeepNewer keeps the page updated last.
+	syncKeepNewer = "newer"
+	// syncSkip leaves both pages alone and reports the conflict.
+	syncSkip = "skip"
+)
+
+// errNoEventLog is returned for wikis without a database, which keep
+// no event log: every page is compared on every round instead.
+var errNoEventLog = errors.New("the wiki keeps no event log")
+
+// syncState is what sync remembers between rounds. The versions of a
+// page are when it was updated on the -from and the -to wiki, zero
+// where it does not exist.
+type syncState struct {
+	Cursors [2]int64                `json:"cursors"`
+	Pages   map[string][2]time.Time `json:"pages"`
+}
+
+// wikiClient calls the JSON API of a wiki.
+type wikiClient struct {
+	base           string
+	user, password string
+	client         *http.Client
+}
+
+// do sends in, if any, as JSON and decodes the response into out, if
+// any. Error responses are returned as errors along with their status.
+func (wc *wikiClient) do(method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, wc.base+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if wc.user != "" {
+		req.SetBasicAuth(wc.user, wc.password)
+	}
+	res, err := wc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e APIError
+		b, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return res.StatusCode, fmt.Errorf("%s %s: %s: %s", method, wc.base+path, res.Status, e.Error)
+	}
+	if out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
+
+// page returns a page, or nil if there is none.
+func (wc *wikiClient) page(title string) (*APIPage, error) {
+	var p APIPage
+	status, err := wc.do(http.MethodGet, pageURL(strings.TrimPrefix(apiPrefix, "/"), title), nil, &p)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// titles returns the titles of every page.
+func (wc *wikiClient) titles() ([]string, error) {
+	var list APIPageList
+	_, err := wc.do(http.MethodGet, apiPrefix, nil, &list)
+	return list.Pages, err
+}
+
+// titlesChanged returns the titles of the pages changed after the event
+// numbered after, and the number of the last event.
+func (wc *wikiClient) titlesChanged(after int64) ([]string, int64, error) {
+	titles := []string{}
+	seen := map[string]bool{}
+	for {
+		var batch EventBatch
+		status, err := wc.do(http.MethodGet, "/events?limit="+strconv.Itoa(maxEventBatch)+"&after="+strconv.FormatInt(after, 10), nil, &batch)
+		if status == http.StatusNotFound {
+			return nil, after, errNoEventLog
+		}
+		if err != nil {
+			return nil, after, err
+		}
+		for _, e := range batch.Events {
+			changed := []string{e.Title}
+			if e.Kind == eventMoved {
+				changed = append(changed, strings.TrimPrefix(e.Summary, "Moved from "))
+			}
+			for _, t := range changed {
+				if !seen[t] {
+					seen[t] = true
+					titles = append(titles, t)
+				}
+			}
+		}
+		if batch.Next == after {
+			return titles, after, nil
+		}
+		after = batch.Next
+	}
+}
+
+// pageVersion is when p was updated, zero if there is no page.
+func pageVersion(p *APIPage) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	return p.Updated
+}
+
+// samePage reports whether two pages, either of them missing, have the
+// same content.
+func samePage(a, b *APIPage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Body == b.Body && a.Lang == b.Lang && a.Owner == b.Owner &&
+		a.Reviewer == b.Reviewer && reflect.DeepEqual(a.Tags, b.Tags)
+}
+
+// syncer copies pages between two wikis, side 0 being -from and side 1
+// -to.
+type syncer struct {
+	wikis  [2]*wikiClient
+	policy string
+	state  *syncState
+	// copied, pending and conflicts count what a round did.
+	copied, pending, conflicts int
+}
+
+// syncTitle brings the page called title on side dst in line with side
+// src, unless it changed on dst as well and the policy keeps it.
+func (s *syncer) syncTitle(src, dst int, title string) error {
+	var pages [2]*APIPage
+	for i, wc := range s.wikis {
+		p, err := wc.page(title)
+		if err != nil {
+			return err
+		}
+		pages[i] = p
+	}
+	// A page not seen before counts as changed wherever it exists.
+	known, seen := s.state.Pages[title]
+	changed := func(side int) bool {
+		if !seen {
+			return pages[side] != nil
+		}
+		return !pageVersion(pages[side]).Equal(known[side])
+	}
+	record := func() {
+		s.state.Pages[title] = [2]time.Time{pageVersion(pages[0]), pageVersion(pages[1])}
+	}
+	if samePage(pages[src], pages[dst]) {
+		record()
+		return nil
+	}
+	if !changed(src) {
+		// Only dst changed; the pass the other way copies it, if any.
+		return nil
+	}
+	if changed(dst) {
+		switch s.keep(pages) {
+		case src:
+		case dst:
+			// The src version is remembered so that it is not copied on
+			// the next round, while dst stays changed for the pass the
+			// other way.
+			known[src] = pageVersion(pages[src])
+			s.state.Pages[title] = known
+			return nil
+		default:
+			s.conflicts++
+			log.Printf("sync: %s changed on both wikis, left alone", title)
+			return nil
+		}
+	}
+
+	to := s.wikis[dst]
+	path := pageURL(strings.TrimPrefix(apiPrefix, "/"), title)
+	if pages[src] == nil {
+		if _, err := to.do(http.MethodDelete, path, nil, nil); err != nil {
+			return err
+		}
+	} else {
+		p := *pages[src]
+		p.Updated, p.Revision, p.Remote = pageVersion(pages[dst]), 0, ""
+		p.Summary = "Synced from " + s.wikis[src].base
+		status, err := to.do(http.MethodPut, path, &p, nil)
+		switch {
+		case status == http.StatusConflict:
+			s.conflicts++
+			log.Printf("sync: %s changed on %s while copying it, left alone", title, to.base)
+			return nil
+		case err != nil:
+			return err
+		case status == http.StatusAccepted:
+			// The copy of a protected page waits for approval; it is
+			// copied again if the page changes before it is approved.
+			s.pending++
+			known[src] = pageVersion(pages[src])
+			s.state.Pages[title] = known
+			return nil
+		}
+	}
+	s.copied++
+	// The wiki sets the time of the copy, which is read back to tell
+	// later changes from it.
+	p, err := to.page(title)
+	if err != nil {
+		return err
+	}
+	pages[dst] = p
+	record()
+	return nil
+}
+
+// keep returns the side whose version of a page changed on both wikis
+// the policy keeps, -1 for neither.
+func (s *syncer) keep(pages [2]*APIPage) int {
+	switch s.policy {
+	case syncKeepFrom:
+		return 0
+	case syncKeepTo:
+		return 1
+	case syncKeepNewer:
+		if pageVersion(pages[1]).After(pageVersion(pages[0])) {
+			return 1
+		}
+		return 0
+	}
+	return -1
+}
+
+// round copies the changes since the last round, or every page on the
+// first one.
+func (s *syncer) round(twoWay bool) error {
+	first := len(s.state.Pages) == 0
+	passes := [][2]int{{0, 1}}
+	if twoWay {
+		passes = append(passes, [2]int{1, 0})
+	}
+	for _, pass := range passes {
+		src, dst := pass[0], pass[1]
+		titles, next, err := s.wikis[src].titlesChanged(s.state.Cursors[src])
+		if err == errNoEventLog || err == nil && first {
+			titles, err = s.allTitles(src)
+		}
+		if err != nil {
+			return err
+		}
+		for _, title := range titles {
+			if err := s.syncTitle(src, dst, title); err != nil {
+				return fmt.Errorf("%s: %v", title, err)
+			}
+		}
+		s.state.Cursors[src] = next
+	}
+	return nil
+}
+
+// allTitles returns the titles of the pages on side src and of those
+// copied before, which may have been deleted since.
+func (s *syncer) allTitles(src int) ([]string, error) {
+	titles, err := s.wikis[src].titles()
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	for _, t := range titles {
+		listed[t] = true
+	}
+	for t := range s.state.Pages {
+		if !listed[t] {
+			titles = append(titles, t)
+		}
+	}
+	return titles, nil
+}
+
+func loadSyncState(path string) (*syncState, error) {
+	state := &syncState{Pages: map[string][2]time.Time{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if state.Pages == nil {
+		state.Pages = map[string][2]time.Time{}
+	}
+	return state, nil
+}
+
+// saveSyncState writes state to path through a temporary file, so an
+// interrupted write does not lose it.
+func saveSyncState(path string, state *syncState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// syncCommand implements "gowiki sync", which copies the changes of
+// one wiki to another, such as an internal wiki to a copy in the DMZ:
+//
+//	gowiki sync -from https://wiki.internal -to https://wiki.example.com -to-user sync -to-password ... -interval 1m
+//
+// Reading needs an account that may read every page to be copied, and
+// writing an editor's account, or an admin's to copy deletions.
+func syncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	from := fs.String("from", "", "address of the wiki to copy from")
+	to := fs.String("to", "", "address of the wiki to copy to")
+	fromUser := fs.String("from-user", "", "user name to sign in to the -from wiki with")
+	fromPassword := fs.String("from-password", "", "password to sign in to the -from wiki with")
+	toUser := fs.String("to-user", "", "user name to sign in to the -to wiki with")
+	toPassword := fs.String("to-password", "", "password to sign in to the -to wiki with")
+	twoWay := fs.Bool("two-way", false, "copy the changes of the -to wiki back as well")
+	policy := fs.String("conflict", syncSkip, `what to do with pages changed on both wikis: keep "from", "to" or the "newer", or "skip" them`)
+	statePath := fs.String("state", "gowiki-sync.json", "file remembering what was copied")
+	interval := fs.Duration("interval", 0, "copy changes this often, 0 once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to are needed")
+	}
+	switch *policy {
+	case syncKeepFrom, syncKeepTo, syncKeepNewer, syncSkip:
+	default:
+		return fmt.Errorf("unknown conflict policy %q", *policy)
+	}
+	for _, u := range []string{*from, *to} {
+		if p, err := url.Parse(u); err != nil || p.Host == "" {
+			return fmt.Errorf("%q is not the address of a wiki", u)
+		}
+	}
+	state, err := loadSyncState(*statePath)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	s := &syncer{
+		wikis: [2]*wikiClient{
+			{base: strings.TrimRight(*from, "/"), user: *fromUser, password: *fromPassword, client: client},
+			{base: strings.TrimRight(*to, "/"), user: *toUser, password: *toPassword, client: client},
+		},
+		policy: *policy,
+		state:  state,
+	}
+	for {
+		err := s.round(*twoWay)
+		// What was copied before a failure is remembered all the same.
+		if serr := saveSyncState(*statePath, state); err == nil {
+			err = serr
+		}
+		if err != nil && *interval == 0 {
+			return err
+		}
+		if err != nil {
+			log.Printf("sync: %v", err)
+		}
+		fmt.Printf("%d pages copied, %d waiting for approval, %d conflicts\n", s.copied, s.pending, s.conflicts)
+		s.copied, s.pending, s.conflicts = 0, 0, 0
+		if *interval == 0 {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tagPattern matches valid tags: letters, digits, "_" and "-". Tags are
+// kept in lower case so that "Security" and "security" are one tag.
+var tagPattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]{1,40}$`)
+
+// TagCount is a tag with the number of pages carrying it.
+type TagCount struct {
+	Name  string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// TaggedPages lists the pages carrying a tag.
+type TaggedPages struct {
+	Tag   string
+	Pages []Page
+}
+
+// parseTags reads a comma separated list of tags as typed into the
+// edit form. Spaces inside a tag become dashes and duplicates are
+// dropped.
+func parseTags(s string) ([]string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.Join(strings.Fields(strings.ToLower(t)), "-")
+		if t == "" || seen[t] {
+			continue
+		}
+		if !tagPattern.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q", t)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// formatTags is the inverse of parseTags, for the edit form.
+func formatTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// createTagIndex makes sure pages can be looked up by tag quickly.
+func createTagIndex(c context.Context) error {
+	_, err := appFrom(c).db.pages.Indexes().CreateOne(c, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tags", Value: 1}},
+		Options: options.Index().SetName("tags"),
+	})
+	return err
+}
+
+// tagCounts returns every tag in use on the pages u may read that are
+// not archived with its number of pages, sorted by name.
+func tagCounts(c context.Context, u *User) ([]TagCount, error) {
+	hidden, err := unlistedNamespaces(c, u)
+	if err != nil {
+		return nil, err
+	}
+	if !appFrom(c).pagesInMongo() {
+		n := map[string]int{}
+		err := scanPages(c, hidden, func(p *Page) error {
+			for _, t := range p.Tags {
+				n[t]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		counts := []TagCount{}
+		for t, count := range n {
+			counts = append(counts, TagCount{Name: t, Count: count})
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i].Name < counts[j].Name })
+		return counts, nil
+	}
+	cur, err := appFrom(c).db.pages.Aggregate(c, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: namespaceFilter("title", hidden)}},
+		bson.D{{Key: "$unwind", Value: "$tags"}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$tags"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := []TagCount{}
+	err = cur.All(c, &counts)
+	return counts, err
+}
+
+// taggedPages returns the pages carrying tag that u may read and are
+// not archived, without their bodies, sorted by title.
+func taggedPages(c context.Context, tag string, u *User) ([]Page, error) {
+	hidden, err := unlistedNamespaces(c, u)
+	if err != nil {
+		return nil, err
+	}
+	if !appFrom(c).pagesInMongo() {
+		list := []Page{}
+		err := scanPages(c, hidden, func(p *Page) error {
+			for _, t := range p.Tags {
+				if t == tag {
+					p.Body = nil
+					list = append(list, *p)
+					break
+				}
+			}
+			return nil
+		})
+		return list, err
+	}
+	opts := options.Find().
+		SetProjection(withoutBody).
+		SetSort(bson.D{{Key: "title", Value: 1}})
+	filter := append(bson.D{primitive.E{Key: "tags", Value: tag}}, namespaceFilter("title", hidden)...)
+	cur, err := appFrom(c).db.pages.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := []Page{}
+	err = cur.All(c, &list)
+	return list, err
+}
+
+// tagsHandler serves /tags, the index of all tags.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := tagCounts(r.Context(), currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "tags", nil, counts)
+}
+
+// tagHandler serves /tag/{name}, the pages carrying a tag.
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/tag/")
+	if !tagPattern.MatchString(tag) {
+		notFound(w, r)
+		return
+	}
+	list, err := taggedPages(r.Context(), tag, currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "tag", nil, &TaggedPages{Tag: tag, Pages: list})
+}
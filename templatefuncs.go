@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Templates, including customized ones from -templates, can call the
+// wiki's own functions (render, sidebar, toc and so on) and a small set
+// of general helpers meant for themes:
+//
+//	date LAYOUT TIME      a time as "date", "datetime", "rfc3339" or a Go layout
+//	ago TIME              how long ago a time was, such as "3 hours ago"
+//	markdown TEXT         wiki markup in a string rendered as HTML
+//	truncate N TEXT       TEXT cut at a word boundary after N characters
+//	pageURL ACTION TITLE  the address of a page, such as /edit/Home
+//	absURL PATH           PATH prefixed with -base-url, for links in mail
+//	query KEY VALUE ...   an escaped query string such as ?q=a+b&page=2
+//
+// The last argument can be piped in, as in {{.Updated | date "date"}}.
+// None of them change anything, so they are safe to offer to people
+// writing templates.
+//
+// Operators building their own binary can add functions by calling
+// registerTemplateFunc from an init function in a file of their own:
+//
+//	func init() {
+//		registerTemplateFunc("upper", strings.ToUpper)
+//	}
+
+// dateLayouts are the layout names understood by the date function.
+var dateLayouts = map[string]string{
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04",
+	"rfc3339":  time.RFC3339,
+}
+
+func init() {
+	registerTemplateFunc("date", formatDate)
+	registerTemplateFunc("ago", timeAgo)
+	registerTemplateFunc("truncate", truncateText)
+	registerTemplateFunc("pageURL", pageURL)
+	registerTemplateFunc("query", queryString)
+}
+
+// registerTemplateFunc makes fn available to templates as name. It must
+// be called before the templates are parsed, which happens at startup,
+// and panics if name is already taken.
+func registerTemplateFunc(name string, fn interface{}) {
+	if _, ok := templateFuncs[name]; ok || boundTemplateFuncs[name] {
+		panic("template function " + name + " registered twice")
+	}
+	templateFuncs[name] = fn
+}
+
+// boundTemplateFuncs are the names App.funcs gives functions of its own.
+var boundTemplateFuncs = map[string]bool{
+	"sidebar": true, "header": true, "footer": true, "render": true,
+	"renderPage": true, "offline": true, "markdown": true, "absURL": true,
+	"translation": true,
+}
+
+func formatDate(layout string, t time.Time) string {
+	if l, ok := dateLayouts[layout]; ok {
+		layout = l
+	}
+	return t.Format(layout)
+}
+
+// timeAgo describes how long ago t was, falling back to the date once
+// it is more than a month ago.
+func timeAgo(t time.Time) string {
+	d := time.Since(t)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	}
+	return t.Format(dateLayouts["date"])
+}
+
+// renderMarkdown renders wiki markup that is not a page body, such as a
+// description held in front matter.
+func renderMarkdown(c context.Context, text string) template.HTML {
+	return renderBody(c, "", []byte(text))
+}
+
+func truncateText(n int, text string) string {
+	return excerpt([]byte(text), n)
+}
+
+// pageURL returns the path of action on title. Each namespace segment
+// of the title is escaped, so titles with spaces or other characters
+// that are not allowed in URLs can be linked to; the server gets the
+// title back unescaped in r.URL.Path.
+func pageURL(action, title string) string {
+	segs := strings.Split(title, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return "/" + action + "/" + strings.Join(segs, "/")
+}
+
+// absURL prefixes path with base, the -base-url setting.
+func absURL(base, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// queryString builds a query string from key value pairs. Pairs with an
+// empty value are left out.
+func queryString(pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("query needs key value pairs")
+	}
+	v := url.Values{}
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			v.Add(pairs[i], pairs[i+1])
+		}
+	}
+	if len(v) == 0 {
+		return "", nil
+	}
+	return "?" + v.Encode(), nil
+}
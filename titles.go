@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// TitlePolicy decides which page titles are accepted. A title is one or
+// more namespace segments separated by "/", each matching Segment.
+type TitlePolicy struct {
+	Segment   string
+	MaxDepth  int
+	MaxLength int
+}
+
+// defaultTitlePolicy allows letters and digits of any script, spaces
+// and some punctuation, up to five namespace levels deep. Segments start
+// with a letter or digit and do not end in a space, so "Getting Started"
+// and "Über uns/Café" are titles but " Home" and "..." are not.
+var defaultTitlePolicy = TitlePolicy{
+	Segment:   `[\p{L}\p{N}](?:[\p{L}\p{M}\p{N} '(),.&_-]*[\p{L}\p{M}\p{N}.)])?`,
+	MaxDepth:  5,
+	MaxLength: 200,
+}
+
+// validate checks that the policy is usable and cannot produce titles
+// that escape routing, such as empty segments or "..". "%" is refused
+// as well, since templates link to "/view/{{.Title}}" and a browser
+// would take it for the start of an escape.
+func (tp TitlePolicy) validate() error {
+	if tp.MaxDepth < 1 {
+		return errors.New("title depth must be at least 1")
+	}
+	if tp.MaxLength < 1 {
+		return errors.New("title length must be at least 1")
+	}
+	seg, err := regexp.Compile("^(?:" + tp.Segment + ")$")
+	if err != nil {
+		return fmt.Errorf("title segment pattern: %v", err)
+	}
+	for _, bad := range []string{"", ".", "..", "/", "a/b", "?", "#", "%"} {
+		if seg.MatchString(bad) {
+			return fmt.Errorf("title segment pattern must not match %q", bad)
+		}
+	}
+	return nil
+}
+
+// pathPattern compiles the pattern matching "/{action}/{title}" paths.
+func (tp TitlePolicy) pathPattern() *regexp.Regexp {
+	seg := "(?:" + tp.Segment + ")"
+	return regexp.MustCompile(fmt.Sprintf("^/([a-z]+)/(%s(?:/%s){0,%d})$", seg, seg, tp.MaxDepth-1))
+}
+
+// titleRules is a title policy checked and ready for matching titles.
+type titleRules struct {
+	TitlePolicy
+	// path matches "/{action}/{title}" for titles allowed by the
+	// policy. Titles may be placed in namespaces such as
+	// "Policy/Travel", and translated variants carry a language suffix
+	// such as "Setup/de".
+	path *regexp.Regexp
+}
+
+// newTitleRules validates tp and compiles its pattern.
+func newTitleRules(tp TitlePolicy) (*titleRules, error) {
+	if err := tp.validate(); err != nil {
+		return nil, err
+	}
+	return &titleRules{TitlePolicy: tp, path: tp.pathPattern()}, nil
+}
+
+// valid reports whether title is allowed by the policy.
+func (tr *titleRules) valid(title string) bool {
+	return len(title) <= tr.MaxLength && tr.path.MatchString("/view/"+title)
+}
+
+// split returns the action and title of a "/{action}/{title}" path, or
+// false if the title is not allowed.
+func (tr *titleRules) split(path string) (action, title string, ok bool) {
+	m := tr.path.FindStringSubmatch(path)
+	if m == nil || len(m[2]) > tr.MaxLength {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// validTitle reports whether title is allowed by the title policy of
+// the wiki c belongs to.
+func validTitle(c context.Context, title string) bool {
+	return appFrom(c).titles.valid(title)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Translator translates plain text between two languages. An empty
+// source language asks the provider to detect it.
+type Translator interface {
+	Translate(ctx context.Context, text, from, to string) (string, error)
+}
+
+var translateClient = &http.Client{Timeout: 30 * time.Second}
+
+// newTranslator returns the provider called name. endpoint overrides the
+// provider's default endpoint, which is required for self-hosted
+// LibreTranslate.
+func newTranslator(name, endpoint, key string) (Translator, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "libretranslate":
+		if endpoint == "" {
+			return nil, errors.New("libretranslate needs an endpoint URL")
+		}
+		return &libreTranslate{endpoint: endpoint, key: key}, nil
+	case "deepl":
+		if endpoint == "" {
+			endpoint = "https://api-free.deepl.com/v2/translate"
+		}
+		return &deepL{endpoint: endpoint, key: key}, nil
+	case "google":
+		if endpoint == "" {
+			endpoint = "https://translation.googleapis.com/language/translate/v2"
+		}
+		return &googleTranslate{endpoint: endpoint, key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown translation provider %q", name)
+}
+
+// postJSON sends in as JSON and decodes the JSON response into out.
+func postJSON(ctx context.Context, endpoint string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(req, out)
+}
+
+func doJSON(req *http.Request, out interface{}) error {
+	res, err := translateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("translation provider: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type libreTranslate struct {
+	endpoint string
+	key      string
+}
+
+func (t *libreTranslate) Translate(ctx context.Context, text, from, to string) (string, error) {
+	if from == "" {
+		from = "auto"
+	}
+	var out struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	err := postJSON(ctx, strings.TrimSuffix(t.endpoint, "/")+"/translate", map[string]string{
+		"q":       text,
+		"source":  from,
+		"target":  to,
+		"format":  "text",
+		"api_key": t.key,
+	}, &out)
+	return out.TranslatedText, err
+}
+
+type deepL struct {
+	endpoint string
+	key      string
+}
+
+func (t *deepL) Translate(ctx context.Context, text, from, to string) (string, error) {
+	form := url.Values{
+		"text":        {text},
+		"target_lang": {strings.ToUpper(to)},
+	}
+	if from != "" {
+		form.Set("source_lang", strings.ToUpper(from))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+t.key)
+
+	var out struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return "", err
+	}
+	if len(out.Translations) == 0 {
+		return "", errors.New("deepl returned no translation")
+	}
+	return out.Translations[0].Text, nil
+}
+
+type googleTranslate struct {
+	endpoint string
+	key      string
+}
+
+func (t *googleTranslate) Translate(ctx context.Context, text, from, to string) (string, error) {
+	in := map[string]string{"q": text, "target": to, "format": "text"}
+	if from != "" {
+		in["source"] = from
+	}
+	var out struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	err := postJSON(ctx, t.endpoint+"?key="+url.QueryEscape(t.key), in, &out)
+	if err != nil {
+		return "", err
+	}
+	if len(out.Data.Translations) == 0 {
+		return "", errors.New("google returned no translation")
+	}
+	return out.Data.Translations[0].TranslatedText, nil
+}
+
+// TranslationDraft is a machine translated page awaiting review in the
+// edit form.
+type TranslationDraft struct {
+	*Page
+	Source string
+	Exists bool
+}
+
+// translateHandler machine translates a page into another language and
+// opens the result in the editor of the matching variant. Nothing is
+// saved until a human reviews and submits the form.
+func translateHandler(w http.ResponseWriter, r *http.Request, title string) {
+	translator := appFrom(r.Context()).translator
+	if translator == nil {
+		http.Error(w, "machine translation is not configured", http.StatusNotImplemented)
+		return
+	}
+	to := r.FormValue("lang")
+	if !validLanguage.MatchString(to) {
+		http.Error(w, "invalid language", http.StatusBadRequest)
+		return
+	}
+
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	from := pageLanguage(p)
+	if from == to {
+		http.Error(w, "page is already in "+to, http.StatusBadRequest)
+		return
+	}
+
+	text, err := translator.Translate(r.Context(), string(p.Body), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	base, _ := splitVariant(title)
+	draft := &TranslationDraft{
+		Page:   &Page{Title: base + "/" + to, Body: []byte(text), Lang: to},
+		Source: title,
+	}
+	if _, err := loadPage(r.Context(), draft.Title); err == nil {
+		draft.Exists = true
+	}
+
+	renderTemplate(w, r, "translate", draft.Page, draft)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TrashedPage is a deleted page kept in the trash.
+type TrashedPage struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Page    Page               `bson:"page"`
+	Deleted time.Time          `bson:"deleted"`
+}
+
+// errUndoExpired is returned when undoing a change after -undo-window.
+var errUndoExpired = errors.New("the undo window for this page has passed")
+
+// errPageRecreated is returned when restoring a page whose title has
+// been used again since it was deleted.
+var errPageRecreated = errors.New("a new page with this title has been created since")
+
+// errUndoChanged is returned when undoing the restore of a revision of
+// a page that has been changed since.
+var errUndoChanged = errors.New("the page has been changed since; restore a revision from its history instead")
+
+// trashPage moves a page into the trash. Deleting a page that does not
+// exist is not an error; deleting one under legal hold is errLegalHold.
+func trashPage(ctx context.Context, title string) error {
+	hold, err := legalHoldOn(ctx, title)
+	if err != nil {
+		return err
+	}
+	if hold != nil {
+		return errLegalHold
+	}
+	p, err := loadPage(ctx, title)
+	if err != nil || appFrom(ctx).db == nil {
+		// Without a database there is no trash to keep the page in.
+		return deletePage(ctx, title)
+	}
+	_, err = appFrom(ctx).db.trash.InsertOne(ctx, &TrashedPage{Page: *p, Deleted: time.Now()})
+	if err != nil {
+		return err
+	}
+	return deletePage(ctx, title)
+}
+
+// lastTrashed returns the most recently deleted version of a page.
+func lastTrashed(c context.Context, title string) (*TrashedPage, error) {
+	c, cancel := context.WithTimeout(c, dbTimeout)
+	defer cancel()
+	var tp TrashedPage
+	err := appFrom(c).db.trash.FindOne(c,
+		bson.D{primitive.E{Key: "page.title", Value: title}},
+		options.FindOne().SetSort(bson.D{{Key: "deleted", Value: -1}}),
+	).Decode(&tp)
+	if err != nil {
+		return nil, err
+	}
+	return &tp, nil
+}
+
+// undoDelete restores the most recently deleted version of a page if
+// it was deleted less than -undo-window ago.
+func undoDelete(ctx context.Context, title string) error {
+	tp, err := lastTrashed(ctx, title)
+	if err != nil {
+		return err
+	}
+	if time.Since(tp.Deleted) > appFrom(ctx).cfg.UndoWindow {
+		return errUndoExpired
+	}
+	if _, err := loadPage(ctx, title); err == nil {
+		return errPageRecreated
+	}
+	if err := tp.Page.save(ctx); err != nil {
+		return err
+	}
+	_, err = appFrom(ctx).db.trash.DeleteOne(ctx, bson.D{primitive.E{Key: "_id", Value: tp.ID}})
+	return err
+}
+
+func undeleteHandler(w http.ResponseWriter, r *http.Request, title string) {
+	err := undoDelete(r.Context(), title)
+	if err == mongo.ErrNoDocuments {
+		notFound(w, r)
+		return
+	}
+	if err == errUndoExpired {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err == errPageRecreated {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = recordEvent(r.Context(), eventUndeleted, title, userName(r), "")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addFlash(w, r, "Restored "+title+".")
+	http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
@@ -3,192 +3,576 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"regexp"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Page represents single wiki Page
 type Page struct {
-	Title string
-	Body  []byte
+	Title    string
+	Body     []byte
+	Lang     string
+	Owner    string
+	Reviewer string
+	Tags     []string
+	Updated  time.Time
+	// Revision is the number of the revision the page is at, which
+	// edits are checked against to catch concurrent changes.
+	Revision int
+	// Remote is the address a mirrored page was fetched from and
+	// Fetched when; both are empty for local pages.
+	Remote  string
+	Fetched time.Time
 }
 
-func (p *Page) save() error {
-
-	filter := bson.D{primitive.E{Key: "title", Value: p.Title}}
-	_, err := pagesCollection.ReplaceOne(ctx, filter,
-		bson.D{
-			primitive.E{Key: "title", Value: p.Title},
-			primitive.E{Key: "body", Value: p.Body},
-		},
-	)
-
-	return err
+// save stores p and records what it links to.
+func (p *Page) save(ctx context.Context) error {
+	if err := appFrom(ctx).pages.Put(ctx, p); err != nil {
+		return err
+	}
+	return updateLinks(ctx, p)
 }
 
-func deletePage(title string) error {
-
-	filter := bson.D{primitive.E{Key: "title", Value: title}}
-	_, err := pagesCollection.DeleteOne(ctx, filter)
-
-	return err
+func deletePage(ctx context.Context, title string) error {
+	if err := appFrom(ctx).pages.Delete(ctx, title); err != nil {
+		return err
+	}
+	return removeLinks(ctx, title)
 }
 
-func loadPage(title string) (*Page, error) {
+func loadPage(ctx context.Context, title string) (*Page, error) {
+	return appFrom(ctx).pages.Get(ctx, title)
+}
 
-	var result *Page
-	filter := bson.D{primitive.E{Key: "title", Value: title}}
-	dbErr := pagesCollection.FindOne(ctx, filter).Decode(&result)
+func listPages(ctx context.Context, offset, limit int) ([]string, error) {
+	return appFrom(ctx).pages.List(ctx, offset, limit)
+}
 
-	if dbErr != nil {
-		return nil, errors.New("Page not found")
+func getTitle(w http.ResponseWriter, r *http.Request) (string, error) {
+	_, title, ok := appFrom(r.Context()).titles.split(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return "", errors.New("invalid Page Title")
 	}
-
-	return result, nil
+	return title, nil
 }
 
-func listPages() ([]string, error) {
-
-	cur, err := pagesCollection.Find(ctx, bson.D{})
-
-	names := []string{}
-
-	if err != nil {
-		log.Fatal(err)
+func viewHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method == http.MethodPost {
+		submitFormHandler(w, r, title)
+		return
 	}
-	defer cur.Close(ctx)
-	for cur.Next(ctx) {
-		var result Page
-		err := cur.Decode(&result)
+	if name := browsingSnapshot(r); name != "" {
+		p, err := loadSnapshotPage(r.Context(), name, title)
+		if err == errPageNotFound {
+			notFound(w, r)
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		names = append(names, result.Title)
+		renderTemplate(w, r, "view", p, nil)
+		return
+	}
+	load := loadPage
+	if _, ok := appFrom(r.Context()).remote.remoteTitle(title); ok {
+		load = loadRemotePage
 	}
+	p, err := load(r.Context(), title)
+	if err != nil {
+		if target := findRedirect(r.Context(), r.URL.Path); target != "" {
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		http.Redirect(w, r, pageURL("edit", title), http.StatusFound)
+		return
+	}
+	recordView(title, r)
+	if etag, modified, ok := viewValidators(r, p); ok && notModified(w, r, etag, modified) {
+		return
+	}
+	renderTemplate(w, r, "view", p, nil)
+}
 
-	return names, nil
+func printHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := loadPage(r.Context(), title)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	renderTemplate(w, r, "print", p, nil)
 }
 
-var validPath = regexp.MustCompile("^/(edit|save|view|delete)/([a-zA-Z0-9]+)$")
+// Page list sizes: the default and the most ?limit= may ask for.
+const (
+	listLimit    = 100
+	maxListLimit = 1000
+)
 
-func getTitle(w http.ResponseWriter, r *http.Request) (string, error) {
-	m := validPath.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		http.NotFound(w, r)
-		return "", errors.New("invalid Page Title")
+// PageListing is one page of the page list.
+type PageListing struct {
+	Pages []PageEntry
+	Sort  string
+	// Page is the number of the page shown, from 1, and Total the
+	// number of pages in the wiki.
+	Page, Limit, Total int
+}
+
+// Last returns the number of the last page of the list.
+func (l *PageListing) Last() int {
+	if l.Total == 0 {
+		return 1
 	}
-	return m[2], nil // The title is the second subexpression.
+	return (l.Total + l.Limit - 1) / l.Limit
 }
 
-func viewHandler(w http.ResponseWriter, r *http.Request, title string) {
-	p, err := loadPage(title)
-	if err != nil {
-		http.Redirect(w, r, "/edit/"+title, http.StatusFound)
-		return
+// Prev and Next return the numbers of the pages around the one shown.
+func (l *PageListing) Prev() int { return l.Page - 1 }
+func (l *PageListing) Next() int { return l.Page + 1 }
+
+// URL returns the address of page n of the list in order sort.
+func (l *PageListing) URL(sort string, n int) string {
+	q := url.Values{}
+	if sort != sortByTitle {
+		q.Set("sort", sort)
+	}
+	if n > 1 {
+		q.Set("page", strconv.Itoa(n))
+	}
+	if l.Limit != listLimit {
+		q.Set("limit", strconv.Itoa(l.Limit))
 	}
-	renderPageTemplate(w, "view", p)
+	if len(q) == 0 {
+		return "/list"
+	}
+	return "/list?" + q.Encode()
 }
 
+// listHandler serves /list, the pages of the wiki listed by title or,
+// with ?sort=updated, most recently changed first, ?limit= at a time.
+// ?page= picks which of them to show. Archived pages are left out.
 func listHandler(w http.ResponseWriter, r *http.Request) {
-	pages, err := listPages()
+	l := &PageListing{Sort: sortByTitle, Page: 1, Limit: listLimit}
+	if s := r.FormValue("sort"); s != "" {
+		if s != sortByTitle && s != sortByUpdated {
+			http.Error(w, "sort must be title or updated", http.StatusBadRequest)
+			return
+		}
+		l.Sort = s
+	}
+	for name, v := range map[string]*int{"page": &l.Page, "limit": &l.Limit} {
+		if s := r.FormValue(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*v = n
+		}
+	}
+	if l.Limit > maxListLimit {
+		l.Limit = maxListLimit
+	}
+
+	hidden, err := unlistedNamespaces(r.Context(), currentUser(r))
 	if err != nil {
-		http.Redirect(w, r, "/list", http.StatusFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = templates.ExecuteTemplate(w, "list.html", pages)
-	if err != nil {
+	q := ListQuery{Sort: l.Sort, Offset: (l.Page - 1) * l.Limit, Limit: l.Limit, Hidden: hidden}
+	if l.Pages, l.Total, err = summariesCount(r.Context(), appFrom(r.Context()).pages, q); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	renderTemplate(w, r, "list", nil, l)
+}
+
+// EditForm is the data of the edit page. Preview and Summary are set
+// when an edit is previewed, which shows the form again as it was sent.
+type EditForm struct {
+	Attachments []Attachment
+	Preview     template.HTML
+	Summary     string
+	// Secrets are the likely credentials found in the body; Blocked is
+	// set when they kept it from being saved.
+	Secrets []SecretFinding
+	Blocked bool
 }
 
 func editHandler(w http.ResponseWriter, r *http.Request, title string) {
-	p, err := loadPage(title)
+	p, err := loadPage(r.Context(), title)
 	if err != nil {
 		p = &Page{Title: title}
 	}
-	renderPageTemplate(w, "edit", p)
+	files, err := listAttachments(r.Context(), title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "edit", p, &EditForm{Attachments: files})
 }
 
-func saveHandler(w http.ResponseWriter, r *http.Request, title string) {
-	body := r.FormValue("body")
-	p := &Page{Title: title, Body: []byte(body)}
-	err := p.save()
+// previewHandler renders the body posted from the edit form the way
+// viewHandler would, above the form, without saving anything.
+func previewHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := pageFromForm(r, title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Keep the revision the edit started from, so saving after a
+	// preview still catches edits made in the meantime.
+	p.Revision, _ = strconv.Atoi(r.FormValue("revision"))
+	files, err := listAttachments(r.Context(), title)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/view/"+title, http.StatusFound)
+	renderTemplate(w, r, "edit", p, &EditForm{
+		Attachments: files,
+		Preview:     renderBody(r.Context(), title, p.Body),
+		Summary:     r.FormValue("summary"),
+		Secrets:     appFrom(r.Context()).secrets.preview(p.Body),
+	})
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request, title string) {
+// pageFromForm returns the page posted from the edit form.
+func pageFromForm(r *http.Request, title string) (*Page, error) {
+	lang := r.FormValue("lang")
+	if lang != "" && !validLanguage.MatchString(lang) {
+		return nil, errors.New("invalid language")
+	}
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		return nil, err
+	}
+	return &Page{
+		Title:    title,
+		Body:     []byte(r.FormValue("body")),
+		Lang:     lang,
+		Owner:    strings.TrimSpace(r.FormValue("owner")),
+		Reviewer: strings.TrimSpace(r.FormValue("reviewer")),
+		Tags:     tags,
+		Updated:  time.Now(),
+	}, nil
+}
 
-	err := deletePage(title)
+func saveHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := pageFromForm(r, title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	current, err := loadPage(r.Context(), title)
+	exists := err == nil
+	// base is the revision the edit started from, or -1 if the form
+	// does not say, in which case the edit is saved over any other.
+	base, err := strconv.Atoi(r.FormValue("revision"))
+	switch {
+	case err != nil:
+		base = -1
+	case !exists:
+		base = 0
+	case current.Revision != base:
+		editConflict(w, r, current, p, base)
+		return
+	}
+	secrets, ok := appFrom(r.Context()).secrets.screen(r.Context(), p, userName(r))
+	if !ok {
+		p.Revision, _ = strconv.Atoi(r.FormValue("revision"))
+		files, err := listAttachments(r.Context(), title)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		renderTemplate(w, r, "edit", p, &EditForm{
+			Attachments: files,
+			Summary:     r.FormValue("summary"),
+			Secrets:     secrets,
+			Blocked:     true,
+		})
+		return
+	}
+	if secrets != nil {
+		addFlash(w, r, "The page seems to contain credentials ("+describeSecrets(secrets)+"). Remove them and change them if they are real.")
+	}
+	if isProtected(r.Context(), title) {
+		err := submitPendingEdit(r.Context(), p, userName(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addFlash(w, r, "Your edit of "+title+" is waiting for approval.")
+		http.Redirect(w, r, pageURL("pending", title), http.StatusFound)
+		return
+	}
+	if base < 0 {
+		err = commitRevision(r.Context(), p, userName(r))
+	} else {
+		err = commitEdit(r.Context(), p, userName(r), base)
+	}
+	if err == errEditConflict {
+		// Someone else saved the page since the check above.
+		if current, err := loadPage(r.Context(), title); err == nil {
+			editConflict(w, r, current, p, base)
+			return
+		}
+		http.Error(w, errEditConflict.Error(), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = recordEvent(r.Context(), eventSaved, title, userName(r), editSummary(r.FormValue("summary")))
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/list", http.StatusFound)
+	if exists {
+		addFlash(w, r, "Saved "+title+".")
+	} else {
+		addFlash(w, r, "Created "+title+".")
+	}
+	// 303 makes the browser follow up with a GET, so reloading the page
+	// does not post the edit again.
+	http.Redirect(w, r, pageURL("view", title), http.StatusSeeOther)
+}
+
+// allowMethods wraps handlers that only answer to some HTTP methods,
+// so that links followed by crawlers and prefetchers cannot change
+// anything. Other methods get 405 Method Not Allowed with an Allow
+// header listing the methods that are.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		m := validPath.FindStringSubmatch(r.URL.Path)
-		if m == nil {
-			http.NotFound(w, r)
+		_, title, ok := appFrom(r.Context()).titles.split(r.URL.Path)
+		if !ok {
+			notFound(w, r)
 			return
 		}
-		fn(w, r, m[2])
+		if !checkRead(w, r, title) {
+			return
+		}
+		fn(w, r, title)
 	}
 }
 
-var templates = template.Must(
-	template.ParseFiles(
-		"Templates/edit.html",
-		"Templates/view.html",
-		"Templates/list.html",
-	),
-)
+// templateFuncs are the functions templates can call that need nothing
+// of the App; App.funcs adds those reading its pages.
+var templateFuncs = template.FuncMap{
+	"toc":   tableOfContents,
+	"lang":  pageLanguage,
+	"tags":  formatTags,
+	"forms": pageForms,
+}
 
-func renderPageTemplate(w http.ResponseWriter, tmpl string, p *Page) {
-	err := templates.ExecuteTemplate(w, tmpl+".html", p)
+// templateFiles lists the templates parsed at startup.
+var templateFiles = []string{
+	"edit.html",
+	"view.html",
+	"list.html",
+	"print.html",
+	"special.html",
+	"statistics.html",
+	"analytics.html",
+	"contentgaps.html",
+	"move.html",
+	"backlinks.html",
+	"archive.html",
+	"orphans.html",
+	"wanted.html",
+	"redirects.html",
+	"translate.html",
+	"ownedpages.html",
+	"pending.html",
+	"pendingchanges.html",
+	"announcements.html",
+	"banners.html",
+	"delete.html",
+	"attachremove.html",
+	"offline_page.html",
+	"offline_index.html",
+	"history.html",
+	"diff.html",
+	"login.html",
+	"register.html",
+	"search.html",
+	"conflict.html",
+	"tags.html",
+	"tag.html",
+	"submissions.html",
+	"recent.html",
+	"adminusers.html",
+	"verify.html",
+	"sessions.html",
+	"auditlog.html",
+	"permissions.html",
+	"watchlist.html",
+	"changelog.html",
+	"snapshots.html",
+	"snapshotdiff.html",
+	"import.html",
+	"retention.html",
+}
+
+// funcs returns the functions templates of a can call.
+func (a *App) funcs() template.FuncMap {
+	funcs := template.FuncMap{
+		"sidebar": func(title string) template.HTML { return renderSidebar(a.ctx, title) },
+		"header":  func(title string) template.HTML { return renderHeader(a.ctx, title) },
+		"footer":  func(title string) template.HTML { return renderFooter(a.ctx, title) },
+		"render": func(title string, body []byte) template.HTML {
+			return renderBody(a.ctx, title, body)
+		},
+		"renderPage": func(p *Page) template.HTML { return a.renderPage(p) },
+		"variants":   func(p *Page) []Variant { return renderVariants(a.ctx, p) },
+		"offline": func(title string, body []byte) template.HTML {
+			return renderOffline(a.ctx, title, body)
+		},
+		"markdown":    func(text string) template.HTML { return renderMarkdown(a.ctx, text) },
+		"absURL":      func(path string) string { return absURL(a.cfg.BaseURL, path) },
+		"translation": func() bool { return a.translator != nil },
+		"protected":   func(title string) bool { return isProtected(a.ctx, title) },
+		"archived":    func(title string) *ArchiveEntry { return pageArchive(a.ctx, title) },
+	}
+	for name, fn := range templateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// parseTemplates parses templateFiles, taking each from dir if it is
+// there and from the templates built into the binary otherwise.
+func (a *App) parseTemplates(dir string) (*template.Template, error) {
+	return template.New("").Funcs(a.funcs()).ParseFS(assetFS(embeddedTemplates, "Templates", dir), templateFiles...)
+}
+
+// SiteInfo describes the wiki as a whole.
+type SiteInfo struct {
+	Name string
+}
+
+var site = &SiteInfo{Name: "gowiki"}
+
+// ViewData is what every template is executed with. Page is set by
+// handlers about a single page and Data holds whatever else the handler
+// shows. Things that appear on every page belong in their own field,
+// filled in by newViewData.
+type ViewData struct {
+	Site          *SiteInfo
+	Page          *Page
+	Breadcrumbs   []Crumb
+	Announcements []Announcement
+	Flashes       []Flash
+	User          *User
+	Impersonation *Impersonation
+	Snapshot      string
+	// Degraded is set while the database is down and the wiki read only.
+	Degraded bool
+	CSRF     string
+	Data     interface{}
+}
+
+func newViewData(w http.ResponseWriter, r *http.Request, p *Page, data interface{}) *ViewData {
+	vd := &ViewData{
+		Site:          site,
+		Page:          p,
+		Announcements: currentAnnouncements(r.Context()),
+		Flashes:       popFlashes(w, r),
+		User:          currentUser(r),
+		Impersonation: currentImpersonation(r),
+		Snapshot:      browsingSnapshot(r),
+		Degraded:      databaseDegraded(),
+		CSRF:          csrfToken(w, r),
+		Data:          data,
+	}
+	if p != nil {
+		vd.Breadcrumbs = breadcrumbs(p.Title)
+	}
+	return vd
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, p *Page, data interface{}) {
+	err := appFrom(r.Context()).templates.ExecuteTemplate(w, tmpl+".html", newViewData(w, r, p, data))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-var db *mongo.Database
-var pagesCollection *mongo.Collection
-var ctx = context.TODO()
+// mongoCommands are the commands working on what is kept in MongoDB,
+// which a wiki keeping its pages in files has none of.
+var mongoCommands = map[string]bool{"migrate": true, "mail": true, "verify": true, "digest": true}
 
 func main() {
-
-	dbOptions := options.Client().ApplyURI("mongodb://localhost:27017/")
-	dbConnection, err := mongo.Connect(ctx, dbOptions)
+	cfg, args, err := loadConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	err = dbConnection.Ping(ctx, nil)
+	// The load test and sync are clients of other instances and need no
+	// database.
+	if len(args) > 0 && args[0] == "loadtest" {
+		if err := loadtestCommand(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "sync" {
+		if err := syncCommand(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	app, err := openApp(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	db = dbConnection.Database("golang")
-	pagesCollection = db.Collection("Pages")
-
-	http.HandleFunc("/view/", makeHandler(viewHandler))
-	http.HandleFunc("/edit/", makeHandler(editHandler))
-	http.HandleFunc("/delete/", makeHandler(deleteHandler))
-	http.HandleFunc("/save/", makeHandler(saveHandler))
-	http.HandleFunc("/list", listHandler)
-
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	switch {
+	case len(args) > 0 && !app.hasDatabase() && mongoCommands[args[0]]:
+		err = fmt.Errorf("gowiki %s needs MongoDB, which -storage=fs does not use", args[0])
+	case len(args) > 0 && args[0] == "migrate":
+		err = migrateCommand(app.ctx, args[1:])
+	case len(args) > 0 && args[0] == "mail":
+		err = mailCommand(app.ctx, cfg)
+	case len(args) > 0 && args[0] == "export":
+		err = exportCommand(app.ctx, args[1:])
+	case len(args) > 0 && args[0] == "import":
+		err = importCommand(app.ctx, args[1:])
+	case len(args) > 0 && args[0] == "verify":
+		err = verifyCommand(app.ctx, args[1:])
+	case len(args) > 0 && args[0] == "digest":
+		err = digestCommand(app.ctx, cfg)
+	default:
+		err = app.serve()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+	}
+	// Disconnect even on failure, so writes already sent are not lost.
+	if cerr := app.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }